@@ -0,0 +1,235 @@
+package kcp
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// sendBufferHold a full send buffer holds the stream writers back until a socket write
+// succeeds, or this long after the last failed one
+const sendBufferHold = time.Second
+
+// sendBufferConn turns full socket send buffer errors into backpressure, kcp-go treats
+// any socket write error as fatal for the session, so the packet is dropped like a lost
+// one, which kcp retransmits anyway, and the stream writes of the session wait for the
+// buffer instead of queueing more packets
+type sendBufferConn struct {
+	net.PacketConn
+	buffers *sendBuffers
+	dropped uint64 // packets dropped because the send buffer was full
+}
+
+func (conn *sendBufferConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := conn.PacketConn.WriteTo(b, addr)
+
+	if err == nil {
+		conn.buffers.drain(addr)
+		return n, nil
+	}
+
+	if !sendBufferFull(err) {
+		return n, err
+	}
+
+	atomic.AddUint64(&conn.dropped, 1)
+
+	conn.buffers.fill(addr)
+
+	return len(b), nil
+}
+
+// sendBuffers the send buffer states of the sessions by remote address, only the full
+// ones are kept. A session's buffer is full once a write to its peer failed, so the
+// sessions to the other peers, or on the other sockets, keep writing
+type sendBuffers struct {
+	sync.Mutex
+	full    int32 // the number of full buffers, read without the lock
+	buffers map[string]*sendBuffer
+}
+
+func newSendBuffers() *sendBuffers {
+	return &sendBuffers{buffers: make(map[string]*sendBuffer)}
+}
+
+// fill records a failed write to addr
+func (buffers *sendBuffers) fill(addr net.Addr) {
+	buffers.Lock()
+	defer buffers.Unlock()
+
+	buffer, ok := buffers.buffers[addr.String()]
+
+	if !ok {
+		buffer = newSendBuffer()
+		buffers.buffers[addr.String()] = buffer
+		atomic.StoreInt32(&buffers.full, int32(len(buffers.buffers)))
+	}
+
+	buffer.fill()
+}
+
+// drain records a successful write to addr
+func (buffers *sendBuffers) drain(addr net.Addr) {
+	if atomic.LoadInt32(&buffers.full) == 0 {
+		return
+	}
+
+	buffers.Lock()
+	defer buffers.Unlock()
+
+	buffers.remove(addr.String())
+}
+
+// lookup returns the send buffer of the session to addr, nil unless it's full. buffers
+// may be nil
+func (buffers *sendBuffers) lookup(addr net.Addr) *sendBuffer {
+	if buffers == nil || atomic.LoadInt32(&buffers.full) == 0 {
+		return nil
+	}
+
+	buffers.Lock()
+	defer buffers.Unlock()
+
+	buffer := buffers.buffers[addr.String()]
+
+	// the sessions which stopped writing don't drain their buffer
+	if buffer != nil && buffer.expired() {
+		buffers.remove(addr.String())
+		return nil
+	}
+
+	return buffer
+}
+
+func (buffers *sendBuffers) remove(key string) {
+	if buffer, ok := buffers.buffers[key]; ok {
+		delete(buffers.buffers, key)
+		atomic.StoreInt32(&buffers.full, int32(len(buffers.buffers)))
+		buffer.drain()
+	}
+}
+
+// sendBuffer the send buffer state of a session
+type sendBuffer struct {
+	sync.Mutex
+	full    int32         // a socket write failed since the last successful one
+	expires time.Time     // when a full buffer no longer holds the writers back
+	ready   chan struct{} // closed once a socket write succeeds
+}
+
+func newSendBuffer() *sendBuffer {
+	return &sendBuffer{}
+}
+
+// fill records a failed write
+func (buffer *sendBuffer) fill() {
+	buffer.Lock()
+	defer buffer.Unlock()
+
+	if atomic.LoadInt32(&buffer.full) == 0 {
+		buffer.ready = make(chan struct{})
+		atomic.StoreInt32(&buffer.full, 1)
+	}
+
+	buffer.expires = time.Now().Add(sendBufferHold)
+}
+
+// drain records a successful write
+func (buffer *sendBuffer) drain() {
+	if atomic.LoadInt32(&buffer.full) == 0 {
+		return
+	}
+
+	buffer.Lock()
+	defer buffer.Unlock()
+
+	if atomic.LoadInt32(&buffer.full) != 0 {
+		atomic.StoreInt32(&buffer.full, 0)
+		close(buffer.ready)
+	}
+}
+
+// expired checks if the buffer no longer holds the writers back
+func (buffer *sendBuffer) expired() bool {
+	buffer.Lock()
+	defer buffer.Unlock()
+
+	return !time.Now().Before(buffer.expires)
+}
+
+// wait blocks until the send buffer isn't full, or fails with a timeout error once the
+// deadline expires, a zero deadline means none. buffer may be nil
+func (buffer *sendBuffer) wait(deadline time.Time) error {
+	if buffer == nil {
+		return nil
+	}
+
+	for atomic.LoadInt32(&buffer.full) != 0 {
+		buffer.Lock()
+		ready, expires := buffer.ready, buffer.expires
+		buffer.Unlock()
+
+		now := time.Now()
+
+		if !now.Before(expires) {
+			return nil
+		}
+
+		if !deadline.IsZero() && !now.Before(deadline) {
+			return errSendBufferTimeout
+		}
+
+		wake := expires
+
+		if !deadline.IsZero() && deadline.Before(wake) {
+			wake = deadline
+		}
+
+		timer := time.NewTimer(wake.Sub(now))
+
+		select {
+		case <-ready:
+		case <-timer.C:
+		}
+
+		timer.Stop()
+	}
+
+	return nil
+}
+
+// sendBufferTimeout the write deadline expired while the send buffer was full, it's a
+// timeout like the deadline errors of the muxers
+type sendBufferTimeout struct{}
+
+var errSendBufferTimeout net.Error = sendBufferTimeout{}
+
+func (sendBufferTimeout) Error() string {
+	return "write deadline exceeded, socket send buffer full"
+}
+
+func (sendBufferTimeout) Timeout() bool {
+	return true
+}
+
+func (sendBufferTimeout) Temporary() bool {
+	return true
+}
+
+// sendBufferFull checks if err reports a full socket send buffer. Only ENOBUFS, the full
+// queue of the network interface, reaches the transport: go's poller retries the writes
+// which fail with EAGAIN once the socket is writable, so they block instead of failing
+func sendBufferFull(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+
+	return err == syscall.ENOBUFS
+}
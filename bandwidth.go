@@ -0,0 +1,92 @@
+package kcp
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libs4go/errors"
+)
+
+// the protocols the udp traffic of the peers is reported under, the retransmitted kcp
+// segments are reported apart from the rest of the traffic
+const (
+	BandwidthProtocol  protocol.ID = "/kcp"
+	RetransmitProtocol protocol.ID = "/kcp/retransmit"
+)
+
+// WithBandwidthReporter create kcp transport which reports the udp traffic of its sockets
+// to reporter, with headers, acks and retransmissions included. The traffic of each
+// connection is reported per peer under BandwidthProtocol and RetransmitProtocol once the
+// connection is set up, including its handshake
+func WithBandwidthReporter(reporter metrics.Reporter) Option {
+	return func(kcp *kcpTransport) error {
+		if reporter == nil {
+			return errors.Wrap(ErrOption, "nil bandwidth reporter")
+		}
+
+		kcp.bandwidthReporter = reporter
+
+		return nil
+	}
+}
+
+// bandwidthReporter reports the traffic of a session to the peer of its connection
+type bandwidthReporter struct {
+	sync.Mutex
+	reporter metrics.Reporter
+	peer     peer.ID
+	sent     uint64 // sent bytes reported so far, retransmissions excluded
+	received uint64 // received bytes reported so far
+	retrans  uint64 // retransmitted bytes reported so far
+}
+
+// report reports the traffic of m since the last report
+func (bw *bandwidthReporter) report(m *sessionMonitor) {
+	bw.Lock()
+
+	retrans := atomic.LoadUint64(&m.resent)
+	sent := atomic.LoadUint64(&m.udpSent) - retrans
+	received := atomic.LoadUint64(&m.udpRecv)
+
+	sentDelta, receivedDelta, retransDelta := sent-bw.sent, received-bw.received, retrans-bw.retrans
+
+	bw.sent, bw.received, bw.retrans = sent, received, retrans
+
+	bw.Unlock()
+
+	if sentDelta > 0 {
+		bw.reporter.LogSentMessageStream(int64(sentDelta), BandwidthProtocol, bw.peer)
+	}
+
+	if retransDelta > 0 {
+		bw.reporter.LogSentMessageStream(int64(retransDelta), RetransmitProtocol, bw.peer)
+	}
+
+	if receivedDelta > 0 {
+		bw.reporter.LogRecvMessageStream(int64(receivedDelta), BandwidthProtocol, bw.peer)
+	}
+}
+
+// reportBandwidth reports the traffic of the session of c to its peer, the traffic of the
+// handshake first
+func (c *kcpCapableConn) reportBandwidth(m *sessionMonitor) {
+	if c.kcp.bandwidthReporter == nil {
+		return
+	}
+
+	bw := &bandwidthReporter{reporter: c.kcp.bandwidthReporter, peer: c.remotePeerID}
+
+	m.bw.Store(bw)
+
+	bw.report(m)
+}
+
+// report reports the traffic of the session to the peer of its connection, if any
+func (m *sessionMonitor) report() {
+	if bw, ok := m.bw.Load().(*bandwidthReporter); ok {
+		bw.report(m)
+	}
+}
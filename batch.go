@@ -0,0 +1,31 @@
+package kcp
+
+// WithBatchIO create kcp transport which hands its bare udp sockets to kcp-go, so that
+// on linux the packets are sent and received in batches with sendmmsg and recvmmsg
+// instead of one syscall per packet. kcp-go only batches on bare sockets, so the options
+// which wrap the sockets, WithPacketConn, WithUDPOffload, WithAddressValidation and the session
+// monitoring ones such as WithWatchdog, turn batching off. WithLinger can't be combined with it.
+// A full socket send buffer is no longer turned into backpressure while batching, raise the buffer
+// with WithUDPWriteBuffer. The dialed sessions don't answer the path challenges of the
+// WithNATRebinding listeners, so they don't follow a nat rebinding.
+func WithBatchIO() Option {
+	return func(kcp *kcpTransport) error {
+		kcp.batchIO = true
+
+		return nil
+	}
+}
+
+// batchable checks if the udp sockets can be handed to kcp-go unwrapped
+func (kcp *kcpTransport) batchable() bool {
+	if !kcp.batchIO {
+		return false
+	}
+
+	if kcp.packetConn != nil || kcp.offload || kcp.cookieSecret != nil || kcp.migration || kcp.monitorEnabled() {
+		kcp.W("batch io is turned off by the options wrapping the udp sockets")
+		return false
+	}
+
+	return true
+}
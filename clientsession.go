@@ -0,0 +1,146 @@
+package kcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libs4go/errors"
+)
+
+const (
+	clientSessionTTL  = time.Minute // a failed dial's id is reused by the dials within it
+	maxClientSessions = 1024        // the expired ids are dropped beyond it
+)
+
+// WithClientSessionID create kcp transport which generates a client session id for the
+// dials to a peer, the id is included in the dial logs and errors. The following dials
+// to the peer reuse the id until one succeeds or clientSessionTTL passes, so the retries
+// of a dial share it. ProtocolV3 connections send it to the listener, see ClientSessionID
+// of the kcp.Conn
+func WithClientSessionID() Option {
+	return func(kcp *kcpTransport) error {
+		kcp.clientSessions = &clientSessions{ids: make(map[string]*clientSession)}
+		return nil
+	}
+}
+
+type clientSessionKey struct{}
+
+// clientSessions the client session ids of the dials in flight or failed lately, by peer
+type clientSessions struct {
+	sync.Mutex
+	ids map[string]*clientSession
+}
+
+type clientSession struct {
+	id      string
+	dials   int       // dials in flight
+	expires time.Time // set when the last dial in flight failed
+}
+
+func newClientSessionID() (string, error) {
+	var buf [8]byte
+
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errors.Wrap(err, "generate client session id error")
+	}
+
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// acquire returns the client session id of a dial to key
+func (sessions *clientSessions) acquire(key string) (string, error) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	now := time.Now()
+
+	if session, ok := sessions.ids[key]; ok && (session.dials > 0 || now.Before(session.expires)) {
+		session.dials++
+		return session.id, nil
+	}
+
+	id, err := newClientSessionID()
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(sessions.ids) >= maxClientSessions {
+		for k, session := range sessions.ids {
+			if session.dials == 0 && !now.Before(session.expires) {
+				delete(sessions.ids, k)
+			}
+		}
+	}
+
+	sessions.ids[key] = &clientSession{id: id, dials: 1}
+
+	return id, nil
+}
+
+// release ends a dial to key, the id is dropped once a dial succeeded
+func (sessions *clientSessions) release(key string, succeeded bool) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	session, ok := sessions.ids[key]
+
+	if !ok {
+		return
+	}
+
+	session.dials--
+
+	if succeeded {
+		delete(sessions.ids, key)
+	} else if session.dials == 0 {
+		session.expires = time.Now().Add(clientSessionTTL)
+	}
+}
+
+// withClientSessionID returns a copy of ctx which carries the client session id of a dial
+func withClientSessionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, clientSessionKey{}, id)
+}
+
+// clientSessionID returns the client session id carried by ctx, empty if none
+func clientSessionID(ctx context.Context) string {
+	id, _ := ctx.Value(clientSessionKey{}).(string)
+	return id
+}
+
+// sendClientSessionID sends the client session id of a ProtocolV3 dial, empty if none
+func sendClientSessionID(conn net.Conn, id string) error {
+	_, err := conn.Write(append([]byte{byte(len(id))}, id...))
+	return err
+}
+
+// readClientSessionID reads the client session id of a ProtocolV3 dial
+func readClientSessionID(conn net.Conn) (string, error) {
+	var size [1]byte
+
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, size[0])
+
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// ClientSessionID returns the client session id of the dial which created the connection,
+// empty unless the dialer was created WithClientSessionID, and for accepted connections
+// unless it was sent, see ProtocolV3
+func (c *kcpCapableConn) ClientSessionID() string {
+	return c.sessionID
+}
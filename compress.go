@@ -0,0 +1,57 @@
+package kcp
+
+import (
+	"net"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// WithCompression create kcp transport which compresses the smux frames with the snappy
+// framing format, like kcptun does. Compression runs inside TLS, and both peers must
+// enable it, otherwise the smux session fails. The compressed length leaks how much of a
+// frame repeats earlier data, like CRIME against TLS compression, so don't enable it
+// for the connections carrying secrets next to data the peer or an attacker controls.
+func WithCompression() Option {
+	return func(kcp *kcpTransport) error {
+		kcp.compression = true
+
+		return nil
+	}
+}
+
+// compStream is a snappy compressed stream over conn, every Write is flushed to conn
+// as one or more snappy frames
+type compStream struct {
+	net.Conn
+	sync.Mutex // serializes the writes, the muxers write from more than one goroutine
+	w          *snappy.Writer
+	r          *snappy.Reader
+}
+
+func newCompStream(conn net.Conn) *compStream {
+	return &compStream{
+		Conn: conn,
+		w:    snappy.NewBufferedWriter(conn),
+		r:    snappy.NewReader(conn),
+	}
+}
+
+func (c *compStream) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *compStream) Write(b []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, err := c.w.Write(b); err != nil {
+		return 0, err
+	}
+
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
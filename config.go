@@ -0,0 +1,42 @@
+package kcp
+
+import (
+	"github.com/libs4go/errors"
+	"github.com/libs4go/scf4go"
+)
+
+// WithConfig create kcp transport with the settings of the config kcp section:
+//
+//	kcp:
+//	  mode: fast2
+//	  mtu: 1350
+//	  sndwnd: 256
+//	  rcvwnd: 1024
+//	  fec:
+//	    datashards: 10
+//	    parityshards: 3
+//	  smux:
+//	    version: 2
+//
+// missing keys keep the transport settings
+func WithConfig(config scf4go.Config) Option {
+	return func(kcp *kcpTransport) error {
+		profile := Profile{
+			Mode:         config.Get("kcp", "mode").String(""),
+			MTU:          config.Get("kcp", "mtu").Int(0),
+			SndWnd:       config.Get("kcp", "sndwnd").Int(0),
+			RcvWnd:       config.Get("kcp", "rcvwnd").Int(0),
+			DataShards:   config.Get("kcp", "fec", "datashards").Int(0),
+			ParityShards: config.Get("kcp", "fec", "parityshards").Int(0),
+			SmuxVersion:  config.Get("kcp", "smux", "version").Int(0),
+		}
+
+		for _, option := range profile.options() {
+			if err := option(kcp); err != nil {
+				return errors.Wrap(err, "invalid kcp config")
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,262 @@
+package kcp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libs4go/errors"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+const congestionInterval = 200 * time.Millisecond // congestion controller sampling interval
+
+// CongestionSample the kcp session measurements of one sampling interval
+type CongestionSample struct {
+	Interval  time.Duration // length of the sampling interval
+	RTT       time.Duration // smoothed rtt, 0 before the first sample
+	Acked     int           // data segments acknowledged in the interval
+	Lost      int           // data segments retransmitted in the interval
+	Inflight  int           // data segments sent but not acknowledged
+	Window    int           // current send window in packets
+	MaxWindow int           // the send window of the session settings, which caps Window
+}
+
+// CongestionAction the adjustments of a congestion controller, zero fields keep the
+// current settings
+type CongestionAction struct {
+	Window   int           // send window in packets, which caps the inflight segments
+	Interval time.Duration // kcp update interval
+}
+
+// CongestionController controls the send rate of one kcp session, kcp-go's built-in
+// congestion control is disabled for the sessions which use a controller, also after
+// Reconfigure. The windows are capped by the send window of WithWindowSize
+type CongestionController interface {
+	// Update is called every sampling interval
+	Update(sample CongestionSample) CongestionAction
+}
+
+// WithCongestionController create kcp transport whose sessions are controlled by the
+// controllers created by factory, one per session, instead of kcp-go's built-in
+// congestion control. It can't be combined with WithAdaptiveWindow.
+func WithCongestionController(factory func() CongestionController) Option {
+	return func(kcp *kcpTransport) error {
+		if factory == nil {
+			return errors.Wrap(ErrOption, "nil congestion controller factory")
+		}
+
+		if kcp.adaptiveWindow != nil {
+			return errors.Wrap(ErrOption, "congestion controller can't be combined with adaptive window")
+		}
+
+		kcp.congestion = factory
+
+		return nil
+	}
+}
+
+// congestionState the kcp settings of a session which its congestion controller owns
+type congestionState struct {
+	sync.Mutex
+	noDelay   noDelayConf
+	window    int // the controller window
+	maxWindow int // the send window of the session settings
+}
+
+func newCongestionState(kcp *kcpTransport) *congestionState {
+	state := &congestionState{}
+
+	state.configure(kcp)
+
+	state.window = state.maxWindow
+
+	return state
+}
+
+// configure takes the settings of kcp, the controller window replaces the kcp congestion
+// window so nc stays 1
+func (state *congestionState) configure(kcp *kcpTransport) {
+	state.noDelay = noDelayConf{interval: kcpgo.IKCP_INTERVAL}
+
+	if conf := kcp.sessionConf.noDelay; conf != nil {
+		state.noDelay = *conf
+	}
+
+	state.noDelay.nc = 1
+
+	state.maxWindow = kcp.sessionConf.initialSendWindow()
+
+	if state.window > state.maxWindow {
+		state.window = state.maxWindow
+	}
+}
+
+func (state *congestionState) setNoDelay(c *kcpCapableConn) {
+	c.udpSession.SetNoDelay(state.noDelay.nodelay, state.noDelay.interval, state.noDelay.resend, state.noDelay.nc)
+}
+
+// reconfigure re-applies the controller settings over those Reconfigure applied from kcp
+func (state *congestionState) reconfigure(c *kcpCapableConn, kcp *kcpTransport) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.configure(kcp)
+	state.setNoDelay(c)
+
+	c.setWindow(state.window, 0)
+}
+
+func (c *kcpCapableConn) runCongestionController(m *sessionMonitor) {
+	controller := c.kcp.congestion()
+
+	state := newCongestionState(c.kcp)
+
+	state.Lock()
+	state.setNoDelay(c)
+	state.Unlock()
+
+	c.congestion.Store(state)
+
+	ticker := time.NewTicker(congestionInterval)
+	defer ticker.Stop()
+
+	una := atomic.LoadUint32(&m.una)
+	retrans := atomic.LoadUint64(&m.retrans)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+
+		nextUna := atomic.LoadUint32(&m.una)
+		nextRetrans := atomic.LoadUint64(&m.retrans)
+
+		state.Lock()
+		window, maxWindow := state.window, state.maxWindow
+		state.Unlock()
+
+		action := controller.Update(CongestionSample{
+			Interval:  congestionInterval,
+			RTT:       m.rtt(),
+			Acked:     int(int32(nextUna - una)),
+			Lost:      int(nextRetrans - retrans),
+			Inflight:  int(int32(atomic.LoadUint32(&m.nextSN) - nextUna)),
+			Window:    window,
+			MaxWindow: maxWindow,
+		})
+
+		una, retrans = nextUna, nextRetrans
+
+		state.Lock()
+
+		if window := action.Window; window > 0 {
+			if window > state.maxWindow {
+				window = state.maxWindow
+			}
+
+			if window != state.window {
+				state.window = window
+				c.setWindow(window, 0)
+			}
+		}
+
+		if interval := int(action.Interval / time.Millisecond); interval > 0 && interval != state.noDelay.interval {
+			state.noDelay.interval = interval
+			state.setNoDelay(c)
+		}
+
+		state.Unlock()
+	}
+}
+
+const (
+	bbrBandwidthWindow = 10               // samples of the max bandwidth filter
+	bbrRTTWindow       = 10 * time.Second // duration of the min rtt filter
+	bbrStartupGrowth   = 1.25             // bandwidth growth which keeps the startup phase
+	bbrStartupRounds   = 3                // samples without growth which end the startup phase
+	bbrMinWindow       = 4                // min send window in packets
+)
+
+// bbrGains the pacing gain cycle of the steady phase
+var bbrGains = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// bbrController a bbr like congestion controller, which sizes the send window to the
+// product of the max delivery rate and the min rtt instead of backing off on loss
+type bbrController struct {
+	bandwidth []float64 // recent delivery rates in packets per second
+	minRTT    time.Duration
+	minRTTAt  time.Time
+	startup   bool
+	maxBW     float64 // max delivery rate of the startup phase
+	rounds    int     // startup samples without bandwidth growth
+	cycle     int
+}
+
+// NewBBR creates a bbr like congestion controller, which probes the bottleneck bandwidth
+// and ignores packet loss, for the links whose loss isn't caused by congestion. Being
+// blind to loss it starves the loss based flows sharing its bottleneck, kcp-go's own
+// congestion control and tcp, which back off while it doesn't. Its window grows up to
+// the send window of WithWindowSize, use it with WithCongestionController(NewBBR)
+func NewBBR() CongestionController {
+	return &bbrController{startup: true}
+}
+
+func (bbr *bbrController) Update(sample CongestionSample) CongestionAction {
+	now := time.Now()
+
+	if sample.RTT > 0 && (bbr.minRTT == 0 || sample.RTT < bbr.minRTT || now.Sub(bbr.minRTTAt) > bbrRTTWindow) {
+		bbr.minRTT = sample.RTT
+		bbr.minRTTAt = now
+	}
+
+	if sample.Acked <= 0 || bbr.minRTT == 0 {
+		return CongestionAction{}
+	}
+
+	bbr.bandwidth = append(bbr.bandwidth, float64(sample.Acked)/sample.Interval.Seconds())
+
+	if len(bbr.bandwidth) > bbrBandwidthWindow {
+		bbr.bandwidth = bbr.bandwidth[1:]
+	}
+
+	bw := 0.0
+
+	for _, rate := range bbr.bandwidth {
+		if rate > bw {
+			bw = rate
+		}
+	}
+
+	bdp := bw * bbr.minRTT.Seconds()
+
+	var window float64
+
+	if bbr.startup {
+		if bw >= bbr.maxBW*bbrStartupGrowth {
+			bbr.maxBW = bw
+			bbr.rounds = 0
+		} else if bbr.rounds++; bbr.rounds >= bbrStartupRounds {
+			bbr.startup = false
+		}
+
+		window = float64(sample.Window) * 2
+
+		if sample.MaxWindow > 0 && window > float64(sample.MaxWindow) {
+			window = float64(sample.MaxWindow)
+		}
+	}
+
+	if !bbr.startup {
+		window = bdp * bbrGains[bbr.cycle]
+		bbr.cycle = (bbr.cycle + 1) % len(bbrGains)
+	}
+
+	if window < bbrMinWindow {
+		window = bbrMinWindow
+	}
+
+	return CongestionAction{Window: int(window)}
+}
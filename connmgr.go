@@ -0,0 +1,166 @@
+package kcp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	connTag          = "kcp" // connmgr tag of kcp connections
+	connTagMaxWeight = 100   // weight of the lowest rtt connections
+	connTagMinWeight = 1     // weight of the highest rtt connections and those without rtt sample
+	connTagLatency   = 5 * time.Millisecond
+	connTagInterval  = time.Second // interval of the weight updates
+)
+
+// WithConnManager create kcp transport which tags the remote peers of its connections
+// with a weight derived from the smoothed rtt of the kcp session, the tag is removed
+// when the last connection to the peer is closed
+func WithConnManager(cm connmgr.ConnManager) Option {
+	return func(kcp *kcpTransport) error {
+		kcp.tagger = &connTagger{
+			cm:    cm,
+			conns: make(map[peer.ID]map[*kcpCapableConn]int),
+		}
+
+		return nil
+	}
+}
+
+// WithConnProtection create kcp transport which protects the remote peers of its connections
+// from the trimming of the conn manager of WithConnManager, the protection is removed when
+// the last connection to the peer is closed
+func WithConnProtection() Option {
+	return func(kcp *kcpTransport) error {
+		kcp.protectConns = true
+
+		return nil
+	}
+}
+
+type connTagger struct {
+	sync.Mutex
+	cm    connmgr.ConnManager
+	conns map[peer.ID]map[*kcpCapableConn]int // weights of the open kcp connections per peer
+}
+
+// connTagWeight maps the smoothed rtt to tag weight, each connTagLatency costs one point
+func connTagWeight(rtt time.Duration) int {
+	if rtt <= 0 {
+		return connTagMinWeight
+	}
+
+	weight := connTagMaxWeight - int(rtt/connTagLatency)
+
+	if weight < connTagMinWeight {
+		weight = connTagMinWeight
+	}
+
+	return weight
+}
+
+func (tagger *connTagger) tag(c *kcpCapableConn, protect bool) {
+	p := c.remotePeerID
+
+	if p == "" {
+		return
+	}
+
+	tagger.Lock()
+	defer tagger.Unlock()
+
+	conns, ok := tagger.conns[p]
+
+	if !ok {
+		conns = make(map[*kcpCapableConn]int)
+		tagger.conns[p] = conns
+
+		if protect {
+			tagger.cm.Protect(p, connTag)
+		}
+	}
+
+	conns[c] = connTagMinWeight
+
+	tagger.update(p)
+}
+
+// weigh sets the weight of c, ignored once c is untagged
+func (tagger *connTagger) weigh(c *kcpCapableConn, weight int) {
+	tagger.Lock()
+	defer tagger.Unlock()
+
+	conns := tagger.conns[c.remotePeerID]
+
+	if current, ok := conns[c]; !ok || current == weight {
+		return
+	}
+
+	conns[c] = weight
+
+	tagger.update(c.remotePeerID)
+}
+
+// update tags p with the best link quality of all connections to the peer
+func (tagger *connTagger) update(p peer.ID) {
+	weight := connTagMinWeight
+
+	for _, w := range tagger.conns[p] {
+		if w > weight {
+			weight = w
+		}
+	}
+
+	tagger.cm.TagPeer(p, connTag, weight)
+}
+
+func (tagger *connTagger) untag(c *kcpCapableConn, protect bool) {
+	p := c.remotePeerID
+
+	tagger.Lock()
+	defer tagger.Unlock()
+
+	conns, ok := tagger.conns[p]
+
+	if !ok {
+		return
+	}
+
+	if _, ok := conns[c]; !ok {
+		return
+	}
+
+	delete(conns, c)
+
+	if len(conns) > 0 {
+		tagger.update(p)
+		return
+	}
+
+	delete(tagger.conns, p)
+
+	tagger.cm.UntagPeer(p, connTag)
+
+	if protect {
+		tagger.cm.Unprotect(p, connTag)
+	}
+}
+
+// runConnTagger updates the tag weight of the connection with the rtt observed by m
+func (c *kcpCapableConn) runConnTagger(m *sessionMonitor) {
+	ticker := time.NewTicker(connTagInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+
+		c.kcp.tagger.weigh(c, connTagWeight(m.rtt()))
+	}
+}
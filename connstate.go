@@ -0,0 +1,60 @@
+package kcp
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/sec/insecure"
+	tlsp2p "github.com/libp2p/go-libp2p-tls"
+)
+
+// ConnState the protocols a connection was established with
+type ConnState struct {
+	Transport         string // always "kcp"
+	Security          string // security protocol id, empty for unsecured connections
+	StreamMultiplexer string // negotiated muxer, one of the Muxer constants
+}
+
+// securityID returns the protocol id of the security the credentials secure connections
+// with, security transports other than plaintext have no id and are named by their type
+func (creds credentials) securityID() string {
+	switch security := creds.security.(type) {
+	case nil:
+		if creds.identity != nil {
+			return tlsp2p.ID
+		}
+
+		return ""
+	case *insecure.Transport:
+		return insecure.ID
+	default:
+		return fmt.Sprintf("%T", security)
+	}
+}
+
+// muxerID returns the muxer of the connections created by the transport
+func (kcp *kcpTransport) muxerID() string {
+	if kcp.yamux {
+		return MuxerYamux
+	}
+
+	if kcp.smuxVersion == 2 {
+		return MuxerSmuxV2
+	}
+
+	return MuxerSmuxV1
+}
+
+// Stat returns the direction of the connection
+func (c *kcpCapableConn) Stat() network.Stat {
+	return network.Stat{Direction: c.direction}
+}
+
+// ConnState returns the protocols the connection was established with
+func (c *kcpCapableConn) ConnState() ConnState {
+	return ConnState{
+		Transport:         c.kcp.String(),
+		Security:          c.security,
+		StreamMultiplexer: c.kcp.muxerID(),
+	}
+}
@@ -0,0 +1,64 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ConvValidator checks the kcp conv of a session accepted from raddr
+type ConvValidator func(conv uint32, raddr net.Addr) bool
+
+// WithConvValidator create kcp transport whose listeners drop the accepted sessions
+// whose conv is rejected by validator
+func WithConvValidator(validator ConvValidator) Option {
+	return func(kcp *kcpTransport) error {
+		kcp.convValidator = validator
+		return nil
+	}
+}
+
+// RandomConv returns a ConvProvider which assigns cryptographically random convs
+func RandomConv() ConvProvider {
+	return func(raddr net.Addr, p peer.ID) uint32 {
+		var buff [4]byte
+
+		rand.Read(buff[:])
+
+		return binary.LittleEndian.Uint32(buff[:])
+	}
+}
+
+// SequentialConv returns a ConvProvider which assigns convs sequentially from start
+func SequentialConv(start uint32) ConvProvider {
+	next := start - 1
+
+	return func(raddr net.Addr, p peer.ID) uint32 {
+		return atomic.AddUint32(&next, 1)
+	}
+}
+
+// DerivedConv returns a ConvProvider which derives convs from seed, the remote address,
+// the remote peer and a dial counter, nodes sharing a nat should use distinct seeds,
+// e.g. their peer ids, so that their convs never collide
+func DerivedConv(seed []byte) ConvProvider {
+	var counter uint64
+
+	return func(raddr net.Addr, p peer.ID) uint32 {
+		var buff [8]byte
+
+		binary.LittleEndian.PutUint64(buff[:], atomic.AddUint64(&counter, 1))
+
+		hash := sha256.New()
+		hash.Write(seed)
+		hash.Write([]byte(raddr.String()))
+		hash.Write([]byte(p))
+		hash.Write(buff[:])
+
+		return binary.LittleEndian.Uint32(hash.Sum(nil))
+	}
+}
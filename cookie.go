@@ -0,0 +1,206 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libs4go/errors"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+// address validation packets are shorter than any kcp packet like the monitor probes
+var (
+	cookieRetry = []byte("\x00kcp-retry")
+	cookieEcho  = []byte("\x00kcp-cookie")
+)
+
+const (
+	cookieSize          = 8                // truncated hmac of the cookie
+	cookieLifetime      = 30 * time.Second // cookies of the current and the previous period are valid
+	validatedAddrExpiry = 2 * time.Minute  // idle time after which a validated address must validate again
+)
+
+// WithAddressValidation create kcp transport whose listeners answer the first packets of
+// unknown addresses with a stateless retry cookie, and only hand the packets of addresses
+// which echoed it to kcp-go, so spoofed sources can't create sessions. The retry is smaller
+// than the packet it answers. Both peers need the option, dialers answer the retries
+func WithAddressValidation() Option {
+	return func(kcp *kcpTransport) error {
+		var secret [32]byte
+
+		if _, err := rand.Read(secret[:]); err != nil {
+			return errors.Wrap(err, "generate cookie secret error")
+		}
+
+		kcp.cookieSecret = secret[:]
+
+		return nil
+	}
+}
+
+// validateAddrs wraps the packet conn of a listener with address validation if enabled
+func (kcp *kcpTransport) validateAddrs(packetConn net.PacketConn) net.PacketConn {
+	if kcp.cookieSecret == nil {
+		return packetConn
+	}
+
+	return &validatingConn{PacketConn: packetConn, secret: kcp.cookieSecret}
+}
+
+// answerCookies wraps the packet conn of a dialed session to answer the retries of
+// validating listeners if enabled
+func (kcp *kcpTransport) answerCookies(packetConn net.PacketConn) net.PacketConn {
+	if kcp.cookieSecret == nil {
+		return packetConn
+	}
+
+	return &cookieConn{PacketConn: packetConn}
+}
+
+// validatingConn the listener side of address validation
+type validatingConn struct {
+	net.PacketConn
+	secret    []byte
+	validated sync.Map // remote address => *int64 unix nano of the last packet
+	pruned    int64    // unix nano of the last expiry of validated addresses
+}
+
+func (conn *validatingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := conn.PacketConn.ReadFrom(b)
+
+		if err != nil || conn.isValidated(addr) {
+			return n, addr, err
+		}
+
+		if n == len(cookieEcho)+cookieSize && bytes.HasPrefix(b[:n], cookieEcho) {
+			if conn.checkCookie(b[len(cookieEcho):n], addr) {
+				now := time.Now().UnixNano()
+				conn.validated.Store(addr.String(), &now)
+			}
+
+			continue
+		}
+
+		// never answer with more bytes than received, path challenges validate the new
+		// address of a migrating dialer
+		if n >= kcpgo.IKCP_OVERHEAD || bytes.HasPrefix(b[:n], pathChallenge) {
+			retry := append(append([]byte{}, cookieRetry...), conn.cookie(addr, cookiePeriod(time.Now()))...)
+
+			conn.PacketConn.WriteTo(retry, addr)
+		}
+	}
+}
+
+// isValidated checks if addr echoed a cookie, and expires the idle validated addresses
+func (conn *validatingConn) isValidated(addr net.Addr) bool {
+	now := time.Now().UnixNano()
+
+	if pruned := atomic.LoadInt64(&conn.pruned); now-pruned > int64(validatedAddrExpiry) && atomic.CompareAndSwapInt64(&conn.pruned, pruned, now) {
+		conn.validated.Range(func(key, value interface{}) bool {
+			if now-atomic.LoadInt64(value.(*int64)) > int64(validatedAddrExpiry) {
+				conn.validated.Delete(key)
+			}
+
+			return true
+		})
+	}
+
+	value, ok := conn.validated.Load(addr.String())
+
+	if !ok {
+		return false
+	}
+
+	atomic.StoreInt64(value.(*int64), now)
+
+	return true
+}
+
+func cookiePeriod(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(cookieLifetime))
+}
+
+// cookie returns the cookie of addr for period
+func (conn *validatingConn) cookie(addr net.Addr, period uint64) []byte {
+	mac := hmac.New(sha256.New, conn.secret)
+
+	var buff [8]byte
+
+	binary.LittleEndian.PutUint64(buff[:], period)
+
+	mac.Write(buff[:])
+	mac.Write([]byte(addr.String()))
+
+	return mac.Sum(nil)[:cookieSize]
+}
+
+func (conn *validatingConn) checkCookie(cookie []byte, addr net.Addr) bool {
+	period := cookiePeriod(time.Now())
+
+	return hmac.Equal(cookie, conn.cookie(addr, period)) || hmac.Equal(cookie, conn.cookie(addr, period-1))
+}
+
+// cookieConn the dialer side of address validation
+type cookieConn struct {
+	net.PacketConn
+	sync.Mutex
+	last      []byte // last packet written before the listener answered
+	validated int32  // the listener answered with a kcp packet
+}
+
+func (conn *cookieConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := conn.PacketConn.ReadFrom(b)
+
+		if err != nil || n != len(cookieRetry)+cookieSize || !bytes.HasPrefix(b[:n], cookieRetry) {
+			if err == nil && atomic.LoadInt32(&conn.validated) == 0 {
+				conn.validate()
+			}
+
+			return n, addr, err
+		}
+
+		echo := append(append([]byte{}, cookieEcho...), b[len(cookieRetry):n]...)
+
+		conn.PacketConn.WriteTo(echo, addr)
+
+		// resend the dropped packet instead of waiting for the kcp retransmission
+		conn.Lock()
+		last := conn.last
+		conn.Unlock()
+
+		if last != nil {
+			conn.PacketConn.WriteTo(last, addr)
+		}
+	}
+}
+
+// validate stops the resends once the listener answered
+func (conn *cookieConn) validate() {
+	conn.Lock()
+	defer conn.Unlock()
+
+	atomic.StoreInt32(&conn.validated, 1)
+
+	conn.last = nil
+}
+
+func (conn *cookieConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.LoadInt32(&conn.validated) == 0 {
+		conn.Lock()
+		if atomic.LoadInt32(&conn.validated) == 0 {
+			conn.last = append([]byte{}, b...)
+		}
+		conn.Unlock()
+	}
+
+	return conn.PacketConn.WriteTo(b, addr)
+}
@@ -0,0 +1,102 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+
+	"github.com/libs4go/errors"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+const (
+	cryptNonceSize  = 16                            // kcp-go crypt header nonce
+	cryptCRCSize    = 4                             // kcp-go crypt header checksum
+	cryptHeaderSize = cryptNonceSize + cryptCRCSize // kcp-go crypt header
+)
+
+// packetCiphers supported WithPacketCipher ciphers and their key sizes
+var packetCiphers = map[string]struct {
+	keySize int
+	create  func(key []byte) (kcpgo.BlockCrypt, error)
+}{
+	"aes-128": {16, kcpgo.NewAESBlockCrypt},
+	"aes-192": {24, kcpgo.NewAESBlockCrypt},
+	"aes-256": {32, kcpgo.NewAESBlockCrypt},
+	"salsa20": {32, kcpgo.NewSalsa20BlockCrypt},
+	"twofish": {32, kcpgo.NewTwofishBlockCrypt},
+	"sm4":     {16, kcpgo.NewSM4BlockCrypt},
+}
+
+// WithBlockCrypt create kcp transport which encrypts every udp packet with block,
+// independent of the TLS layer, both peers must use the same cipher and key
+func WithBlockCrypt(block kcpgo.BlockCrypt) Option {
+	return func(kcp *kcpTransport) error {
+		if block == nil {
+			return errors.Wrap(ErrOption, "nil block crypt")
+		}
+
+		kcp.block = block
+
+		return nil
+	}
+}
+
+// WithPacketCipher create kcp transport which encrypts every udp packet with the named
+// cipher(aes-128, aes-192, aes-256, salsa20, twofish or sm4), key must be exactly the
+// cipher key size
+func WithPacketCipher(cipher string, key []byte) Option {
+	return func(kcp *kcpTransport) error {
+		conf, ok := packetCiphers[cipher]
+
+		if !ok {
+			return errors.Wrap(ErrOption, "unknown packet cipher %s", cipher)
+		}
+
+		if len(key) != conf.keySize {
+			return errors.Wrap(ErrOption, "packet cipher %s expect %d bytes key, got %d", cipher, conf.keySize, len(key))
+		}
+
+		block, err := conf.create(key)
+
+		if err != nil {
+			return errors.Wrap(err, "create packet cipher %s error", cipher)
+		}
+
+		kcp.block = block
+
+		return nil
+	}
+}
+
+// cryptBuffers decrypted packet copies of the monitor
+var cryptBuffers = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, kcpgo.IKCP_MTU_DEF)
+	},
+}
+
+// decryptPayload decrypts a copy of packet and calls fn with the plaintext behind
+// the crypt header, packets which fail the checksum are ignored
+func decryptPayload(block kcpgo.BlockCrypt, packet []byte, fn func(payload []byte)) {
+	if len(packet) < cryptHeaderSize {
+		return
+	}
+
+	buff := cryptBuffers.Get().([]byte)
+	defer cryptBuffers.Put(buff)
+
+	if len(buff) < len(packet) {
+		buff = make([]byte, len(packet))
+	}
+
+	plain := buff[:len(packet)]
+
+	block.Decrypt(plain, packet)
+
+	if binary.LittleEndian.Uint32(plain[cryptNonceSize:]) != crc32.ChecksumIEEE(plain[cryptHeaderSize:]) {
+		return
+	}
+
+	fn(plain[cryptHeaderSize:])
+}
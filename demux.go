@@ -0,0 +1,253 @@
+package kcp
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/libs4go/errors"
+	"github.com/multiformats/go-multiaddr"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+// demuxBacklog the max sessions of a shared socket waiting for the listener they go to
+const demuxBacklog = 128
+
+// ListenerDemux picks the listener of a session accepted on a udp socket shared by several
+// listeners, laddrs are the multiaddrs of the listeners in Listen order. It returns the
+// index of the listener in laddrs, any other value drops the session
+type ListenerDemux func(conv uint32, raddr net.Addr, laddrs []multiaddr.Multiaddr) int
+
+// WithListenerDemux create kcp transport whose listeners on the same udp address share one
+// socket instead of failing to bind it, demux picks the listener of each accepted session,
+// e.g. by the conv ranges the dialers of each tenant use, see WithConvProvider
+func WithListenerDemux(demux ListenerDemux) Option {
+	return func(kcp *kcpTransport) error {
+		if demux == nil {
+			return errors.Wrap(ErrOption, "nil listener demux")
+		}
+
+		kcp.listenerDemux = demux
+
+		return nil
+	}
+}
+
+// sessionAcceptor accepts the kcp sessions of a listener
+type sessionAcceptor interface {
+	AcceptKCP() (*kcpgo.UDPSession, error)
+	Addr() net.Addr
+	Close() error
+}
+
+// listenSocket returns the session acceptor of a listener on addr and the socket it reads
+// from, with WithListenerDemux the listeners on the same address share the socket. laddr
+// is returned with the port the socket is bound to
+func (kcp *kcpTransport) listenSocket(network string, addr *net.UDPAddr, laddr multiaddr.Multiaddr) (sessionAcceptor, *sharedSocket, *monitorConn, multiaddr.Multiaddr, error) {
+	if kcp.listenerDemux == nil {
+		listener, socket, monitor, err := kcp.listenSession(network, addr)
+
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+
+		return listener, socket, monitor, boundPort(laddr, addr, socket), nil
+	}
+
+	lc := kcp.lifecycle
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	if addr.Port != 0 {
+		if d, ok := lc.sockets[socketKey(network, addr)]; ok {
+			return d.endpoint(laddr), d.socket.hold(), d.monitor, laddr, nil
+		}
+	}
+
+	listener, socket, monitor, err := kcp.listenSession(network, addr)
+
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	d := &demuxSocket{
+		kcp:      kcp,
+		key:      socketKey(network, socket.LocalAddr().(*net.UDPAddr)),
+		listener: listener,
+		socket:   socket,
+		monitor:  monitor,
+		done:     make(chan struct{}),
+	}
+
+	lc.sockets[d.key] = d
+
+	go d.serve()
+
+	laddr = boundPort(laddr, addr, socket)
+
+	return d.endpoint(laddr), d.socket.hold(), monitor, laddr, nil
+}
+
+// boundPort returns laddr with the port socket is bound to if addr has the random port 0
+func boundPort(laddr multiaddr.Multiaddr, addr *net.UDPAddr, socket *sharedSocket) multiaddr.Multiaddr {
+	if addr.Port != 0 {
+		return laddr
+	}
+
+	return withPort(laddr, socket.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func socketKey(network string, addr *net.UDPAddr) string {
+	return network + "/" + addr.String()
+}
+
+// demuxSocket a udp socket shared by the listeners on its address, its kcp-go listener
+// accepts the sessions of all of them
+type demuxSocket struct {
+	sync.Mutex
+	kcp       *kcpTransport
+	key       string // the key of the socket in the lifecycle
+	listener  sessionAcceptor
+	socket    *sharedSocket
+	monitor   *monitorConn
+	endpoints []*demuxEndpoint // in Listen order
+	done      chan struct{}    // closed when serve returns
+	err       error            // the error serve returned on
+}
+
+// endpoint adds the acceptor of the listener on laddr
+func (d *demuxSocket) endpoint(laddr multiaddr.Multiaddr) *demuxEndpoint {
+	e := &demuxEndpoint{
+		demux:    d,
+		laddr:    laddr,
+		sessions: make(chan *kcpgo.UDPSession, demuxBacklog),
+		closed:   make(chan struct{}),
+	}
+
+	d.Lock()
+	d.endpoints = append(d.endpoints, e)
+	d.Unlock()
+
+	return e
+}
+
+// remove removes the acceptor e, the last one closes the kcp-go listener and releases the
+// socket
+func (d *demuxSocket) remove(e *demuxEndpoint) error {
+	lc := d.kcp.lifecycle
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	d.Lock()
+	defer d.Unlock()
+
+	for i, endpoint := range d.endpoints {
+		if endpoint == e {
+			d.endpoints = append(d.endpoints[:i], d.endpoints[i+1:]...)
+			break
+		}
+	}
+
+	if len(d.endpoints) > 0 {
+		return nil
+	}
+
+	delete(lc.sockets, d.key)
+
+	err := d.listener.Close()
+
+	d.socket.Close()
+
+	return err
+}
+
+// serve hands the accepted sessions to the listeners picked by the demux of the transport
+func (d *demuxSocket) serve() {
+	defer close(d.done)
+
+	for {
+		udpSession, err := d.listener.AcceptKCP()
+
+		if err != nil {
+			d.err = err
+			return
+		}
+
+		d.route(udpSession)
+	}
+}
+
+// route hands udpSession to its listener, the removed listeners get no more sessions
+func (d *demuxSocket) route(udpSession *kcpgo.UDPSession) {
+	d.Lock()
+	defer d.Unlock()
+
+	laddrs := make([]multiaddr.Multiaddr, len(d.endpoints))
+
+	for i, e := range d.endpoints {
+		laddrs[i] = e.laddr
+	}
+
+	i := d.kcp.listenerDemux(udpSession.GetConv(), udpSession.RemoteAddr(), laddrs)
+
+	if i < 0 || i >= len(d.endpoints) {
+		d.kcp.D("drop session from {@raddr}, conv {@conv} has no listener", udpSession.RemoteAddr(), udpSession.GetConv())
+		udpSession.Close()
+		return
+	}
+
+	select {
+	case d.endpoints[i].sessions <- udpSession:
+	default:
+		d.kcp.W("drop session from {@raddr}, listener {@laddr} is full", udpSession.RemoteAddr(), laddrs[i])
+		udpSession.Close()
+	}
+}
+
+// demuxEndpoint the session acceptor of a listener on a shared socket
+type demuxEndpoint struct {
+	demux     *demuxSocket
+	laddr     multiaddr.Multiaddr
+	sessions  chan *kcpgo.UDPSession
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (e *demuxEndpoint) AcceptKCP() (*kcpgo.UDPSession, error) {
+	select {
+	case udpSession := <-e.sessions:
+		return udpSession, nil
+	case <-e.closed:
+		return nil, io.ErrClosedPipe
+	case <-e.demux.done:
+		return nil, e.demux.err
+	}
+}
+
+func (e *demuxEndpoint) Addr() net.Addr {
+	return e.demux.listener.Addr()
+}
+
+// Close closes the acceptor and the sessions waiting for it
+func (e *demuxEndpoint) Close() error {
+	var err error
+
+	e.closeOnce.Do(func() {
+		close(e.closed)
+
+		err = e.demux.remove(e)
+
+		for {
+			select {
+			case udpSession := <-e.sessions:
+				udpSession.Close()
+			default:
+				return
+			}
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,104 @@
+package kcp
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libs4go/errors"
+	"github.com/multiformats/go-multiaddr"
+)
+
+type dialOptionsKey struct{}
+
+// WithDialOptions returns a copy of ctx which carries options overriding the transport
+// defaults for the connections dialed with it, e.g. a mode or fec setting for one peer
+func WithDialOptions(ctx context.Context, options ...Option) context.Context {
+	if current, ok := ctx.Value(dialOptionsKey{}).([]Option); ok {
+		options = append(append([]Option{}, current...), options...)
+	}
+
+	return context.WithValue(ctx, dialOptionsKey{}, options)
+}
+
+// dialPeer strips the trailing /p2p component of raddr, a peer multiaddr, and returns the
+// peer to dial, the one of the component if p is empty. The component must name p otherwise
+func dialPeer(raddr multiaddr.Multiaddr, p peer.ID) (multiaddr.Multiaddr, peer.ID, error) {
+	base, last := multiaddr.SplitLast(raddr)
+
+	if base == nil || last == nil || last.Protocol().Code != multiaddr.P_P2P {
+		return raddr, p, nil
+	}
+
+	id, err := peer.IDFromBytes(last.RawValue())
+
+	if err != nil {
+		return nil, "", errors.Wrap(ErrAddr, "invalid peer id of %s: %s", raddr, err)
+	}
+
+	if p != "" && p != id {
+		return nil, "", errors.Wrap(ErrAddr, "%s is an address of %s, not %s", raddr, id.Pretty(), p.Pretty())
+	}
+
+	return base, id, nil
+}
+
+// dialer returns the transport which dials peer p at raddr, the settings override each
+// other in the order: transport, reconfigured, mode advertised by raddr, peer profile and
+// the options carried by ctx
+func (kcp *kcpTransport) dialer(ctx context.Context, raddr multiaddr.Multiaddr, p peer.ID) (*kcpTransport, error) {
+	options := kcp.connOptions(addrOptions(raddr), p)
+
+	if dialOptions, ok := ctx.Value(dialOptionsKey{}).([]Option); ok {
+		options = append(options, dialOptions...)
+	}
+
+	dialer, err := kcp.derive(options)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "apply dial options error")
+	}
+
+	return dialer, nil
+}
+
+// dialWatcher closes the session being dialed when the dial context is done, which fails
+// the handshake blocked on it
+type dialWatcher struct {
+	done      chan struct{}
+	exited    chan struct{}
+	stopOnce  sync.Once
+	cancelled bool
+}
+
+func watchDial(ctx context.Context, session io.Closer) *dialWatcher {
+	w := &dialWatcher{
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.exited)
+
+		select {
+		case <-ctx.Done():
+			w.cancelled = true
+			session.Close()
+		case <-w.done:
+		}
+	}()
+
+	return w
+}
+
+// stop stops watching the dial context, returns whether the session was closed by it
+func (w *dialWatcher) stop() bool {
+	w.stopOnce.Do(func() {
+		close(w.done)
+	})
+
+	<-w.exited
+
+	return w.cancelled
+}
@@ -0,0 +1,94 @@
+package kcp
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libs4go/errors"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// ConnEventKind the kind of connection lifecycle event
+type ConnEventKind int
+
+// connection lifecycle events, a dial or an accepted session ends with either
+// ConnHandshakeCompleted, followed by ConnClosed, or ConnHandshakeFailed
+const (
+	ConnDialStarted        ConnEventKind = iota // dial started, Local is nil
+	ConnHandshakeCompleted                      // connection set up
+	ConnHandshakeFailed                         // dial or accepted session failed, see Err
+	ConnClosed                                  // connection closed, Err is the reason if any
+)
+
+func (kind ConnEventKind) String() string {
+	switch kind {
+	case ConnDialStarted:
+		return "dial started"
+	case ConnHandshakeCompleted:
+		return "handshake completed"
+	case ConnHandshakeFailed:
+		return "handshake failed"
+	case ConnClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnEvent a connection lifecycle event
+type ConnEvent struct {
+	Kind      ConnEventKind
+	Direction network.Direction
+	Peer      peer.ID             // remote peer, empty for accepted sessions before the handshake
+	Local     multiaddr.Multiaddr // local multiaddr, nil if not known yet
+	Remote    multiaddr.Multiaddr
+	Err       error // the failure, a *HandshakeError for handshakes, or the close reason
+}
+
+// ConnEventHandler receives the connection lifecycle events, it is called from the dial,
+// accept and close paths and must not block
+type ConnEventHandler func(event ConnEvent)
+
+// WithConnEventHandler create kcp transport which calls handler with the lifecycle events
+// of its connections, e.g. to count the handshake failures per remote subnet
+func WithConnEventHandler(handler ConnEventHandler) Option {
+	return func(kcp *kcpTransport) error {
+		if handler == nil {
+			return errors.Wrap(ErrOption, "nil conn event handler")
+		}
+
+		kcp.eventHandler = handler
+
+		return nil
+	}
+}
+
+func (kcp *kcpTransport) emit(event ConnEvent) {
+	if kcp.eventHandler != nil {
+		kcp.eventHandler(event)
+	}
+}
+
+// emit emits the event of kind of c, with the reason err
+func (c *kcpCapableConn) emit(kind ConnEventKind, err error) {
+	c.kcp.emit(ConnEvent{
+		Kind:      kind,
+		Direction: c.direction,
+		Peer:      c.remotePeerID,
+		Local:     c.localMultiaddr,
+		Remote:    c.remoteMultiaddr,
+		Err:       err,
+	})
+}
+
+// closeReason returns the reason c is closed for, nil if closed by Close
+func (c *kcpCapableConn) closeReason() error {
+	if err, ok := c.closeErr.Load().(error); ok {
+		return err
+	}
+
+	if c.watched.failed() || c.session.IsClosed() {
+		return ErrConnLost
+	}
+
+	return nil
+}
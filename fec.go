@@ -0,0 +1,53 @@
+package kcp
+
+import (
+	"encoding/binary"
+
+	"github.com/libs4go/errors"
+)
+
+const (
+	fecHeaderSize = 6    // kcp-go fec header, seqid(4) + flag(2)
+	fecSizeSize   = 2    // kcp-go data shard size field
+	fecTypeData   = 0xf1 // kcp-go fec data shard flag
+	fecTypeParity = 0xf2 // kcp-go fec parity shard flag
+	fecMaxShards  = 256  // reed-solomon limit of total shards
+)
+
+// WithFEC create kcp transport with reed-solomon forward error correction, every
+// dataShards packets are followed by parityShards recovery packets, both peers
+// must use the same parameters
+func WithFEC(dataShards, parityShards int) Option {
+	return func(kcp *kcpTransport) error {
+		if dataShards <= 0 || parityShards <= 0 || dataShards+parityShards > fecMaxShards {
+			return errors.Wrap(ErrOption, "invalid fec shards %d %d", dataShards, parityShards)
+		}
+
+		kcp.dataShards = dataShards
+		kcp.parityShards = parityShards
+
+		return nil
+	}
+}
+
+// fecPayload strips the fec header of packet, parity shards carry no kcp segments
+// so an empty payload is returned for them
+func fecPayload(packet []byte) []byte {
+	if len(packet) < fecHeaderSize+fecSizeSize {
+		return packet
+	}
+
+	switch binary.LittleEndian.Uint16(packet[4:]) {
+	case fecTypeData:
+		return packet[fecHeaderSize+fecSizeSize:]
+	case fecTypeParity:
+		return packet[:0]
+	}
+
+	return packet
+}
+
+// fecParity checks if packet is a fec parity shard
+func fecParity(packet []byte) bool {
+	return len(packet) >= fecHeaderSize+fecSizeSize && binary.LittleEndian.Uint16(packet[4:]) == fecTypeParity
+}
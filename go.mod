@@ -4,12 +4,22 @@ go 1.14
 
 require (
 	github.com/golang/protobuf v1.4.2
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
 	github.com/ipfs/go-log v1.0.4
 	github.com/klauspost/reedsolomon v1.9.9 // indirect
+	github.com/libp2p/go-conn-security-multistream v0.2.0
 	github.com/libp2p/go-libp2p v0.11.0
 	github.com/libp2p/go-libp2p-core v0.6.1
+	github.com/libp2p/go-libp2p-noise v0.1.1
 	github.com/libp2p/go-libp2p-peerstore v0.2.6
+	github.com/libp2p/go-libp2p-pnet v0.2.0
+	github.com/libp2p/go-libp2p-testing v0.1.1
 	github.com/libp2p/go-libp2p-tls v0.1.3
+	github.com/libp2p/go-libp2p-transport-upgrader v0.3.0
+	github.com/libp2p/go-libp2p-yamux v0.2.8
+	github.com/libp2p/go-mplex v0.1.2
+	github.com/libp2p/go-stream-muxer-multistream v0.3.0
+	github.com/libp2p/go-yamux v1.3.7
 	github.com/libs4go/errors v0.0.3
 	github.com/libs4go/libp2p-grpc v0.0.4
 	github.com/libs4go/scf4go v0.0.7
@@ -24,5 +34,6 @@ require (
 	github.com/xtaci/kcp-go v5.4.20+incompatible
 	github.com/xtaci/lossyconn v0.0.0-20200209145036-adba10fffc37 // indirect
 	github.com/xtaci/smux v1.5.14
+	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b
 	google.golang.org/grpc v1.31.1
 )
@@ -0,0 +1,146 @@
+package kcp
+
+import (
+	"context"
+	"crypto/x509"
+	stderrors "errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/libs4go/errors"
+)
+
+// defaultHandshakeTimeout the default max duration of a connection handshake
+const defaultHandshakeTimeout = 15 * time.Second
+
+// WithHandshakeTimeout create kcp transport whose connection handshakes, from the first
+// kcp packet until smux is set up, fail and close the kcp session after d
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(kcp *kcpTransport) error {
+		if d <= 0 {
+			return errors.Wrap(ErrOption, "invalid handshake timeout %s", d)
+		}
+
+		kcp.handshakeTimeout = d
+
+		return nil
+	}
+}
+
+// HandshakeErrorKind the kind of connection handshake failure
+type HandshakeErrorKind int
+
+// handshake failure kinds
+const (
+	HandshakeUnknown        HandshakeErrorKind = iota // unclassified failure
+	HandshakeUnreachable                              // udp path to the peer is unreachable
+	HandshakeNotEstablished                           // no kcp packet ever arrived from the peer
+	HandshakeCertInvalid                              // tls certificate verification failed
+	HandshakePeerMismatch                             // authenticated peer isn't the expected one
+	HandshakeTimeout                                  // handshake started but didn't finish in time
+)
+
+func (kind HandshakeErrorKind) String() string {
+	switch kind {
+	case HandshakeUnreachable:
+		return "unreachable"
+	case HandshakeNotEstablished:
+		return "not established"
+	case HandshakeCertInvalid:
+		return "cert invalid"
+	case HandshakePeerMismatch:
+		return "peer mismatch"
+	case HandshakeTimeout:
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+// HandshakeError the classified handshake failure returned by Dial and Accept
+type HandshakeError struct {
+	Kind HandshakeErrorKind
+	Err  error
+}
+
+func (err *HandshakeError) Error() string {
+	return fmt.Sprintf("kcp handshake error(%s): %s", err.Kind, err.Err)
+}
+
+// Unwrap returns the original error
+func (err *HandshakeError) Unwrap() error {
+	return err.Err
+}
+
+// newHandshakeError classifies the handshake failure err, received is the number of
+// bytes received from the kcp session during the handshake
+func newHandshakeError(err error, received uint64) *HandshakeError {
+	return &HandshakeError{
+		Kind: handshakeErrorKind(err, received),
+		Err:  err,
+	}
+}
+
+func handshakeErrorKind(err error, received uint64) HandshakeErrorKind {
+	if err == ErrTLS {
+		return HandshakeCertInvalid
+	}
+
+	var errno syscall.Errno
+
+	if stderrors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+			return HandshakeUnreachable
+		}
+	}
+
+	if isTimeout(err) {
+		if received == 0 {
+			return HandshakeNotEstablished
+		}
+
+		return HandshakeTimeout
+	}
+
+	var certErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+
+	if stderrors.As(err, &certErr) || stderrors.As(err, &authorityErr) {
+		return HandshakeCertInvalid
+	}
+
+	// go-libp2p-tls, crypto/tls and plaintext report verification failures as plain errors
+	msg := err.Error()
+
+	switch {
+	case strings.Contains(msg, "peer IDs don't match"),
+		strings.Contains(msg, "unexpected peer ID"):
+		return HandshakePeerMismatch
+	case strings.Contains(msg, "certificate"),
+		strings.Contains(msg, "signature"),
+		strings.Contains(msg, "public key"),
+		strings.Contains(msg, "key extension"):
+		return HandshakeCertInvalid
+	}
+
+	return HandshakeUnknown
+}
+
+// isTimeout checks if err is a timeout, kcp-go reports timeouts as plain errors
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	if stderrors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	if stderrors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	return strings.HasSuffix(err.Error(), "timeout")
+}
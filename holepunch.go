@@ -0,0 +1,155 @@
+package kcp
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+	"github.com/libs4go/errors"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// punchInterval the interval of the punch packets which open the nat mapping to a peer
+const punchInterval = 200 * time.Millisecond
+
+// punchPacket shorter than any kcp packet so that the kcp sessions of the peer drop it
+var punchPacket = []byte("\x00kcp-punch")
+
+// HolePunch connects to p at raddr, the address p is observed at, while p does the same,
+// e.g. coordinated by DCUtR. The peer with the lower peer id dials from its listen socket,
+// the other one sends punch packets to raddr from its listen socket to open its nat and
+// accepts the session of p, so the race of the simultaneous dials always yields a single
+// connection. Both transports need WithDialFromListener
+func (kcp *kcpTransport) HolePunch(ctx context.Context, raddr multiaddr.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	if !kcp.dialFromListener {
+		return nil, errors.Wrap(ErrOption, "hole punching needs WithDialFromListener")
+	}
+
+	raddr, p, err := dialPeer(raddr, p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if kcp.credentials().localPeer < p {
+		return kcp.Dial(ctx, raddr, p)
+	}
+
+	base, _ := splitKcpMode(raddr)
+
+	udpNetwork, host, err := manet.DialArgs(base)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "manet.DialArgs error")
+	}
+
+	addr, err := net.ResolveUDPAddr(udpNetwork, host)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve udp addr %s %s error", udpNetwork, host)
+	}
+
+	kcp.I("hole punch to {@addr}", raddr)
+
+	return kcp.acceptPunched(ctx, addr, p)
+}
+
+// acceptPunched sends punch packets to addr until the session of p is accepted
+func (kcp *kcpTransport) acceptPunched(ctx context.Context, addr *net.UDPAddr, p peer.ID) (transport.CapableConn, error) {
+	socket, _ := kcp.dialMux(addr)
+
+	if socket == nil {
+		return nil, errors.Wrap(ErrUnreachable, "no listener to punch %s from", addr)
+	}
+
+	punched := make(chan transport.CapableConn, 1)
+
+	if !kcp.expectPunch(p, punched) {
+		return nil, errors.Wrap(ErrUnreachable, "hole punch to %s in progress", p.Pretty())
+	}
+
+	defer kcp.cancelPunch(p, punched)
+
+	// p dials within the handshake timeout, like any other dialer
+	ctx, cancel := context.WithTimeout(ctx, kcp.handshakeTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(punchInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := socket.WriteTo(punchPacket, addr); err != nil {
+			kcp.D("punch {@addr} error: {@err}", addr, err)
+		}
+
+		select {
+		case conn := <-punched:
+			return conn, nil
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "hole punch to %s error", addr)
+		case <-kcp.lifecycle.closed:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// expectPunch registers punched for the accepted connection of p, returns false if a hole
+// punch to p is in progress already
+func (kcp *kcpTransport) expectPunch(p peer.ID, punched chan transport.CapableConn) bool {
+	lc := kcp.lifecycle
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	if _, ok := lc.punches[p]; ok {
+		return false
+	}
+
+	lc.punches[p] = punched
+
+	return true
+}
+
+// cancelPunch unregisters punched, and closes the connection it missed
+func (kcp *kcpTransport) cancelPunch(p peer.ID, punched chan transport.CapableConn) {
+	lc := kcp.lifecycle
+
+	lc.Lock()
+
+	if lc.punches[p] == punched {
+		delete(lc.punches, p)
+	}
+
+	lc.Unlock()
+
+	select {
+	case conn := <-punched:
+		conn.Close()
+	default:
+	}
+}
+
+// claimPunch hands the accepted conn to the hole punch waiting for its peer, returns false
+// if there is none
+func (kcp *kcpTransport) claimPunch(conn transport.CapableConn) bool {
+	lc := kcp.lifecycle
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	punched, ok := lc.punches[conn.RemotePeer()]
+
+	if !ok {
+		return false
+	}
+
+	delete(lc.punches, conn.RemotePeer())
+
+	punched <- conn
+
+	return true
+}
@@ -0,0 +1,182 @@
+package kcp
+
+import (
+	"crypto/x509"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/sec"
+	"github.com/libp2p/go-libp2p-core/sec/insecure"
+	tlsp2p "github.com/libp2p/go-libp2p-tls"
+	"github.com/libs4go/errors"
+)
+
+// identityCacheSize max number of cached tls identities
+const identityCacheSize = 128
+
+var identityCache = struct {
+	sync.Mutex
+	identities map[peer.ID]*tlsp2p.Identity
+}{identities: make(map[peer.ID]*tlsp2p.Identity)}
+
+// cachedIdentity returns the tls identity of privKey, the certificate is generated once
+// for the transports sharing a key
+func cachedIdentity(privKey crypto.PrivKey) (*tlsp2p.Identity, error) {
+	id, err := peer.IDFromPrivateKey(privKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	identityCache.Lock()
+	defer identityCache.Unlock()
+
+	if identity, ok := identityCache.identities[id]; ok {
+		return identity, nil
+	}
+
+	identity, err := tlsp2p.NewIdentity(privKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(identityCache.identities) >= identityCacheSize {
+		identityCache.identities = make(map[peer.ID]*tlsp2p.Identity)
+	}
+
+	identityCache.identities[id] = identity
+
+	return identity, nil
+}
+
+// WithIdentity create kcp transport with TLS using identity, which must be created from
+// the transport's private key. It replaces WithTLS and WithSecurity, whichever comes last wins
+func WithIdentity(identity *tlsp2p.Identity) Option {
+	return func(kcp *kcpTransport) error {
+		if identity == nil {
+			return errors.Wrap(ErrOption, "nil tls identity")
+		}
+
+		pubKey, err := identityPubKey(identity)
+
+		if err != nil {
+			return errors.Wrap(err, "parse tls identity certificate error")
+		}
+
+		if !pubKey.Equals(kcp.privKey.GetPublic()) {
+			return errors.Wrap(ErrOption, "tls identity of another key")
+		}
+
+		kcp.identity = identity
+		kcp.security = nil
+
+		return nil
+	}
+}
+
+// identityPubKey returns the host public key certified by identity
+func identityPubKey(identity *tlsp2p.Identity) (crypto.PubKey, error) {
+	conf, _ := identity.ConfigForAny()
+
+	if len(conf.Certificates) == 0 {
+		return nil, errors.Wrap(ErrOption, "tls identity without certificate")
+	}
+
+	chain := make([]*x509.Certificate, 0, len(conf.Certificates[0].Certificate))
+
+	for _, raw := range conf.Certificates[0].Certificate {
+		cert, err := x509.ParseCertificate(raw)
+
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, cert)
+	}
+
+	return tlsp2p.PubKeyFromCertChain(chain)
+}
+
+// credentials the keys which authenticate the local peer of new connections
+type credentials struct {
+	localPeer peer.ID
+	privKey   crypto.PrivKey
+	identity  *tlsp2p.Identity
+	security  sec.SecureTransport
+}
+
+// rotated the credentials set by Transport.SetIdentity, shared by the derived transports
+type rotated struct {
+	sync.Mutex
+	current *credentials
+}
+
+// credentials returns the credentials of new connections
+func (kcp *kcpTransport) credentials() credentials {
+	r := kcp.root().rotated
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.current != nil {
+		return *r.current
+	}
+
+	return credentials{
+		localPeer: kcp.localPeer,
+		privKey:   kcp.privKey,
+		identity:  kcp.identity,
+		security:  kcp.security,
+	}
+}
+
+// SetIdentity replaces the key of the new connections, the established ones keep the
+// old key until they are closed. The session tickets issued with the old key are
+// revoked. The keys of security transports set by WithSecurity can't be rotated
+func (kcp *kcpTransport) SetIdentity(privKey crypto.PrivKey) error {
+	root := kcp.root()
+
+	id, err := peer.IDFromPrivateKey(privKey)
+
+	if err != nil {
+		return errors.Wrap(err, "generate peer id from private key error")
+	}
+
+	old := root.credentials()
+
+	creds := &credentials{
+		localPeer: id,
+		privKey:   privKey,
+	}
+
+	switch security := old.security.(type) {
+	case nil:
+		if old.identity != nil {
+			creds.identity, err = cachedIdentity(privKey)
+
+			if err != nil {
+				return errors.Wrap(err, "generate identity from private key error")
+			}
+		}
+	case *insecure.Transport:
+		creds.security = insecure.NewWithIdentity(id, privKey)
+	default:
+		return errors.Wrap(ErrOption, "the key of security transport %T can't be rotated", security)
+	}
+
+	if root.resumption != nil {
+		if err := root.resumption.rotate(); err != nil {
+			return err
+		}
+	}
+
+	root.rotated.Lock()
+	root.rotated.current = creds
+	root.rotated.Unlock()
+
+	root.I("rotate identity {@old} -> {@new}", old.localPeer.Pretty(), id.Pretty())
+
+	return nil
+}
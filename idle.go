@@ -0,0 +1,84 @@
+package kcp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/libs4go/errors"
+)
+
+const idleChecks = 4 // idle checks per idle timeout
+
+// WithIdleTimeout create kcp transport which closes the connections that have no open
+// stream and no stream activity for d, the swarm sees the close as an AcceptStream error
+// wrapping ErrIdleTimeout
+func WithIdleTimeout(d time.Duration) Option {
+	return func(kcp *kcpTransport) error {
+		if d <= 0 {
+			return errors.Wrap(ErrOption, "invalid idle timeout %s", d)
+		}
+
+		kcp.idleTimeout = d
+
+		return nil
+	}
+}
+
+// activity records the last stream activity of a connection
+type activity struct {
+	last int64 // unix nano
+}
+
+func (a *activity) touch() {
+	if a != nil {
+		atomic.StoreInt64(&a.last, time.Now().UnixNano())
+	}
+}
+
+func (a *activity) since(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// watchIdle starts the idle timer of connection if enabled, it must be called before
+// any stream is opened or accepted
+func (c *kcpCapableConn) watchIdle() {
+	if c.kcp.idleTimeout <= 0 {
+		return
+	}
+
+	c.activity = &activity{}
+	c.activity.touch()
+
+	go c.runIdleTimer()
+}
+
+func (c *kcpCapableConn) runIdleTimer() {
+	timeout := c.kcp.idleTimeout
+
+	ticker := time.NewTicker(timeout / idleChecks)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+
+		if c.session.IsClosed() {
+			return
+		}
+
+		if c.session.NumStreams() > 0 || c.activity.since(time.Now()) < timeout {
+			continue
+		}
+
+		c.kcp.I("close connection to {@raddr} idle for {@timeout}", c.remoteMultiaddr, timeout)
+
+		c.closeErr.Store(errors.Wrap(ErrIdleTimeout, "connection to %s idle for %s", c.remoteMultiaddr, timeout))
+
+		c.Close()
+
+		return
+	}
+}
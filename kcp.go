@@ -3,14 +3,24 @@ package kcp
 import (
 	"context"
 	"crypto/tls"
+	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/metrics"
 	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	ipnet "github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/libp2p/go-libp2p-core/sec"
 	"github.com/libp2p/go-libp2p-core/transport"
 	tlsp2p "github.com/libp2p/go-libp2p-tls"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
 	"github.com/libs4go/errors"
 	"github.com/libs4go/slf4go"
 	"github.com/multiformats/go-multiaddr"
@@ -24,10 +34,22 @@ const errVendor = "kcp"
 
 // errors
 var (
-	ErrInternal = errors.New("the internal error", errors.WithVendor(errVendor), errors.WithCode(-1))
-	ErrAddr     = errors.New("invalid libp2p net.addr", errors.WithVendor(errVendor), errors.WithCode(-2))
-	ErrClosed   = errors.New("transport closed", errors.WithVendor(errVendor), errors.WithCode(-3))
-	ErrTLS      = errors.New("expected remote pub key to be set", errors.WithVendor(errVendor), errors.WithCode(-4))
+	ErrInternal       = errors.New("the internal error", errors.WithVendor(errVendor), errors.WithCode(-1))
+	ErrAddr           = errors.New("invalid libp2p net.addr", errors.WithVendor(errVendor), errors.WithCode(-2))
+	ErrClosed         = errors.New("transport closed", errors.WithVendor(errVendor), errors.WithCode(-3))
+	ErrTLS            = errors.New("expected remote pub key to be set", errors.WithVendor(errVendor), errors.WithCode(-4))
+	ErrOption         = errors.New("invalid transport option", errors.WithVendor(errVendor), errors.WithCode(-5))
+	ErrSmuxVersion    = errors.New("smux version mismatch", errors.WithVendor(errVendor), errors.WithCode(-6))
+	ErrStalled        = errors.New("kcp session stalled", errors.WithVendor(errVendor), errors.WithCode(-7))
+	ErrUnreachable    = errors.New("peer unreachable", errors.WithVendor(errVendor), errors.WithCode(-8))
+	ErrWouldBlock     = errors.New("write would block", errors.WithVendor(errVendor), errors.WithCode(-9))
+	ErrTooManyStreams = errors.New("too many streams", errors.WithVendor(errVendor), errors.WithCode(-10))
+	ErrIdleTimeout    = errors.New("connection idle timeout", errors.WithVendor(errVendor), errors.WithCode(-11))
+	ErrInsecure       = errors.New("insecure transport", errors.WithVendor(errVendor), errors.WithCode(-12))
+	ErrHalfClose      = errors.New("muxer has no half-close", errors.WithVendor(errVendor), errors.WithCode(-13))
+	ErrVersion        = errors.New("protocol version mismatch", errors.WithVendor(errVendor), errors.WithCode(-14))
+	ErrConnLost       = errors.New("connection lost", errors.WithVendor(errVendor), errors.WithCode(-15))
+	ErrMigration      = errors.New("connection migration failed", errors.WithVendor(errVendor), errors.WithCode(-16))
 )
 
 const protocolKCPID = 482
@@ -38,35 +60,223 @@ var protoKCP = multiaddr.Protocol{
 	VCode: multiaddr.CodeToVarint(protocolKCPID),
 }
 
+// protoKCPErr the error of the registration of protoKCP, a protocol taking its code or
+// name fails New instead of the process, unless WithProtocolCode picks another code
+var protoKCPErr error
+
 func init() {
-	if err := multiaddr.AddProtocol(protoKCP); err != nil {
-		panic(err)
-	}
+	protoKCPErr = registerProtocol(protoKCP)
 }
 
 // Option transport creation option
 type Option func(kcp *kcpTransport) error
 
+// ConvProvider returns the kcp conv of the session dialed to raddr
+type ConvProvider func(raddr net.Addr, p peer.ID) uint32
+
+// WithConvProvider create kcp transport which assigns the conv of dialed sessions
+// by provider instead of a random one
+func WithConvProvider(provider ConvProvider) Option {
+	return func(kcp *kcpTransport) error {
+		kcp.convProvider = provider
+		return nil
+	}
+}
+
+// WithPacketConn create kcp transport which wraps the udp sockets of listeners and
+// dialed sessions by wrapper, e.g. for traffic shaping or loss simulation
+func WithPacketConn(wrapper func(conn net.PacketConn) net.PacketConn) Option {
+	return func(kcp *kcpTransport) error {
+		kcp.packetConn = wrapper
+		return nil
+	}
+}
+
 // WithTLS create kcp transport with TLS
 func WithTLS() Option {
 	return func(kcp *kcpTransport) error {
-		identity, err := tlsp2p.NewIdentity(kcp.privKey)
+		identity, err := cachedIdentity(kcp.privKey)
 
 		if err != nil {
 			return errors.Wrap(err, "generate identity from private key error")
 		}
 
 		kcp.identity = identity
+		kcp.security = nil
 
 		return nil
 	}
 }
 
 type kcpTransport struct {
-	slf4go.Logger                  // mixin logger
-	localPeer     peer.ID          // local peer.ID
-	privKey       crypto.PrivKey   // local peer key
-	identity      *tlsp2p.Identity //
+	slf4go.Logger                                              // mixin logger
+	localPeer         peer.ID                                  // local peer.ID
+	privKey           crypto.PrivKey                           // local peer key
+	identity          *tlsp2p.Identity                         //
+	security          sec.SecureTransport                      // libp2p security transport replacing tls
+	psk               ipnet.PSK                                // private network psk, nil means public network
+	resumption        *resumption                              // tls session resumption, nil means disabled
+	handshakeTimeout  time.Duration                            // max duration of the handshake of dialed and accepted sessions
+	maxHandshakes     int                                      // max parallel handshakes of a listener
+	protocol          multiaddr.Protocol                       // multiaddr protocol of the kcp component
+	versions          []int                                    // negotiated wire protocol versions, nil means no negotiation
+	observedHandler   ObservedAddrHandler                      // receives the observed addresses of the connections
+	eventHandler      ConnEventHandler                         // receives the connection lifecycle events
+	bandwidthReporter metrics.Reporter                         // reports the udp traffic, nil means disabled
+	upgrader          *tptu.Upgrader                           // upgrades the kcp sessions instead of tls and smux, nil means disabled
+	listenShards      int                                      // SO_REUSEPORT sockets of a listener, 0 means one plain socket
+	dialFromListener  bool                                     // dial from the udp socket of a listener
+	natRebinding      bool                                     // move accepted sessions to the new addresses of their peers
+	migration         bool                                     // dialed sessions can move to new udp sockets
+	listenerDemux     ListenerDemux                            // picks the listener of the sessions of shared sockets, nil means no sharing
+	acceptBacklog     int                                      // max upgraded connections waiting for Accept, 0 means unbuffered
+	backlogPolicy     BacklogPolicy                            // overflow policy of the accept backlog
+	cookieSecret      []byte                                   // address validation cookie secret, nil means disabled
+	tlsCurves         []tls.CurveID                            // tls key exchange curves, nil means crypto/tls defaults
+	tlsCipherSuites   []uint16                                 // allowed tls 1.3 cipher suites, nil means all
+	requireSecurity   bool                                     // New fails without tls or a security transport
+	certVerifier      PeerCertificateVerifier                  // extra verification of the remote peer's certificates
+	rcmgr             ResourceManager                          // connection resource limits, nil means unlimited
+	tlsKeyLog         io.Writer                                // tls secrets key log, nil means disabled
+	autoMTU           int                                      // min mtu of automatic mtu reduction, 0 means disabled
+	tagger            *connTagger                              // connmgr tagger
+	sendBuffers       *sendBuffers                             // send buffer states of the sessions
+	protectConns      bool                                     // protect the tagged peers
+	convProvider      ConvProvider                             // kcp conv provider for dialed sessions
+	convValidator     ConvValidator                            // kcp conv validator for accepted sessions
+	peerValidator     PeerValidator                            // remote peer validator for accepted sessions
+	smuxVersion       int                                      // smux protocol version
+	keepAliveInterval time.Duration                            // smux keepalive interval
+	keepAliveTimeout  time.Duration                            // smux keepalive timeout
+	smuxConfig        *smux.Config                             // smux frame and buffer settings, nil means smux defaults
+	smuxNegotiate     bool                                     // negotiate the muxer by tls alpn
+	muxers            []string                                 // muxers advertised by tls alpn in preference order
+	yamux             bool                                     // use yamux instead of smux
+	mplex             bool                                     // use mplex instead of smux
+	maxStreams        int                                      // max open smux streams per connection, 0 means unlimited
+	compression       bool                                     // snappy compress smux frames
+	writeTimeout      time.Duration                            // default write deadline of streams, 0 means none
+	batchIO           bool                                     // hand bare udp sockets to kcp-go for batched syscalls
+	offload           bool                                     // udp receive offload where supported
+	watchdog          time.Duration                            // session stall duration, 0 means disabled
+	clientSessions    *clientSessions                          // client session ids of the dials, nil means disabled
+	linger            time.Duration                            // max duration Close waits for the send queue to drain
+	idleTimeout       time.Duration                            // close connections without stream activity, 0 means disabled
+	packetConn        func(conn net.PacketConn) net.PacketConn // udp socket wrapper
+	ctx               context.Context                          // transport lifecycle context
+	lifecycle         *lifecycle                               // listeners and connections tracker
+	sessionConf       sessionConf                              // kcp session tuning
+	dataShards        int                                      // fec data shards, 0 means disabled
+	parityShards      int                                      // fec parity shards
+	block             kcpgo.BlockCrypt                         // packet level cipher, nil means disabled
+	socketConf        socketConf                               // udp socket options
+	base              *kcpTransport                            // transport created by New, set for derived copies
+	profiles          map[peer.ID]Profile                      // per peer settings
+	reconfigured      *reconfigured                            // settings changed after New
+	rotated           *rotated                                 // credentials changed after New
+	adaptiveWindow    *windowRange                             // adaptive window range, nil means disabled
+	pathMTU           int                                      // max mtu of path mtu discovery, 0 means disabled
+	congestion        func() CongestionController              // congestion controller factory, nil means kcp-go built-in
+}
+
+// Transport kcp transport
+type Transport interface {
+	transport.Transport
+	// ListenAll listens on all of the given multiaddrs, if any of them fails,
+	// the already opened listeners are closed
+	ListenAll(laddrs []multiaddr.Multiaddr) ([]transport.Listener, error)
+	// Reconfigure applies profile to the future connections and, where kcp-go
+	// permits, to the established ones
+	Reconfigure(profile Profile) error
+	// SetIdentity replaces the key of the future connections, the established
+	// ones keep the old key until they are closed
+	SetIdentity(privKey crypto.PrivKey) error
+	// Close closes all the listeners and connections created by the transport
+	Close() error
+	// Shutdown closes the listeners, waits until ctx is done for the connections to
+	// close their streams, then closes the connections
+	Shutdown(ctx context.Context) error
+	// ListenAddrs returns the dialable multiaddrs of the listeners, the ones on an
+	// unspecified address are expanded to the interface addresses
+	ListenAddrs() ([]multiaddr.Multiaddr, error)
+	// HolePunch connects to p at raddr while p connects to the local peer at the same
+	// time, the simultaneous dials yield a single connection
+	HolePunch(ctx context.Context, raddr multiaddr.Multiaddr, p peer.ID) (transport.CapableConn, error)
+	// KCPAddrs filters addrs to the kcp multiaddrs which can be dialed by the transport,
+	// which are those of its protocol code, see WithProtocolCode
+	KCPAddrs(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr
+}
+
+// Stats kcp connection statistics
+type Stats struct {
+	Direction     network.Direction // whether the connection was dialed or accepted
+	Opened        time.Time         // when the connection was established
+	NumStreams    int               // open muxer streams
+	MTU           int               // current effective mtu
+	BytesSent     uint64            // bytes written to the kcp session
+	BytesReceived uint64            // bytes read from the kcp session
+	WireSent      uint64            // bytes of the sent udp packets, 0 unless monitored, see WithBandwidthReporter
+	WireReceived  uint64            // bytes of the received udp packets, 0 unless monitored
+	Retransmitted uint64            // bytes of the retransmitted kcp segments, 0 unless monitored
+	DataShards    int               // fec data shards of the session, 0 without fec
+	ParityShards  int               // fec parity shards of the session, fixed for its lifetime
+	ParitySent    uint64            // fec parity packets sent, 0 unless monitored
+	ParityRecv    uint64            // fec parity packets received, 0 unless monitored
+}
+
+// Stream kcp transport stream
+type Stream interface {
+	mux.MuxedStream
+	// StreamID returns the muxer stream id, which is the same on both ends
+	StreamID() uint32
+	// TryWrite writes b only if the kcp session isn't congested, which means its
+	// send window is full, otherwise returns ErrWouldBlock without writing anything
+	TryWrite(b []byte) (int, error)
+	// CloseWrite closes the stream for writing, the stream stays readable
+	CloseWrite() error
+	// CloseRead closes the stream for reading, the stream stays writable
+	CloseRead() error
+	// Reset aborts the stream on both ends, except on smux which has no stream reset and
+	// closes the stream instead, the remote peer reads EOF then
+	Reset() error
+}
+
+// Conn kcp transport connection
+type Conn interface {
+	transport.CapableConn
+	// Stats returns the connection statistics
+	Stats() *Stats
+	// Stat returns the libp2p connection metadata
+	Stat() network.Stat
+	// ConnState returns the protocols the connection was established with
+	ConnState() ConnState
+	// Conv returns the kcp conv of the underlying session
+	Conv() uint32
+	// BytesSent returns the bytes written to the kcp session
+	BytesSent() uint64
+	// BytesReceived returns the bytes read from the kcp session
+	BytesReceived() uint64
+	// Resumed returns whether the tls session of the connection was resumed
+	Resumed() bool
+	// Version returns the wire protocol version of the connection
+	Version() int
+	// ObservedAddr returns the local multiaddr as observed by the remote peer, nil
+	// unless the connection exchanged it
+	ObservedAddr() multiaddr.Multiaddr
+	// ClientSessionID returns the client session id of the dial which created the
+	// connection, empty if none, see WithClientSessionID
+	ClientSessionID() string
+	// Migrate moves a dialed connection to a new udp socket, e.g. after the local
+	// address changed, see WithMigration
+	Migrate(ctx context.Context) error
+}
+
+// Listener kcp transport listener
+type Listener interface {
+	transport.Listener
+	// Multiaddrs returns the dialable multiaddrs of the listener, a listener on an
+	// unspecified address has one for each interface address of its ip family
+	Multiaddrs() ([]multiaddr.Multiaddr, error)
 }
 
 // New create kcp transport
@@ -79,9 +289,21 @@ func New(privkey crypto.PrivKey, options ...Option) (transport.Transport, error)
 	}
 
 	kcp := &kcpTransport{
-		Logger:    slf4go.Get("kcp-transport"),
-		localPeer: id,
-		privKey:   privkey,
+		Logger:            slf4go.Get("kcp-transport"),
+		localPeer:         id,
+		privKey:           privkey,
+		smuxVersion:       1,
+		smuxNegotiate:     true,
+		muxers:            []string{MuxerSmuxV2},
+		keepAliveInterval: defaultKeepAliveInterval,
+		keepAliveTimeout:  defaultKeepAliveTimeout,
+		handshakeTimeout:  defaultHandshakeTimeout,
+		maxHandshakes:     defaultMaxHandshakes,
+		protocol:          protoKCP,
+		lifecycle:         newLifecycle(),
+		reconfigured:      &reconfigured{},
+		rotated:           &rotated{},
+		sendBuffers:       newSendBuffers(),
 	}
 
 	for _, option := range options {
@@ -90,258 +312,941 @@ func New(privkey crypto.PrivKey, options ...Option) (transport.Transport, error)
 		}
 	}
 
+	if kcp.protocol.Code == protoKCP.Code && kcp.protocol.Name == protoKCP.Name && protoKCPErr != nil {
+		return nil, protoKCPErr
+	}
+
+	if err := registerProtocol(kcp.protocol); err != nil {
+		return nil, err
+	}
+
+	if err := registerProtocol(protoKCPMode); err != nil {
+		return nil, err
+	}
+
+	if ipnet.ForcePrivateNetwork && kcp.psk == nil {
+		return nil, ipnet.NewError("private network was not configured but is enforced by the environment")
+	}
+
+	if kcp.batchIO && kcp.linger > 0 {
+		return nil, errors.Wrap(ErrOption, "linger needs the session monitor, which batch io leaves out")
+	}
+
+	if kcp.requireSecurity && !kcp.secured() {
+		return nil, errors.Wrap(ErrInsecure, "neither tls nor a security transport is configured")
+	}
+
+	kcp.watchContext()
+
 	return kcp, nil
 }
 
-func smuxConf() (conf *smux.Config) {
+func (kcp *kcpTransport) smuxConf() (conf *smux.Config) {
 	conf = smux.DefaultConfig()
-	// TODO: potentially tweak timeouts
-	conf.KeepAliveInterval = time.Second * 5
-	conf.KeepAliveTimeout = time.Second * 13
+
+	if kcp.smuxConfig != nil {
+		*conf = *kcp.smuxConfig
+	}
+
+	conf.Version = kcp.smuxVersion
+	conf.KeepAliveInterval = kcp.keepAliveInterval
+	conf.KeepAliveTimeout = kcp.keepAliveTimeout
 	return
 }
 
 func (kcp *kcpTransport) Dial(ctx context.Context, raddr multiaddr.Multiaddr, p peer.ID) (transport.CapableConn, error) {
-	kcp.I("dial to {@addr}", raddr)
+	raddr, p, err := dialPeer(raddr, p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	kcp, err = kcp.dialer(ctx, raddr, p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if kcp.clientSessions == nil {
+		kcp.I("dial to {@addr}", raddr)
+
+		return kcp.dial(ctx, raddr, p)
+	}
+
+	key := string(p)
+
+	if key == "" {
+		key = raddr.String()
+	}
+
+	sessionID, err := kcp.clientSessions.acquire(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	kcp.I("dial to {@addr} client session {@session}", raddr, sessionID)
+
+	conn, err := kcp.dial(withClientSessionID(ctx, sessionID), raddr, p)
+
+	kcp.clientSessions.release(key, err == nil)
+
+	if err != nil {
+		kcp.W("dial to {@addr} client session {@session} error: {@err}", raddr, sessionID, err)
+
+		return nil, errors.Wrap(err, "client session %s", sessionID)
+	}
+
+	kcp.D("dial to {@addr} client session {@session} -- success", raddr, sessionID)
+
+	return conn, nil
+}
+
+func (kcp *kcpTransport) dial(ctx context.Context, raddr multiaddr.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	if kcp.isClosed() {
+		return nil, ErrClosed
+	}
+
+	if kcp.upgrader != nil {
+		return kcp.dialUpgraded(ctx, raddr, p)
+	}
+
+	unknownPeer := p == ""
+
+	// only a secure handshake tells the peer of a dial without peer id
+	if unknownPeer && !kcp.secured() {
+		return nil, errors.Wrap(ErrInsecure, "dial to %s without peer id", raddr)
+	}
 
 	var remotePubKey crypto.PubKey
+	var resumed bool
+
+	advertised := addrOptions(raddr)
+
+	raddr, _ = splitKcpMode(raddr)
 
-	network, host, err := manet.DialArgs(raddr)
+	udpNetwork, host, err := manet.DialArgs(raddr)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "manet.DialArgs error")
 	}
 
-	addr, err := net.ResolveUDPAddr(network, host)
+	addr, err := net.ResolveUDPAddr(udpNetwork, host)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve udp addr %s %s error", udpNetwork, host)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "kcp dial to %s cancelled", addr.String())
+	}
+
+	kcp.emit(ConnEvent{Kind: ConnDialStarted, Direction: network.DirOutbound, Peer: p, Remote: raddr})
+
+	dialFailed := func(err error) error {
+		kcp.emit(ConnEvent{Kind: ConnHandshakeFailed, Direction: network.DirOutbound, Peer: p, Remote: raddr, Err: err})
+		return err
+	}
+
+	scope, err := kcp.openConnScope(network.DirOutbound, raddr)
+
+	if err != nil {
+		return nil, dialFailed(err)
+	}
+
+	key := &pathKey{}
+
+	// the profile learned by the handshake no longer changes the fec of the session
+	dataShards, parityShards := kcp.dataShards, kcp.parityShards
+
+	udpSession, socket, monitor, err := kcp.dialSession(addr, p, key)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "resolve udp addr %s %s error", network, host)
+		scope.Done()
+		return nil, dialFailed(errors.Wrap(err, "kcp dial to %s error", addr.String()))
 	}
 
-	kcpConn, err := kcpgo.Dial(addr.String())
+	m := monitor.watch(udpSession)
+
+	// cancelling ctx aborts the handshake and muxer setup
+	watcher := watchDial(ctx, udpSession)
+
+	fail := func(err error) (transport.CapableConn, error) {
+		if watcher.stop() {
+			err = errors.Wrap(ctx.Err(), "kcp dial to %s cancelled", addr.String())
+		}
+
+		udpSession.Close()
+		socket.Close()
+		monitor.unwatch(udpSession)
+		scope.Done()
+		return nil, dialFailed(err)
+	}
+
+	// the handshake must finish in time, a silent peer would block it forever, and
+	// before the deadline of ctx, whichever comes first
+	deadline := time.Now().Add(kcp.handshakeTimeout)
+
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	udpSession.SetDeadline(deadline)
+
+	counter := &counterConn{Conn: udpSession}
+
+	var kcpConn net.Conn = counter
+
+	kcpConn, err = kcp.protect(kcpConn)
+
+	if err != nil {
+		return fail(errors.Wrap(err, "kcp dial to %s private network error", addr.String()))
+	}
+
+	version, transcript, err := kcp.dialVersion(kcpConn)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "kcp dial to %s error", addr.String())
+		return fail(errors.Wrap(newHandshakeError(err, atomic.LoadUint64(&counter.received)), "kcp dial to %s version negotiation error", addr.String()))
 	}
 
-	if kcp.identity != nil {
-		tlsConf, keyCh := kcp.identity.ConfigForPeer(p)
+	creds := kcp.credentials()
 
-		tlsConn := tls.Client(kcpConn, tlsConf)
+	if creds.security != nil {
+		handshakeCtx, cancel := context.WithDeadline(ctx, deadline)
+		defer cancel()
+
+		secConn, err := creds.security.SecureOutbound(handshakeCtx, kcpConn, p)
+
+		if err != nil {
+			return fail(errors.Wrap(newHandshakeError(err, atomic.LoadUint64(&counter.received)), "kcp dial to %s security handshake error", addr.String()))
+		}
+
+		remotePubKey = secConn.RemotePublicKey()
+
+		if unknownPeer {
+			p = secConn.RemotePeer()
+		}
+
+		kcpConn = secConn
+	} else if creds.identity != nil {
+		tlsConf, keyCh := creds.identity.ConfigForPeer(p)
+
+		tlsConn := tls.Client(kcpConn, kcp.tlsConfig(tlsConf, p))
 
 		// explicit call handshake
 		err = tlsConn.Handshake()
 
+		if err == nil {
+			err = kcp.checkTLSState(tlsConn.ConnectionState())
+		}
+
+		if err == nil {
+			err = key.export(tlsConn.ConnectionState())
+		}
+
+		if err == nil {
+			err = confirmVersion(tlsConn, transcript)
+		}
+
 		if err != nil {
-			return nil, errors.Wrap(err, "kcp dial to %s tls handshake error", addr.String())
+			return fail(errors.Wrap(newHandshakeError(err, atomic.LoadUint64(&counter.received)), "kcp dial to %s tls handshake error", addr.String()))
 		}
 
 		select {
 		case remotePubKey = <-keyCh:
 		default:
+			remotePubKey, err = resumedPubKey(tlsConn.ConnectionState(), p)
 		}
 
 		if remotePubKey == nil {
-			return nil, errors.Wrap(ErrTLS, "connect to %s error", p.Pretty())
+			return fail(errors.Wrap(newHandshakeError(err, atomic.LoadUint64(&counter.received)), "connect to %s error", p.Pretty()))
+		}
+
+		if unknownPeer {
+			p, err = peer.IDFromPublicKey(remotePubKey)
+
+			if err != nil {
+				return fail(errors.Wrap(newHandshakeError(err, atomic.LoadUint64(&counter.received)), "kcp dial to %s tls handshake error", addr.String()))
+			}
 		}
 
 		kcpConn = tlsConn
+		resumed = tlsConn.ConnectionState().DidResume
+
+		kcp = kcp.negotiatedMuxer(tlsConn.ConnectionState())
+	}
+
+	// the profile of the peer learned by the handshake applies like on accepted sessions
+	if unknownPeer {
+		learned, err := kcp.derive(kcp.peerOptions(p))
+
+		if err != nil {
+			return fail(errors.Wrap(err, "apply profile of peer %s error", p.Pretty()))
+		}
+
+		if learned != kcp {
+			learned.sessionConf.apply(udpSession)
+			kcp = learned
+		}
+	}
+
+	var observedAddr multiaddr.Multiaddr
+
+	if version >= ProtocolV2 {
+		observedAddr, err = kcp.exchangeObserved(kcpConn, addr)
+
+		if err != nil {
+			return fail(errors.Wrap(newHandshakeError(err, atomic.LoadUint64(&counter.received)), "kcp dial to %s observed address error", addr.String()))
+		}
+	}
+
+	sessionID := clientSessionID(ctx)
+
+	if version >= ProtocolV3 {
+		if err := sendClientSessionID(kcpConn, sessionID); err != nil {
+			return fail(errors.Wrap(newHandshakeError(err, atomic.LoadUint64(&counter.received)), "kcp dial to %s client session id error", addr.String()))
+		}
 	}
 
-	remoteMultiaddr, err := toKcpMultiaddr(addr)
+	remoteMultiaddr, err := kcp.toMultiaddr(addr)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "create remote multiaddr error")
+		return fail(errors.Wrap(err, "create remote multiaddr error"))
 	}
 
-	localMultiaddr, err := toKcpMultiaddr(kcpConn.LocalAddr())
+	localMultiaddr, err := kcp.toMultiaddr(kcpConn.LocalAddr())
 
 	if err != nil {
-		return nil, errors.Wrap(err, "create local multiaddr error")
+		return fail(errors.Wrap(err, "create local multiaddr error"))
+	}
+
+	if err := kcp.reserveConn(scope, p); err != nil {
+		return fail(err)
 	}
 
-	smuxSession, err := smux.Client(kcpConn, smuxConf())
+	// a blocked read of smux keeps the deadline, clear it before
+	udpSession.SetDeadline(time.Time{})
+
+	watched := &watchedConn{Conn: kcpConn}
+
+	session, err := kcp.muxSession(watched, true)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "create kcp smux session error")
+		return fail(errors.Wrap(err, "create kcp smux session error"))
+	}
+
+	if watcher.stop() {
+		session.Close()
+		return fail(ctx.Err())
 	}
 
-	return &kcpCapableConn{
+	// the sockets of listeners don't migrate
+	migration, _ := socket.(*migratingConn)
+
+	conn := &kcpCapableConn{
 		kcp:             kcp,
 		conn:            kcpConn,
+		watched:         watched,
+		counter:         counter,
+		udpSession:      udpSession,
+		socket:          socket,
+		migration:       migration,
+		mtu:             int32(kcp.sessionConf.initialMTU()),
+		dataShards:      dataShards,
+		parityShards:    parityShards,
+		sndwnd:          int32(kcp.sessionConf.initialSendWindow()),
+		addrOptions:     advertised,
+		closed:          make(chan struct{}),
 		localMultiaddr:  localMultiaddr,
 		remoteMultiaddr: remoteMultiaddr,
 		remotePeerID:    p,
-		localPeer:       kcp.localPeer,
-		privKey:         kcp.privKey,
-		session:         smuxSession,
+		localPeer:       creds.localPeer,
+		privKey:         creds.privKey,
+		session:         session,
 		remotePubKey:    remotePubKey,
-	}, nil
-}
+		resumed:         resumed,
+		direction:       network.DirOutbound,
+		version:         version,
+		observedAddr:    observedAddr,
+		sessionID:       sessionID,
+		scope:           scope,
+		opened:          time.Now(),
+		security:        creds.securityID(),
+	}
 
-func (kcp *kcpTransport) CanDial(addr multiaddr.Multiaddr) bool {
+	conn.emit(ConnHandshakeCompleted, nil)
 
-	_, err := fromKcpMultiaddr(addr)
+	if !kcp.trackConn(conn) {
+		conn.Close()
+		return nil, ErrClosed
+	}
+
+	conn.monitor(monitor, m)
+	conn.watchIdle()
+	conn.tag()
+	conn.reportObserved()
 
-	return err == nil
+	return conn, nil
 }
 
-func (kcp *kcpTransport) Listen(laddr multiaddr.Multiaddr) (transport.Listener, error) {
-	kcp.I("listen on {@addr}", laddr)
+// dialSession creates the kcp session to addr on a new udp socket, or the socket of a
+// listener with WithDialFromListener, which kcp-go doesn't close with the session. The
+// session answers the path challenges of the listener with key, which may be nil
+func (kcp *kcpTransport) dialSession(addr *net.UDPAddr, p peer.ID, key *pathKey) (*kcpgo.UDPSession, net.PacketConn, *monitorConn, error) {
+	if socket, monitor := kcp.dialMux(addr); socket != nil {
+		ref := socket.acquire()
 
-	network, host, err := manet.DialArgs(laddr)
+		// a second session to addr can't share the socket, its packets couldn't be told apart
+		if conn := socket.mux.dial(addr, ref); conn != nil {
+			udpSession, err := kcp.newSession(addr, p, answerPaths(kcp.answerCookies(conn), addr, key))
 
-	if err != nil {
-		return nil, errors.Wrap(err, "manet.DialArgs error")
+			if err != nil {
+				conn.Close()
+				return nil, nil, nil, err
+			}
+
+			return udpSession, conn, monitor, nil
+		}
+
+		ref.Close()
 	}
 
-	addr, err := net.ResolveUDPAddr(network, host)
+	network := "udp4"
 
-	if err != nil {
-		return nil, err
+	if addr.IP.To4() == nil {
+		network = "udp6"
 	}
 
-	listener, err := kcpgo.Listen(addr.String())
+	laddr, err := kcp.socketConf.dialAddr(addr)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "listen %s error", addr.String())
+		return nil, nil, nil, err
 	}
 
-	l := &kcpListener{
-		listener:       listener,
-		localMultiaddr: laddr,
-		transport:      kcp,
-		privKey:        kcp.privKey,
-		localPeer:      kcp.localPeer,
-	}
+	udpConn, err := kcp.socketConf.listenUDP(kcp, network, laddr)
 
-	if kcp.identity != nil {
-		var tlsConf tls.Config
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "create udp socket error")
+	}
 
-		tlsConf.GetConfigForClient = func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
-			// return a tls.Config that verifies the peer's certificate chain.
-			// Note that since we have no way of associating an incoming QUIC connection with
-			// the peer ID calculated here, we don't actually receive the peer's public key
-			// from the key chan.
-			conf, _ := kcp.identity.ConfigForAny()
-			return conf, nil
-		}
+	var socket net.PacketConn = udpConn
+	var packetConn net.PacketConn
+	var monitor *monitorConn
 
-		l.tlsConf = &tlsConf
+	if kcp.migration {
+		socket = kcp.newMigratingConn(udpConn, network, addr)
+		packetConn, monitor = kcp.wrapSocket(socket)
+	} else {
+		packetConn, monitor = kcp.wrapPacketConn(udpConn)
 	}
 
-	return l, nil
-}
+	packetConn = answerPaths(kcp.answerCookies(packetConn), addr, key)
 
-func (kcp *kcpTransport) Protocols() []int {
-	return []int{protocolKCPID}
-}
+	udpSession, err := kcp.newSession(addr, p, packetConn)
 
-func (kcp *kcpTransport) Proxy() bool {
-	return false
-}
+	if err != nil {
+		socket.Close()
+		return nil, nil, nil, err
+	}
 
-func (kcp *kcpTransport) String() string {
-	return "kcp"
+	return udpSession, socket, monitor, nil
 }
 
-var kcpMultiAddr multiaddr.Multiaddr
-
-func init() {
+// newSession creates the kcp session to addr on packetConn
+func (kcp *kcpTransport) newSession(addr *net.UDPAddr, p peer.ID, packetConn net.PacketConn) (*kcpgo.UDPSession, error) {
+	var udpSession *kcpgo.UDPSession
 	var err error
-	kcpMultiAddr, err = multiaddr.NewMultiaddr("/kcp")
-	if err != nil {
-		panic(err)
+
+	if kcp.convProvider != nil {
+		udpSession, err = kcpgo.NewConn3(kcp.convProvider(addr, p), addr, kcp.block, kcp.dataShards, kcp.parityShards, packetConn)
+	} else {
+		udpSession, err = kcpgo.NewConn2(addr, kcp.block, kcp.dataShards, kcp.parityShards, packetConn)
 	}
-}
 
-func toKcpMultiaddr(na net.Addr) (multiaddr.Multiaddr, error) {
-	udpMA, err := manet.FromNetAddr(na)
 	if err != nil {
 		return nil, err
 	}
-	return udpMA.Encapsulate(kcpMultiAddr), nil
-}
 
-func fromKcpMultiaddr(addr multiaddr.Multiaddr) (net.Addr, error) {
-	return manet.ToNetAddr(addr.Decapsulate(kcpMultiAddr))
+	kcp.sessionConf.apply(udpSession)
+
+	return udpSession, nil
 }
 
-type kcpCapableConn struct {
-	kcp            *kcpTransport
-	conn           net.Conn
-	localPeer      peer.ID
-	privKey        crypto.PrivKey
-	localMultiaddr multiaddr.Multiaddr
+// wrapPacketConn wraps the udp socket with the packet conn layers the transport needs
+func (kcp *kcpTransport) wrapPacketConn(udpConn *net.UDPConn) (net.PacketConn, *monitorConn) {
+	if kcp.batchable() {
+		return udpConn, nil
+	}
 
-	remotePeerID    peer.ID
-	remotePubKey    crypto.PubKey
-	remoteMultiaddr multiaddr.Multiaddr
-	session         *smux.Session
+	return kcp.wrapSocket(kcp.offloadConn(udpConn))
 }
 
-func (c *kcpCapableConn) Close() error {
-	return nil
-}
+// wrapSocket wraps the udp socket, with receive offload if enabled, with the other layers
+func (kcp *kcpTransport) wrapSocket(packetConn net.PacketConn) (net.PacketConn, *monitorConn) {
+	if kcp.packetConn != nil {
+		packetConn = kcp.packetConn(packetConn)
+	}
 
-// IsClosed returns whether a connection is fully closed.
-func (c *kcpCapableConn) IsClosed() bool {
-	return false
-}
+	packetConn = &sendBufferConn{PacketConn: packetConn, buffers: kcp.sendBuffers}
 
-// OpenStream creates a new stream.
-func (c *kcpCapableConn) OpenStream() (mux.MuxedStream, error) {
+	if !kcp.monitorEnabled() {
+		return packetConn, nil
+	}
 
-	c.kcp.D("open stream {@c} -- start", c.localPeer.Pretty())
+	monitor := &monitorConn{PacketConn: packetConn, monitors: &sync.Map{}, fec: kcp.dataShards > 0, block: kcp.block, pathMTU: kcp.pathMTU > 0, reporter: kcp.bandwidthReporter}
 
-	stream, err := c.session.OpenStream()
+	return monitor, monitor
+}
+
+// listenSession listens on addr, network is udp4 or udp6 so that the listeners on the
+// unspecified addresses of both families can share a port. kcp-go doesn't close the udp
+// socket with the listener
+func (kcp *kcpTransport) listenSession(network string, addr *net.UDPAddr) (sessionAcceptor, *sharedSocket, *monitorConn, error) {
+	if kcp.listenShards > 1 {
+		return kcp.listenSharded(network, addr)
+	}
+
+	udpConn, err := kcp.socketConf.listenUDP(kcp, network, addr)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "open kcp smux session error")
+		return nil, nil, nil, err
 	}
 
-	c.kcp.D("open stream {@c} -- finish", c.localPeer.Pretty())
+	packetConn, monitor := kcp.wrapPacketConn(udpConn)
 
-	return &kcpStream{Stream: stream}, nil
-}
+	socket := newSharedSocket(udpConn)
 
-// AcceptStream accepts a stream opened by the other side.
-func (c *kcpCapableConn) AcceptStream() (mux.MuxedStream, error) {
+	// the sessions dialed from the socket read their packets from the mux too
+	if kcp.dialFromListener {
+		socket.mux = newPacketMux(packetConn)
+		packetConn = socket.mux.listener
+	}
 
-	c.kcp.D("accept stream {@c} -- start", c.localPeer.Pretty())
+	packetConn = kcp.validateAddrs(packetConn)
+
+	if rebind := kcp.rebindAddrs(packetConn, monitor); rebind != nil {
+		socket.rebind = rebind
+		packetConn = rebind
+	}
 
-	stream, err := c.session.AcceptStream()
+	listener, err := kcpgo.ServeConn(kcp.block, kcp.dataShards, kcp.parityShards, packetConn)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "open kcp smux session error")
+		udpConn.Close()
+		return nil, nil, nil, err
 	}
 
-	c.kcp.D("accept stream {@c} -- finish", c.localPeer.Pretty())
+	if socket.mux != nil {
+		return &muxListener{Listener: listener, mux: socket.mux}, socket, monitor, nil
+	}
 
-	return &kcpStream{Stream: stream}, nil
+	return listener, socket, monitor, nil
 }
 
-// LocalPeer returns our peer ID
-func (c *kcpCapableConn) LocalPeer() peer.ID {
-	return c.localPeer
+func (kcp *kcpTransport) CanDial(addr multiaddr.Multiaddr) bool {
+	return isProtoMultiaddr(addr, kcp.protocol.Code)
 }
 
-// LocalPrivateKey returns our private key
-func (c *kcpCapableConn) LocalPrivateKey() crypto.PrivKey {
-	return c.privKey
+// KCPAddrs filters addrs to the kcp multiaddrs which can be dialed by the kcp transports
+// with the default protocol code, see KCPAddrs of the kcp.Transport for the others
+func KCPAddrs(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	return protoAddrs(addrs, protoKCP.Code)
 }
 
-// RemotePeer returns the peer ID of the remote peer.
-func (c *kcpCapableConn) RemotePeer() peer.ID {
-	return c.remotePeerID
+// KCPAddrs filters addrs to the kcp multiaddrs which can be dialed by the transport
+func (kcp *kcpTransport) KCPAddrs(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	return protoAddrs(addrs, kcp.protocol.Code)
 }
 
-// RemotePublicKey returns the public key of the remote peer.
-func (c *kcpCapableConn) RemotePublicKey() crypto.PubKey {
-	return c.remotePubKey
+// protoAddrs filters addrs to the kcp multiaddrs of the kcp protocol code
+func protoAddrs(addrs []multiaddr.Multiaddr, code int) []multiaddr.Multiaddr {
+	var kcpAddrs []multiaddr.Multiaddr
+
+	for _, addr := range addrs {
+		if isProtoMultiaddr(addr, code) {
+			kcpAddrs = append(kcpAddrs, addr)
+		}
+	}
+
+	return kcpAddrs
 }
 
-// LocalMultiaddr returns the local Multiaddr associated
+func (kcp *kcpTransport) Listen(laddr multiaddr.Multiaddr) (transport.Listener, error) {
+	kcp.I("listen on {@addr}", laddr)
+
+	if kcp.isClosed() {
+		return nil, ErrClosed
+	}
+
+	base, mode := splitKcpMode(laddr)
+
+	network, host, err := manet.DialArgs(base)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "manet.DialArgs error")
+	}
+
+	addr, err := net.ResolveUDPAddr(network, host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bound, err := kcp.socketConf.listenAddr(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the listener advertises the local address it's bound to instead of the unspecified one
+	if bound != addr {
+		addr = bound
+
+		laddr, err = kcp.toMultiaddr(bound)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "create local multiaddr error")
+		}
+
+		if mode != "" {
+			laddr = laddr.Encapsulate(multiaddr.StringCast("/kcpmode/" + mode))
+		}
+	}
+
+	// the advertised mode applies to the accepted sessions
+	kcp, err = kcp.derive(addrOptions(laddr))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "apply %s options error", laddr)
+	}
+
+	// the listener advertises the port it's bound to instead of the random port 0
+	listener, socket, monitor, laddr, err := kcp.listenSocket(network, addr, laddr)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "listen %s error", addr.String())
+	}
+
+	l := &kcpListener{
+		listener:       listener,
+		socket:         socket,
+		monitor:        monitor,
+		localMultiaddr: laddr,
+		transport:      kcp,
+		closed:         make(chan struct{}),
+		handshakes:     newHandshakes(),
+		accepted:       make(chan transport.CapableConn, kcp.acceptBacklog),
+		served:         make(chan struct{}),
+	}
+
+	if !kcp.trackListener(l) {
+		l.close()
+		return nil, ErrClosed
+	}
+
+	return l, nil
+}
+
+func (kcp *kcpTransport) ListenAll(laddrs []multiaddr.Multiaddr) ([]transport.Listener, error) {
+	var listeners []transport.Listener
+
+	for _, laddr := range laddrs {
+		l, err := kcp.Listen(laddr)
+
+		if err != nil {
+			for _, opened := range listeners {
+				opened.(*kcpListener).close()
+			}
+
+			return nil, errors.Wrap(err, "listen on %s error", laddr)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// Protocols returns the multiaddr protocol code of the transport, with the one of kcpmode
+// for the default protocol whose multiaddrs advertise the mode
+func (kcp *kcpTransport) Protocols() []int {
+	if kcp.protocol.Code != protoKCP.Code {
+		return []int{kcp.protocol.Code}
+	}
+
+	return []int{kcp.protocol.Code, protocolKCPModeID}
+}
+
+func (kcp *kcpTransport) Proxy() bool {
+	return false
+}
+
+func (kcp *kcpTransport) String() string {
+	return "kcp"
+}
+
+func toKcpMultiaddr(na net.Addr) (multiaddr.Multiaddr, error) {
+	return toProtoMultiaddr(na, protoKCP)
+}
+
+// toProtoMultiaddr returns the udp multiaddr of na encapsulating the kcp protocol proto
+func toProtoMultiaddr(na net.Addr, proto multiaddr.Protocol) (multiaddr.Multiaddr, error) {
+	udpMA, err := manet.FromNetAddr(na)
+	if err != nil {
+		return nil, err
+	}
+
+	component, err := multiaddr.NewComponent(proto.Name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return udpMA.Encapsulate(component), nil
+}
+
+// isProtoMultiaddr checks if addr is an /ip4, /ip6 or /dns udp multiaddr with a port
+// encapsulating the kcp protocol code, optionally followed by /kcpmode and /p2p
+func isProtoMultiaddr(addr multiaddr.Multiaddr, code int) bool {
+	var protocols []int
+
+	valid := true
+
+	multiaddr.ForEach(addr, func(c multiaddr.Component) bool {
+		if c.Protocol().Code == multiaddr.P_UDP {
+			port, err := strconv.Atoi(c.Value())
+
+			valid = err == nil && port > 0 && port <= 65535
+		}
+
+		protocols = append(protocols, c.Protocol().Code)
+
+		return valid
+	})
+
+	if !valid {
+		return false
+	}
+
+	// the zone of a link-local ip6 address
+	if len(protocols) > 1 && protocols[0] == multiaddr.P_IP6ZONE && protocols[1] == multiaddr.P_IP6 {
+		protocols = protocols[1:]
+	}
+
+	if len(protocols) < 3 {
+		return false
+	}
+
+	switch protocols[0] {
+	case multiaddr.P_IP4, multiaddr.P_IP6, multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6:
+	default:
+		return false
+	}
+
+	if protocols[1] != multiaddr.P_UDP || protocols[2] != code {
+		return false
+	}
+
+	rest := protocols[3:]
+
+	if len(rest) > 0 && rest[0] == protocolKCPModeID {
+		rest = rest[1:]
+	}
+
+	if len(rest) > 0 && rest[0] == multiaddr.P_P2P {
+		rest = rest[1:]
+	}
+
+	return len(rest) == 0
+}
+
+type kcpCapableConn struct {
+	kcp            *kcpTransport
+	conn           net.Conn
+	watched        *watchedConn // the conn read by the muxer session
+	udpSession     *kcpgo.UDPSession
+	socket         net.PacketConn // udp socket of dialed connections, accepted ones share the listener's
+	rebinding      *rebinding     // binding of the accepted session to the address of its peer, nil if disabled
+	migration      *migratingConn // udp socket of a dialed connection which can migrate, nil if disabled
+	counter        *counterConn
+	mtu            int32
+	sndwnd         int32    // current kcp send window
+	dataShards     int      // fec data shards of the kcp session, 0 without fec
+	parityShards   int      // fec parity shards of the kcp session
+	addrOptions    []Option // options advertised by the dialed or listened multiaddr
+	monitorConn    *monitorConn
+	sessionMonitor *sessionMonitor
+	congestion     atomic.Value // *congestionState, set once the congestion controller runs
+	closeOnce      sync.Once
+	closed         chan struct{}
+	closeErr       atomic.Value // the reason of abort
+	activity       *activity    // last stream activity, nil if idle timeout is disabled
+	localPeer      peer.ID
+	privKey        crypto.PrivKey
+	localMultiaddr multiaddr.Multiaddr
+	direction      network.Direction
+	opened         time.Time
+	security       string              // security protocol id
+	scope          ConnScope           // resource manager scope
+	version        int                 // wire protocol version
+	observedAddr   multiaddr.Multiaddr // local address observed by the remote peer, nil if not exchanged
+	sessionID      string              // client session id of the dial, empty if none
+
+	remotePeerID    peer.ID
+	remotePubKey    crypto.PubKey
+	resumed         bool
+	remoteMultiaddr multiaddr.Multiaddr
+	session         muxSession
+}
+
+func (c *kcpCapableConn) Close() error {
+	var err error
+
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		reason := c.closeReason()
+
+		if _, aborted := c.closeErr.Load().(error); !aborted {
+			c.drain()
+		}
+
+		// closing the muxer session unblocks AcceptStream, the security conn and the
+		// kcp session below it are closed too, whatever the muxer closes
+		err = c.session.Close()
+
+		c.conn.Close()
+		c.udpSession.Close()
+
+		if c.socket != nil {
+			c.socket.Close()
+		}
+
+		c.scope.Done()
+
+		if c.monitorConn != nil {
+			c.monitorConn.detach(c.udpSession.RemoteAddr())
+		}
+
+		c.rebinding.release()
+
+		if c.kcp.tagger != nil {
+			c.kcp.tagger.untag(c, c.kcp.protectConns)
+		}
+
+		c.kcp.untrackConn(c)
+
+		c.emit(ConnClosed, reason)
+	})
+
+	return err
+}
+
+// IsClosed returns whether a connection is fully closed, by Close or an abort, by the remote
+// peer, or because the muxer session died, e.g. of a keepalive timeout
+func (c *kcpCapableConn) IsClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+	}
+
+	return c.watched.failed() || c.session.IsClosed()
+}
+
+// OpenStream creates a new stream.
+func (c *kcpCapableConn) OpenStream() (mux.MuxedStream, error) {
+
+	c.kcp.D("open stream {@c} -- start", c.localPeer.Pretty())
+
+	if max := c.kcp.maxStreams; max > 0 && c.session.NumStreams() >= max {
+		return nil, errors.Wrap(ErrTooManyStreams, "connection to %s reached max streams %d", c.remoteMultiaddr, max)
+	}
+
+	scope, err := c.openStreamScope(network.DirOutbound)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := c.session.OpenStream()
+
+	if err != nil {
+		scope.Done()
+		return nil, c.wrapErr(err, "open kcp smux session error")
+	}
+
+	c.kcp.D("open stream {@c} -- finish", c.localPeer.Pretty())
+
+	c.activity.touch()
+
+	return c.newStream(stream, scope), nil
+}
+
+// AcceptStream accepts a stream opened by the other side.
+func (c *kcpCapableConn) AcceptStream() (mux.MuxedStream, error) {
+
+	c.kcp.D("accept stream {@c} -- start", c.localPeer.Pretty())
+
+	for {
+		stream, err := c.session.AcceptStream()
+
+		if err != nil {
+			return nil, c.wrapErr(err, "open kcp smux session error")
+		}
+
+		// streams waiting to be accepted count against the limit too, the streams beyond
+		// it are closed and the remote peer reads EOF from them
+		if max := c.kcp.maxStreams; max > 0 && c.session.NumStreams() > max {
+			c.kcp.W("reject stream {@id} from {@raddr}: {@err}", stream.ID(), c.remoteMultiaddr, ErrTooManyStreams)
+
+			stream.Close()
+
+			continue
+		}
+
+		scope, err := c.openStreamScope(network.DirInbound)
+
+		if err != nil {
+			c.kcp.W("reject stream {@id} from {@raddr}: {@err}", stream.ID(), c.remoteMultiaddr, err)
+
+			stream.Close()
+
+			continue
+		}
+
+		c.kcp.D("accept stream {@c} -- finish", c.localPeer.Pretty())
+
+		c.activity.touch()
+
+		return c.newStream(stream, scope), nil
+	}
+}
+
+func (c *kcpCapableConn) newStream(stream muxStream, scope StreamScope) *kcpStream {
+	return &kcpStream{muxStream: stream, conn: c, counter: c.counter, activity: c.activity, sendBuffers: c.kcp.sendBuffers, writeTimeout: c.kcp.writeTimeout, scope: scope}
+}
+
+// LocalPeer returns our peer ID
+func (c *kcpCapableConn) LocalPeer() peer.ID {
+	return c.localPeer
+}
+
+// LocalPrivateKey returns our private key
+func (c *kcpCapableConn) LocalPrivateKey() crypto.PrivKey {
+	return c.privKey
+}
+
+// RemotePeer returns the peer ID of the remote peer.
+func (c *kcpCapableConn) RemotePeer() peer.ID {
+	return c.remotePeerID
+}
+
+// RemotePublicKey returns the public key of the remote peer.
+func (c *kcpCapableConn) RemotePublicKey() crypto.PubKey {
+	return c.remotePubKey
+}
+
+// LocalMultiaddr returns the local Multiaddr associated
 func (c *kcpCapableConn) LocalMultiaddr() multiaddr.Multiaddr {
 	return c.localMultiaddr
 }
@@ -352,83 +1257,537 @@ func (c *kcpCapableConn) RemoteMultiaddr() multiaddr.Multiaddr {
 }
 
 func (c *kcpCapableConn) Transport() transport.Transport {
-	return c.kcp
+	return c.kcp.root()
+}
+
+// Stats returns the connection statistics
+func (c *kcpCapableConn) Stats() *Stats {
+	stats := &Stats{
+		Direction:     c.direction,
+		Opened:        c.opened,
+		NumStreams:    c.session.NumStreams(),
+		MTU:           c.MTU(),
+		BytesSent:     c.BytesSent(),
+		BytesReceived: c.BytesReceived(),
+		DataShards:    c.dataShards,
+		ParityShards:  c.parityShards,
+	}
+
+	if m := c.sessionMonitor; m != nil {
+		stats.WireSent = atomic.LoadUint64(&m.udpSent)
+		stats.WireReceived = atomic.LoadUint64(&m.udpRecv)
+		stats.Retransmitted = atomic.LoadUint64(&m.resent)
+		stats.ParitySent = atomic.LoadUint64(&m.paritySent)
+		stats.ParityRecv = atomic.LoadUint64(&m.parityRecv)
+	}
+
+	return stats
+}
+
+// Conv returns the kcp conv of the underlying session
+func (c *kcpCapableConn) Conv() uint32 {
+	return c.udpSession.GetConv()
+}
+
+// Resumed returns whether the tls session of the connection was resumed
+func (c *kcpCapableConn) Resumed() bool {
+	return c.resumed
+}
+
+// BytesSent returns the bytes written to the kcp session
+func (c *kcpCapableConn) BytesSent() uint64 {
+	return atomic.LoadUint64(&c.counter.sent)
+}
+
+// BytesReceived returns the bytes read from the kcp session
+func (c *kcpCapableConn) BytesReceived() uint64 {
+	return atomic.LoadUint64(&c.counter.received)
+}
+
+// MTU returns the current effective mtu
+func (c *kcpCapableConn) MTU() int {
+	return int(atomic.LoadInt32(&c.mtu))
+}
+
+func (c *kcpCapableConn) setMTU(mtu int) bool {
+	if !c.udpSession.SetMtu(mtu) {
+		return false
+	}
+
+	atomic.StoreInt32(&c.mtu, int32(mtu))
+
+	return true
+}
+
+// setWindow sets the kcp window sizes of the session, zero keeps the current size
+func (c *kcpCapableConn) setWindow(sndwnd, rcvwnd int) {
+	c.udpSession.SetWindowSize(sndwnd, rcvwnd)
+
+	if sndwnd > 0 {
+		atomic.StoreInt32(&c.sndwnd, int32(sndwnd))
+	}
+}
+
+// windowFull checks if the kcp send window is full, which blocks the session writes.
+// The segments waiting for an ack and for the window are counted by the session monitor,
+// so the window of a session without it is never full
+func (c *kcpCapableConn) windowFull() bool {
+	m := c.sessionMonitor
+
+	if m == nil {
+		return false
+	}
+
+	waiting := int(int32(atomic.LoadUint32(&m.nextSN) - atomic.LoadUint32(&m.una)))
+
+	// the bytes written to the session which weren't sent yet
+	if queued := int64(atomic.LoadUint64(&c.counter.sent) - atomic.LoadUint64(&m.pushed)); queued > 0 {
+		mss := int64(c.MTU() - kcpgo.IKCP_OVERHEAD)
+		waiting += int((queued + mss - 1) / mss)
+	}
+
+	return waiting >= int(atomic.LoadInt32(&c.sndwnd))
+}
+
+func (c *kcpCapableConn) tag() {
+	if c.kcp.tagger != nil {
+		c.kcp.tagger.tag(c, c.kcp.protectConns)
+	}
+}
+
+// monitor starts the connection features built on the session monitor m
+func (c *kcpCapableConn) monitor(conn *monitorConn, m *sessionMonitor) {
+	if conn == nil {
+		return
+	}
+
+	c.monitorConn = conn
+	c.sessionMonitor = m
+
+	c.reportBandwidth(m)
+
+	if c.kcp.autoMTU > 0 {
+		m.mtu.Store(newMTUMonitor(c, c.kcp.autoMTU))
+	}
+
+	if c.kcp.watchdog > 0 {
+		go c.runWatchdog(m)
+	}
+
+	if c.kcp.adaptiveWindow != nil {
+		go c.runWindowTuner(m)
+	}
+
+	if c.kcp.pathMTU > 0 {
+		go c.runPathMTU(m)
+	}
+
+	if c.kcp.congestion != nil {
+		go c.runCongestionController(m)
+	}
+
+	if c.kcp.tagger != nil {
+		go c.runConnTagger(m)
+	}
+}
+
+// abort closes the connection because of err
+func (c *kcpCapableConn) abort(err error) {
+	c.kcp.E("abort connection to {@raddr}: {@err}", c.remoteMultiaddr, err)
+
+	c.closeErr.Store(err)
+
+	c.session.Close()
+
+	c.Close()
+}
+
+// wrapErr replaces err with the reason of abort if any
+func (c *kcpCapableConn) wrapErr(err error, fmtstr string, args ...interface{}) error {
+	if cause, ok := c.closeErr.Load().(error); ok {
+		err = cause
+	}
+
+	return errors.Wrap(err, fmtstr, args...)
 }
 
 type kcpListener struct {
-	listener       net.Listener
+	listener       sessionAcceptor
+	socket         *sharedSocket // udp socket shared with the accepted connections
+	monitor        *monitorConn
 	transport      *kcpTransport
-	privKey        crypto.PrivKey
-	localPeer      peer.ID
 	localMultiaddr multiaddr.Multiaddr
-	tlsConf        *tls.Config
+	rejected       rejectedAddrs
+	closeOnce      sync.Once
+	closed         chan struct{}
+	handshakes     *handshakes // sessions being upgraded
+	serveOnce      sync.Once
+	accepted       chan transport.CapableConn // upgraded connections
+	served         chan struct{}              // closed when serve returns
+	serveErr       error                      // the error serve returned on
 }
 
-// Accept accepts new connections.
+// Accept accepts new connections, the handshakes of the accepted sessions run in
+// parallel, see WithMaxHandshakes
 func (l *kcpListener) Accept() (transport.CapableConn, error) {
+	l.serveOnce.Do(func() {
+		go l.serve()
+	})
+
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	case <-l.served:
+		if l.isClosed() || l.transport.isClosed() {
+			return nil, ErrClosed
+		}
+
+		return nil, l.serveErr
+	}
+}
+
+// serve accepts the kcp sessions and upgrades them in parallel, at most maxHandshakes
+// at once, until the listener fails
+func (l *kcpListener) serve() {
+	defer close(l.served)
+
+	slots := make(chan struct{}, l.transport.maxHandshakes)
+
 	for {
-		sess, err := l.listener.Accept()
+		udpSession, err := l.listener.AcceptKCP()
 
 		if err != nil {
-			return nil, err
+			l.serveErr = err
+			return
 		}
 
-		l.transport.D("accept connection {@raddr}", sess.RemoteAddr())
+		if l.rejected.contains(udpSession.RemoteAddr()) {
+			l.transport.D("drop session from rejected {@raddr}", udpSession.RemoteAddr())
+			udpSession.Close()
+			continue
+		}
 
-		var remotePeer peer.ID
+		if validator := l.transport.convValidator; validator != nil && !validator(udpSession.GetConv(), udpSession.RemoteAddr()) {
+			l.transport.W("drop session from {@raddr}, conv {@conv} rejected", udpSession.RemoteAddr(), udpSession.GetConv())
+			udpSession.Close()
+			continue
+		}
 
-		if l.tlsConf != nil {
-			tlsSess := tls.Server(sess, l.tlsConf)
+		select {
+		case slots <- struct{}{}:
+		case <-l.closed:
+			udpSession.Close()
+			return
+		}
 
-			err := tlsSess.Handshake()
+		// Close cancels the handshakes in progress
+		if !l.handshakes.add(udpSession) {
+			udpSession.Close()
+			return
+		}
 
-			if err != nil {
-				return nil, err
-			}
+		go func() {
+			defer func() { <-slots }()
 
-			remotePubKey, err := tlsp2p.PubKeyFromCertChain(tlsSess.ConnectionState().PeerCertificates)
+			conn, err := l.upgrade(udpSession)
+
+			l.handshakes.remove(udpSession)
 
 			if err != nil {
-				return nil, err
-			}
+				// a failed handshake only drops its session, so a misbehaving peer can't
+				// stop the listener
+				if !l.isClosed() && !l.transport.isClosed() {
+					l.transport.W("drop session from {@raddr}: {@err}", udpSession.RemoteAddr(), err)
+				}
 
-			remotePeer, err = peer.IDFromPublicKey(remotePubKey)
+				return
+			}
 
-			if err != nil {
-				return nil, err
+			// a hole punch to the peer takes its connection
+			if conn != nil && !l.transport.claimPunch(conn) {
+				l.enqueue(conn)
 			}
+		}()
+	}
+}
+
+// upgrade secures and multiplexes the accepted udpSession, returns nil without error
+// if the session is dropped
+func (l *kcpListener) upgrade(udpSession *kcpgo.UDPSession) (transport.CapableConn, error) {
+	if l.transport.upgrader != nil {
+		return l.upgradeWith(udpSession)
+	}
+
+	endpoint, err := l.transport.toMultiaddr(udpSession.RemoteAddr())
+
+	if err != nil {
+		udpSession.Close()
+		return nil, errors.Wrap(err, "parse remote multiaddr error")
+	}
+
+	scope, err := l.transport.openConnScope(network.DirInbound, endpoint)
+
+	if err != nil {
+		l.transport.W("drop session from {@raddr}: {@err}", udpSession.RemoteAddr(), err)
+		udpSession.Close()
+		return nil, nil
+	}
+
+	l.transport.sessionConf.apply(udpSession)
+
+	m := l.monitor.watch(udpSession)
+
+	fail := func(err error) (transport.CapableConn, error) {
+		udpSession.Close()
+		l.monitor.unwatch(udpSession)
+		scope.Done()
+
+		l.transport.emit(ConnEvent{
+			Kind:      ConnHandshakeFailed,
+			Direction: network.DirInbound,
+			Local:     l.localMultiaddr,
+			Remote:    endpoint,
+			Err:       err,
+		})
+
+		return nil, err
+	}
+
+	// the handshake must finish in time, a silent peer would hold its handshake slot forever
+	deadline := time.Now().Add(l.transport.handshakeTimeout)
+
+	udpSession.SetDeadline(deadline)
+
+	counter := &counterConn{Conn: udpSession}
+
+	var sess net.Conn = counter
+
+	l.transport.D("accept connection {@raddr}", sess.RemoteAddr())
+
+	sess, err = l.transport.protect(sess)
+
+	if err != nil {
+		return fail(errors.Wrap(err, "protect session from %s error", counter.RemoteAddr()))
+	}
+
+	sess, version, transcript, err := l.transport.acceptVersion(sess, deadline)
+
+	if err != nil {
+		return fail(newHandshakeError(err, atomic.LoadUint64(&counter.received)))
+	}
+
+	var remotePeer peer.ID
+	var remotePubKey crypto.PubKey
+	var resumed bool
+	var tlsState tls.ConnectionState
+
+	creds := l.transport.credentials()
+
+	if security := creds.security; security != nil {
+		handshakeCtx, cancel := context.WithDeadline(context.Background(), deadline)
+
+		secConn, err := security.SecureInbound(handshakeCtx, sess)
+
+		cancel()
 
-			sess = tlsSess
+		if err != nil {
+			return fail(newHandshakeError(err, atomic.LoadUint64(&counter.received)))
+		}
+
+		remotePeer = secConn.RemotePeer()
+		remotePubKey = secConn.RemotePublicKey()
+
+		sess = secConn
+	} else if identity := creds.identity; identity != nil {
+		// the key channel delivers the public key verified by the handshake
+		tlsConf, keyCh := identity.ConfigForAny()
+
+		tlsSess := tls.Server(sess, l.transport.tlsConfig(tlsConf, ""))
+
+		err := tlsSess.Handshake()
+
+		if err == nil {
+			err = l.transport.checkTLSState(tlsSess.ConnectionState())
 		}
 
-		remoteMultiaddr, err := toKcpMultiaddr(sess.RemoteAddr())
+		if err == nil {
+			err = confirmVersion(tlsSess, transcript)
+		}
 
 		if err != nil {
-			return nil, errors.Wrap(err, "parse remote multiaddr error")
+			return fail(newHandshakeError(err, atomic.LoadUint64(&counter.received)))
+		}
+
+		select {
+		case remotePubKey = <-keyCh:
+		default:
+			remotePubKey, err = resumedPubKey(tlsSess.ConnectionState(), "")
+		}
+
+		if remotePubKey == nil {
+			return fail(newHandshakeError(err, atomic.LoadUint64(&counter.received)))
 		}
 
-		smuxSession, err := smux.Server(sess, smuxConf())
+		remotePeer, err = peer.IDFromPublicKey(remotePubKey)
 
 		if err != nil {
-			return nil, errors.Wrap(err, "create kcp smux session error")
+			return fail(newHandshakeError(err, atomic.LoadUint64(&counter.received)))
 		}
 
-		return &kcpCapableConn{
-			conn:            sess,
-			kcp:             l.transport,
-			localMultiaddr:  l.localMultiaddr,
-			remoteMultiaddr: remoteMultiaddr,
-			localPeer:       l.transport.localPeer,
-			privKey:         l.transport.privKey,
-			session:         smuxSession,
-			remotePeerID:    remotePeer,
-		}, nil
+		sess = tlsSess
+		tlsState = tlsSess.ConnectionState()
+		resumed = tlsState.DidResume
 	}
+
+	if validator := l.transport.peerValidator; validator != nil && !validator(remotePeer, counter.RemoteAddr()) {
+		l.transport.W("drop session from {@raddr}, peer {@peer} rejected", counter.RemoteAddr(), remotePeer.Pretty())
+		l.reject(sess, udpSession)
+		scope.Done()
+		return nil, nil
+	}
+
+	var observedAddr multiaddr.Multiaddr
+
+	if version >= ProtocolV2 {
+		observedAddr, err = l.transport.exchangeObserved(sess, counter.RemoteAddr())
+
+		if err != nil {
+			return fail(newHandshakeError(err, atomic.LoadUint64(&counter.received)))
+		}
+	}
+
+	var sessionID string
+
+	if version >= ProtocolV3 {
+		sessionID, err = readClientSessionID(sess)
+
+		if err != nil {
+			return fail(newHandshakeError(err, atomic.LoadUint64(&counter.received)))
+		}
+	}
+
+	kcp, err := l.transport.derive(l.transport.connOptions(addrOptions(l.localMultiaddr), remotePeer))
+
+	if err != nil {
+		return fail(errors.Wrap(err, "apply profile of peer %s error", remotePeer.Pretty()))
+	}
+
+	if kcp != l.transport {
+		kcp.sessionConf.apply(udpSession)
+	}
+
+	kcp = kcp.negotiatedMuxer(tlsState)
+
+	if err := kcp.reserveConn(scope, remotePeer); err != nil {
+		return fail(err)
+	}
+
+	// a blocked read of smux keeps the deadline, clear it before
+	udpSession.SetDeadline(time.Time{})
+
+	watched := &watchedConn{Conn: sess}
+
+	session, err := kcp.muxSession(watched, false)
+
+	if err != nil {
+		return fail(errors.Wrap(err, "create kcp smux session error"))
+	}
+
+	var rebound *rebinding
+
+	// only the peers of tls connections move their sessions, the key exported by the tls
+	// session authenticates their new addresses
+	if tlsState.HandshakeComplete {
+		rebound, err = l.socket.rebind.bind(udpSession, remotePeer, tlsState)
+
+		if err != nil {
+			session.Close()
+			return fail(err)
+		}
+	}
+
+	conn := &kcpCapableConn{
+		conn:            sess,
+		watched:         watched,
+		counter:         counter,
+		udpSession:      udpSession,
+		socket:          l.socket.acquire(),
+		mtu:             int32(kcp.sessionConf.initialMTU()),
+		dataShards:      l.transport.dataShards,
+		parityShards:    l.transport.parityShards,
+		sndwnd:          int32(kcp.sessionConf.initialSendWindow()),
+		addrOptions:     addrOptions(l.localMultiaddr),
+		closed:          make(chan struct{}),
+		kcp:             kcp,
+		localMultiaddr:  l.localMultiaddr,
+		remoteMultiaddr: endpoint,
+		localPeer:       creds.localPeer,
+		privKey:         creds.privKey,
+		session:         session,
+		remotePeerID:    remotePeer,
+		remotePubKey:    remotePubKey,
+		resumed:         resumed,
+		direction:       network.DirInbound,
+		version:         version,
+		observedAddr:    observedAddr,
+		sessionID:       sessionID,
+		scope:           scope,
+		opened:          time.Now(),
+		security:        creds.securityID(),
+		rebinding:       rebound,
+	}
+
+	conn.emit(ConnHandshakeCompleted, nil)
+
+	if !l.transport.trackConn(conn) {
+		conn.Close()
+		return nil, ErrClosed
+	}
+
+	conn.monitor(l.monitor, m)
+	conn.watchIdle()
+	conn.tag()
+	conn.reportObserved()
+
+	return conn, nil
 }
 
-// Close closes the listener.
+// Close closes the listener, the pending Accept calls return ErrClosed and the handshakes
+// in progress are cancelled. The accepted connections keep the udp socket open until
+// they are closed too
 func (l *kcpListener) Close() error {
-	return nil
+	return l.close()
+}
+
+func (l *kcpListener) close() error {
+	var err error
+
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		l.transport.untrackListener(l)
+
+		err = l.listener.Close()
+
+		l.handshakes.cancel()
+
+		l.closeBacklog()
+
+		l.socket.Close()
+	})
+
+	return err
+}
+
+func (l *kcpListener) isClosed() bool {
+	select {
+	case <-l.closed:
+		return true
+	default:
+		return false
+	}
 }
 
 // Addr returns the address of this listener.
@@ -441,10 +1800,207 @@ func (l *kcpListener) Multiaddr() multiaddr.Multiaddr {
 	return l.localMultiaddr
 }
 
+// counterConn counts the bytes read from and written to the kcp session
+type counterConn struct {
+	net.Conn
+	sent     uint64
+	received uint64
+	writing  int32 // a write is in progress, kcp session writes only block on a full send window
+}
+
+func (conn *counterConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+
+	atomic.AddUint64(&conn.received, uint64(n))
+
+	return n, err
+}
+
+func (conn *counterConn) Write(b []byte) (int, error) {
+	atomic.StoreInt32(&conn.writing, 1)
+
+	n, err := conn.Conn.Write(b)
+
+	atomic.StoreInt32(&conn.writing, 0)
+
+	atomic.AddUint64(&conn.sent, uint64(n))
+
+	return n, err
+}
+
+// watchedConn records whether a read failed, smux doesn't close its session when the
+// remote peer closed the conn
+type watchedConn struct {
+	net.Conn
+	readFailed int32
+}
+
+func (conn *watchedConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+
+	if err != nil {
+		atomic.StoreInt32(&conn.readFailed, 1)
+	}
+
+	return n, err
+}
+
+func (conn *watchedConn) failed() bool {
+	return atomic.LoadInt32(&conn.readFailed) != 0
+}
+
 type kcpStream struct {
-	*smux.Stream
+	muxStream
+	conn         *kcpCapableConn
+	counter      *counterConn
+	activity     *activity
+	sendBuffers  *sendBuffers
+	writeTimeout time.Duration // default write deadline, 0 means none
+	deadline     atomic.Value  // the explicit write deadline, zero means none
+	scope        StreamScope   // resource manager scope
+	releaseOnce  sync.Once
+	readClosed   int32 // closed for reading by CloseRead
+	reset        int32 // aborted by Reset
+}
+
+func (s *kcpStream) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(&s.readClosed) != 0 {
+		return 0, io.ErrClosedPipe
+	}
+
+	n, err := s.muxStream.Read(b)
+
+	if n > 0 {
+		s.activity.touch()
+	}
+
+	return n, s.resetErr(err)
 }
 
+func (s *kcpStream) Write(b []byte) (int, error) {
+	s.activity.touch()
+
+	deadline, _ := s.deadline.Load().(time.Time)
+
+	if s.writeTimeout > 0 && deadline.IsZero() {
+		deadline = time.Now().Add(s.writeTimeout)
+
+		if err := s.muxStream.SetWriteDeadline(deadline); err != nil {
+			return 0, s.resetErr(err)
+		}
+	}
+
+	// the packets of a full socket send buffer are lost, so wait for it
+	if err := s.sendBuffers.lookup(s.conn.udpSession.RemoteAddr()).wait(deadline); err != nil {
+		return 0, err
+	}
+
+	n, err := s.muxStream.Write(b)
+
+	return n, s.resetErr(err)
+}
+
+// SetWriteDeadline sets the write deadline, which replaces the default one until t is zero
+func (s *kcpStream) SetWriteDeadline(t time.Time) error {
+	s.explicitDeadline(t)
+
+	return s.muxStream.SetWriteDeadline(t)
+}
+
+// SetDeadline sets the read and write deadlines, the write one replaces the default one
+// until t is zero
+func (s *kcpStream) SetDeadline(t time.Time) error {
+	s.explicitDeadline(t)
+
+	return s.muxStream.SetDeadline(t)
+}
+
+func (s *kcpStream) explicitDeadline(t time.Time) {
+	s.deadline.Store(t)
+}
+
+// Close closes the stream and releases its resource scope
+func (s *kcpStream) Close() error {
+	defer s.release()
+
+	return s.muxStream.Close()
+}
+
+// CloseWrite closes the stream for writing, the remote peer reads EOF after the written
+// data while the stream stays readable. smux has no half-close and returns ErrHalfClose,
+// negotiate yamux with WithMuxers for the protocols which need it
+func (s *kcpStream) CloseWrite() error {
+	if closer, ok := s.muxStream.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+
+	return errors.Wrap(ErrHalfClose, "stream %d", s.muxStream.ID())
+}
+
+// CloseRead closes the stream for reading, the following reads fail and the data which
+// still arrives is discarded, so the remote writes aren't blocked by the muxer flow
+// control. smux has no half-close and returns ErrHalfClose like CloseWrite
+func (s *kcpStream) CloseRead() error {
+	if _, ok := s.muxStream.(interface{ CloseWrite() error }); !ok {
+		return errors.Wrap(ErrHalfClose, "stream %d", s.muxStream.ID())
+	}
+
+	if atomic.CompareAndSwapInt32(&s.readClosed, 0, 1) {
+		// ends when the stream is closed or reset
+		go io.Copy(ioutil.Discard, s.muxStream)
+	}
+
+	return nil
+}
+
+// Reset aborts the stream, the pending and following reads and writes fail with
+// mux.ErrReset, on the remote peer too. smux has no stream reset, the stream is closed
+// instead and the remote peer reads EOF as if the data ended, negotiate yamux or mplex
+// with WithMuxers for the protocols which must tell an abort from the end of a stream
 func (s *kcpStream) Reset() error {
+	defer s.release()
+
+	atomic.StoreInt32(&s.reset, 1)
+
+	if resetter, ok := s.muxStream.(interface{ Reset() error }); ok {
+		return resetter.Reset()
+	}
+
+	s.conn.kcp.D("reset smux stream {@id} of {@raddr} by closing it", s.muxStream.ID(), s.conn.remoteMultiaddr)
+
+	// closing a closed smux stream fails, the reset of a closed stream doesn't
+	s.muxStream.Close()
+
 	return nil
 }
+
+// resetErr replaces err with mux.ErrReset if the stream was reset by either peer
+func (s *kcpStream) resetErr(err error) error {
+	if err != nil && (atomic.LoadInt32(&s.reset) != 0 || isStreamReset(err)) {
+		return mux.ErrReset
+	}
+
+	return err
+}
+
+func (s *kcpStream) release() {
+	s.releaseOnce.Do(s.scope.Done)
+}
+
+// StreamID returns the muxer stream id, which is the same on both ends
+func (s *kcpStream) StreamID() uint32 {
+	return s.muxStream.ID()
+}
+
+// TryWrite writes b only if the kcp session isn't congested, which means no write of
+// the session is waiting for the kcp send window and the window isn't full, otherwise
+// returns ErrWouldBlock. The window is checked on the monitored sessions only, see
+// windowFull. It's a best effort check, the write may still block when the window fills
+// up meanwhile.
+func (s *kcpStream) TryWrite(b []byte) (int, error) {
+	if atomic.LoadInt32(&s.counter.writing) != 0 || s.conn.windowFull() {
+		return 0, ErrWouldBlock
+	}
+
+	return s.Write(b)
+}
@@ -1,24 +1,59 @@
 package kcp
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	ipfslog "github.com/ipfs/go-log"
+	csms "github.com/libp2p/go-conn-security-multistream"
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ipnet "github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/libp2p/go-libp2p-core/sec/insecure"
+	"github.com/libp2p/go-libp2p-core/transport"
+	noise "github.com/libp2p/go-libp2p-noise"
 	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	ttransport "github.com/libp2p/go-libp2p-testing/suites/transport"
+	tlsp2p "github.com/libp2p/go-libp2p-tls"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	p2pyamux "github.com/libp2p/go-libp2p-yamux"
+	msmux "github.com/libp2p/go-stream-muxer-multistream"
+	"github.com/libs4go/errors"
 	grpc "github.com/libs4go/libp2p-grpc"
 	"github.com/libs4go/libp2p-kcp/pro"
 	"github.com/libs4go/scf4go"
 	_ "github.com/libs4go/scf4go/codec" //
 	"github.com/libs4go/scf4go/reader/file"
+	"github.com/libs4go/scf4go/reader/memory"
 	"github.com/libs4go/slf4go"
 	_ "github.com/libs4go/slf4go/backend/console" //
+	"github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
+	kcpgo "github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+	"golang.org/x/net/ipv4"
 )
 
 //go:generate protoc --proto_path=./pro --go_out=plugins=grpc,paths=source_relative:./pro echo.proto
@@ -112,3 +147,5340 @@ func TestMultAddr(t *testing.T) {
 
 	require.Equal(t, "/ip4/192.168.0.42/udp/1337/kcp", maddr.String())
 }
+
+func TestListenAll(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	kcp, err := New(prikey)
+
+	require.NoError(t, err)
+
+	addr1 := multiaddr.StringCast("/ip4/127.0.0.1/udp/1820/kcp")
+	addr2 := multiaddr.StringCast("/ip4/127.0.0.1/udp/1821/kcp")
+
+	// the second listen on 1820 fails, so the first one must be released
+	_, err = kcp.(Transport).ListenAll([]multiaddr.Multiaddr{addr1, addr2, addr1})
+
+	require.Error(t, err)
+
+	listeners, err := kcp.(Transport).ListenAll([]multiaddr.Multiaddr{addr1, addr2})
+
+	require.NoError(t, err)
+
+	require.Len(t, listeners, 2)
+
+	for _, l := range listeners {
+		l.(*kcpListener).close()
+	}
+}
+
+func makeConnPair(t *testing.T, options ...Option) (Conn, Conn) {
+	return makeConnPairWith(t, options, options)
+}
+
+func makeConnPairWith(t *testing.T, listenerOptions []Option, dialerOptions []Option) (Conn, Conn) {
+	return makeConnPairContext(t, context.Background(), listenerOptions, dialerOptions)
+}
+
+func makeConnPairContext(t *testing.T, ctx context.Context, listenerOptions []Option, dialerOptions []Option) (Conn, Conn) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	return makeConnPairKeys(t, ctx, prikey1, prikey2, listenerOptions, dialerOptions)
+}
+
+func makeConnPairKeys(t *testing.T, ctx context.Context, prikey1, prikey2 crypto.PrivKey, listenerOptions []Option, dialerOptions []Option) (Conn, Conn) {
+	return makeConnPairAt(t, ctx, multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"), prikey1, prikey2, listenerOptions, dialerOptions)
+}
+
+// makeConnPairAt returns a connected pair without streams, the stream which established
+// the session is closed on both ends
+func makeConnPairAt(t *testing.T, ctx context.Context, laddr multiaddr.Multiaddr, prikey1, prikey2 crypto.PrivKey, listenerOptions []Option, dialerOptions []Option) (Conn, Conn) {
+	dialed, accepted, first := dialConnPairAt(t, ctx, laddr, prikey1, prikey2, listenerOptions, dialerOptions)
+
+	stream, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(stream, make([]byte, 1))
+
+	require.NoError(t, err)
+
+	stream.Close()
+	first.Close()
+
+	return dialed, accepted
+}
+
+// dialConnPair returns a connected pair and the dialed stream which established the
+// session, the stream is still to be accepted
+func dialConnPair(t *testing.T, listenerOptions []Option, dialerOptions []Option) (Conn, Conn, mux.MuxedStream) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	return dialConnPairAt(t, context.Background(), multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"), prikey1, prikey2, listenerOptions, dialerOptions)
+}
+
+func dialConnPairAt(t *testing.T, ctx context.Context, laddr multiaddr.Multiaddr, prikey1, prikey2 crypto.PrivKey, listenerOptions []Option, dialerOptions []Option) (Conn, Conn, mux.MuxedStream) {
+	kcp1, err := New(prikey1, listenerOptions...)
+
+	require.NoError(t, err)
+
+	kcp2, err := New(prikey2, dialerOptions...)
+
+	require.NoError(t, err)
+
+	l, err := kcp1.Listen(laddr)
+
+	require.NoError(t, err)
+
+	t.Cleanup(func() { l.(*kcpListener).close() })
+
+	raddr, err := toKcpMultiaddr(l.Addr())
+
+	require.NoError(t, err)
+
+	accepted := make(chan transport.CapableConn, 1)
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err == nil {
+			accepted <- conn
+		}
+
+		close(accepted)
+	}()
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	dialed, err := kcp2.Dial(ctx, raddr, p1)
+
+	require.NoError(t, err)
+
+	// kcp session is established by the first packet
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = stream.Write([]byte{0})
+
+	require.NoError(t, err)
+
+	conn, ok := <-accepted
+
+	require.True(t, ok)
+
+	return dialed.(Conn), conn.(Conn), stream
+}
+
+// openStream opens a stream on dialed and accepts it on accepted, the remote peer learns
+// of the stream by its first byte
+func openStream(t *testing.T, dialed, accepted Conn) (mux.MuxedStream, mux.MuxedStream) {
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = stream.Write([]byte{0})
+
+	require.NoError(t, err)
+
+	remote, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(remote, make([]byte, 1))
+
+	require.NoError(t, err)
+
+	return stream, remote
+}
+
+func TestConvProvider(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithConvProvider(func(raddr net.Addr, p peer.ID) uint32 {
+		return 0x1234
+	}))
+
+	require.Equal(t, uint32(0x1234), dialed.Conv())
+	require.Equal(t, uint32(0x1234), accepted.Conv())
+}
+
+func TestSmuxVersionMismatch(t *testing.T) {
+	// the keepalives of the listener are the first v1 frames the dialer reads
+	dialed, accepted, _ := dialConnPair(t, []Option{WithSmuxVersion(1), WithKeepAlive(50*time.Millisecond, 5*time.Second)}, []Option{WithSmuxVersion(2)})
+
+	_, err := accepted.AcceptStream()
+
+	require.True(t, errors.Is(err, ErrSmuxVersion))
+
+	_, err = dialed.AcceptStream()
+
+	require.True(t, errors.Is(err, ErrSmuxVersion))
+
+	require.NoError(t, dialed.Close())
+	require.NoError(t, accepted.Close())
+}
+
+func TestByteCounters(t *testing.T) {
+	dialed, accepted := makeConnPair(t)
+
+	openStream(t, dialed, accepted)
+
+	require.NotZero(t, dialed.BytesSent())
+	require.Equal(t, dialed.BytesSent(), accepted.BytesReceived())
+}
+
+func TestStreamID(t *testing.T) {
+	dialed, accepted := makeConnPair(t)
+
+	stream1, stream2 := openStream(t, dialed, accepted)
+
+	require.Equal(t, stream1.(Stream).StreamID(), stream2.(Stream).StreamID())
+}
+
+// fullBufferConn fails the writes with ENOBUFS while full
+type fullBufferConn struct {
+	net.PacketConn
+	full int32
+}
+
+func (conn *fullBufferConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.LoadInt32(&conn.full) != 0 {
+		return 0, &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", syscall.ENOBUFS)}
+	}
+
+	if conn.PacketConn == nil {
+		return len(b), nil
+	}
+
+	return conn.PacketConn.WriteTo(b, addr)
+}
+
+func TestSendBufferFull(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1337}
+
+	// dropped as a lost packet without blocking the sender
+	full := &fullBufferConn{full: 1}
+	conn := &sendBufferConn{PacketConn: full, buffers: newSendBuffers()}
+
+	n, err := conn.WriteTo(make([]byte, 100), addr)
+
+	require.NoError(t, err)
+	require.Equal(t, 100, n)
+	require.Equal(t, uint64(1), conn.dropped)
+
+	buffer := conn.buffers.lookup(addr)
+
+	require.NotNil(t, buffer)
+
+	err = buffer.wait(time.Now().Add(50 * time.Millisecond))
+
+	require.True(t, err.(net.Error).Timeout())
+
+	// the sessions to the other peers keep writing
+	require.Nil(t, conn.buffers.lookup(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1338}))
+
+	// a successful write releases the writers
+	atomic.StoreInt32(&full.full, 0)
+
+	_, err = conn.WriteTo(make([]byte, 100), addr)
+
+	require.NoError(t, err)
+
+	require.NoError(t, buffer.wait(time.Now().Add(50*time.Millisecond)))
+	require.Nil(t, conn.buffers.lookup(addr))
+
+	// other errors are not swallowed
+	_, err = (&sendBufferConn{PacketConn: &errorConn{}, buffers: newSendBuffers()}).WriteTo(make([]byte, 100), addr)
+
+	require.Error(t, err)
+
+	// the stream writes wait for the buffer until their deadline
+	full = &fullBufferConn{}
+
+	dialed, accepted := makeConnPairWith(t, nil, []Option{WithPacketConn(func(conn net.PacketConn) net.PacketConn {
+		full.PacketConn = conn
+		return full
+	})})
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	atomic.StoreInt32(&full.full, 1)
+
+	// the packets of the write hit the full buffer
+	_, err = stream.Write([]byte{1})
+
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		c := dialed.(*kcpCapableConn)
+
+		return c.kcp.sendBuffers.lookup(c.udpSession.RemoteAddr()) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, stream.SetWriteDeadline(time.Now().Add(200*time.Millisecond)))
+
+	start := time.Now()
+
+	_, err = stream.Write(make([]byte, 1024))
+
+	require.Error(t, err)
+	require.True(t, err.(net.Error).Timeout())
+	require.True(t, time.Since(start) >= 150*time.Millisecond)
+
+	// the kcp retransmissions drain it
+	atomic.StoreInt32(&full.full, 0)
+
+	require.NoError(t, stream.SetWriteDeadline(time.Time{}))
+
+	_, err = stream.Write(make([]byte, 1024))
+
+	require.NoError(t, err)
+
+	received, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	buf := make([]byte, 1025)
+
+	_, err = io.ReadFull(received, buf)
+
+	require.NoError(t, err)
+}
+
+type errorConn struct {
+	net.PacketConn
+}
+
+func (conn *errorConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", syscall.EHOSTUNREACH)}
+}
+
+func TestKCPAddrs(t *testing.T) {
+	addrs := []multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001"),
+		multiaddr.StringCast("/ip4/127.0.0.1/udp/4001/quic"),
+		multiaddr.StringCast("/ip4/127.0.0.1/udp/4001/kcp"),
+		multiaddr.StringCast("/ip6/::1/udp/4001/kcp"),
+		multiaddr.StringCast("/ip4/127.0.0.1/udp/4001"),
+	}
+
+	kcpAddrs := KCPAddrs(addrs)
+
+	require.Equal(t, []multiaddr.Multiaddr{addrs[2], addrs[3]}, kcpAddrs)
+
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	kcp, err := New(prikey)
+
+	require.NoError(t, err)
+
+	require.Equal(t, kcpAddrs, kcp.(Transport).KCPAddrs(addrs))
+	require.Equal(t, []int{protocolKCPID, protocolKCPModeID}, kcp.Protocols())
+}
+
+func TestCanDial(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	kcp, err := New(prikey)
+
+	require.NoError(t, err)
+
+	for _, addr := range []string{
+		"/ip4/127.0.0.1/udp/4001/kcp",
+		"/ip6/::1/udp/4001/kcp",
+		"/ip6zone/eth0/ip6/fe80::1/udp/4001/kcp",
+		"/dns4/example.com/udp/4001/kcp",
+		"/ip4/127.0.0.1/udp/4001/kcp/kcpmode/fast3",
+		"/ip4/127.0.0.1/udp/4001/kcp/p2p/QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC",
+		"/ip4/127.0.0.1/udp/4001/kcp/kcpmode/fast/p2p/QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC",
+	} {
+		require.True(t, kcp.CanDial(multiaddr.StringCast(addr)), addr)
+	}
+
+	for _, addr := range []string{
+		"/ip4/127.0.0.1/tcp/4001/kcp",
+		"/ip4/127.0.0.1/udp/0/kcp",
+		"/ip4/127.0.0.1/udp/4001",
+		"/ip4/127.0.0.1/udp/4001/quic",
+		"/ip4/127.0.0.1/udp/4001/kcp/quic",
+		"/udp/4001/kcp",
+		"/ip4/127.0.0.1/udp/4001/udp/4002/kcp",
+		"/ip4/127.0.0.1/udp/4001/kcp/p2p/QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC/kcpmode/fast",
+	} {
+		require.False(t, kcp.CanDial(multiaddr.StringCast(addr)), addr)
+	}
+}
+
+func TestLinger(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithLinger(time.Second*5))
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	data := make([]byte, 64*1024)
+
+	_, err = stream.Write(data)
+
+	require.NoError(t, err)
+
+	require.NoError(t, stream.Close())
+	require.NoError(t, dialed.Close())
+
+	stream, err = accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	received, err := ioutil.ReadAll(stream)
+
+	require.NoError(t, err)
+
+	require.Equal(t, len(data), len(received))
+
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	// batch io hands the sockets to kcp-go without the monitor linger waits on
+	_, err = New(prikey, WithBatchIO(), WithLinger(time.Second))
+
+	require.True(t, errors.Is(err, ErrOption))
+}
+
+// lossyConn drops a fraction of the written packets
+type lossyConn struct {
+	net.PacketConn
+	sync.Mutex
+	rand *rand.Rand
+	loss float64
+}
+
+func (conn *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	conn.Lock()
+	drop := conn.rand.Float64() < conn.loss
+	conn.Unlock()
+
+	if drop {
+		return len(b), nil
+	}
+
+	return conn.PacketConn.WriteTo(b, addr)
+}
+
+func withLoss(loss float64) Option {
+	return WithPacketConn(func(conn net.PacketConn) net.PacketConn {
+		return &lossyConn{PacketConn: conn, rand: rand.New(rand.NewSource(1)), loss: loss}
+	})
+}
+
+func requireTransfer(t *testing.T, dialed, accepted Conn, size int) {
+	data := make([]byte, size)
+
+	rand.New(rand.NewSource(2)).Read(data)
+
+	go func() {
+		stream, err := dialed.OpenStream()
+
+		if err != nil {
+			return
+		}
+
+		stream.Write(data)
+		stream.Close()
+	}()
+
+	stream, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	received, err := ioutil.ReadAll(stream)
+
+	require.NoError(t, err)
+
+	require.True(t, bytes.Equal(data, received))
+}
+
+func TestLossRecovery(t *testing.T) {
+	dialed, accepted := makeConnPair(t, withLoss(0.1))
+
+	requireTransfer(t, dialed, accepted, 64*1024)
+}
+
+func TestContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	dialed, accepted := makeConnPair(t, WithContext(ctx))
+
+	cancel()
+
+	require.Eventually(t, func() bool {
+		_, err1 := dialed.OpenStream()
+		_, err2 := accepted.OpenStream()
+
+		return err1 != nil && err2 != nil
+	}, time.Second, time.Millisecond*10)
+
+	_, err := dialed.Transport().Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.True(t, errors.Is(err, ErrClosed))
+}
+
+func TestHandshakePeerMismatch(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	kcp1, err := New(prikey1, WithTLS())
+
+	require.NoError(t, err)
+
+	kcp2, err := New(prikey2, WithTLS())
+
+	require.NoError(t, err)
+
+	l, err := kcp1.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	defer l.(*kcpListener).close()
+
+	go l.Accept()
+
+	raddr, err := toKcpMultiaddr(l.Addr())
+
+	require.NoError(t, err)
+
+	// dial with the peer id of the dialer itself
+	p2, err := peer.IDFromPrivateKey(prikey2)
+
+	require.NoError(t, err)
+
+	_, err = kcp2.Dial(context.Background(), raddr, p2)
+
+	var handshakeErr *HandshakeError
+
+	require.True(t, errors.As(err, &handshakeErr))
+
+	require.Equal(t, HandshakePeerMismatch, handshakeErr.Kind)
+}
+
+func TestNoDelay(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithNoDelay(2, 10, 2, 1))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	dialed, accepted := makeConnPair(t, WithNoDelay(1, 10, 2, 1))
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = stream.Write([]byte("hello"))
+
+	require.NoError(t, err)
+
+	stream2, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	buff := make([]byte, 5)
+
+	_, err = io.ReadFull(stream2, buff)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(buff))
+}
+
+func TestMode(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithMode("turbo"))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	dialed, accepted := makeConnPair(t, WithMode("fast3"))
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = stream.Write([]byte{1})
+
+	require.NoError(t, err)
+
+	_, err = accepted.AcceptStream()
+
+	require.NoError(t, err)
+}
+
+func TestFEC(t *testing.T) {
+	require.Empty(t, fecPayload([]byte{0, 0, 0, 0, fecTypeParity, 0, 0, 0, 1}))
+	require.Equal(t, []byte{1}, fecPayload([]byte{0, 0, 0, 0, fecTypeData, 0, 0, 0, 1}))
+
+	dialed, accepted := makeConnPair(t, WithFEC(10, 3), WithLinger(time.Second), withLoss(0.1))
+
+	requireTransfer(t, dialed, accepted, 64*1024)
+
+	// the sessions report their parity level and traffic
+	for _, stats := range []*Stats{dialed.Stats(), accepted.Stats()} {
+		require.Equal(t, 10, stats.DataShards)
+		require.Equal(t, 3, stats.ParityShards)
+	}
+
+	require.NotZero(t, dialed.Stats().ParitySent)
+	require.NotZero(t, accepted.Stats().ParityRecv)
+
+	dialed, accepted = makeConnPair(t)
+
+	require.Zero(t, dialed.Stats().DataShards)
+	require.Zero(t, accepted.Stats().ParityShards)
+}
+
+func TestPacketCipher(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithPacketCipher("aes-128", make([]byte, 15)))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	key := bytes.Repeat([]byte{1}, 16)
+
+	dialed, accepted := makeConnPair(t, WithPacketCipher("aes-128", key), WithFEC(10, 3), WithLinger(time.Second))
+
+	requireTransfer(t, dialed, accepted, 64*1024)
+
+	// linger returns early only if the monitor decrypts the acks
+	start := time.Now()
+
+	require.NoError(t, dialed.Close())
+
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+// sessionField reads an unexported setting of the kcp session of conn, kcp-go has no
+// getters for them
+func sessionField(conn Conn, path ...string) reflect.Value {
+	v := reflect.ValueOf(conn.(*kcpCapableConn).udpSession)
+
+	for _, name := range path {
+		v = v.Elem().FieldByName(name)
+	}
+
+	return v
+}
+
+func TestACKNoDelay(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithACKNoDelay(true))
+
+	require.True(t, sessionField(dialed, "ackNoDelay").Bool())
+	require.True(t, sessionField(accepted, "ackNoDelay").Bool())
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	dialed, accepted = makeConnPair(t)
+
+	require.False(t, sessionField(dialed, "ackNoDelay").Bool())
+	require.False(t, sessionField(accepted, "ackNoDelay").Bool())
+}
+
+func TestWriteDelay(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithWriteDelay(true))
+
+	require.True(t, sessionField(dialed, "writeDelay").Bool())
+	require.True(t, sessionField(accepted, "writeDelay").Bool())
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	dialed, accepted = makeConnPair(t)
+
+	require.False(t, sessionField(dialed, "writeDelay").Bool())
+	require.False(t, sessionField(accepted, "writeDelay").Bool())
+}
+
+func TestUDPBuffer(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithUDPReadBuffer(0))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	dialed, accepted := makeConnPair(t, WithUDPReadBuffer(4*1024*1024), WithUDPWriteBuffer(4*1024*1024))
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	readMax, writeMax := socketBufferMax()
+
+	if readMax == 0 || writeMax == 0 {
+		t.Skip("os maximum buffer sizes are unknown")
+	}
+
+	min := func(a, b int) int {
+		if a < b {
+			return a
+		}
+
+		return b
+	}
+
+	// the buffers are sized within the os maximum, with or without configuration
+	for _, c := range []struct {
+		options     []Option
+		read, write int
+	}{
+		{nil, min(defaultSocketBuffer, readMax), min(defaultSocketBuffer, writeMax)},
+		{[]Option{WithUDPReadBuffer(readMax * 4), WithUDPWriteBuffer(writeMax * 4)}, readMax, writeMax},
+		{[]Option{WithUDPReadBuffer(64 * 1024), WithUDPWriteBuffer(32 * 1024)}, 64 * 1024, 32 * 1024},
+	} {
+		var sockets []net.PacketConn
+		var lock sync.Mutex
+
+		capture := WithPacketConn(func(conn net.PacketConn) net.PacketConn {
+			lock.Lock()
+			defer lock.Unlock()
+
+			sockets = append(sockets, conn)
+
+			return conn
+		})
+
+		makeConnPair(t, append(c.options, capture)...)
+
+		lock.Lock()
+
+		require.Len(t, sockets, 2)
+
+		for _, conn := range sockets {
+			read, write, err := socketBuffers(conn.(*net.UDPConn))
+
+			require.NoError(t, err)
+			require.Equal(t, c.read, read)
+			require.Equal(t, c.write, write)
+		}
+
+		lock.Unlock()
+	}
+}
+
+func TestDSCP(t *testing.T) {
+	var sockets []net.PacketConn
+	var lock sync.Mutex
+
+	capture := WithPacketConn(func(conn net.PacketConn) net.PacketConn {
+		lock.Lock()
+		defer lock.Unlock()
+
+		sockets = append(sockets, conn)
+
+		return conn
+	})
+
+	makeConnPair(t, WithDSCP(46), capture)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	require.Len(t, sockets, 2)
+
+	for _, conn := range sockets {
+		tos, err := ipv4.NewConn(conn.(*net.UDPConn)).TOS()
+
+		require.NoError(t, err)
+		require.Equal(t, 46<<2, tos)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithTTL(256))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	var sockets []net.PacketConn
+	var lock sync.Mutex
+
+	capture := WithPacketConn(func(conn net.PacketConn) net.PacketConn {
+		lock.Lock()
+		defer lock.Unlock()
+
+		sockets = append(sockets, conn)
+
+		return conn
+	})
+
+	dialed, accepted := makeConnPair(t, WithTTL(2), capture)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	require.Len(t, sockets, 2)
+
+	for _, conn := range sockets {
+		ttl, err := ipv4.NewConn(conn.(*net.UDPConn)).TTL()
+
+		require.NoError(t, err)
+		require.Equal(t, 2, ttl)
+	}
+}
+
+func TestStreamMode(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithStreamMode(true))
+
+	// kcp-go keeps the stream mode in the kcp control block
+	require.Equal(t, int64(1), sessionField(dialed, "kcp", "stream").Int())
+	require.Equal(t, int64(1), sessionField(accepted, "kcp", "stream").Int())
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	dialed, accepted = makeConnPair(t)
+
+	require.Zero(t, sessionField(dialed, "kcp", "stream").Int())
+	require.Zero(t, sessionField(accepted, "kcp", "stream").Int())
+}
+
+func TestDialOptions(t *testing.T) {
+	ctx := WithDialOptions(context.Background(), WithConvProvider(func(raddr net.Addr, p peer.ID) uint32 {
+		return 0x4321
+	}))
+
+	dialed, accepted := makeConnPairContext(t, ctx, nil, nil)
+
+	require.Equal(t, uint32(0x4321), dialed.Conv())
+	require.Equal(t, uint32(0x4321), accepted.Conv())
+
+	// the override is dial scoped, the conn still belongs to the transport
+	require.Nil(t, dialed.Transport().(*kcpTransport).convProvider)
+
+	// the peer profiles of a dial don't leak into the map shared with the transport
+	_, pubkey, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	other, err := peer.IDFromPublicKey(pubkey)
+
+	require.NoError(t, err)
+
+	ctx = WithDialOptions(context.Background(), WithPeerProfile(other, Profile{Mode: "fast3"}))
+
+	dialed, _ = makeConnPairContext(t, ctx, nil, []Option{WithPeerProfile(dialed.RemotePeer(), Profile{Mode: "fast"})})
+
+	profiles := dialed.Transport().(*kcpTransport).profiles
+
+	require.Len(t, profiles, 1)
+	require.NotContains(t, profiles, other)
+}
+
+func TestPeerProfile(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	p2, err := peer.IDFromPrivateKey(prikey2)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithPeerProfile(p2, Profile{Mode: "turbo"}))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	profile := Profile{Mode: "fast2", SndWnd: 512, SmuxVersion: 2}
+
+	dialed, accepted := makeConnPairKeys(t, context.Background(), prikey1, prikey2,
+		[]Option{WithTLS(), WithPeerProfile(p2, profile)},
+		[]Option{WithTLS(), WithPeerProfile(p1, profile)})
+
+	// smux v2 is only used by the profiled connections
+	require.Equal(t, 2, dialed.(*kcpCapableConn).kcp.smuxVersion)
+	require.Equal(t, 2, accepted.(*kcpCapableConn).kcp.smuxVersion)
+	require.Equal(t, 1, dialed.Transport().(*kcpTransport).smuxVersion)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+}
+
+func TestConfig(t *testing.T) {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Object(map[string]interface{}{
+		"kcp": map[string]interface{}{
+			"mode":   "fast2",
+			"mtu":    1200,
+			"rcvwnd": 2048,
+			"fec": map[string]interface{}{
+				"datashards":   10,
+				"parityshards": 3,
+			},
+			"smux": map[string]interface{}{
+				"version": 2,
+			},
+		},
+	})))
+
+	require.NoError(t, err)
+
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	tpt, err := New(prikey, WithConfig(config))
+
+	require.NoError(t, err)
+
+	kcp := tpt.(*kcpTransport)
+
+	require.Equal(t, 1, kcp.sessionConf.noDelay.nodelay)
+	require.Equal(t, 1200, kcp.sessionConf.mtu)
+	require.Equal(t, windowConf{sndwnd: 256, rcvwnd: 2048}, *kcp.sessionConf.window)
+	require.Equal(t, 10, kcp.dataShards)
+	require.Equal(t, 3, kcp.parityShards)
+	require.Equal(t, 2, kcp.smuxVersion)
+
+	dialed, accepted := makeConnPair(t, WithConfig(config))
+
+	require.Equal(t, 1200, dialed.Stats().MTU)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+}
+
+func TestReconfigure(t *testing.T) {
+	dialed, accepted := makeConnPair(t)
+
+	tpt := dialed.Transport().(Transport)
+
+	require.True(t, errors.Is(tpt.Reconfigure(Profile{Mode: "turbo"}), ErrOption))
+
+	require.NoError(t, tpt.Reconfigure(Profile{Mode: "fast3", MTU: 1000}))
+
+	require.Equal(t, 1000, dialed.Stats().MTU)
+	require.Equal(t, defaultMTU, accepted.Stats().MTU)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+}
+
+func TestTuneWindow(t *testing.T) {
+	// 1000 packets/s over 100ms rtt is a 100 packets bdp
+	require.Equal(t, 200, tuneWindow(32, 1000, 0, 100*time.Millisecond, time.Second, 16, 1024))
+	// window limited sessions double the window
+	require.Equal(t, 64, tuneWindow(32, 10, 30, 100*time.Millisecond, time.Second, 16, 1024))
+	require.Equal(t, 1024, tuneWindow(800, 10, 800, 100*time.Millisecond, time.Second, 16, 1024))
+	// slow sessions shrink, idle sessions keep the window, small changes are ignored
+	require.Equal(t, 20, tuneWindow(32, 100, 0, 100*time.Millisecond, time.Second, 16, 1024))
+	require.Equal(t, 32, tuneWindow(32, 0, 0, 0, time.Second, 16, 1024))
+	require.Equal(t, 100, tuneWindow(100, 52, 0, time.Second, time.Second, 16, 1024))
+}
+
+func TestAdaptiveWindow(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithAdaptiveWindow(16, 1024))
+
+	requireTransfer(t, dialed, accepted, 64*1024)
+}
+
+type mtuLimitConn struct {
+	net.PacketConn
+	mtu int
+}
+
+func (conn *mtuLimitConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > conn.mtu {
+		return len(b), nil
+	}
+
+	return conn.PacketConn.WriteTo(b, addr)
+}
+
+func TestPathMTUDiscovery(t *testing.T) {
+	blackhole := WithPacketConn(func(conn net.PacketConn) net.PacketConn {
+		return &mtuLimitConn{PacketConn: conn, mtu: 1200}
+	})
+
+	dialed, accepted := makeConnPair(t, WithPathMTUDiscovery(1500), blackhole)
+
+	for _, conn := range []Conn{dialed, accepted} {
+		conn := conn
+
+		require.Eventually(t, func() bool {
+			mtu := conn.Stats().MTU
+			return mtu > 1200-pathMTUPrecision && mtu <= 1200
+		}, 10*time.Second, 50*time.Millisecond)
+	}
+
+	requireTransfer(t, dialed, accepted, 64*1024)
+
+	// a peer without discovery never answers the probes, the search keeps the mtu
+	dialed, accepted = makeConnPairWith(t, nil, []Option{WithPathMTUDiscovery(1500)})
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	c := dialed.(*kcpCapableConn)
+
+	c.runPathMTU(c.monitorConn.lookup(c.udpSession.RemoteAddr()))
+
+	require.Equal(t, defaultMTU, dialed.Stats().MTU)
+}
+
+func TestAutoMTU(t *testing.T) {
+	// the path drops the packets above 1200 bytes, the default mtu is 1400
+	blackhole := WithPacketConn(func(conn net.PacketConn) net.PacketConn {
+		return &mtuLimitConn{PacketConn: conn, mtu: 1200}
+	})
+
+	dialed, _ := makeConnPair(t, WithAutoMTU(1000), blackhole)
+
+	require.Equal(t, defaultMTU, dialed.Stats().MTU)
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	go stream.Write(make([]byte, 1024*1024))
+
+	require.Eventually(t, func() bool {
+		return dialed.Stats().MTU <= 1200
+	}, 30*time.Second, 50*time.Millisecond)
+
+	require.GreaterOrEqual(t, dialed.Stats().MTU, 1000)
+
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithAutoMTU(24))
+
+	require.True(t, errors.Is(err, ErrOption))
+}
+
+func TestBBR(t *testing.T) {
+	bbr := NewBBR()
+
+	sample := CongestionSample{Interval: time.Second, RTT: 100 * time.Millisecond, Acked: 1000, Window: 32}
+
+	// startup doubles the window while the bandwidth grows
+	require.Equal(t, 64, bbr.Update(sample).Window)
+
+	sample.Window = 64
+
+	// 3 samples without growth end the startup, the window is the 100 packets bdp times the gain
+	for i := 0; i < bbrStartupRounds-1; i++ {
+		require.Equal(t, 128, bbr.Update(sample).Window)
+	}
+
+	require.Equal(t, 125, bbr.Update(sample).Window)
+	require.Equal(t, 75, bbr.Update(sample).Window)
+	require.Equal(t, 100, bbr.Update(sample).Window)
+
+	// the startup doubling stops at the send window
+	sample = CongestionSample{Interval: time.Second, RTT: 100 * time.Millisecond, Acked: 1000, Window: 32, MaxWindow: 48}
+
+	require.Equal(t, 48, NewBBR().Update(sample).Window)
+
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithAdaptiveWindow(16, 1024), WithCongestionController(NewBBR))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	dialed, accepted := makeConnPair(t, WithCongestionController(NewBBR), withLoss(0.05))
+
+	requireTransfer(t, dialed, accepted, 64*1024)
+
+	require.Eventually(t, func() bool {
+		return sessionField(dialed, "kcp", "nocwnd").Int() == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the profile turns the kcp congestion window on, the controller keeps it off
+	require.NoError(t, dialed.Transport().(Transport).Reconfigure(Profile{Interval: 20, Resend: 2, SndWnd: 64}))
+
+	require.Equal(t, int64(1), sessionField(dialed, "kcp", "nocwnd").Int())
+	require.LessOrEqual(t, sessionField(dialed, "kcp", "snd_wnd").Uint(), uint64(64))
+
+	requireTransfer(t, dialed, accepted, 64*1024)
+}
+
+func TestConvStrategy(t *testing.T) {
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1812}
+
+	sequential := SequentialConv(7)
+
+	require.Equal(t, uint32(7), sequential(raddr, ""))
+	require.Equal(t, uint32(8), sequential(raddr, ""))
+
+	require.NotEqual(t, DerivedConv([]byte("a"))(raddr, ""), DerivedConv([]byte("b"))(raddr, ""))
+
+	derived := DerivedConv([]byte("a"))
+
+	require.NotEqual(t, derived(raddr, ""), derived(raddr, ""))
+
+	validator := WithConvValidator(func(conv uint32, raddr net.Addr) bool {
+		return conv >= 7
+	})
+
+	dialed, accepted := makeConnPairWith(t, []Option{validator}, []Option{WithConvProvider(SequentialConv(7))})
+
+	require.Equal(t, uint32(7), dialed.Conv())
+	require.Equal(t, uint32(7), accepted.Conv())
+}
+
+func TestModeMultiaddr(t *testing.T) {
+	_, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1812/kcp/kcpmode/turbo")
+
+	require.Error(t, err)
+
+	// a collision of the kcpmode registration is an error of New, not a panic
+	taken := protoKCPMode
+	taken.Name = "kcpmode-test"
+
+	require.True(t, errors.Is(registerProtocol(taken), ErrOption))
+
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	kcp1, err := New(prikey1)
+
+	require.NoError(t, err)
+
+	kcp2, err := New(prikey2)
+
+	require.NoError(t, err)
+
+	l, err := kcp1.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp/kcpmode/fast3"))
+
+	require.NoError(t, err)
+
+	defer l.(*kcpListener).close()
+
+	raddr, err := toKcpMultiaddr(l.Addr())
+
+	require.NoError(t, err)
+
+	raddr = raddr.Encapsulate(multiaddr.StringCast("/kcpmode/fast3"))
+
+	require.True(t, kcp2.CanDial(raddr))
+
+	accepted := make(chan transport.CapableConn, 1)
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err == nil {
+			accepted <- conn
+		}
+
+		close(accepted)
+	}()
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	dialed, err := kcp2.Dial(context.Background(), raddr, p1)
+
+	require.NoError(t, err)
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = stream.Write([]byte{0})
+
+	require.NoError(t, err)
+
+	conn, ok := <-accepted
+
+	require.True(t, ok)
+
+	require.Equal(t, 10, dialed.(*kcpCapableConn).kcp.sessionConf.noDelay.interval)
+	require.Equal(t, 10, conn.(*kcpCapableConn).kcp.sessionConf.noDelay.interval)
+	require.Nil(t, kcp2.(*kcpTransport).sessionConf.noDelay)
+}
+
+func TestKeepAlive(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithKeepAlive(time.Second, time.Millisecond))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	dialed, accepted := makeConnPair(t, WithKeepAlive(50*time.Millisecond, 200*time.Millisecond))
+
+	// the remote smux session goes silent
+	require.NoError(t, accepted.(*kcpCapableConn).session.Close())
+
+	require.Eventually(t, func() bool {
+		return dialed.(*kcpCapableConn).session.IsClosed()
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestWithoutKeepAlive(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithKeepAlive(50*time.Millisecond, 200*time.Millisecond))
+
+	sent := dialed.BytesSent()
+
+	time.Sleep(300 * time.Millisecond)
+
+	require.Greater(t, dialed.BytesSent(), sent)
+
+	// the watchdog stall must outlast the kcp ack delay, which is the interval of fast3
+	dialed, accepted = makeConnPair(t, WithKeepAlive(50*time.Millisecond, 200*time.Millisecond), WithoutKeepAlive(), WithMode("fast3"), WithWatchdog(100*time.Millisecond))
+
+	sent = dialed.BytesSent()
+
+	time.Sleep(300 * time.Millisecond)
+
+	// idle sessions stay silent and open, the acks of the receiving side aren't taken
+	// for unanswered data by the watchdog
+	require.Equal(t, sent, dialed.BytesSent())
+	require.False(t, dialed.(*kcpCapableConn).session.IsClosed())
+	require.False(t, accepted.(*kcpCapableConn).session.IsClosed())
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+}
+
+// silentConn drops the written packets while silent
+type silentConn struct {
+	net.PacketConn
+	silent int32
+}
+
+func (conn *silentConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.LoadInt32(&conn.silent) == 1 {
+		return len(b), nil
+	}
+
+	return conn.PacketConn.WriteTo(b, addr)
+}
+
+func withSilentConn(conn **silentConn) Option {
+	return WithPacketConn(func(packetConn net.PacketConn) net.PacketConn {
+		*conn = &silentConn{PacketConn: packetConn}
+		return *conn
+	})
+}
+
+func TestWatchdog(t *testing.T) {
+	var listener *silentConn
+
+	// dead peer
+	options := []Option{WithoutKeepAlive(), WithWatchdog(200 * time.Millisecond)}
+
+	dialed, _ := makeConnPairWith(t, append(options, withSilentConn(&listener)), options)
+
+	// armed by the answer of the listener's session monitor
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&dialed.(*kcpCapableConn).sessionMonitor.lastPong) != 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	atomic.StoreInt32(&listener.silent, 1)
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	go stream.Write(make([]byte, 16*1024))
+
+	require.Eventually(t, dialed.IsClosed, 10*time.Second, 10*time.Millisecond)
+
+	cause, _ := dialed.(*kcpCapableConn).closeErr.Load().(error)
+
+	require.True(t, errors.Is(cause, ErrUnreachable))
+
+	// silent but alive peer, which doesn't monitor its sessions
+	dialed, accepted := makeConnPairWith(t, []Option{WithoutKeepAlive(), withSilentConn(&listener)}, options)
+
+	atomic.StoreInt32(&listener.silent, 1)
+
+	stream, err = dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	data := make([]byte, 16*1024)
+
+	rand.New(rand.NewSource(2)).Read(data)
+
+	go stream.Write(data)
+
+	// several stall durations without an answer
+	time.Sleep(time.Second)
+
+	require.False(t, dialed.IsClosed())
+
+	atomic.StoreInt32(&listener.silent, 0)
+
+	received, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	buf := make([]byte, len(data))
+
+	_, err = io.ReadFull(received, buf)
+
+	require.NoError(t, err)
+
+	require.True(t, bytes.Equal(data, buf))
+
+	require.False(t, dialed.IsClosed())
+}
+
+func TestTryWrite(t *testing.T) {
+	var listener *silentConn
+
+	// the window is checked with the session monitor of the bandwidth reporter
+	dialed, _ := makeConnPairWith(t, []Option{withSilentConn(&listener)}, []Option{WithWindowSize(4, 0), WithBandwidthReporter(metrics.NewBandwidthCounter())})
+
+	conn := dialed.(*kcpCapableConn)
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return !conn.windowFull()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = stream.(Stream).TryWrite([]byte{1})
+
+	require.NoError(t, err)
+
+	// the segments of a write admitted by an open window fill it, the peer acks nothing
+	atomic.StoreInt32(&listener.silent, 1)
+
+	_, err = stream.Write(make([]byte, 8*1024))
+
+	require.NoError(t, err)
+
+	_, err = stream.(Stream).TryWrite([]byte{1})
+
+	require.True(t, errors.Is(err, ErrWouldBlock))
+
+	atomic.StoreInt32(&listener.silent, 0)
+
+	require.Eventually(t, func() bool {
+		return !conn.windowFull()
+	}, 10*time.Second, 10*time.Millisecond)
+
+	_, err = stream.(Stream).TryWrite([]byte{1})
+
+	require.NoError(t, err)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithWriteTimeout(0))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	conf := smux.DefaultConfig()
+	conf.MaxReceiveBuffer = 16 * 1024
+	conf.MaxStreamBuffer = 16 * 1024
+
+	// the accepting side never reads, so the writes stall once its buffers are full
+	dialed, accepted := makeConnPairWith(t, []Option{WithSmuxConfig(conf), WithWindowSize(32, 32)}, []Option{WithWriteTimeout(200 * time.Millisecond)})
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	// an explicit deadline replaces the default one until it's cleared
+	deadline := time.Now().Add(time.Hour)
+
+	require.NoError(t, stream.SetWriteDeadline(deadline))
+
+	require.True(t, deadline.Equal(stream.(*kcpStream).deadline.Load().(time.Time)))
+
+	require.NoError(t, stream.SetDeadline(time.Time{}))
+
+	require.True(t, stream.(*kcpStream).deadline.Load().(time.Time).IsZero())
+
+	start := time.Now()
+
+	for err == nil {
+		_, err = stream.Write(make([]byte, 64*1024))
+
+		require.True(t, time.Since(start) < 10*time.Second)
+	}
+
+	require.Equal(t, smux.ErrTimeout, err)
+}
+
+func TestSmuxConfig(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	invalid := smux.DefaultConfig()
+	invalid.MaxFrameSize = 0
+
+	_, err = New(prikey, WithSmuxConfig(invalid))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	conf := smux.DefaultConfig()
+	conf.Version = 2
+	conf.MaxFrameSize = 4096
+	conf.MaxStreamBuffer = 128 * 1024
+
+	dialed, accepted := makeConnPair(t, WithSmuxConfig(conf), WithKeepAlive(time.Second, 3*time.Second))
+
+	applied := dialed.(*kcpCapableConn).kcp.smuxConf()
+
+	require.Equal(t, 2, applied.Version)
+	require.Equal(t, 4096, applied.MaxFrameSize)
+	require.Equal(t, 128*1024, applied.MaxStreamBuffer)
+	require.Equal(t, time.Second, applied.KeepAliveInterval)
+
+	requireTransfer(t, dialed, accepted, 64*1024)
+}
+
+func TestSmuxNegotiation(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithTLS())
+
+	require.Equal(t, 2, dialed.(*kcpCapableConn).kcp.smuxVersion)
+	require.Equal(t, 2, accepted.(*kcpCapableConn).kcp.smuxVersion)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	// peers pinned to v1 don't advertise smux v2
+	dialed, accepted = makeConnPairWith(t, []Option{WithTLS(), WithSmuxVersion(1)}, []Option{WithTLS()})
+
+	require.Equal(t, 1, dialed.(*kcpCapableConn).kcp.smuxVersion)
+	require.Equal(t, 1, accepted.(*kcpCapableConn).kcp.smuxVersion)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	// plain connections can't negotiate
+	dialed, _ = makeConnPair(t)
+
+	require.Equal(t, 1, dialed.(*kcpCapableConn).kcp.smuxVersion)
+}
+
+func TestMaxStreams(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithMaxStreams(0))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	dialed, accepted := makeConnPairWith(t, []Option{WithMaxStreams(1)}, []Option{WithMaxStreams(2)})
+
+	s1, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = s1.Write([]byte("hello"))
+
+	require.NoError(t, err)
+
+	a1, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+
+	_, err = io.ReadFull(a1, buf)
+
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	s2, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = dialed.OpenStream()
+
+	require.True(t, errors.Is(err, ErrTooManyStreams))
+
+	// the accepting side closes the stream beyond its limit
+	go accepted.AcceptStream()
+
+	_, err = s2.Write([]byte("world"))
+
+	require.NoError(t, err)
+
+	s2.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = s2.Read(buf)
+
+	require.Equal(t, io.EOF, err)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithIdleTimeout(0))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	dialed, accepted := makeConnPairWith(t, []Option{WithIdleTimeout(400 * time.Millisecond)}, nil)
+
+	_, first := openStream(t, dialed, accepted)
+
+	// open streams keep the connection alive
+	time.Sleep(600 * time.Millisecond)
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = stream.Write([]byte("hello"))
+
+	require.NoError(t, err)
+
+	second, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+
+	_, err = io.ReadFull(second, buf)
+
+	require.NoError(t, err)
+
+	first.Close()
+	second.Close()
+
+	_, err = accepted.AcceptStream()
+
+	require.True(t, errors.Is(err, ErrIdleTimeout))
+}
+
+func TestCompression(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithTLS(), WithCompression())
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	dialed, accepted = makeConnPair(t, WithCompression())
+
+	data := bytes.Repeat([]byte(`{"topic":"blocks","seqno":1024,"data":"aGVsbG8="}`), 2048)
+
+	sent := dialed.BytesSent()
+
+	go func() {
+		stream, err := dialed.OpenStream()
+
+		if err != nil {
+			return
+		}
+
+		stream.Write(data)
+		stream.Close()
+	}()
+
+	stream, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	received, err := ioutil.ReadAll(stream)
+
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, received))
+
+	require.Less(t, dialed.BytesSent()-sent, uint64(len(data)/4))
+}
+
+func TestLocalAddr(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithLocalAddr(net.IPv4zero))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	tpt, err := New(prikey, WithLocalAddr(net.ParseIP("127.0.0.1")))
+
+	require.NoError(t, err)
+
+	// the unspecified listen address is replaced by the local address
+	l, err := tpt.Listen(multiaddr.StringCast("/ip4/0.0.0.0/udp/0/kcp/kcpmode/fast"))
+
+	require.NoError(t, err)
+
+	defer l.(*kcpListener).close()
+
+	require.True(t, l.Addr().(*net.UDPAddr).IP.Equal(net.ParseIP("127.0.0.1")))
+	require.Equal(t, fmt.Sprintf("/ip4/127.0.0.1/udp/%d/kcp/kcpmode/fast", l.Addr().(*net.UDPAddr).Port), l.Multiaddr().String())
+
+	_, err = tpt.Listen(multiaddr.StringCast("/ip6/::/udp/0/kcp"))
+
+	require.True(t, errors.Is(err, ErrAddr))
+
+	dialed, _ := makeConnPair(t, WithLocalAddr(net.ParseIP("127.0.0.1")))
+
+	require.Equal(t, "127.0.0.1", dialed.(*kcpCapableConn).udpSession.LocalAddr().(*net.UDPAddr).IP.String())
+
+	dialer, err := New(prikey, WithLocalAddr(net.ParseIP("::1")))
+
+	require.NoError(t, err)
+
+	_, err = dialer.Dial(context.Background(), multiaddr.StringCast("/ip4/127.0.0.1/udp/1812/kcp"), "")
+
+	require.True(t, errors.Is(err, ErrAddr))
+}
+
+func TestBindDevice(t *testing.T) {
+	if !bindDeviceSupported {
+		t.Skip("bind device is not supported on this platform")
+	}
+
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithBindDevice(""))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	tpt, err := New(prikey, WithBindDevice("lo"))
+
+	require.NoError(t, err)
+
+	l, err := tpt.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("binding to a device requires CAP_NET_RAW")
+	}
+
+	require.NoError(t, err)
+
+	l.(*kcpListener).close()
+
+	dialed, accepted := makeConnPair(t, WithBindDevice("lo"))
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+}
+
+// linkLocalAddr returns a link-local ipv6 multiaddr of an up interface, nil if none
+func linkLocalAddr(t *testing.T) multiaddr.Multiaddr {
+	ifaces, err := net.Interfaces()
+
+	require.NoError(t, err)
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+
+			if ok && ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+				return multiaddr.StringCast(fmt.Sprintf("/ip6zone/%s/ip6/%s/udp/0/kcp", iface.Name, ipnet.IP))
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestIPv6(t *testing.T) {
+	laddr := multiaddr.StringCast("/ip6/::1/udp/0/kcp")
+
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	tpt, err := New(prikey1)
+
+	require.NoError(t, err)
+
+	l, err := tpt.Listen(laddr)
+
+	if err != nil {
+		t.Skip("ipv6 loopback is not available")
+	}
+
+	l.(*kcpListener).close()
+
+	dialed, accepted := makeConnPairAt(t, context.Background(), laddr, prikey1, prikey2, []Option{WithTLS()}, []Option{WithTLS()})
+
+	require.True(t, strings.HasPrefix(dialed.RemoteMultiaddr().String(), "/ip6/::1/udp/"))
+	require.True(t, strings.HasPrefix(accepted.RemoteMultiaddr().String(), "/ip6/::1/udp/"))
+
+	requireTransfer(t, dialed, accepted, 64*1024)
+
+	// link-local addresses carry the zone
+	if laddr = linkLocalAddr(t); laddr != nil {
+		dialed, accepted = makeConnPairAt(t, context.Background(), laddr, prikey1, prikey2, nil, nil)
+
+		require.True(t, strings.HasPrefix(dialed.RemoteMultiaddr().String(), "/ip6zone/"))
+
+		requireTransfer(t, dialed, accepted, 16*1024)
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	tpt, err := New(prikey)
+
+	require.NoError(t, err)
+
+	l, err := tpt.Listen(multiaddr.StringCast("/ip6/::1/udp/0/kcp"))
+
+	if err != nil {
+		t.Skip("ipv6 is not available")
+	}
+
+	l.(*kcpListener).close()
+
+	l4, err := tpt.Listen(multiaddr.StringCast("/ip4/0.0.0.0/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	defer l4.(*kcpListener).close()
+
+	port := l4.Addr().(*net.UDPAddr).Port
+
+	// the unspecified ipv6 listener doesn't take the ipv4 port
+	l6, err := tpt.Listen(multiaddr.StringCast(fmt.Sprintf("/ip6/::/udp/%d/kcp", port)))
+
+	require.NoError(t, err)
+
+	defer l6.(*kcpListener).close()
+
+	dialer, err := New(prikey)
+
+	require.NoError(t, err)
+
+	for _, pair := range []struct {
+		l     transport.Listener
+		raddr string
+	}{
+		{l4, fmt.Sprintf("/ip4/127.0.0.1/udp/%d/kcp", port)},
+		{l6, fmt.Sprintf("/ip6/::1/udp/%d/kcp", port)},
+	} {
+		accepted := make(chan transport.CapableConn, 1)
+
+		go func(l transport.Listener) {
+			conn, err := l.Accept()
+
+			if err == nil {
+				accepted <- conn
+			}
+
+			close(accepted)
+		}(pair.l)
+
+		dialed, err := dialer.Dial(context.Background(), multiaddr.StringCast(pair.raddr), "")
+
+		require.NoError(t, err)
+
+		stream, err := dialed.OpenStream()
+
+		require.NoError(t, err)
+
+		_, err = stream.Write([]byte{0})
+
+		require.NoError(t, err)
+
+		conn, ok := <-accepted
+
+		require.True(t, ok)
+
+		requireTransfer(t, dialed.(Conn), conn.(Conn), 16*1024)
+	}
+}
+
+func TestBatchIO(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	require.NoError(t, err)
+
+	defer udpConn.Close()
+
+	for _, c := range []struct {
+		options []Option
+		bare    bool
+	}{
+		{nil, false},
+		{[]Option{WithBatchIO()}, true},
+		{[]Option{WithBatchIO(), WithWatchdog(time.Second)}, false},
+		{[]Option{WithBatchIO(), withLoss(0)}, false},
+	} {
+		tpt, err := New(prikey, c.options...)
+
+		require.NoError(t, err)
+
+		packetConn, _ := tpt.(*kcpTransport).wrapPacketConn(udpConn)
+
+		_, bare := packetConn.(*net.UDPConn)
+
+		require.Equal(t, c.bare, bare)
+	}
+
+	dialed, accepted := makeConnPair(t, WithBatchIO())
+
+	requireTransfer(t, dialed, accepted, 64*1024)
+}
+
+func TestUDPOffload(t *testing.T) {
+	require.Equal(t, [][]byte{[]byte("abc")}, splitSegments([]byte("abc"), 0))
+	require.Equal(t, [][]byte{[]byte("abc")}, splitSegments([]byte("abc"), 3))
+	require.Equal(t, [][]byte{[]byte("ab"), []byte("cd"), []byte("e")}, splitSegments([]byte("abcde"), 2))
+
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	tpt, err := New(prikey, WithUDPOffload())
+
+	require.NoError(t, err)
+
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	require.NoError(t, err)
+
+	defer udpConn.Close()
+
+	if _, ok := tpt.(*kcpTransport).offloadConn(udpConn).(*groConn); !ok {
+		t.Log("udp receive offload is not supported")
+	}
+
+	dialed, accepted := makeConnPair(t, WithUDPOffload(), WithMode("fast3"))
+
+	requireTransfer(t, dialed, accepted, 256*1024)
+}
+
+func TestSecurity(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithSecurity(nil))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	noise1, err := noise.New(prikey1)
+
+	require.NoError(t, err)
+
+	noise2, err := noise.New(prikey2)
+
+	require.NoError(t, err)
+
+	dialed, accepted := makeConnPairKeys(t, context.Background(), prikey1, prikey2, []Option{WithTLS(), WithSecurity(noise1)}, []Option{WithSecurity(noise2)})
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	p2, err := peer.IDFromPrivateKey(prikey2)
+
+	require.NoError(t, err)
+
+	require.Equal(t, p1, dialed.RemotePeer())
+	require.True(t, prikey1.GetPublic().Equals(dialed.RemotePublicKey()))
+	require.Equal(t, p2, accepted.RemotePeer())
+	require.True(t, prikey2.GetPublic().Equals(accepted.RemotePublicKey()))
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithPrivateNetwork(make([]byte, 16)))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	psk1 := bytes.Repeat([]byte{1}, 32)
+	psk2 := bytes.Repeat([]byte{2}, 32)
+
+	dialed, accepted := makeConnPair(t, WithTLS(), WithPrivateNetwork(psk1))
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	// the host's psk is passed to the constructor
+	tpt, err := Constructor(WithTLS())(prikey1, psk1)
+
+	require.NoError(t, err)
+	require.Equal(t, ipnet.PSK(psk1), tpt.(*kcpTransport).psk)
+
+	// peers of other networks can't connect
+	dialer, err := New(prikey2, WithTLS(), WithPrivateNetwork(psk2))
+
+	require.NoError(t, err)
+
+	l, err := tpt.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	defer l.(*kcpListener).close()
+
+	raddr, err := toKcpMultiaddr(l.Addr())
+
+	require.NoError(t, err)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	accepted := make(chan error, 1)
+
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = dialer.Dial(ctx, raddr, p1)
+
+	require.Error(t, err)
+
+	// the listener drops the session and keeps accepting
+	select {
+	case err := <-accepted:
+		require.Fail(t, "accept returned", "%v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the environment can enforce private networks
+	ipnet.ForcePrivateNetwork = true
+	defer func() { ipnet.ForcePrivateNetwork = false }()
+
+	_, err = New(prikey1)
+
+	require.True(t, ipnet.IsPNetError(err))
+
+	_, err = New(prikey1, WithPrivateNetwork(psk1))
+
+	require.NoError(t, err)
+}
+
+func TestInboundIdentity(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 2048)
+
+	require.NoError(t, err)
+
+	dialed, accepted := makeConnPairKeys(t, context.Background(), prikey1, prikey2, []Option{WithTLS()}, []Option{WithTLS()})
+
+	p2, err := peer.IDFromPrivateKey(prikey2)
+
+	require.NoError(t, err)
+
+	require.Equal(t, p2, accepted.RemotePeer())
+	require.NotNil(t, accepted.RemotePublicKey())
+	require.True(t, prikey2.GetPublic().Equals(accepted.RemotePublicKey()))
+	require.True(t, prikey1.GetPublic().Equals(dialed.RemotePublicKey()))
+}
+
+func TestAllowedPeers(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey3, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	p2, err := peer.IDFromPrivateKey(prikey2)
+
+	require.NoError(t, err)
+
+	listener, err := New(prikey1, WithTLS(), WithAllowedPeers(p2))
+
+	require.NoError(t, err)
+
+	l, err := listener.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	defer l.(*kcpListener).close()
+
+	raddr, err := toKcpMultiaddr(l.Addr())
+
+	require.NoError(t, err)
+
+	accepted := make(chan transport.CapableConn, 1)
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err == nil {
+			accepted <- conn
+		}
+
+		close(accepted)
+	}()
+
+	// the session of a peer out of the allowlist is closed before smux is set up
+	rejected, err := New(prikey3, WithTLS())
+
+	require.NoError(t, err)
+
+	rejectedConn, err := rejected.Dial(context.Background(), raddr, p1)
+
+	require.NoError(t, err)
+
+	defer rejectedConn.Close()
+
+	// later packets of the rejected peer are dropped before the handshake
+	_, err = rejectedConn.OpenStream()
+
+	require.NoError(t, err)
+
+	select {
+	case <-accepted:
+		require.Fail(t, "rejected peer accepted")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	allowed, err := New(prikey2, WithTLS())
+
+	require.NoError(t, err)
+
+	dialed, err := allowed.Dial(context.Background(), raddr, p1)
+
+	require.NoError(t, err)
+
+	defer dialed.Close()
+
+	select {
+	case conn, ok := <-accepted:
+		require.True(t, ok)
+		require.Equal(t, p2, conn.RemotePeer())
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "allowed peer not accepted")
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithTLS(), WithSessionResumption(0))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	listener, err := New(prikey1, WithTLS(), WithSessionResumption(16))
+
+	require.NoError(t, err)
+
+	dialer, err := New(prikey2, WithTLS(), WithSessionResumption(16))
+
+	require.NoError(t, err)
+
+	l, err := listener.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	defer l.(*kcpListener).close()
+
+	raddr, err := toKcpMultiaddr(l.Addr())
+
+	require.NoError(t, err)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	p2, err := peer.IDFromPrivateKey(prikey2)
+
+	require.NoError(t, err)
+
+	connect := func() (Conn, Conn) {
+		accepted := make(chan transport.CapableConn, 1)
+
+		go func() {
+			conn, err := l.Accept()
+
+			if err == nil {
+				accepted <- conn
+			}
+
+			close(accepted)
+		}()
+
+		dialed, err := dialer.Dial(context.Background(), raddr, p1)
+
+		require.NoError(t, err)
+
+		stream, err := dialed.OpenStream()
+
+		require.NoError(t, err)
+
+		_, err = stream.Write([]byte{0})
+
+		require.NoError(t, err)
+
+		conn, ok := <-accepted
+
+		require.True(t, ok)
+
+		requireTransfer(t, dialed.(Conn), conn.(Conn), 1024)
+
+		return dialed.(Conn), conn.(Conn)
+	}
+
+	dialed, accepted := connect()
+
+	defer dialed.Close()
+	defer accepted.Close()
+
+	require.False(t, dialed.Resumed())
+	require.False(t, accepted.Resumed())
+
+	// the session ticket received by the first connection is used by the second
+	dialed, accepted = connect()
+
+	defer dialed.Close()
+	defer accepted.Close()
+
+	require.True(t, dialed.Resumed())
+	require.True(t, accepted.Resumed())
+	require.Equal(t, p1, dialed.RemotePeer())
+	require.Equal(t, p2, accepted.RemotePeer())
+	require.True(t, prikey2.GetPublic().Equals(accepted.RemotePublicKey()))
+}
+
+func TestIdentity(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	// transports sharing a key share the identity
+	kcp1, err := New(prikey1, WithTLS())
+
+	require.NoError(t, err)
+
+	kcp2, err := New(prikey1, WithTLS())
+
+	require.NoError(t, err)
+
+	require.True(t, kcp1.(*kcpTransport).identity == kcp2.(*kcpTransport).identity)
+
+	identity, err := tlsp2p.NewIdentity(prikey1)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithIdentity(nil))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	_, err = New(prikey2, WithIdentity(identity))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	dialed, accepted := makeConnPairKeys(t, context.Background(), prikey1, prikey2, []Option{WithIdentity(identity)}, []Option{WithTLS()})
+
+	requireTransfer(t, dialed, accepted, 1024)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	require.Equal(t, p1, dialed.RemotePeer())
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithHandshakeTimeout(0))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	listener, err := New(prikey1, WithTLS(), WithHandshakeTimeout(500*time.Millisecond))
+
+	require.NoError(t, err)
+
+	l, err := listener.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	defer l.(*kcpListener).close()
+
+	laddr, err := net.ResolveUDPAddr("udp", l.(*kcpListener).listener.Addr().String())
+
+	require.NoError(t, err)
+
+	// a peer which opens a kcp session by a window probe and goes silent
+	silent, err := net.DialUDP("udp", nil, laddr)
+
+	require.NoError(t, err)
+
+	defer silent.Close()
+
+	probe := make([]byte, 24)
+	probe[0] = 1
+	probe[4] = 83
+
+	_, err = silent.Write(probe)
+
+	require.NoError(t, err)
+
+	udpSession, err := l.(*kcpListener).listener.AcceptKCP()
+
+	require.NoError(t, err)
+
+	start := time.Now()
+
+	_, err = l.(*kcpListener).upgrade(udpSession)
+
+	var handshakeErr *HandshakeError
+
+	require.True(t, errors.As(err, &handshakeErr))
+	require.True(t, isTimeout(handshakeErr.Err))
+	require.True(t, time.Since(start) < 5*time.Second)
+
+	// the dialed peer never answers
+	dialer, err := New(prikey2, WithTLS(), WithHandshakeTimeout(500*time.Millisecond))
+
+	require.NoError(t, err)
+
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	require.NoError(t, err)
+
+	defer sink.Close()
+
+	raddr, err := toKcpMultiaddr(sink.LocalAddr())
+
+	require.NoError(t, err)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	start = time.Now()
+
+	_, err = dialer.Dial(context.Background(), raddr, p1)
+
+	require.True(t, errors.As(err, &handshakeErr))
+	require.Equal(t, HandshakeNotEstablished, handshakeErr.Kind)
+	require.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestPlaintext(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 2048)
+
+	require.NoError(t, err)
+
+	dialed, accepted := makeConnPairKeys(t, context.Background(), prikey1, prikey2, []Option{WithPlaintext()}, []Option{WithPlaintext()})
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	p2, err := peer.IDFromPrivateKey(prikey2)
+
+	require.NoError(t, err)
+
+	require.Equal(t, p1, dialed.RemotePeer())
+	require.Equal(t, p2, accepted.RemotePeer())
+	require.True(t, prikey2.GetPublic().Equals(accepted.RemotePublicKey()))
+
+	// the exchanged peer id is checked by the dialer
+	kcp1, err := New(prikey1, WithPlaintext())
+
+	require.NoError(t, err)
+
+	kcp2, err := New(prikey2, WithPlaintext())
+
+	require.NoError(t, err)
+
+	l, err := kcp1.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	defer l.(*kcpListener).close()
+
+	go l.Accept()
+
+	raddr, err := toKcpMultiaddr(l.Addr())
+
+	require.NoError(t, err)
+
+	_, err = kcp2.Dial(context.Background(), raddr, p2)
+
+	var handshakeErr *HandshakeError
+
+	require.True(t, errors.As(err, &handshakeErr))
+	require.Equal(t, HandshakePeerMismatch, handshakeErr.Kind)
+}
+
+func TestAddressValidation(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithTLS(), WithAddressValidation())
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	listener, err := New(prikey1, WithTLS(), WithAddressValidation())
+
+	require.NoError(t, err)
+
+	l, err := listener.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	defer l.(*kcpListener).close()
+
+	laddr, err := net.ResolveUDPAddr("udp", l.(*kcpListener).listener.Addr().String())
+
+	require.NoError(t, err)
+
+	// an unvalidated source gets a retry no larger than its packet instead of a session
+	spoofed, err := net.DialUDP("udp", nil, laddr)
+
+	require.NoError(t, err)
+
+	defer spoofed.Close()
+
+	probe := make([]byte, 24)
+	probe[0] = 1
+	probe[4] = 83
+
+	_, err = spoofed.Write(probe)
+
+	require.NoError(t, err)
+
+	buff := make([]byte, 1500)
+
+	spoofed.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n, err := spoofed.Read(buff)
+
+	require.NoError(t, err)
+	require.True(t, n <= len(probe))
+	require.True(t, bytes.HasPrefix(buff[:n], cookieRetry))
+
+	accepted2 := make(chan transport.CapableConn, 1)
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err == nil {
+			accepted2 <- conn
+		}
+
+		close(accepted2)
+	}()
+
+	dialer, err := New(prikey2, WithTLS(), WithAddressValidation())
+
+	require.NoError(t, err)
+
+	raddr, err := toKcpMultiaddr(l.Addr())
+
+	require.NoError(t, err)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	conn, err := dialer.Dial(context.Background(), raddr, p1)
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	p2, err := peer.IDFromPrivateKey(prikey2)
+
+	require.NoError(t, err)
+
+	select {
+	case conn, ok := <-accepted2:
+		require.True(t, ok)
+		require.Equal(t, p2, conn.RemotePeer())
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "validated dialer not accepted")
+	}
+
+	// the dialer forgets the packet it resends once the listener answered
+	local, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	require.NoError(t, err)
+
+	defer local.Close()
+
+	remote, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	require.NoError(t, err)
+
+	defer remote.Close()
+
+	cookies := &cookieConn{PacketConn: local}
+
+	_, err = cookies.WriteTo(make([]byte, 64), remote.LocalAddr())
+
+	require.NoError(t, err)
+	require.NotNil(t, cookies.last)
+
+	_, err = remote.WriteTo(make([]byte, 64), local.LocalAddr())
+
+	require.NoError(t, err)
+
+	_, _, err = cookies.ReadFrom(make([]byte, 1500))
+
+	require.NoError(t, err)
+	require.Nil(t, cookies.last)
+
+	_, err = cookies.WriteTo(make([]byte, 64), remote.LocalAddr())
+
+	require.NoError(t, err)
+	require.Nil(t, cookies.last)
+}
+
+// natConn moves the packets of the dialer to a new source port on rebind, like a nat
+// whose mapping timed out, and reads the packets sent to both ports
+type natConn struct {
+	net.PacketConn
+	sync.Mutex
+	current   net.PacketConn
+	packets   chan natPacket
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type natPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+func newNATConn(conn net.PacketConn) *natConn {
+	nat := &natConn{PacketConn: conn, current: conn, packets: make(chan natPacket, 1024), closed: make(chan struct{})}
+
+	go nat.read(conn)
+
+	return nat
+}
+
+func (nat *natConn) read(conn net.PacketConn) {
+	for {
+		buff := make([]byte, 2048)
+
+		n, addr, err := conn.ReadFrom(buff)
+
+		if err != nil {
+			return
+		}
+
+		select {
+		case nat.packets <- natPacket{b: buff[:n], addr: addr}:
+		case <-nat.closed:
+			return
+		}
+	}
+}
+
+func (nat *natConn) rebind() (net.Addr, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		return nil, err
+	}
+
+	nat.Lock()
+	nat.current = conn
+	nat.Unlock()
+
+	go nat.read(conn)
+
+	return conn.LocalAddr(), nil
+}
+
+func (nat *natConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-nat.packets:
+		return copy(b, packet.b), packet.addr, nil
+	case <-nat.closed:
+		return 0, nil, io.ErrClosedPipe
+	}
+}
+
+func (nat *natConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	nat.Lock()
+	conn := nat.current
+	nat.Unlock()
+
+	return conn.WriteTo(b, addr)
+}
+
+func (nat *natConn) Close() error {
+	nat.closeOnce.Do(func() {
+		close(nat.closed)
+
+		nat.Lock()
+		nat.current.Close()
+		nat.Unlock()
+	})
+
+	return nat.PacketConn.Close()
+}
+
+func TestNATRebinding(t *testing.T) {
+	var nat *natConn
+
+	dialed, accepted := makeConnPairWith(t, []Option{WithTLS(), WithNATRebinding()}, []Option{WithTLS(), WithPacketConn(func(conn net.PacketConn) net.PacketConn {
+		nat = newNATConn(conn)
+		return nat
+	})})
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	rebinding := accepted.(*kcpCapableConn).rebinding
+
+	require.NotNil(t, rebinding)
+
+	current := rebinding.remoteAddr()
+
+	// a packet with the conv of the session from another address is challenged, and the
+	// echo of the challenge doesn't answer it without the path key
+	spoofer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	require.NoError(t, err)
+
+	defer spoofer.Close()
+
+	listenAddr := dialed.(*kcpCapableConn).udpSession.RemoteAddr()
+
+	packet := make([]byte, kcpgo.IKCP_OVERHEAD)
+
+	binary.LittleEndian.PutUint32(packet, accepted.(*kcpCapableConn).udpSession.GetConv())
+
+	_, err = spoofer.WriteTo(packet, listenAddr)
+
+	require.NoError(t, err)
+
+	spoofer.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buff := make([]byte, 2048)
+
+	n, _, err := spoofer.ReadFrom(buff)
+
+	require.NoError(t, err)
+
+	require.True(t, bytes.HasPrefix(buff[:n], pathChallenge))
+
+	_, err = spoofer.WriteTo(append(append([]byte{}, pathResponse...), buff[len(pathChallenge):n]...), listenAddr)
+
+	require.NoError(t, err)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	require.Equal(t, current.String(), rebinding.remoteAddr().String())
+
+	raddr, err := nat.rebind()
+
+	require.NoError(t, err)
+
+	data := make([]byte, 16*1024)
+
+	rand.New(rand.NewSource(3)).Read(data)
+
+	go func() {
+		stream, err := dialed.OpenStream()
+
+		if err != nil {
+			return
+		}
+
+		stream.Write(data)
+		stream.Close()
+	}()
+
+	// the session of the conv follows the peer to its new port
+	stream, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	received, err := ioutil.ReadAll(stream)
+
+	require.NoError(t, err)
+
+	require.True(t, bytes.Equal(data, received))
+
+	require.Equal(t, raddr.String(), rebinding.remoteAddr().String())
+
+	stream, err = accepted.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = stream.Write(data)
+
+	require.NoError(t, err)
+
+	stream.Close()
+
+	stream, err = dialed.AcceptStream()
+
+	require.NoError(t, err)
+
+	received, err = ioutil.ReadAll(stream)
+
+	require.NoError(t, err)
+
+	require.True(t, bytes.Equal(data, received))
+
+	// plain and WithSecurity connections don't rebind, they have no path key
+	_, accepted = makeConnPair(t, WithPlaintext(), WithNATRebinding())
+
+	require.Nil(t, accepted.(*kcpCapableConn).rebinding)
+}
+
+func TestMigration(t *testing.T) {
+	dialed, accepted := makeConnPairWith(t, []Option{WithTLS(), WithNATRebinding()}, []Option{WithTLS(), WithMigration()})
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	data := make([]byte, 32*1024)
+
+	rand.New(rand.NewSource(4)).Read(data)
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = stream.Write(data[:16*1024])
+
+	require.NoError(t, err)
+
+	remote, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	received := make([]byte, len(data))
+
+	_, err = io.ReadFull(remote, received[:16*1024])
+
+	require.NoError(t, err)
+
+	migration := dialed.(*kcpCapableConn).migration
+
+	port := migration.LocalAddr().(*net.UDPAddr).Port
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, dialed.Migrate(ctx))
+
+	require.NotEqual(t, port, migration.LocalAddr().(*net.UDPAddr).Port)
+
+	// the stream goes on over the new socket
+	_, err = stream.Write(data[16*1024:])
+
+	require.NoError(t, err)
+
+	stream.Close()
+
+	_, err = io.ReadFull(remote, received[16*1024:])
+
+	require.NoError(t, err)
+
+	require.True(t, bytes.Equal(data, received))
+
+	require.Equal(t, migration.LocalAddr().(*net.UDPAddr).Port, accepted.(*kcpCapableConn).rebinding.remoteAddr().(*net.UDPAddr).Port)
+
+	require.True(t, errors.Is(accepted.Migrate(ctx), ErrMigration))
+
+	// the new address of a validating listener echoes a cookie first
+	dialed, accepted = makeConnPairWith(t, []Option{WithTLS(), WithNATRebinding(), WithAddressValidation()}, []Option{WithTLS(), WithMigration(), WithAddressValidation()})
+
+	require.NoError(t, dialed.Migrate(ctx))
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	// listeners without nat rebinding don't answer the challenge
+	dialed, _ = makeConnPair(t, WithTLS(), WithMigration())
+
+	short, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.True(t, errors.Is(dialed.Migrate(short), ErrMigration))
+
+	// only the errors of a changed path migrate, the writes fail once the migration failed
+	dialed, _ = makeConnPairWith(t, nil, []Option{WithTLS(), WithMigration(), WithHandshakeTimeout(time.Second)})
+
+	migration = dialed.(*kcpCapableConn).migration
+
+	socket := migration.current()
+
+	raddr := migration.raddr
+
+	unreachable := &failingConn{PacketConn: socket.packetConn, err: &net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.ENETUNREACH)}}
+
+	migration.socket.Store(&migrationSocket{udpConn: socket.udpConn, packetConn: unreachable})
+
+	n, err := migration.WriteTo([]byte("packet"), raddr)
+
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+
+	require.Eventually(t, func() bool {
+		_, err := migration.WriteTo([]byte("packet"), raddr)
+		return errors.Is(err, ErrMigration)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	denied := &failingConn{PacketConn: socket.packetConn, err: &net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.EACCES)}}
+
+	migration.socket.Store(&migrationSocket{udpConn: socket.udpConn, packetConn: denied})
+
+	_, err = migration.WriteTo([]byte("packet"), raddr)
+
+	require.False(t, pathChanged(err))
+	require.False(t, errors.Is(err, ErrMigration))
+	require.True(t, pathChanged(unreachable.err))
+}
+
+type failingConn struct {
+	net.PacketConn
+	err error
+}
+
+func (conn *failingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return 0, conn.err
+}
+
+func TestSetIdentity(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey3, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 2048)
+
+	require.NoError(t, err)
+
+	dialed, accepted := makeConnPairKeys(t, context.Background(), prikey1, prikey2, []Option{WithTLS()}, []Option{WithTLS()})
+
+	listener := accepted.Transport().(Transport)
+
+	require.NoError(t, listener.SetIdentity(prikey3))
+
+	// the established connections keep the old key
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	lc := accepted.(*kcpCapableConn).kcp.root().lifecycle
+
+	var l *kcpListener
+
+	lc.Lock()
+	for listener := range lc.listeners {
+		l = listener
+	}
+	lc.Unlock()
+
+	raddr, err := toKcpMultiaddr(l.Addr())
+
+	require.NoError(t, err)
+
+	acceptedCh := make(chan transport.CapableConn, 1)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err == nil {
+				acceptedCh <- conn
+				return
+			}
+
+			if errors.Is(err, ErrClosed) {
+				return
+			}
+		}
+	}()
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	p3, err := peer.IDFromPrivateKey(prikey3)
+
+	require.NoError(t, err)
+
+	// the new connections use the new key
+	_, err = dialed.Transport().Dial(context.Background(), raddr, p1)
+
+	var handshakeErr *HandshakeError
+
+	require.True(t, errors.As(err, &handshakeErr))
+	require.Equal(t, HandshakePeerMismatch, handshakeErr.Kind)
+
+	conn, err := dialed.Transport().Dial(context.Background(), raddr, p3)
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	require.Equal(t, p3, conn.RemotePeer())
+
+	select {
+	case conn := <-acceptedCh:
+		require.Equal(t, p3, conn.LocalPeer())
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "connection to the new key not accepted")
+	}
+
+	// the keys of other security transports can't be rotated
+	security, err := noise.New(prikey1)
+
+	require.NoError(t, err)
+
+	tpt, err := New(prikey1, WithSecurity(security))
+
+	require.NoError(t, err)
+
+	require.True(t, errors.Is(tpt.(Transport).SetIdentity(prikey3), ErrOption))
+}
+
+func TestMuxers(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithMuxers())
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	_, err = New(prikey, WithMuxers("/yamux/1.0.0"))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	dialed, accepted := makeConnPair(t, WithTLS(), WithMuxers(MuxerYamux, MuxerSmuxV2))
+
+	require.True(t, dialed.(*kcpCapableConn).kcp.yamux)
+	require.True(t, accepted.(*kcpCapableConn).kcp.yamux)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	// the listener's preference wins
+	dialed, accepted = makeConnPairWith(t, []Option{WithTLS(), WithMuxers(MuxerSmuxV2, MuxerYamux)}, []Option{WithTLS(), WithMuxers(MuxerYamux, MuxerSmuxV2)})
+
+	require.False(t, dialed.(*kcpCapableConn).kcp.yamux)
+	require.Equal(t, 2, dialed.(*kcpCapableConn).kcp.smuxVersion)
+	require.Equal(t, 2, accepted.(*kcpCapableConn).kcp.smuxVersion)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	// peers without a common muxer use smux v1
+	dialed, accepted = makeConnPairWith(t, []Option{WithTLS(), WithMuxers(MuxerYamux)}, []Option{WithTLS()})
+
+	require.False(t, dialed.(*kcpCapableConn).kcp.yamux)
+	require.False(t, accepted.(*kcpCapableConn).kcp.yamux)
+	require.Equal(t, 1, dialed.(*kcpCapableConn).kcp.smuxVersion)
+	require.Equal(t, 1, accepted.(*kcpCapableConn).kcp.smuxVersion)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+}
+
+func TestMuxer(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithMuxer("quic"))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	// connections without alpn use the muxer too
+	dialed, accepted := makeConnPair(t, WithPlaintext(), WithMuxer("yamux"))
+
+	require.True(t, dialed.(*kcpCapableConn).kcp.yamux)
+	require.True(t, accepted.(*kcpCapableConn).kcp.yamux)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	dialed, accepted = makeConnPair(t, WithTLS(), WithMuxer("yamux"))
+
+	require.True(t, dialed.(*kcpCapableConn).kcp.yamux)
+	require.True(t, accepted.(*kcpCapableConn).kcp.yamux)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	dialed, accepted = makeConnPair(t, WithTLS(), WithMuxer("yamux"), WithMuxer("smux"))
+
+	require.False(t, dialed.(*kcpCapableConn).kcp.yamux)
+	require.Equal(t, 1, accepted.(*kcpCapableConn).kcp.smuxVersion)
+}
+
+func TestMplex(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithTLS(), WithMuxers(MuxerMplex, MuxerYamux))
+
+	require.True(t, dialed.(*kcpCapableConn).kcp.mplex)
+	require.True(t, accepted.(*kcpCapableConn).kcp.mplex)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	dialed, accepted = makeConnPair(t, WithPlaintext(), WithMuxer("mplex"), WithCompression())
+
+	require.True(t, dialed.(*kcpCapableConn).kcp.mplex)
+	require.False(t, accepted.(*kcpCapableConn).kcp.yamux)
+
+	requireTransfer(t, dialed, accepted, 16*1024)
+
+	// a later muxer option replaces mplex
+	dialed, _ = makeConnPair(t, WithPlaintext(), WithMuxer("mplex"), WithMuxer("yamux"))
+
+	require.False(t, dialed.(*kcpCapableConn).kcp.mplex)
+	require.True(t, dialed.(*kcpCapableConn).kcp.yamux)
+}
+
+func TestTLSProfile(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithTLSCurves())
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	_, err = New(prikey1, WithTLSCipherSuites())
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	_, err = New(prikey1, WithTLSCipherSuites(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	dialed, accepted := makeConnPair(t, WithTLS(), WithTLSCurves(tls.CurveP256))
+
+	requireTransfer(t, dialed, accepted, 1024)
+
+	state := dialed.(*kcpCapableConn).conn.(*tls.Conn).ConnectionState()
+
+	require.Equal(t, uint16(tls.VersionTLS13), state.Version)
+
+	// the suite negotiated by the peers is only accepted if allowed
+	dialed, accepted = makeConnPair(t, WithTLS(), WithTLSCipherSuites(state.CipherSuite))
+
+	requireTransfer(t, dialed, accepted, 1024)
+
+	other := uint16(tls.TLS_CHACHA20_POLY1305_SHA256)
+
+	if state.CipherSuite == other {
+		other = tls.TLS_AES_128_GCM_SHA256
+	}
+
+	dial := func(listenerOptions []Option, dialerOptions []Option) error {
+		kcp1, err := New(prikey1, listenerOptions...)
+
+		require.NoError(t, err)
+
+		kcp2, err := New(prikey2, dialerOptions...)
+
+		require.NoError(t, err)
+
+		l, err := kcp1.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+		require.NoError(t, err)
+
+		defer l.(*kcpListener).close()
+
+		go l.Accept()
+
+		raddr, err := toKcpMultiaddr(l.Addr())
+
+		require.NoError(t, err)
+
+		p1, err := peer.IDFromPrivateKey(prikey1)
+
+		require.NoError(t, err)
+
+		conn, err := kcp2.Dial(context.Background(), raddr, p1)
+
+		if err == nil {
+			conn.Close()
+		}
+
+		return err
+	}
+
+	require.Error(t, dial([]Option{WithTLS()}, []Option{WithTLS(), WithTLSCipherSuites(other)}))
+
+	// peers without a common curve can't connect
+	require.Error(t, dial([]Option{WithTLS(), WithTLSCurves(tls.CurveP384)}, []Option{WithTLS(), WithTLSCurves(tls.X25519)}))
+}
+
+func TestRequireSecurity(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithRequireSecurity())
+
+	require.True(t, errors.Is(err, ErrInsecure))
+
+	_, err = New(prikey, WithRequireSecurity(), WithPlaintext())
+
+	require.True(t, errors.Is(err, ErrInsecure))
+
+	_, err = New(prikey, WithRequireSecurity(), WithTLS())
+
+	require.NoError(t, err)
+
+	security, err := noise.New(prikey)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithSecurity(security), WithRequireSecurity())
+
+	require.NoError(t, err)
+}
+
+func TestVerifyPeerCertificate(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithVerifyPeerCertificate(nil))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	p2, err := peer.IDFromPrivateKey(prikey2)
+
+	require.NoError(t, err)
+
+	verified := make(chan peer.ID, 2)
+
+	verify := func(p peer.ID, chain []*x509.Certificate) error {
+		require.Len(t, chain, 1)
+
+		verified <- p
+
+		return nil
+	}
+
+	dialed, accepted := makeConnPairKeys(t, context.Background(), prikey1, prikey2, []Option{WithTLS(), WithVerifyPeerCertificate(verify)}, []Option{WithTLS(), WithVerifyPeerCertificate(verify)})
+
+	requireTransfer(t, dialed, accepted, 1024)
+
+	require.ElementsMatch(t, []peer.ID{p1, p2}, []peer.ID{<-verified, <-verified})
+
+	// the rejected certificates fail the handshake
+	kcp1, err := New(prikey1, WithTLS())
+
+	require.NoError(t, err)
+
+	kcp2, err := New(prikey2, WithTLS(), WithVerifyPeerCertificate(func(p peer.ID, chain []*x509.Certificate) error {
+		return fmt.Errorf("issued too late")
+	}))
+
+	require.NoError(t, err)
+
+	l, err := kcp1.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	defer l.(*kcpListener).close()
+
+	go l.Accept()
+
+	raddr, err := toKcpMultiaddr(l.Addr())
+
+	require.NoError(t, err)
+
+	_, err = kcp2.Dial(context.Background(), raddr, p1)
+
+	var handshakeErr *HandshakeError
+
+	require.True(t, errors.As(err, &handshakeErr))
+	require.Equal(t, HandshakeCertInvalid, handshakeErr.Kind)
+}
+
+func TestTLSKeyLog(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithTLSKeyLog(nil))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	var listenerLog, dialerLog bytes.Buffer
+
+	dialed, accepted := makeConnPairWith(t, []Option{WithTLS(), WithTLSKeyLog(&listenerLog)}, []Option{WithTLS(), WithTLSKeyLog(&dialerLog)})
+
+	requireTransfer(t, dialed, accepted, 1024)
+
+	require.Contains(t, dialerLog.String(), "CLIENT_TRAFFIC_SECRET_0")
+	require.Contains(t, listenerLog.String(), "SERVER_TRAFFIC_SECRET_0")
+}
+
+func TestConnState(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithTLS(), WithMuxers(MuxerYamux))
+
+	require.Equal(t, network.DirOutbound, dialed.Stat().Direction)
+	require.Equal(t, network.DirInbound, accepted.Stat().Direction)
+
+	stats := dialed.Stats()
+
+	require.Equal(t, network.DirOutbound, stats.Direction)
+	require.False(t, stats.Opened.IsZero())
+	require.Equal(t, 1, stats.NumStreams)
+
+	require.Equal(t, ConnState{Transport: "kcp", Security: tlsp2p.ID, StreamMultiplexer: MuxerYamux}, dialed.ConnState())
+	require.Equal(t, ConnState{Transport: "kcp", Security: tlsp2p.ID, StreamMultiplexer: MuxerYamux}, accepted.ConnState())
+
+	dialed, accepted = makeConnPair(t, WithPlaintext())
+
+	require.Equal(t, ConnState{Transport: "kcp", Security: insecure.ID, StreamMultiplexer: MuxerSmuxV1}, dialed.ConnState())
+	require.Equal(t, ConnState{Transport: "kcp", Security: insecure.ID, StreamMultiplexer: MuxerSmuxV1}, accepted.ConnState())
+}
+
+// testScope records the reservations of a connection
+type testScope struct {
+	rcmgr  *testResourceManager
+	peer   peer.ID
+	memory int
+}
+
+func (s *testScope) ReserveMemory(size int, prio uint8) error {
+	s.rcmgr.Lock()
+	defer s.rcmgr.Unlock()
+
+	s.memory += size
+
+	return nil
+}
+
+func (s *testScope) ReleaseMemory(size int) {
+	s.rcmgr.Lock()
+	defer s.rcmgr.Unlock()
+
+	s.memory -= size
+}
+
+func (s *testScope) SetPeer(p peer.ID) error {
+	s.rcmgr.Lock()
+	defer s.rcmgr.Unlock()
+
+	s.peer = p
+
+	return nil
+}
+
+func (s *testScope) Done() {
+	s.rcmgr.Lock()
+	defer s.rcmgr.Unlock()
+
+	delete(s.rcmgr.scopes, s)
+	delete(s.rcmgr.streams, s)
+}
+
+// testResourceManager limits the number of open connections and streams
+type testResourceManager struct {
+	sync.Mutex
+	maxConns   int
+	maxStreams int
+	scopes     map[*testScope]network.Direction
+	streams    map[*testScope]network.Direction
+}
+
+func newTestResourceManager(maxConns int) *testResourceManager {
+	return &testResourceManager{
+		maxConns:   maxConns,
+		maxStreams: 1 << 16,
+		scopes:     make(map[*testScope]network.Direction),
+		streams:    make(map[*testScope]network.Direction),
+	}
+}
+
+func (rcmgr *testResourceManager) OpenStream(p peer.ID, dir network.Direction) (StreamScope, error) {
+	rcmgr.Lock()
+	defer rcmgr.Unlock()
+
+	if len(rcmgr.streams) >= rcmgr.maxStreams {
+		return nil, fmt.Errorf("stream limit exceeded")
+	}
+
+	scope := &testScope{rcmgr: rcmgr, peer: p}
+
+	rcmgr.streams[scope] = dir
+
+	return scope, nil
+}
+
+func (rcmgr *testResourceManager) openStreams() []*testScope {
+	rcmgr.Lock()
+	defer rcmgr.Unlock()
+
+	var scopes []*testScope
+
+	for scope := range rcmgr.streams {
+		scopes = append(scopes, scope)
+	}
+
+	return scopes
+}
+
+func (rcmgr *testResourceManager) OpenConnection(dir network.Direction, usefd bool, endpoint multiaddr.Multiaddr) (ConnScope, error) {
+	rcmgr.Lock()
+	defer rcmgr.Unlock()
+
+	if len(rcmgr.scopes) >= rcmgr.maxConns {
+		return nil, fmt.Errorf("connection limit exceeded")
+	}
+
+	scope := &testScope{rcmgr: rcmgr}
+
+	rcmgr.scopes[scope] = dir
+
+	return scope, nil
+}
+
+func (rcmgr *testResourceManager) open() []*testScope {
+	rcmgr.Lock()
+	defer rcmgr.Unlock()
+
+	var scopes []*testScope
+
+	for scope := range rcmgr.scopes {
+		scopes = append(scopes, scope)
+	}
+
+	return scopes
+}
+
+func TestResourceManager(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithResourceManager(nil))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	listenerRcmgr := newTestResourceManager(1)
+	dialerRcmgr := newTestResourceManager(1)
+
+	dialed, accepted := makeConnPairWith(t, []Option{WithTLS(), WithResourceManager(listenerRcmgr)}, []Option{WithTLS(), WithResourceManager(dialerRcmgr)})
+
+	scopes := dialerRcmgr.open()
+
+	require.Len(t, scopes, 1)
+	require.Equal(t, dialed.RemotePeer(), scopes[0].peer)
+	require.Equal(t, smux.DefaultConfig().MaxReceiveBuffer, scopes[0].memory)
+
+	scopes = listenerRcmgr.open()
+
+	require.Len(t, scopes, 1)
+	require.Equal(t, accepted.RemotePeer(), scopes[0].peer)
+
+	// the dialer is out of connections
+	_, err = dialed.Transport().Dial(context.Background(), dialed.RemoteMultiaddr(), dialed.RemotePeer())
+
+	require.Error(t, err)
+
+	require.NoError(t, dialed.Close())
+	require.NoError(t, accepted.Close())
+
+	require.Empty(t, dialerRcmgr.open())
+	require.Empty(t, listenerRcmgr.open())
+}
+
+func TestStreamResourceManager(t *testing.T) {
+	listenerRcmgr := newTestResourceManager(1)
+	dialerRcmgr := newTestResourceManager(1)
+
+	dialed, accepted, _ := dialConnPair(t, []Option{WithTLS(), WithResourceManager(listenerRcmgr)}, []Option{WithTLS(), WithResourceManager(dialerRcmgr)})
+
+	// the stream which established the session
+	scopes := dialerRcmgr.openStreams()
+
+	require.Len(t, scopes, 1)
+	require.Equal(t, dialed.RemotePeer(), scopes[0].peer)
+	require.Equal(t, smux.DefaultConfig().MaxStreamBuffer, scopes[0].memory)
+
+	stream, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	require.Len(t, listenerRcmgr.openStreams(), 1)
+
+	require.NoError(t, stream.Close())
+
+	require.Empty(t, listenerRcmgr.openStreams())
+
+	// the streams beyond the limit fail to be opened
+	dialerRcmgr.Lock()
+	dialerRcmgr.maxStreams = 1
+	dialerRcmgr.Unlock()
+
+	_, err = dialed.OpenStream()
+
+	require.Error(t, err)
+
+	// the streams beyond the limit of the listener are closed when accepted
+	listenerRcmgr.Lock()
+	listenerRcmgr.maxStreams = 0
+	listenerRcmgr.Unlock()
+
+	dialerRcmgr.Lock()
+	dialerRcmgr.maxStreams = 2
+	dialerRcmgr.Unlock()
+
+	rejected, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = rejected.Write([]byte{1})
+
+	require.NoError(t, err)
+
+	go accepted.AcceptStream()
+
+	_, err = rejected.Read(make([]byte, 1))
+
+	require.Equal(t, io.EOF, err)
+
+	require.NoError(t, rejected.Reset())
+
+	require.Len(t, dialerRcmgr.openStreams(), 1)
+}
+
+func TestHalfClose(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithTLS(), WithMuxers(MuxerYamux))
+
+	request, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = request.Write([]byte("request"))
+
+	require.NoError(t, err)
+
+	require.NoError(t, request.(Stream).CloseWrite())
+
+	_, err = request.Write([]byte("request"))
+
+	require.Error(t, err)
+
+	response, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	received, err := ioutil.ReadAll(response)
+
+	require.NoError(t, err)
+	require.Equal(t, "request", string(received))
+
+	_, err = response.Write([]byte("response"))
+
+	require.NoError(t, err)
+
+	require.NoError(t, response.Close())
+
+	received, err = ioutil.ReadAll(request)
+
+	require.NoError(t, err)
+	require.Equal(t, "response", string(received))
+
+	require.NoError(t, request.(Stream).CloseRead())
+
+	_, err = request.Read(make([]byte, 1))
+
+	require.Equal(t, io.ErrClosedPipe, err)
+
+	// the data sent to a stream closed for reading is discarded, beyond the yamux window
+	request, response = openStream(t, dialed, accepted)
+
+	require.NoError(t, request.(Stream).CloseRead())
+
+	require.NoError(t, response.SetWriteDeadline(time.Now().Add(10*time.Second)))
+
+	_, err = response.Write(make([]byte, 1024*1024))
+
+	require.NoError(t, err)
+
+	// smux has no half-close
+	dialed, _ = makeConnPair(t)
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	require.True(t, errors.Is(stream.(Stream).CloseWrite(), ErrHalfClose))
+	require.True(t, errors.Is(stream.(Stream).CloseRead(), ErrHalfClose))
+}
+
+func TestStreamReset(t *testing.T) {
+	for _, options := range [][]Option{{WithTLS()}, {WithTLS(), WithMuxers(MuxerYamux)}, {WithTLS(), WithMuxers(MuxerMplex)}} {
+		dialed, accepted := makeConnPair(t, options...)
+
+		stream, err := dialed.OpenStream()
+
+		require.NoError(t, err)
+
+		_, err = stream.Write([]byte{1})
+
+		require.NoError(t, err)
+
+		remote, err := accepted.AcceptStream()
+
+		require.NoError(t, err)
+
+		_, err = remote.Read(make([]byte, 1))
+
+		require.NoError(t, err)
+
+		// the reset unblocks the pending read
+		read := make(chan error, 1)
+
+		go func() {
+			_, err := stream.Read(make([]byte, 1))
+			read <- err
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+
+		require.NoError(t, stream.Reset())
+
+		select {
+		case err := <-read:
+			require.Equal(t, mux.ErrReset, err)
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "read isn't unblocked by reset")
+		}
+
+		_, err = stream.Write([]byte{1})
+
+		require.Equal(t, mux.ErrReset, err)
+
+		// the remote peer is notified, smux closes the stream instead and the remote peer
+		// reads the end of the stream
+		_, err = remote.Read(make([]byte, 1))
+
+		if _, ok := stream.(*kcpStream).muxStream.(interface{ Reset() error }); ok {
+			require.Equal(t, mux.ErrReset, err)
+		} else {
+			require.Equal(t, io.EOF, err)
+		}
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithTLS())
+
+	accepting := make(chan error, 1)
+
+	go func() {
+		_, err := dialed.AcceptStream()
+		accepting <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, dialed.Close())
+
+	select {
+	case err := <-accepting:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "AcceptStream isn't unblocked by Close")
+	}
+
+	conn := dialed.(*kcpCapableConn)
+
+	_, err := conn.udpSession.Write([]byte{1})
+
+	require.Error(t, err)
+
+	// the udp port is released
+	_, err = conn.socket.WriteTo([]byte{1}, conn.udpSession.RemoteAddr())
+
+	require.Error(t, err)
+
+	require.NoError(t, accepted.Close())
+}
+
+func TestIsClosed(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithTLS())
+
+	require.False(t, dialed.IsClosed())
+	require.False(t, accepted.IsClosed())
+
+	require.NoError(t, dialed.Close())
+
+	require.True(t, dialed.IsClosed())
+
+	// the tls close alert reaches the remote peer
+	require.Eventually(t, accepted.IsClosed, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestListenerClose(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	kcp, err := New(prikey, WithTLS())
+
+	require.NoError(t, err)
+
+	l, err := kcp.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	accepting := make(chan error, 1)
+
+	go func() {
+		_, err := l.Accept()
+		accepting <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, l.Close())
+
+	select {
+	case err := <-accepting:
+		require.Equal(t, ErrClosed, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "Accept isn't unblocked by Close")
+	}
+
+	// the udp port is released
+	udpConn, err := net.ListenUDP("udp4", l.Addr().(*net.UDPAddr))
+
+	require.NoError(t, err)
+
+	udpConn.Close()
+
+	// the accepted connections keep the udp port until they are closed
+	dialed, accepted := makeConnPair(t, WithTLS())
+
+	laddr := accepted.(*kcpCapableConn).socket.LocalAddr().(*net.UDPAddr)
+
+	lc := accepted.(*kcpCapableConn).kcp.lifecycle
+
+	lc.Lock()
+
+	var listeners []*kcpListener
+
+	for l := range lc.listeners {
+		listeners = append(listeners, l)
+	}
+
+	lc.Unlock()
+
+	for _, l := range listeners {
+		require.NoError(t, l.Close())
+	}
+
+	requireTransfer(t, dialed, accepted, 1024)
+
+	_, err = net.ListenUDP("udp4", laddr)
+
+	require.Error(t, err)
+
+	require.NoError(t, accepted.Close())
+
+	udpConn, err = net.ListenUDP("udp4", laddr)
+
+	require.NoError(t, err)
+
+	udpConn.Close()
+}
+
+func TestTransportClose(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithTLS())
+
+	require.NoError(t, accepted.Transport().(Transport).Close())
+
+	require.True(t, accepted.IsClosed())
+
+	_, err := accepted.Transport().Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.Equal(t, ErrClosed, err)
+
+	// the connections are drained until the context is done
+	tpt := dialed.Transport().(Transport)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	require.True(t, errors.Is(tpt.Shutdown(ctx), context.DeadlineExceeded))
+
+	require.True(t, dialed.IsClosed())
+
+	_, err = tpt.Dial(context.Background(), accepted.LocalMultiaddr(), accepted.LocalPeer())
+
+	require.Equal(t, ErrClosed, err)
+
+	// the connections closed by the remote peer are drained
+	dialed, accepted = makeConnPair(t, WithTLS())
+
+	tpt = dialed.Transport().(Transport)
+
+	require.NoError(t, accepted.Close())
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, tpt.Shutdown(ctx))
+
+	require.True(t, dialed.IsClosed())
+}
+
+func TestDialCancel(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	kcp, err := New(prikey2, WithTLS(), WithHandshakeTimeout(time.Minute))
+
+	require.NoError(t, err)
+
+	// a black hole which never answers the handshake
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	require.NoError(t, err)
+
+	defer silent.Close()
+
+	raddr, err := toKcpMultiaddr(silent.LocalAddr())
+
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+
+	_, err = kcp.Dial(ctx, raddr, p1)
+
+	require.True(t, errors.Is(err, context.Canceled))
+	require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+	// a cancelled context doesn't dial at all
+	_, err = kcp.Dial(ctx, raddr, p1)
+
+	require.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestDialDeadline(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	kcp, err := New(prikey2, WithTLS(), WithHandshakeTimeout(time.Minute))
+
+	require.NoError(t, err)
+
+	// a black hole which never answers the handshake
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	require.NoError(t, err)
+
+	defer silent.Close()
+
+	raddr, err := toKcpMultiaddr(silent.LocalAddr())
+
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err = kcp.Dial(ctx, raddr, p1)
+
+	require.Error(t, err)
+	require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestAcceptHandshakeFailure(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	listener, err := New(prikey1, WithTLS(), WithHandshakeTimeout(500*time.Millisecond))
+
+	require.NoError(t, err)
+
+	l, err := listener.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	defer l.(*kcpListener).close()
+
+	accepted := make(chan transport.CapableConn, 1)
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	raddr, err := toKcpMultiaddr(l.Addr())
+
+	require.NoError(t, err)
+
+	// a peer which doesn't speak tls fails its handshake
+	plain, err := New(prikey2, WithPlaintext())
+
+	require.NoError(t, err)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = plain.Dial(ctx, raddr, p1)
+
+	require.Error(t, err)
+
+	// and the next one is accepted
+	dialer, err := New(prikey2, WithTLS())
+
+	require.NoError(t, err)
+
+	dialed, err := dialer.Dial(context.Background(), raddr, p1)
+
+	require.NoError(t, err)
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = stream.Write([]byte{1})
+
+	require.NoError(t, err)
+
+	select {
+	case conn := <-accepted:
+		require.Equal(t, dialed.LocalPeer(), conn.RemotePeer())
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "listener stopped accepting")
+	}
+}
+
+func TestParallelHandshakes(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithMaxHandshakes(0))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	listener, err := New(prikey1, WithTLS(), WithHandshakeTimeout(time.Minute))
+
+	require.NoError(t, err)
+
+	l, err := listener.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	defer l.(*kcpListener).close()
+
+	accepted := make(chan transport.CapableConn, 1)
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	laddr, err := net.ResolveUDPAddr("udp", l.(*kcpListener).listener.Addr().String())
+
+	require.NoError(t, err)
+
+	// a peer which opens a kcp session by a window probe and goes silent
+	silent, err := net.DialUDP("udp", nil, laddr)
+
+	require.NoError(t, err)
+
+	defer silent.Close()
+
+	probe := make([]byte, 24)
+	probe[0] = 1
+	probe[4] = 83
+
+	_, err = silent.Write(probe)
+
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// doesn't wait for the silent peer's handshake
+	dialer, err := New(prikey2, WithTLS())
+
+	require.NoError(t, err)
+
+	raddr, err := toKcpMultiaddr(l.Addr())
+
+	require.NoError(t, err)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dialed, err := dialer.Dial(ctx, raddr, p1)
+
+	require.NoError(t, err)
+
+	select {
+	case conn := <-accepted:
+		require.Equal(t, dialed.LocalPeer(), conn.RemotePeer())
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "handshake blocked by the silent peer")
+	}
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithAcceptBacklog(0, BacklogRefuseNew))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	_, err = New(prikey1, WithAcceptBacklog(1, BacklogPolicy(-1)))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	for _, policy := range []BacklogPolicy{BacklogRefuseNew, BacklogDropOldest} {
+		listener, err := New(prikey1, WithTLS(), WithAcceptBacklog(1, policy))
+
+		require.NoError(t, err)
+
+		l, err := listener.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+		require.NoError(t, err)
+
+		raddr, err := toKcpMultiaddr(l.Addr())
+
+		require.NoError(t, err)
+
+		dialer, err := New(prikey2, WithTLS())
+
+		require.NoError(t, err)
+
+		dial := func() transport.CapableConn {
+			conn, err := dialer.Dial(context.Background(), raddr, p1)
+
+			require.NoError(t, err)
+
+			return conn
+		}
+
+		// the first Accept starts the handshakes
+		accepting := make(chan transport.CapableConn, 1)
+
+		go func() {
+			conn, err := l.Accept()
+
+			if err == nil {
+				accepting <- conn
+			}
+		}()
+
+		dial()
+
+		<-accepting
+
+		queued := dial()
+
+		time.Sleep(200 * time.Millisecond)
+
+		overflowed := dial()
+
+		dropped, kept := overflowed, queued
+
+		if policy == BacklogDropOldest {
+			dropped, kept = queued, overflowed
+		}
+
+		require.Eventually(t, dropped.IsClosed, 5*time.Second, 10*time.Millisecond)
+
+		require.False(t, kept.IsClosed())
+
+		conn, err := l.Accept()
+
+		require.NoError(t, err)
+		require.False(t, conn.IsClosed())
+
+		require.NoError(t, l.Close())
+	}
+}
+
+func TestProtocolCode(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithProtocolCode(0))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	_, err = New(prikey1, WithProtocolCode(multiaddr.P_QUIC))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	_, err = New(prikey1, WithProtocolCode(0x3f0001))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	options := []Option{WithProtocolCode(0x3f0001), WithProtocolName("kcp-test")}
+
+	kcp1, err := New(prikey1, options...)
+
+	require.NoError(t, err)
+
+	kcp2, err := New(prikey2, options...)
+
+	require.NoError(t, err)
+
+	require.Equal(t, []int{0x3f0001}, kcp1.Protocols())
+
+	addrs := []multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip4/127.0.0.1/udp/4001/kcp"),
+		multiaddr.StringCast("/ip4/127.0.0.1/udp/4001/kcp-test"),
+	}
+
+	require.Equal(t, addrs[1:], kcp1.(Transport).KCPAddrs(addrs))
+	require.Equal(t, addrs[:1], KCPAddrs(addrs))
+	require.False(t, kcp1.CanDial(multiaddr.StringCast("/ip4/127.0.0.1/udp/4001/kcp")))
+	require.True(t, kcp1.CanDial(multiaddr.StringCast("/ip4/127.0.0.1/udp/4001/kcp-test")))
+
+	l, err := kcp1.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp-test"))
+
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	require.Equal(t, "kcp-test", l.Multiaddr().Protocols()[2].Name)
+
+	go l.Accept()
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	dialed, err := kcp2.Dial(context.Background(), l.Multiaddr(), p1)
+
+	require.NoError(t, err)
+
+	defer dialed.Close()
+
+	require.Equal(t, "kcp-test", dialed.RemoteMultiaddr().Protocols()[2].Name)
+	require.Equal(t, "kcp-test", dialed.LocalMultiaddr().Protocols()[2].Name)
+}
+
+func TestProtocolVersions(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithProtocolVersions())
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	_, err = New(prikey, WithProtocolVersions(9))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	dialed, accepted := makeConnPair(t, WithProtocolVersions(ProtocolV1))
+
+	require.Equal(t, ProtocolV1, dialed.Version())
+	require.Equal(t, ProtocolV1, accepted.Version())
+
+	requireTransfer(t, dialed, accepted, 1024)
+
+	// tls connections confirm the negotiation
+	dialed, accepted = makeConnPair(t, WithTLS(), WithProtocolVersions(ProtocolV3, ProtocolV1))
+
+	require.Equal(t, ProtocolV3, dialed.Version())
+	require.Equal(t, ProtocolV3, accepted.Version())
+
+	requireTransfer(t, dialed, accepted, 1024)
+
+	// listeners accept the dialers which don't negotiate
+	dialed, accepted = makeConnPairWith(t, []Option{WithProtocolVersions(ProtocolV1)}, nil)
+
+	require.Equal(t, ProtocolV1, dialed.Version())
+	require.Equal(t, ProtocolV1, accepted.Version())
+
+	requireTransfer(t, dialed, accepted, 1024)
+
+	// a dialer offering only unknown versions is refused
+	listener := &kcpTransport{versions: []int{ProtocolV1}}
+
+	local, remote := net.Pipe()
+
+	defer local.Close()
+	defer remote.Close()
+
+	go remote.Write(append(append([]byte{}, versionMagic...), 1, 2))
+
+	replied := make(chan []byte, 1)
+
+	go func() {
+		reply := make([]byte, len(versionMagic)+1)
+		io.ReadFull(remote, reply)
+		replied <- reply
+	}()
+
+	_, _, _, err = listener.acceptVersion(local, time.Time{})
+
+	require.True(t, errors.Is(err, ErrVersion))
+
+	require.Equal(t, append(append([]byte{}, versionMagic...), 0), <-replied)
+
+	// the dialers which wait for the listener to speak first fall back to ProtocolV1
+	local, remote = net.Pipe()
+
+	defer local.Close()
+	defer remote.Close()
+
+	conn, version, transcript, err := listener.acceptVersion(local, time.Now().Add(5*time.Second))
+
+	require.NoError(t, err)
+	require.Equal(t, ProtocolV1, version)
+	require.Nil(t, transcript)
+
+	go remote.Write([]byte("hello"))
+
+	buf := make([]byte, 5)
+
+	_, err = io.ReadFull(conn, buf)
+
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// tls connections fail when the negotiation was tampered with
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	identity1, err := tlsp2p.NewIdentity(prikey1)
+
+	require.NoError(t, err)
+
+	identity2, err := tlsp2p.NewIdentity(prikey2)
+
+	require.NoError(t, err)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	// tcp buffers the macs both peers write before reading
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	require.NoError(t, err)
+
+	defer tcpListener.Close()
+
+	confirmed := make(chan error, 1)
+
+	go func() {
+		conn, err := tcpListener.Accept()
+
+		if err != nil {
+			confirmed <- err
+			return
+		}
+
+		defer conn.Close()
+
+		conf, _ := identity1.ConfigForAny()
+
+		server := tls.Server(conn, conf)
+
+		err = server.Handshake()
+
+		if err == nil {
+			err = confirmVersion(server, append(append([]byte("/kcp\x01\x03"), versionMagic...), ProtocolV3))
+		}
+
+		confirmed <- err
+	}()
+
+	tcpConn, err := net.Dial("tcp", tcpListener.Addr().String())
+
+	require.NoError(t, err)
+
+	defer tcpConn.Close()
+
+	conf, _ := identity2.ConfigForPeer(p1)
+
+	client := tls.Client(tcpConn, conf)
+
+	require.NoError(t, client.Handshake())
+
+	// the reply was rewritten to ProtocolV1
+	err = confirmVersion(client, append(append([]byte("/kcp\x01\x03"), versionMagic...), ProtocolV1))
+
+	require.True(t, errors.Is(err, ErrVersion))
+	require.True(t, errors.Is(<-confirmed, ErrVersion))
+}
+
+func TestClientSessionID(t *testing.T) {
+	dialed, accepted := makeConnPair(t, WithProtocolVersions(ProtocolV3), WithClientSessionID())
+
+	require.Len(t, dialed.ClientSessionID(), 16)
+	require.Equal(t, dialed.ClientSessionID(), accepted.ClientSessionID())
+
+	requireTransfer(t, dialed, accepted, 1024)
+
+	// only ProtocolV3 connections send it
+	dialed, accepted = makeConnPair(t, WithProtocolVersions(ProtocolV2), WithClientSessionID())
+
+	require.NotEmpty(t, dialed.ClientSessionID())
+	require.Empty(t, accepted.ClientSessionID())
+
+	// the retries of a failed dial share the id, until one succeeds
+	sessions := &clientSessions{ids: make(map[string]*clientSession)}
+
+	id, err := sessions.acquire("peer")
+
+	require.NoError(t, err)
+
+	sessions.release("peer", false)
+
+	retry, err := sessions.acquire("peer")
+
+	require.NoError(t, err)
+	require.Equal(t, id, retry)
+
+	other, err := sessions.acquire("other")
+
+	require.NoError(t, err)
+	require.NotEqual(t, id, other)
+
+	sessions.release("peer", true)
+
+	next, err := sessions.acquire("peer")
+
+	require.NoError(t, err)
+	require.NotEqual(t, id, next)
+}
+
+func TestWildcardListen(t *testing.T) {
+	interfaces := interfaceMultiaddrs
+
+	defer func() { interfaceMultiaddrs = interfaces }()
+
+	interfaceMultiaddrs = func() ([]multiaddr.Multiaddr, error) {
+		return []multiaddr.Multiaddr{
+			multiaddr.StringCast("/ip4/127.0.0.1"),
+			multiaddr.StringCast("/ip4/192.168.1.2"),
+			multiaddr.StringCast("/ip6/::1"),
+			multiaddr.StringCast("/ip6/fe80::1"),
+		}, nil
+	}
+
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	tpt, err := New(prikey)
+
+	require.NoError(t, err)
+
+	defer tpt.(Transport).Close()
+
+	l, err := tpt.Listen(multiaddr.StringCast("/ip4/0.0.0.0/udp/0/kcp/kcpmode/fast"))
+
+	require.NoError(t, err)
+
+	port := l.Addr().(*net.UDPAddr).Port
+
+	require.NotZero(t, port)
+	require.Equal(t, fmt.Sprintf("/ip4/0.0.0.0/udp/%d/kcp/kcpmode/fast", port), l.Multiaddr().String())
+
+	addrs, err := l.(Listener).Multiaddrs()
+
+	require.NoError(t, err)
+
+	require.Equal(t, []multiaddr.Multiaddr{
+		multiaddr.StringCast(fmt.Sprintf("/ip4/127.0.0.1/udp/%d/kcp/kcpmode/fast", port)),
+		multiaddr.StringCast(fmt.Sprintf("/ip4/192.168.1.2/udp/%d/kcp/kcpmode/fast", port)),
+	}, addrs)
+
+	l2, err := tpt.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	addrs, err = l2.(Listener).Multiaddrs()
+
+	require.NoError(t, err)
+
+	require.Equal(t, []multiaddr.Multiaddr{l2.Multiaddr()}, addrs)
+
+	addrs, err = tpt.(Transport).ListenAddrs()
+
+	require.NoError(t, err)
+
+	require.Len(t, addrs, 3)
+	require.Contains(t, addrs, l2.Multiaddr())
+}
+
+func TestListenerDemux(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithListenerDemux(nil))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	// tenants are told apart by the conv ranges of their dialers
+	tpt, err := New(prikey1, WithListenerDemux(func(conv uint32, raddr net.Addr, laddrs []multiaddr.Multiaddr) int {
+		if conv < 1000 {
+			return 0
+		}
+
+		return 1
+	}))
+
+	require.NoError(t, err)
+
+	defer tpt.(Transport).Close()
+
+	l1, err := tpt.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	l2, err := tpt.Listen(l1.Multiaddr())
+
+	require.NoError(t, err)
+
+	require.Equal(t, l1.Addr().String(), l2.Addr().String())
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	for i, l := range []transport.Listener{l1, l2} {
+		dialer, err := New(prikey2, WithConvProvider(SequentialConv(uint32(1+i*1000))))
+
+		require.NoError(t, err)
+
+		accepted := make(chan transport.CapableConn, 1)
+
+		go func(l transport.Listener) {
+			conn, err := l.Accept()
+
+			if err == nil {
+				accepted <- conn
+			}
+		}(l)
+
+		dialed, err := dialer.Dial(context.Background(), l.Multiaddr(), p1)
+
+		require.NoError(t, err)
+
+		stream, err := dialed.OpenStream()
+
+		require.NoError(t, err)
+
+		_, err = stream.Write([]byte{0})
+
+		require.NoError(t, err)
+
+		select {
+		case conn := <-accepted:
+			require.Equal(t, dialed.(Conn).Conv(), conn.(Conn).Conv())
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "session not accepted by its listener")
+		}
+	}
+
+	// the socket stays open until both listeners are closed
+	require.NoError(t, l1.Close())
+
+	l3, err := tpt.Listen(l2.Multiaddr())
+
+	require.NoError(t, err)
+
+	require.NoError(t, l2.Close())
+	require.NoError(t, l3.Close())
+
+	require.Empty(t, tpt.(*kcpTransport).lifecycle.sockets)
+}
+
+func TestDialFromListener(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	kcp1, err := New(prikey1, WithDialFromListener())
+
+	require.NoError(t, err)
+
+	defer kcp1.(Transport).Close()
+
+	kcp2, err := New(prikey2, WithDialFromListener())
+
+	require.NoError(t, err)
+
+	defer kcp2.(Transport).Close()
+
+	l1, err := kcp1.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	l2, err := kcp2.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	accepted := make(chan transport.CapableConn, 1)
+
+	go func() {
+		conn, err := l1.Accept()
+
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	dialed, err := kcp2.Dial(context.Background(), l1.Multiaddr(), p1)
+
+	require.NoError(t, err)
+
+	// the dialed peer sees the listen port of the dialer
+	require.Equal(t, l2.Multiaddr(), dialed.LocalMultiaddr())
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = stream.Write([]byte{0})
+
+	require.NoError(t, err)
+
+	conn := <-accepted
+
+	require.Equal(t, l2.Multiaddr(), conn.RemoteMultiaddr())
+
+	requireTransfer(t, dialed.(Conn), conn.(Conn), 1024)
+
+	// the listener keeps accepting sessions next to the dialed one
+	dialer, err := New(prikey1)
+
+	require.NoError(t, err)
+
+	p2, err := peer.IDFromPrivateKey(prikey2)
+
+	require.NoError(t, err)
+
+	go l2.Accept()
+
+	other, err := dialer.Dial(context.Background(), l2.Multiaddr(), p2)
+
+	require.NoError(t, err)
+
+	other.Close()
+
+	// the dialed connection keeps the socket of a closed listener open
+	require.NoError(t, l2.Close())
+
+	requireTransfer(t, dialed.(Conn), conn.(Conn), 1024)
+}
+
+func TestReusePortShards(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithReusePortShards(0))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	if !reusePortSupported {
+		t.Skip("reuse port is not supported on this platform")
+	}
+
+	for i := 0; i < 8; i++ {
+		dialed, accepted := makeConnPairWith(t, []Option{WithReusePortShards(4)}, nil)
+
+		requireTransfer(t, dialed, accepted, 1024)
+	}
+
+	tpt, err := New(prikey, WithReusePortShards(4))
+
+	require.NoError(t, err)
+
+	l, err := tpt.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	shards := l.(*kcpListener).socket.PacketConn.(*shardedConn).conns
+
+	require.Len(t, shards, 4)
+
+	for _, shard := range shards {
+		require.Equal(t, l.Addr().String(), shard.LocalAddr().String())
+	}
+
+	require.NoError(t, l.Close())
+
+	// the port is free again once all the shards are closed
+	l, err = tpt.Listen(l.Multiaddr())
+
+	require.NoError(t, err)
+
+	require.NoError(t, l.Close())
+}
+
+func TestObservedAddr(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithObservedAddrHandler(nil))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	observed := make(chan multiaddr.Multiaddr, 2)
+
+	handler := WithObservedAddrHandler(func(p peer.ID, local, addr multiaddr.Multiaddr) {
+		require.Equal(t, local, addr)
+
+		observed <- addr
+	})
+
+	options := []Option{WithProtocolVersions(ProtocolV2, ProtocolV1), handler}
+
+	dialed, accepted := makeConnPair(t, options...)
+
+	require.Equal(t, ProtocolV2, dialed.Version())
+
+	require.Equal(t, dialed.LocalMultiaddr(), dialed.ObservedAddr())
+	require.Equal(t, accepted.LocalMultiaddr(), accepted.ObservedAddr())
+
+	require.Len(t, observed, 2)
+
+	requireTransfer(t, dialed, accepted, 1024)
+
+	// ProtocolV1 connections don't exchange their observed addresses
+	dialed, accepted = makeConnPairWith(t, options, []Option{WithProtocolVersions(ProtocolV1), handler})
+
+	require.Equal(t, ProtocolV1, dialed.Version())
+
+	require.Nil(t, dialed.ObservedAddr())
+	require.Nil(t, accepted.ObservedAddr())
+}
+
+func TestHolePunch(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	tpt, err := New(prikey1)
+
+	require.NoError(t, err)
+
+	_, err = tpt.(Transport).HolePunch(context.Background(), multiaddr.StringCast("/ip4/127.0.0.1/udp/4001/kcp"), "")
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	var transports []Transport
+	var listeners []transport.Listener
+	var peers []peer.ID
+
+	for _, prikey := range []crypto.PrivKey{prikey1, prikey2} {
+		tpt, err := New(prikey, WithDialFromListener())
+
+		require.NoError(t, err)
+
+		defer tpt.(Transport).Close()
+
+		l, err := tpt.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+		require.NoError(t, err)
+
+		p, err := peer.IDFromPrivateKey(prikey)
+
+		require.NoError(t, err)
+
+		transports = append(transports, tpt.(Transport))
+		listeners = append(listeners, l)
+		peers = append(peers, p)
+	}
+
+	// the listeners accept the sessions of the hole punches only
+	for _, l := range listeners {
+		go l.Accept()
+	}
+
+	conns := make([]transport.CapableConn, 2)
+	errs := make([]error, 2)
+
+	var wg sync.WaitGroup
+
+	for i := range transports {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			conns[i], errs[i] = transports[i].HolePunch(context.Background(), listeners[1-i].Multiaddr(), peers[1-i])
+		}(i)
+	}
+
+	wg.Wait()
+
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+
+	dialer, punched := 0, 1
+
+	if peers[1] < peers[0] {
+		dialer, punched = 1, 0
+	}
+
+	require.Equal(t, network.DirOutbound, conns[dialer].(Conn).Stat().Direction)
+	require.Equal(t, network.DirInbound, conns[punched].(Conn).Stat().Direction)
+
+	require.Equal(t, listeners[dialer].Multiaddr(), conns[punched].RemoteMultiaddr())
+
+	requireTransfer(t, conns[dialer].(Conn), conns[punched].(Conn), 1024)
+}
+
+func TestRelay(t *testing.T) {
+	var transports []transport.Transport
+	var peers []peer.ID
+
+	for i := 0; i < 3; i++ {
+		prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+		require.NoError(t, err)
+
+		tpt, err := New(prikey)
+
+		require.NoError(t, err)
+
+		defer tpt.(Transport).Close()
+
+		p, err := peer.IDFromPrivateKey(prikey)
+
+		require.NoError(t, err)
+
+		transports = append(transports, tpt)
+		peers = append(peers, p)
+	}
+
+	relayListener, err := transports[0].Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	go ServeRelay(relayListener)
+
+	_, err = NewRelayTransport(nil)
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	listenRelay, err := NewRelayTransport(transports[1])
+
+	require.NoError(t, err)
+
+	require.True(t, listenRelay.Proxy())
+
+	circuit := relayListener.Multiaddr().Encapsulate(multiaddr.StringCast("/p2p/" + peers[0].Pretty() + "/p2p-circuit"))
+
+	require.True(t, listenRelay.CanDial(circuit))
+
+	require.False(t, listenRelay.CanDial(relayListener.Multiaddr()))
+
+	l, err := listenRelay.Listen(circuit)
+
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	dialRelay, err := NewRelayTransport(transports[2])
+
+	require.NoError(t, err)
+
+	// peers without reservation are unreachable through the relay
+	_, err = dialRelay.Dial(context.Background(), circuit, peers[2])
+
+	require.Error(t, err)
+
+	dialed, err := dialRelay.Dial(context.Background(), circuit, peers[1])
+
+	require.NoError(t, err)
+
+	defer dialed.Close()
+
+	accepted, err := l.Accept()
+
+	require.NoError(t, err)
+
+	require.Equal(t, peers[1], dialed.RemotePeer())
+	require.Equal(t, peers[2], accepted.RemotePeer())
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = stream.Write([]byte("hello"))
+
+	require.NoError(t, err)
+
+	remote, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+
+	_, err = io.ReadFull(remote, buf)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(buf))
+
+	// the accepted connection is lost with the reservation
+	require.NoError(t, l.Close())
+
+	require.Eventually(t, accepted.IsClosed, 5*time.Second, 10*time.Millisecond)
+}
+
+// denyRelayACL denies every reservation and connection
+type denyRelayACL struct{}
+
+func (denyRelayACL) AllowReserve(p peer.ID) bool {
+	return false
+}
+
+func (denyRelayACL) AllowConnect(src, dst peer.ID) bool {
+	return false
+}
+
+func TestRelayLimits(t *testing.T) {
+	var relays []transport.Transport
+	var peers []peer.ID
+
+	for i := 0; i < 3; i++ {
+		prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+		require.NoError(t, err)
+
+		tpt, err := New(prikey)
+
+		require.NoError(t, err)
+
+		defer tpt.(Transport).Close()
+
+		p, err := peer.IDFromPrivateKey(prikey)
+
+		require.NoError(t, err)
+
+		relay, err := NewRelayTransport(tpt)
+
+		require.NoError(t, err)
+
+		relays = append(relays, relay)
+		peers = append(peers, p)
+	}
+
+	kcp := relays[0].(*relayTransport).kcp
+
+	relayListener, err := kcp.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	require.True(t, errors.Is(ServeRelay(relayListener, WithRelayLimit(0, 1024)), ErrOption))
+	require.True(t, errors.Is(ServeRelay(relayListener, WithRelayCircuits(1, 2)), ErrOption))
+
+	go ServeRelay(relayListener, WithRelayCircuits(1, 1), WithRelayLimit(time.Minute, 64*1024))
+
+	circuit := relayListener.Multiaddr().Encapsulate(multiaddr.StringCast("/p2p/" + peers[0].Pretty() + "/p2p-circuit"))
+
+	l, err := relays[1].Listen(circuit)
+
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	dialed, err := relays[2].Dial(context.Background(), circuit, peers[1])
+
+	require.NoError(t, err)
+
+	defer dialed.Close()
+
+	accepted, err := l.Accept()
+
+	require.NoError(t, err)
+
+	// the relay is out of circuits
+	_, err = relays[2].Dial(context.Background(), circuit, peers[1])
+
+	require.True(t, errors.Is(err, ErrUnreachable))
+
+	// the relayed connection is reset once it relays more than the limit
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	go stream.Write(make([]byte, 128*1024))
+
+	remote, err := accepted.AcceptStream()
+
+	require.NoError(t, err)
+
+	received, _ := ioutil.ReadAll(remote)
+
+	require.Less(t, len(received), 128*1024)
+
+	require.Eventually(t, accepted.IsClosed, 5*time.Second, 10*time.Millisecond)
+
+	// the relays with an acl serve the allowed peers only
+	aclListener, err := kcp.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	require.True(t, errors.Is(ServeRelay(aclListener, WithRelayACL(nil)), ErrOption))
+
+	go ServeRelay(aclListener, WithRelayACL(denyRelayACL{}))
+
+	_, err = relays[1].Listen(aclListener.Multiaddr().Encapsulate(multiaddr.StringCast("/p2p/" + peers[0].Pretty() + "/p2p-circuit")))
+
+	require.True(t, errors.Is(err, ErrUnreachable))
+}
+
+func TestConnEvents(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithConnEventHandler(nil))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	events := make(chan ConnEvent, 16)
+
+	handler := WithConnEventHandler(func(event ConnEvent) {
+		events <- event
+	})
+
+	dialed, accepted := makeConnPair(t, handler)
+
+	require.NoError(t, dialed.Close())
+
+	kinds := make(map[network.Direction][]ConnEventKind)
+
+	for len(events) > 0 {
+		event := <-events
+
+		kinds[event.Direction] = append(kinds[event.Direction], event.Kind)
+
+		switch event.Direction {
+		case network.DirOutbound:
+			require.Equal(t, accepted.LocalPeer(), event.Peer)
+		case network.DirInbound:
+			require.Equal(t, dialed.LocalPeer(), event.Peer)
+		}
+
+		if event.Kind == ConnClosed {
+			require.NoError(t, event.Err)
+		}
+	}
+
+	require.Equal(t, []ConnEventKind{ConnDialStarted, ConnHandshakeCompleted, ConnClosed}, kinds[network.DirOutbound])
+	require.Equal(t, []ConnEventKind{ConnHandshakeCompleted}, kinds[network.DirInbound])
+
+	// the accepted side sees the connection lost once its muxer session dies
+	require.Eventually(t, accepted.IsClosed, 10*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, accepted.Close())
+
+	event := <-events
+
+	require.Equal(t, ConnClosed, event.Kind)
+
+	require.True(t, errors.Is(event.Err, ErrConnLost))
+}
+
+func TestBandwidthReporter(t *testing.T) {
+	prikey, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey, WithBandwidthReporter(nil))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	reporter := metrics.NewBandwidthCounter()
+
+	dialed, accepted := makeConnPair(t, WithBandwidthReporter(reporter))
+
+	requireTransfer(t, dialed, accepted, 64*1024)
+
+	stats := dialed.Stats()
+
+	require.True(t, stats.WireSent > stats.BytesSent)
+	require.True(t, stats.WireReceived > 0)
+
+	// the flow meters of the counter update their totals every second
+	require.Eventually(t, func() bool {
+		dialer := reporter.GetBandwidthForPeer(dialed.LocalPeer())
+		listener := reporter.GetBandwidthForPeer(accepted.LocalPeer())
+
+		return dialer.TotalOut >= 64*1024 && listener.TotalIn >= 64*1024
+	}, 10*time.Second, 100*time.Millisecond)
+
+	totals := reporter.GetBandwidthTotals()
+
+	require.True(t, totals.TotalOut >= 64*1024)
+
+	protocols := reporter.GetBandwidthByProtocol()
+
+	require.Contains(t, protocols, BandwidthProtocol)
+}
+
+// testConnManager records the tags and protections of the peers
+type testConnManager struct {
+	connmgr.NullConnMgr
+	sync.Mutex
+	tags      map[peer.ID]int
+	protected map[peer.ID]string
+}
+
+func (cm *testConnManager) TagPeer(p peer.ID, tag string, weight int) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	if tag == connTag {
+		cm.tags[p] = weight
+	}
+}
+
+func (cm *testConnManager) UntagPeer(p peer.ID, tag string) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	if tag == connTag {
+		delete(cm.tags, p)
+	}
+}
+
+func (cm *testConnManager) Protect(p peer.ID, tag string) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	cm.protected[p] = tag
+}
+
+func (cm *testConnManager) Unprotect(p peer.ID, tag string) bool {
+	cm.Lock()
+	defer cm.Unlock()
+
+	if cm.protected[p] == tag {
+		delete(cm.protected, p)
+	}
+
+	return false
+}
+
+func (cm *testConnManager) weight(p peer.ID) (int, bool) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	weight, ok := cm.tags[p]
+
+	return weight, ok
+}
+
+func (cm *testConnManager) protection(p peer.ID) string {
+	cm.Lock()
+	defer cm.Unlock()
+
+	return cm.protected[p]
+}
+
+func TestConnManager(t *testing.T) {
+	cm := &testConnManager{tags: make(map[peer.ID]int), protected: make(map[peer.ID]string)}
+
+	dialed, accepted := makeConnPairWith(t, []Option{WithTLS()}, []Option{WithTLS(), WithConnManager(cm), WithConnProtection()})
+
+	p := dialed.RemotePeer()
+
+	require.Equal(t, accepted.LocalPeer(), p)
+
+	_, ok := cm.weight(p)
+
+	require.True(t, ok)
+
+	require.Equal(t, connTag, cm.protection(p))
+
+	requireTransfer(t, dialed, accepted, 64*1024)
+
+	// the weight follows the smoothed rtt of the loopback session
+	require.Eventually(t, func() bool {
+		weight, _ := cm.weight(p)
+		return weight > connTagMinWeight
+	}, 10*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, dialed.Close())
+
+	_, ok = cm.weight(p)
+
+	require.False(t, ok)
+
+	require.Empty(t, cm.protection(p))
+
+	require.Equal(t, connTagMinWeight, connTagWeight(0))
+	require.Equal(t, connTagMaxWeight, connTagWeight(time.Millisecond))
+	require.Equal(t, connTagMinWeight, connTagWeight(time.Second))
+}
+
+func TestTransportSuite(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	// the suite closes streams for writing and reads the replies, which smux can't, the
+	// muxers are negotiated by tls
+	ta, err := New(prikey1, WithTLS(), WithMuxers(MuxerYamux))
+
+	require.NoError(t, err)
+
+	defer ta.(Transport).Close()
+
+	tb, err := New(prikey2, WithTLS(), WithMuxers(MuxerYamux))
+
+	require.NoError(t, err)
+
+	defer tb.(Transport).Close()
+
+	peerA, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	ttransport.SubtestTransport(t, ta, tb, "/ip4/127.0.0.1/udp/0/kcp", peerA)
+}
+
+func TestDialUnknownPeer(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	kcp1, err := New(prikey1, WithTLS())
+
+	require.NoError(t, err)
+
+	defer kcp1.(Transport).Close()
+
+	kcp2, err := New(prikey2, WithTLS())
+
+	require.NoError(t, err)
+
+	defer kcp2.(Transport).Close()
+
+	l, err := kcp1.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	go l.Accept()
+
+	dialed, err := kcp2.Dial(context.Background(), l.Multiaddr(), "")
+
+	require.NoError(t, err)
+
+	defer dialed.Close()
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	require.Equal(t, p1, dialed.RemotePeer())
+
+	require.True(t, dialed.RemotePublicKey().Equals(prikey1.GetPublic()))
+
+	// plaintext handshakes can't tell the peer
+	plain, err := New(prikey2)
+
+	require.NoError(t, err)
+
+	defer plain.(Transport).Close()
+
+	_, err = plain.Dial(context.Background(), l.Multiaddr(), "")
+
+	require.True(t, errors.Is(err, ErrInsecure))
+}
+
+func TestDialPeerMultiaddr(t *testing.T) {
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	kcp1, err := New(prikey1, WithTLS())
+
+	require.NoError(t, err)
+
+	defer kcp1.(Transport).Close()
+
+	kcp2, err := New(prikey2, WithTLS())
+
+	require.NoError(t, err)
+
+	defer kcp2.(Transport).Close()
+
+	l, err := kcp1.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	defer l.Close()
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	p2, err := peer.IDFromPrivateKey(prikey2)
+
+	require.NoError(t, err)
+
+	raddr := l.Multiaddr().Encapsulate(multiaddr.StringCast("/p2p/" + p1.Pretty()))
+
+	require.True(t, kcp2.CanDial(raddr))
+
+	dialed, err := kcp2.Dial(context.Background(), raddr, p1)
+
+	require.NoError(t, err)
+
+	require.Equal(t, p1, dialed.RemotePeer())
+
+	require.Equal(t, l.Multiaddr(), dialed.RemoteMultiaddr())
+
+	dialed.Close()
+
+	// the peer of the /p2p component is dialed without peer id
+	dialed, err = kcp2.Dial(context.Background(), raddr, "")
+
+	require.NoError(t, err)
+
+	require.Equal(t, p1, dialed.RemotePeer())
+
+	dialed.Close()
+
+	_, err = kcp2.Dial(context.Background(), raddr, p2)
+
+	require.True(t, errors.Is(err, ErrAddr))
+}
+
+func TestUpgrader(t *testing.T) {
+	newUpgrader := func(prikey crypto.PrivKey) *tptu.Upgrader {
+		security, err := noise.New(prikey)
+
+		require.NoError(t, err)
+
+		secure := new(csms.SSMuxer)
+		secure.AddTransport(noise.ID, security)
+
+		muxer := msmux.NewBlankTransport()
+		muxer.AddTransport("/yamux/1.0.0", p2pyamux.DefaultTransport)
+
+		return &tptu.Upgrader{Secure: secure, Muxer: muxer}
+	}
+
+	prikey1, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	prikey2, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 2048)
+
+	require.NoError(t, err)
+
+	_, err = New(prikey1, WithUpgrader(nil))
+
+	require.True(t, errors.Is(err, ErrOption))
+
+	kcp1, err := UpgraderConstructor()(newUpgrader(prikey1), prikey1)
+
+	require.NoError(t, err)
+
+	defer kcp1.(Transport).Close()
+
+	kcp2, err := UpgraderConstructor()(newUpgrader(prikey2), prikey2)
+
+	require.NoError(t, err)
+
+	defer kcp2.(Transport).Close()
+
+	l, err := kcp1.Listen(multiaddr.StringCast("/ip4/127.0.0.1/udp/0/kcp"))
+
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	accepted := make(chan transport.CapableConn, 1)
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	p1, err := peer.IDFromPrivateKey(prikey1)
+
+	require.NoError(t, err)
+
+	dialed, err := kcp2.Dial(context.Background(), l.Multiaddr(), p1)
+
+	require.NoError(t, err)
+
+	defer dialed.Close()
+
+	require.Equal(t, p1, dialed.RemotePeer())
+
+	require.Equal(t, kcp2, dialed.Transport())
+
+	stream, err := dialed.OpenStream()
+
+	require.NoError(t, err)
+
+	_, err = stream.Write([]byte("hello"))
+
+	require.NoError(t, err)
+
+	conn := <-accepted
+
+	defer conn.Close()
+
+	remote, err := conn.AcceptStream()
+
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+
+	_, err = io.ReadFull(remote, buf)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(buf))
+}
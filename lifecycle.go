@@ -0,0 +1,203 @@
+package kcp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+	"github.com/libs4go/errors"
+)
+
+// drainPoll interval of checking the connections drained by Shutdown
+const drainPoll = 50 * time.Millisecond
+
+// WithContext create kcp transport bound to ctx, cancelling ctx closes all the
+// listeners and connections of the transport and stops its background goroutines
+func WithContext(ctx context.Context) Option {
+	return func(kcp *kcpTransport) error {
+		kcp.ctx = ctx
+		return nil
+	}
+}
+
+// lifecycle tracks the listeners and connections created by the transport
+type lifecycle struct {
+	sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+	listeners map[*kcpListener]struct{}
+	conns     map[*kcpCapableConn]struct{}
+	sockets   map[string]*demuxSocket                // udp sockets shared by listeners
+	punches   map[peer.ID]chan transport.CapableConn // hole punches waiting for their peers
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		closed:    make(chan struct{}),
+		listeners: make(map[*kcpListener]struct{}),
+		conns:     make(map[*kcpCapableConn]struct{}),
+		sockets:   make(map[string]*demuxSocket),
+		punches:   make(map[peer.ID]chan transport.CapableConn),
+	}
+}
+
+func (kcp *kcpTransport) watchContext() {
+	if kcp.ctx == nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-kcp.ctx.Done():
+			kcp.I("transport context done, shutdown")
+			kcp.shutdown()
+		case <-kcp.lifecycle.closed:
+		}
+	}()
+}
+
+func (kcp *kcpTransport) isClosed() bool {
+	select {
+	case <-kcp.lifecycle.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown closes all the listeners and connections of the transport
+func (kcp *kcpTransport) shutdown() {
+	kcp.stop(nil)
+}
+
+// Close closes all the listeners and connections of the transport, which can't dial
+// or listen anymore
+func (kcp *kcpTransport) Close() error {
+	kcp.I("close transport")
+
+	kcp.stop(nil)
+
+	return nil
+}
+
+// Shutdown closes the listeners of the transport, then waits until ctx is done for the
+// connections to close their streams, and closes them. It returns the error of ctx if
+// some connections still had open streams
+func (kcp *kcpTransport) Shutdown(ctx context.Context) error {
+	kcp.I("shutdown transport")
+
+	return kcp.stop(ctx)
+}
+
+// stop closes the transport, the connections are drained until ctx is done, a nil ctx
+// closes them immediately
+func (kcp *kcpTransport) stop(ctx context.Context) error {
+	lc := kcp.lifecycle
+
+	var err error
+
+	lc.closeOnce.Do(func() {
+		lc.Lock()
+		close(lc.closed)
+
+		listeners := lc.listeners
+		conns := lc.conns
+
+		lc.listeners = make(map[*kcpListener]struct{})
+		lc.conns = make(map[*kcpCapableConn]struct{})
+		lc.Unlock()
+
+		for l := range listeners {
+			l.close()
+		}
+
+		if ctx != nil {
+			err = drainConns(ctx, conns)
+		}
+
+		for conn := range conns {
+			conn.Close()
+		}
+	})
+
+	return err
+}
+
+// drainConns waits until the conns are closed or have no open streams
+func drainConns(ctx context.Context, conns map[*kcpCapableConn]struct{}) error {
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+
+	for {
+		drained := true
+
+		for conn := range conns {
+			if !conn.IsClosed() && conn.session.NumStreams() > 0 {
+				drained = false
+				break
+			}
+		}
+
+		if drained {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "drain connections error")
+		}
+	}
+}
+
+// trackConn tracks conn, returns false if the transport is closed
+func (kcp *kcpTransport) trackConn(conn *kcpCapableConn) bool {
+	lc := kcp.lifecycle
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	if kcp.isClosed() {
+		return false
+	}
+
+	lc.conns[conn] = struct{}{}
+
+	return true
+}
+
+func (kcp *kcpTransport) untrackConn(conn *kcpCapableConn) {
+	lc := kcp.lifecycle
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	delete(lc.conns, conn)
+}
+
+// trackListener tracks l, returns false if the transport is closed
+func (kcp *kcpTransport) trackListener(l *kcpListener) bool {
+	lc := kcp.lifecycle
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	if kcp.isClosed() {
+		return false
+	}
+
+	lc.listeners[l] = struct{}{}
+
+	return true
+}
+
+func (kcp *kcpTransport) untrackListener(l *kcpListener) {
+	lc := kcp.lifecycle
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	delete(lc.listeners, l)
+}
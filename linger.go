@@ -0,0 +1,60 @@
+package kcp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/libs4go/errors"
+)
+
+const lingerPoll = time.Millisecond * 10
+
+// WithLinger create kcp transport whose connection Close waits up to d for the data
+// queued in kcp to be sent and acknowledged by remote peer before the session is shut,
+// it can't be combined with WithBatchIO
+func WithLinger(d time.Duration) Option {
+	return func(kcp *kcpTransport) error {
+		if d <= 0 {
+			return errors.Wrap(ErrOption, "invalid linger duration %s", d)
+		}
+
+		kcp.linger = d
+
+		return nil
+	}
+}
+
+// drain waits for the kcp send queue to drain, or the linger duration to expire
+func (c *kcpCapableConn) drain() {
+	if c.kcp.linger <= 0 {
+		return
+	}
+
+	// linger enabled by the options of a peer or a dial on a socket without monitor
+	if c.monitorConn == nil {
+		c.kcp.W("close connection to {@raddr} without linger, its socket isn't monitored", c.remoteMultiaddr)
+		return
+	}
+
+	m := c.monitorConn.lookup(c.udpSession.RemoteAddr())
+
+	if m == nil {
+		return
+	}
+
+	deadline := time.Now().Add(c.kcp.linger)
+
+	ticker := time.NewTicker(lingerPoll)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if m.flushed(atomic.LoadUint64(&c.counter.sent)) && m.acknowledged() {
+			return
+		}
+
+		if now.After(deadline) {
+			c.kcp.W("close connection to {@raddr}, linger timeout with unacknowledged data", c.remoteMultiaddr)
+			return
+		}
+	}
+}
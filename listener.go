@@ -0,0 +1,220 @@
+package kcp
+
+import (
+	"net"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/transport"
+	"github.com/libs4go/errors"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+// defaultMaxHandshakes the default max parallel handshakes of a listener
+const defaultMaxHandshakes = 64
+
+// WithMaxHandshakes create kcp transport whose listeners upgrade at most n accepted
+// sessions at once, the following sessions wait in the kcp-go accept queue
+func WithMaxHandshakes(n int) Option {
+	return func(kcp *kcpTransport) error {
+		if n <= 0 {
+			return errors.Wrap(ErrOption, "invalid max handshakes %d", n)
+		}
+
+		kcp.maxHandshakes = n
+
+		return nil
+	}
+}
+
+// BacklogPolicy what a listener does with the upgraded connections when its accept
+// backlog is full
+type BacklogPolicy int
+
+// accept backlog overflow policies
+const (
+	BacklogRefuseNew  BacklogPolicy = iota // close the new connection
+	BacklogDropOldest                      // close the longest waiting connection
+)
+
+// WithAcceptBacklog create kcp transport whose listeners queue up to n upgraded connections
+// until Accept, so the handshakes don't wait for Accept. The connections which overflow the
+// backlog are handled by policy. Without it, the handshakes wait for Accept to take the
+// upgraded connections
+func WithAcceptBacklog(n int, policy BacklogPolicy) Option {
+	return func(kcp *kcpTransport) error {
+		if n <= 0 {
+			return errors.Wrap(ErrOption, "invalid accept backlog %d", n)
+		}
+
+		switch policy {
+		case BacklogRefuseNew, BacklogDropOldest:
+		default:
+			return errors.Wrap(ErrOption, "invalid accept backlog policy %d", policy)
+		}
+
+		kcp.acceptBacklog = n
+		kcp.backlogPolicy = policy
+
+		return nil
+	}
+}
+
+// enqueue queues the upgraded conn for Accept
+func (l *kcpListener) enqueue(conn transport.CapableConn) {
+	if l.transport.acceptBacklog == 0 {
+		select {
+		case l.accepted <- conn:
+		case <-l.closed:
+			conn.Close()
+		}
+
+		return
+	}
+
+	for {
+		select {
+		case l.accepted <- conn:
+			// Close may have drained the backlog already
+			if l.isClosed() {
+				l.closeBacklog()
+			}
+
+			return
+		case <-l.closed:
+			conn.Close()
+			return
+		default:
+		}
+
+		if l.transport.backlogPolicy == BacklogRefuseNew {
+			l.transport.W("refuse connection from {@raddr}, accept backlog is full", conn.RemoteMultiaddr())
+			conn.Close()
+			return
+		}
+
+		select {
+		case oldest := <-l.accepted:
+			l.transport.W("drop connection from {@raddr}, accept backlog is full", oldest.RemoteMultiaddr())
+			oldest.Close()
+		default:
+		}
+	}
+}
+
+// closeBacklog closes the connections waiting for Accept
+func (l *kcpListener) closeBacklog() {
+	for {
+		select {
+		case conn := <-l.accepted:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// sharedSocket the udp socket of a listener, which is closed when the listener and all of
+// its accepted connections are closed
+type sharedSocket struct {
+	net.PacketConn
+	sync.Mutex
+	refs   int
+	mux    *packetMux     // splits the packets of the sessions dialed from the socket, nil if disabled
+	rebind *rebindingConn // moves the accepted sessions to the new addresses of their peers, nil if disabled
+}
+
+func newSharedSocket(conn net.PacketConn) *sharedSocket {
+	return &sharedSocket{PacketConn: conn, refs: 1}
+}
+
+// acquire returns a reference of the socket for an accepted connection
+func (s *sharedSocket) acquire() net.PacketConn {
+	s.Lock()
+	s.refs++
+	s.Unlock()
+
+	return &socketRef{sharedSocket: s}
+}
+
+// hold takes a reference of the socket for another listener
+func (s *sharedSocket) hold() *sharedSocket {
+	s.Lock()
+	s.refs++
+	s.Unlock()
+
+	return s
+}
+
+// Close releases the reference of the listener
+func (s *sharedSocket) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.refs--
+
+	if s.refs > 0 {
+		return nil
+	}
+
+	return s.PacketConn.Close()
+}
+
+// socketRef a reference of a shared socket, closing it releases the reference once
+type socketRef struct {
+	*sharedSocket
+	once sync.Once
+}
+
+func (r *socketRef) Close() error {
+	var err error
+
+	r.once.Do(func() {
+		err = r.sharedSocket.Close()
+	})
+
+	return err
+}
+
+// handshakes the accepted sessions being upgraded by a listener
+type handshakes struct {
+	sync.Mutex
+	sessions  map[*kcpgo.UDPSession]struct{}
+	cancelled bool
+}
+
+func newHandshakes() *handshakes {
+	return &handshakes{sessions: make(map[*kcpgo.UDPSession]struct{})}
+}
+
+// add tracks the session, returns false if the listener is closed
+func (h *handshakes) add(session *kcpgo.UDPSession) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.cancelled {
+		return false
+	}
+
+	h.sessions[session] = struct{}{}
+
+	return true
+}
+
+func (h *handshakes) remove(session *kcpgo.UDPSession) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.sessions, session)
+}
+
+// cancel closes the sessions being upgraded, which fails their handshakes
+func (h *handshakes) cancel() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.cancelled = true
+
+	for session := range h.sessions {
+		session.Close()
+	}
+}
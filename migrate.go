@@ -0,0 +1,326 @@
+package kcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/libs4go/errors"
+)
+
+// path validation packets are shorter than any kcp packet like the monitor probes, and
+// the response is no larger than the challenge it answers
+var (
+	pathChallenge = []byte("\x00kcp-challenge")
+	pathResponse  = []byte("\x00kcp-response")
+)
+
+const (
+	pathTokenSize         = 8                      // random token echoed by the response
+	pathChallengeInterval = 200 * time.Millisecond // resend interval of unanswered challenges
+)
+
+// WithMigration create kcp transport whose dialed connections can move to a new udp
+// socket with Migrate of the kcp.Conn, e.g. when a mobile device switches between wifi
+// and cellular, keeping the kcp session and its streams. The new path is validated by a
+// challenge the listener answers, which needs WithNATRebinding, and the listener moves the
+// session once the new socket answered its challenge in turn, which needs tls. A write
+// failing because the local address or route went away migrates the connection too, the
+// writes fail once such a migration failed. The connections dialed from the socket of a
+// listener don't migrate, see WithDialFromListener
+func WithMigration() Option {
+	return func(kcp *kcpTransport) error {
+		kcp.migration = true
+
+		return nil
+	}
+}
+
+// migratingConn the udp socket of a dialed session, which Migrate replaces by a new one
+type migratingConn struct {
+	sync.Mutex // guards the socket swap against Close
+	kcp        *kcpTransport
+	network    string
+	raddr      *net.UDPAddr
+	socket     atomic.Value // *migrationSocket
+	migrations sync.Mutex   // serializes the migrations
+	recovering int32        // a migration after a failed write is running
+	failure    atomic.Value // *migrationFailure of the last migration after a failed write
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+// migrationFailure the error of a migration, nil once a migration succeeded
+type migrationFailure struct {
+	err error
+}
+
+type migrationSocket struct {
+	udpConn    *net.UDPConn
+	packetConn net.PacketConn // udpConn with receive offload if enabled
+}
+
+func (kcp *kcpTransport) newMigratingConn(udpConn *net.UDPConn, network string, raddr *net.UDPAddr) *migratingConn {
+	conn := &migratingConn{
+		kcp:     kcp,
+		network: network,
+		raddr:   raddr,
+		closed:  make(chan struct{}),
+	}
+
+	conn.socket.Store(&migrationSocket{udpConn: udpConn, packetConn: kcp.offloadConn(udpConn)})
+
+	return conn
+}
+
+func (conn *migratingConn) current() *migrationSocket {
+	return conn.socket.Load().(*migrationSocket)
+}
+
+// ReadFrom reads from the current socket, the read of a replaced socket goes on with the
+// new one
+func (conn *migratingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		socket := conn.current()
+
+		n, addr, err := socket.packetConn.ReadFrom(b)
+
+		if err != nil && !conn.isClosed() && socket != conn.current() {
+			continue
+		}
+
+		return n, addr, err
+	}
+}
+
+// WriteTo writes to the current socket, a write failing because the path changed migrates
+// the connection and the packet is lost like on the wire, instead of failing the kcp
+// session. Once the migration failed the writes fail until one succeeds
+func (conn *migratingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := conn.current().packetConn.WriteTo(b, addr)
+
+	if err == nil || !pathChanged(err) || conn.isClosed() {
+		return n, err
+	}
+
+	go conn.recover()
+
+	if failure, ok := conn.failure.Load().(*migrationFailure); ok && failure.err != nil {
+		return n, errors.Wrap(ErrMigration, "write to %s error: %s, migrate error: %s", addr, err, failure.err)
+	}
+
+	conn.kcp.D("write to {@raddr} error: {@err}, migrate", addr, err)
+
+	return len(b), nil
+}
+
+// pathChanged returns true if err of a write means the local address or the route to the
+// peer went away, e.g. after a switch between wifi and cellular
+func pathChanged(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+
+	switch err {
+	case syscall.EADDRNOTAVAIL, syscall.ENETUNREACH, syscall.ENETDOWN:
+		return true
+	default:
+		return false
+	}
+}
+
+func (conn *migratingConn) recover() {
+	if !atomic.CompareAndSwapInt32(&conn.recovering, 0, 1) {
+		return
+	}
+
+	defer atomic.StoreInt32(&conn.recovering, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), conn.kcp.handshakeTimeout)
+	defer cancel()
+
+	if err := conn.migrate(ctx); err != nil {
+		conn.kcp.W("migrate session to {@raddr} error: {@err}", conn.raddr, err)
+
+		conn.failure.Store(&migrationFailure{err: err})
+	}
+}
+
+// migrate moves the session to a new socket once the listener answered its challenge
+func (conn *migratingConn) migrate(ctx context.Context) error {
+	conn.migrations.Lock()
+	defer conn.migrations.Unlock()
+
+	laddr, err := conn.kcp.socketConf.dialAddr(conn.raddr)
+
+	if err != nil {
+		return err
+	}
+
+	udpConn, err := conn.kcp.socketConf.listenUDP(conn.kcp, conn.network, laddr)
+
+	if err != nil {
+		return errors.Wrap(err, "create udp socket error")
+	}
+
+	if err := conn.validate(ctx, udpConn); err != nil {
+		udpConn.Close()
+		return err
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.isClosed() {
+		udpConn.Close()
+		return ErrClosed
+	}
+
+	old := conn.current()
+
+	conn.socket.Store(&migrationSocket{udpConn: udpConn, packetConn: conn.kcp.offloadConn(udpConn)})
+
+	// unblocks the read of the old socket
+	old.udpConn.Close()
+
+	conn.kcp.I("session to {@raddr} moved from {@old} to {@laddr}", conn.raddr, old.udpConn.LocalAddr(), udpConn.LocalAddr())
+
+	conn.failure.Store(&migrationFailure{})
+
+	return nil
+}
+
+// validate sends challenges from udpConn until the listener answers one, or ctx is done.
+// A validating listener answers the first ones with a retry cookie, see WithAddressValidation
+func (conn *migratingConn) validate(ctx context.Context, udpConn *net.UDPConn) error {
+	token := make([]byte, pathTokenSize)
+
+	if _, err := rand.Read(token); err != nil {
+		return errors.Wrap(err, "generate path token error")
+	}
+
+	challenge := append(append([]byte{}, pathChallenge...), token...)
+	response := append(append([]byte{}, pathResponse...), token...)
+
+	buff := make([]byte, pathMTUMax)
+
+	defer udpConn.SetReadDeadline(time.Time{})
+
+	for {
+		if _, err := udpConn.WriteTo(challenge, conn.raddr); err != nil {
+			return errors.Wrap(ErrMigration, "send path challenge from %s error: %s", udpConn.LocalAddr(), err)
+		}
+
+		deadline := time.Now().Add(pathChallengeInterval)
+
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+
+		udpConn.SetReadDeadline(deadline)
+
+		for {
+			n, addr, err := udpConn.ReadFrom(buff)
+
+			if err != nil {
+				break
+			}
+
+			if addr.String() != conn.raddr.String() {
+				continue
+			}
+
+			if bytes.Equal(buff[:n], response) {
+				return nil
+			}
+
+			if n == len(cookieRetry)+cookieSize && bytes.HasPrefix(buff[:n], cookieRetry) {
+				echo := append(append([]byte{}, cookieEcho...), buff[len(cookieRetry):n]...)
+
+				udpConn.WriteTo(echo, conn.raddr)
+
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ErrMigration, "path from %s to %s not validated", udpConn.LocalAddr(), conn.raddr)
+		default:
+		}
+	}
+}
+
+func (conn *migratingConn) isClosed() bool {
+	select {
+	case <-conn.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (conn *migratingConn) Close() error {
+	var err error
+
+	conn.closeOnce.Do(func() {
+		conn.Lock()
+		defer conn.Unlock()
+
+		close(conn.closed)
+
+		err = conn.current().udpConn.Close()
+	})
+
+	return err
+}
+
+func (conn *migratingConn) LocalAddr() net.Addr {
+	return conn.current().udpConn.LocalAddr()
+}
+
+func (conn *migratingConn) SetDeadline(t time.Time) error {
+	return conn.current().udpConn.SetDeadline(t)
+}
+
+func (conn *migratingConn) SetReadDeadline(t time.Time) error {
+	return conn.current().udpConn.SetReadDeadline(t)
+}
+
+func (conn *migratingConn) SetWriteDeadline(t time.Time) error {
+	return conn.current().udpConn.SetWriteDeadline(t)
+}
+
+// answerChallenge answers the path challenge of a migrating dialer, returns false if
+// packet isn't one
+func answerChallenge(conn net.PacketConn, packet []byte, addr net.Addr) bool {
+	if len(packet) != len(pathChallenge)+pathTokenSize || !bytes.HasPrefix(packet, pathChallenge) {
+		return false
+	}
+
+	response := append(append([]byte{}, pathResponse...), packet[len(pathChallenge):]...)
+
+	conn.WriteTo(response, addr)
+
+	return true
+}
+
+// Migrate moves a dialed connection to a new udp socket once the listener validated the
+// new path, e.g. after the local address changed, see WithMigration
+func (c *kcpCapableConn) Migrate(ctx context.Context) error {
+	if c.migration == nil {
+		return errors.Wrap(ErrMigration, "connection created without migration")
+	}
+
+	return c.migration.migrate(ctx)
+}
@@ -0,0 +1,68 @@
+package kcp
+
+import (
+	"github.com/libs4go/errors"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const protocolKCPModeID = 483
+
+// protoKCPMode the kcp mode a listener advertises, multiaddr components can't have
+// optional values so the mode follows /kcp as its own component, e.g.
+// /ip4/1.2.3.4/udp/9000/kcp/kcpmode/fast3
+var protoKCPMode = multiaddr.Protocol{
+	Name:       "kcpmode",
+	Code:       protocolKCPModeID,
+	VCode:      multiaddr.CodeToVarint(protocolKCPModeID),
+	Size:       multiaddr.LengthPrefixedVarSize,
+	Transcoder: multiaddr.NewTranscoderFromFunctions(kcpModeStB, kcpModeBtS, kcpModeValidate),
+}
+
+func init() {
+	// a protocol taking the code or the name fails New instead of the process
+	registerProtocol(protoKCPMode)
+}
+
+func kcpModeStB(mode string) ([]byte, error) {
+	if _, ok := modes[mode]; !ok {
+		return nil, errors.Wrap(ErrAddr, "unknown kcp mode %s", mode)
+	}
+
+	return []byte(mode), nil
+}
+
+func kcpModeBtS(b []byte) (string, error) {
+	if err := kcpModeValidate(b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func kcpModeValidate(b []byte) error {
+	if _, ok := modes[string(b)]; !ok {
+		return errors.Wrap(ErrAddr, "unknown kcp mode %s", string(b))
+	}
+
+	return nil
+}
+
+// splitKcpMode splits the trailing kcpmode component from addr
+func splitKcpMode(addr multiaddr.Multiaddr) (multiaddr.Multiaddr, string) {
+	base, last := multiaddr.SplitLast(addr)
+
+	if last == nil || last.Protocol().Code != protocolKCPModeID || base == nil {
+		return addr, ""
+	}
+
+	return base, last.Value()
+}
+
+// addrOptions returns the options advertised by addr
+func addrOptions(addr multiaddr.Multiaddr) []Option {
+	if _, mode := splitKcpMode(addr); mode != "" {
+		return []Option{WithMode(mode)}
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/metrics"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+// out-of-band liveness probes, shorter than any kcp packet so that they are
+// dropped by peers which don't monitor their sockets
+var (
+	probePing = []byte("\x00kcp-ping")
+	probePong = []byte("\x00kcp-pong")
+)
+
+// monitorConn wraps the session's packet conn to observe kcp packets
+type monitorConn struct {
+	net.PacketConn
+	monitors *sync.Map        // remote addr -> *sessionMonitor, shared by the shards of a listener
+	fec      bool             // kcp packets are wrapped by fec headers
+	block    kcpgo.BlockCrypt // kcp packets are encrypted by block
+	pathMTU  bool             // answer path mtu probes
+	reporter metrics.Reporter // reports the udp traffic of the socket, nil means disabled
+}
+
+func (kcp *kcpTransport) monitorEnabled() bool {
+	return kcp.autoMTU > 0 || kcp.watchdog > 0 || kcp.linger > 0 || kcp.adaptiveWindow != nil || kcp.pathMTU > 0 || kcp.congestion != nil || kcp.bandwidthReporter != nil || kcp.tagger != nil
+}
+
+func (conn *monitorConn) lookup(addr net.Addr) *sessionMonitor {
+	if m, ok := conn.monitors.Load(addr.String()); ok {
+		return m.(*sessionMonitor)
+	}
+
+	return nil
+}
+
+// observe calls fn with the kcp segments of packet, and counts the fec parity packets
+// to parity
+func (conn *monitorConn) observe(packet []byte, fn func(payload []byte), parity *uint64) {
+	if conn.block == nil {
+		conn.countParity(packet, parity)
+		fn(conn.payload(packet))
+		return
+	}
+
+	decryptPayload(conn.block, packet, func(plain []byte) {
+		conn.countParity(plain, parity)
+		fn(conn.payload(plain))
+	})
+}
+
+// countParity counts the plain packet to parity if it's a fec parity shard
+func (conn *monitorConn) countParity(packet []byte, parity *uint64) {
+	if conn.fec && fecParity(packet) {
+		atomic.AddUint64(parity, 1)
+	}
+}
+
+// payload strips the fec header of a plain packet
+func (conn *monitorConn) payload(packet []byte) []byte {
+	if conn.fec {
+		return fecPayload(packet)
+	}
+
+	return packet
+}
+
+func (conn *monitorConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := conn.PacketConn.ReadFrom(b)
+
+		if err != nil {
+			return n, addr, err
+		}
+
+		if conn.reporter != nil {
+			conn.reporter.LogRecvMessage(int64(n))
+		}
+
+		if conn.pathMTU && conn.answerMTUProbe(b[:n], addr) {
+			continue
+		}
+
+		if n < kcpgo.IKCP_OVERHEAD {
+			if bytes.Equal(b[:n], probePing) {
+				conn.PacketConn.WriteTo(probePong, addr)
+				continue
+			}
+
+			if bytes.Equal(b[:n], probePong) {
+				if m := conn.lookup(addr); m != nil {
+					atomic.StoreInt64(&m.lastPong, time.Now().UnixNano())
+				}
+				continue
+			}
+		}
+
+		if m := conn.lookup(addr); m != nil {
+			atomic.AddUint64(&m.udpRecv, uint64(n))
+			conn.observe(b[:n], m.received, &m.parityRecv)
+			m.report()
+		}
+
+		return n, addr, err
+	}
+}
+
+func (conn *monitorConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if conn.reporter != nil {
+		conn.reporter.LogSentMessage(int64(len(b)))
+	}
+
+	if m := conn.lookup(addr); m != nil {
+		atomic.AddUint64(&m.udpSent, uint64(len(b)))
+		conn.observe(b, m.sent, &m.paritySent)
+		m.report()
+	}
+
+	return conn.PacketConn.WriteTo(b, addr)
+}
+
+func (conn *monitorConn) ping(addr net.Addr) error {
+	_, err := conn.PacketConn.WriteTo(probePing, addr)
+	return err
+}
+
+func (conn *monitorConn) attach(addr net.Addr, m *sessionMonitor) {
+	conn.monitors.Store(addr.String(), m)
+}
+
+func (conn *monitorConn) detach(addr net.Addr) {
+	conn.monitors.Delete(addr.String())
+}
+
+// watch attaches a new session monitor to udpSession before any data is written,
+// so that every pushed byte is observed, returns nil if conn is nil
+func (conn *monitorConn) watch(udpSession *kcpgo.UDPSession) *sessionMonitor {
+	if conn == nil {
+		return nil
+	}
+
+	m := newSessionMonitor()
+
+	conn.attach(udpSession.RemoteAddr(), m)
+
+	return m
+}
+
+// unwatch detaches the session monitor of udpSession
+func (conn *monitorConn) unwatch(udpSession *kcpgo.UDPSession) {
+	if conn != nil {
+		conn.detach(udpSession.RemoteAddr())
+	}
+}
+
+// sessionMonitor the observed state of one kcp session
+type sessionMonitor struct {
+	lastRecv   int64        // unix nano of the last received kcp packet
+	lastSend   int64        // unix nano of the last sent kcp data segment, acks excluded
+	lastPong   int64        // unix nano of the last received liveness probe reply
+	pushed     uint64       // payload bytes of the sent data segments, retransmissions excluded
+	retrans    uint64       // retransmitted data segments
+	resent     uint64       // bytes of the retransmitted data segments, kcp headers included
+	udpSent    uint64       // bytes of the sent udp packets
+	udpRecv    uint64       // bytes of the received udp packets
+	paritySent uint64       // fec parity packets sent
+	parityRecv uint64       // fec parity packets received
+	nextSN     uint32       // next sn of the sent data segments
+	una        uint32       // the first sn not acknowledged by remote peer
+	rttSN      uint32       // sn of the segment timed for the next rtt sample
+	rttSent    int64        // unix nano when rttSN was sent, 0 means no sample in flight
+	srtt       int64        // smoothed rtt in nanoseconds
+	mtuAck     int32        // size of the last acknowledged path mtu probe
+	mtu        atomic.Value // *mtuMonitor, set once the connection is established
+	bw         atomic.Value // *bandwidthReporter, set once the connection is established
+}
+
+func newSessionMonitor() *sessionMonitor {
+	now := time.Now().UnixNano()
+
+	return &sessionMonitor{
+		lastRecv: now,
+		lastSend: now,
+	}
+}
+
+func (m *sessionMonitor) sent(packet []byte) {
+	kcpSegments(packet, func(cmd byte, sn, una uint32, length int) {
+		if cmd != kcpgo.IKCP_CMD_PUSH {
+			return
+		}
+
+		// the acks of an idle session expect nothing back
+		atomic.StoreInt64(&m.lastSend, time.Now().UnixNano())
+
+		if int32(sn+1-atomic.LoadUint32(&m.nextSN)) <= 0 {
+			atomic.AddUint64(&m.retrans, 1)
+			atomic.AddUint64(&m.resent, uint64(kcpgo.IKCP_OVERHEAD+length))
+
+			// ambiguous rtt sample of a retransmitted segment
+			if sn == atomic.LoadUint32(&m.rttSN) {
+				atomic.StoreInt64(&m.rttSent, 0)
+			}
+
+			return
+		}
+
+		atomic.StoreUint32(&m.nextSN, sn+1)
+		atomic.AddUint64(&m.pushed, uint64(length))
+
+		if atomic.LoadInt64(&m.rttSent) == 0 {
+			atomic.StoreUint32(&m.rttSN, sn)
+			atomic.StoreInt64(&m.rttSent, time.Now().UnixNano())
+		}
+	})
+
+	if mtu, ok := m.mtu.Load().(*mtuMonitor); ok {
+		mtu.observe(packet)
+	}
+}
+
+func (m *sessionMonitor) received(packet []byte) {
+	now := time.Now().UnixNano()
+
+	atomic.StoreInt64(&m.lastRecv, now)
+
+	kcpSegments(packet, func(cmd byte, sn, una uint32, length int) {
+		if current := atomic.LoadUint32(&m.una); int32(una-current) > 0 {
+			atomic.StoreUint32(&m.una, una)
+		}
+
+		if sent := atomic.LoadInt64(&m.rttSent); sent != 0 && int32(una-atomic.LoadUint32(&m.rttSN)) > 0 {
+			m.sampleRTT(now - sent)
+			atomic.StoreInt64(&m.rttSent, 0)
+		}
+	})
+}
+
+// sampleRTT updates the smoothed rtt with sample
+func (m *sessionMonitor) sampleRTT(sample int64) {
+	srtt := atomic.LoadInt64(&m.srtt)
+
+	if srtt == 0 {
+		srtt = sample
+	} else {
+		srtt = (srtt*7 + sample) / 8
+	}
+
+	atomic.StoreInt64(&m.srtt, srtt)
+}
+
+// rtt returns the smoothed rtt observed on the session, 0 if there is no sample yet
+func (m *sessionMonitor) rtt() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.srtt))
+}
+
+// acknowledged checks if all the sent data segments are acknowledged by remote peer
+func (m *sessionMonitor) acknowledged() bool {
+	return int32(atomic.LoadUint32(&m.una)-atomic.LoadUint32(&m.nextSN)) >= 0
+}
+
+// flushed checks if written bytes of session data have been pushed to the socket
+func (m *sessionMonitor) flushed(written uint64) bool {
+	return atomic.LoadUint64(&m.pushed) >= written
+}
+
+// kcpSegments calls fn with the cmd, sn, una and payload length of each kcp segment in packet
+func kcpSegments(packet []byte, fn func(cmd byte, sn, una uint32, length int)) {
+	for data := packet; len(data) >= kcpgo.IKCP_OVERHEAD; {
+		length := int(binary.LittleEndian.Uint32(data[20:]))
+
+		if length < 0 || kcpgo.IKCP_OVERHEAD+length > len(data) {
+			return
+		}
+
+		fn(data[4], binary.LittleEndian.Uint32(data[kcpgo.IKCP_SN_OFFSET:]), binary.LittleEndian.Uint32(data[16:]), length)
+
+		data = data[kcpgo.IKCP_OVERHEAD+length:]
+	}
+}
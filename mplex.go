@@ -0,0 +1,101 @@
+package kcp
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	mplex "github.com/libp2p/go-mplex"
+)
+
+// mplexSession creates the mplex session of conn. mplex keeps a few buffered messages per
+// stream instead of the receive buffers of smux and yamux, and has no keepalive
+func (kcp *kcpTransport) mplexSession(conn net.Conn, client bool) muxSession {
+	if kcp.compression {
+		conn = newCompStream(conn)
+	}
+
+	return &mplexMux{Multiplex: mplex.NewMultiplex(conn, client), conn: conn}
+}
+
+type mplexMux struct {
+	*mplex.Multiplex
+	conn    net.Conn
+	streams int32 // the streams not closed or reset locally
+}
+
+func (m *mplexMux) OpenStream() (muxStream, error) {
+	stream, err := m.Multiplex.NewStream()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m.wrap(stream), nil
+}
+
+func (m *mplexMux) AcceptStream() (muxStream, error) {
+	stream, err := m.Multiplex.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m.wrap(stream), nil
+}
+
+func (m *mplexMux) wrap(stream *mplex.Stream) *mplexStream {
+	atomic.AddInt32(&m.streams, 1)
+
+	return &mplexStream{Stream: stream, mux: m}
+}
+
+// NumStreams returns the streams not closed or reset locally, mplex doesn't count them
+func (m *mplexMux) NumStreams() int {
+	return int(atomic.LoadInt32(&m.streams))
+}
+
+type mplexStream struct {
+	*mplex.Stream
+	mux       *mplexMux
+	closeOnce sync.Once
+}
+
+// ID returns the mplex stream id, which go-mplex names the unnamed streams after
+func (s *mplexStream) ID() uint32 {
+	id, _ := strconv.ParseUint(s.Stream.Name(), 10, 32)
+
+	return uint32(id)
+}
+
+// Close closes the stream for writing like yamux, the stream stays readable until the
+// remote peer closes it too
+func (s *mplexStream) Close() error {
+	s.closeOnce.Do(s.release)
+
+	return s.Stream.Close()
+}
+
+// CloseWrite closes the stream for writing
+func (s *mplexStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+func (s *mplexStream) Reset() error {
+	s.closeOnce.Do(s.release)
+
+	return s.Stream.Reset()
+}
+
+func (s *mplexStream) release() {
+	atomic.AddInt32(&s.mux.streams, -1)
+}
+
+func (s *mplexStream) LocalAddr() net.Addr {
+	return s.mux.conn.LocalAddr()
+}
+
+func (s *mplexStream) RemoteAddr() net.Addr {
+	return s.mux.conn.RemoteAddr()
+}
@@ -0,0 +1,153 @@
+package kcp
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/libs4go/errors"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+const (
+	defaultMTU       = kcpgo.IKCP_MTU_DEF // kcp-go default mtu
+	mtuLossWindow    = 256                // evaluate loss after this many large packets
+	mtuLossRatio     = 0.2                // large packet loss ratio which triggers mtu reduction
+	mtuTrackedWindow = 8192               // max tracked push segments per session
+)
+
+// WithAutoMTU create kcp transport which automatically reduces the session mtu
+// (down to minMtu) when large packets are repeatedly lost
+func WithAutoMTU(minMtu int) Option {
+	return func(kcp *kcpTransport) error {
+		if minMtu < kcpgo.IKCP_OVERHEAD*2 || minMtu > defaultMTU {
+			return errors.Wrap(ErrOption, "invalid min mtu %d", minMtu)
+		}
+
+		kcp.autoMTU = minMtu
+
+		return nil
+	}
+}
+
+// WithMTU create kcp transport with the kcp session mtu, which is the max udp payload size
+func WithMTU(mtu int) Option {
+	return func(kcp *kcpTransport) error {
+		if mtu < kcpgo.IKCP_OVERHEAD*2 || mtu > defaultMTU {
+			return errors.Wrap(ErrOption, "invalid mtu %d", mtu)
+		}
+
+		kcp.sessionConf.mtu = mtu
+
+		return nil
+	}
+}
+
+// mtuMonitor correlates kcp segment retransmissions with the size of the udp packet
+// which carried the original transmission
+type mtuMonitor struct {
+	sync.Mutex
+	conn     *kcpCapableConn
+	minMtu   int
+	seen     map[uint32]int // push segment sn -> original packet size
+	maxSN    uint32
+	sent     [2]uint64 // sent packets, small/large
+	lost     [2]uint64 // lost packets, small/large
+	reducing int32     // a reduction is running
+}
+
+func newMTUMonitor(conn *kcpCapableConn, minMtu int) *mtuMonitor {
+	return &mtuMonitor{
+		conn:   conn,
+		minMtu: minMtu,
+		seen:   make(map[uint32]int),
+	}
+}
+
+func (m *mtuMonitor) class(size int) int {
+	mtu := m.conn.MTU()
+
+	if size > mtu-mtu/4 {
+		return 1
+	}
+
+	return 0
+}
+
+// observe called with the session lock held, so mtu changes are applied asynchronously
+func (m *mtuMonitor) observe(packet []byte) {
+	if len(packet) == 0 {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	size := len(packet)
+	retrans := false
+
+	kcpSegments(packet, func(cmd byte, sn, una uint32, length int) {
+		if cmd != kcpgo.IKCP_CMD_PUSH {
+			return
+		}
+
+		if origin, ok := m.seen[sn]; ok {
+			if !retrans {
+				m.lost[m.class(origin)]++
+			}
+			retrans = true
+		} else {
+			m.seen[sn] = size
+			if sn > m.maxSN {
+				m.maxSN = sn
+			}
+		}
+	})
+
+	m.sent[m.class(size)]++
+
+	if len(m.seen) > mtuTrackedWindow {
+		for sn := range m.seen {
+			if m.maxSN-sn > mtuTrackedWindow/2 {
+				delete(m.seen, sn)
+			}
+		}
+	}
+
+	if m.sent[1] < mtuLossWindow {
+		return
+	}
+
+	large := float64(m.lost[1]) / float64(m.sent[1])
+	small := 0.0
+
+	if m.sent[0] > 0 {
+		small = float64(m.lost[0]) / float64(m.sent[0])
+	}
+
+	m.sent = [2]uint64{}
+	m.lost = [2]uint64{}
+
+	if large >= mtuLossRatio && large > small*2 && atomic.CompareAndSwapInt32(&m.reducing, 0, 1) {
+		go m.reduce()
+	}
+}
+
+func (m *mtuMonitor) reduce() {
+	defer atomic.StoreInt32(&m.reducing, 0)
+
+	current := m.conn.MTU()
+
+	mtu := current - current/8
+
+	if mtu < m.minMtu {
+		mtu = m.minMtu
+	}
+
+	if mtu >= current {
+		return
+	}
+
+	if m.conn.setMTU(mtu) {
+		m.conn.kcp.W("large packet loss detected, reduce mtu of {@raddr} from {@old} to {@new}", m.conn.remoteMultiaddr, current, mtu)
+	}
+}
@@ -0,0 +1,261 @@
+package kcp
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+
+	mplex "github.com/libp2p/go-mplex"
+	"github.com/libp2p/go-yamux"
+	"github.com/libs4go/errors"
+	"github.com/xtaci/smux"
+)
+
+// stream multiplexers negotiated by tls alpn
+const (
+	MuxerSmuxV1 = "smux/1"
+	MuxerSmuxV2 = "smux/2"
+	MuxerYamux  = "yamux/1.0.0"
+	MuxerMplex  = "mplex/6.7.0"
+)
+
+// WithMuxers create kcp transport which advertises muxers by tls alpn in preference order,
+// the listener's preference wins. Peers without a common muxer use smux v1, plain and
+// WithSecurity connections have no alpn and use the smux version of WithSmuxVersion.
+// The smux settings don't apply to yamux, except the keepalive ones
+func WithMuxers(muxers ...string) Option {
+	return func(kcp *kcpTransport) error {
+		if len(muxers) == 0 {
+			return errors.Wrap(ErrOption, "no muxer")
+		}
+
+		for _, muxer := range muxers {
+			switch muxer {
+			case MuxerSmuxV1, MuxerSmuxV2, MuxerYamux, MuxerMplex:
+			default:
+				return errors.Wrap(ErrOption, "unsupported muxer %s", muxer)
+			}
+		}
+
+		kcp.muxers = muxers
+		kcp.smuxNegotiate = true
+
+		return nil
+	}
+}
+
+// WithMuxer create kcp transport whose connections all use the muxer, "yamux", "mplex" or
+// "smux", or one of the muxer ids, without negotiation, e.g. yamux for its flow control and pings
+// on the plain and WithSecurity connections too. Both peers must use the same muxer, and
+// it replaces WithMuxers and WithSmuxVersion, whichever comes last wins
+func WithMuxer(muxer string) Option {
+	return func(kcp *kcpTransport) error {
+		switch muxer {
+		case "yamux", MuxerYamux:
+			kcp.yamux = true
+			kcp.mplex = false
+		case "mplex", MuxerMplex:
+			kcp.yamux = false
+			kcp.mplex = true
+		case "smux", MuxerSmuxV1:
+			kcp.yamux = false
+			kcp.mplex = false
+			kcp.smuxVersion = 1
+		case MuxerSmuxV2:
+			kcp.yamux = false
+			kcp.mplex = false
+			kcp.smuxVersion = 2
+		default:
+			return errors.Wrap(ErrOption, "unsupported muxer %s", muxer)
+		}
+
+		kcp.smuxNegotiate = false
+
+		return nil
+	}
+}
+
+// muxerProtos prepends the alpn protocols of the muxers to the libp2p tls protos
+func (kcp *kcpTransport) muxerProtos(conf *tls.Config) *tls.Config {
+	if !kcp.smuxNegotiate {
+		return conf
+	}
+
+	conf = conf.Clone()
+	conf.NextProtos = append(append([]string{}, kcp.muxers...), conf.NextProtos...)
+
+	return conf
+}
+
+// negotiatedMuxer returns the transport which uses the muxer negotiated by the tls handshake
+func (kcp *kcpTransport) negotiatedMuxer(state tls.ConnectionState) *kcpTransport {
+	if !kcp.smuxNegotiate {
+		return kcp
+	}
+
+	var negotiated *kcpTransport
+
+	switch state.NegotiatedProtocol {
+	case MuxerSmuxV2:
+		negotiated, _ = kcp.derive([]Option{WithSmuxVersion(2)})
+	case MuxerYamux:
+		negotiated, _ = kcp.derive([]Option{withYamux()})
+	case MuxerMplex:
+		negotiated, _ = kcp.derive([]Option{withMplex()})
+	default:
+		negotiated, _ = kcp.derive([]Option{WithSmuxVersion(1)})
+	}
+
+	return negotiated
+}
+
+// isStreamReset checks if err reports a stream reset by the remote peer, the muxers have
+// their own reset errors instead of mux.ErrReset
+func isStreamReset(err error) bool {
+	return err == yamux.ErrStreamReset || err == mplex.ErrStreamReset
+}
+
+func withYamux() Option {
+	return func(kcp *kcpTransport) error {
+		kcp.yamux = true
+		kcp.mplex = false
+		return nil
+	}
+}
+
+func withMplex() Option {
+	return func(kcp *kcpTransport) error {
+		kcp.yamux = false
+		kcp.mplex = true
+		return nil
+	}
+}
+
+// muxSession the stream multiplexer session of a connection
+type muxSession interface {
+	OpenStream() (muxStream, error)
+	AcceptStream() (muxStream, error)
+	NumStreams() int
+	IsClosed() bool
+	Close() error
+}
+
+// muxStream a stream of muxSession
+type muxStream interface {
+	net.Conn
+	// ID returns the stream id, which is the same on both ends
+	ID() uint32
+}
+
+func (kcp *kcpTransport) muxSession(conn net.Conn, client bool) (muxSession, error) {
+	if kcp.mplex {
+		return kcp.mplexSession(conn, client), nil
+	}
+
+	if !kcp.yamux {
+		session, err := kcp.smuxSession(conn, client)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &smuxMux{Session: session}, nil
+	}
+
+	if kcp.compression {
+		conn = newCompStream(conn)
+	}
+
+	var session *yamux.Session
+	var err error
+
+	if client {
+		session, err = yamux.Client(conn, kcp.yamuxConf())
+	} else {
+		session, err = yamux.Server(conn, kcp.yamuxConf())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &yamuxMux{Session: session}, nil
+}
+
+func (kcp *kcpTransport) yamuxConf() *yamux.Config {
+	conf := yamux.DefaultConfig()
+
+	conf.LogOutput = ioutil.Discard
+
+	if kcp.keepAliveInterval == keepAliveDisabled {
+		conf.EnableKeepAlive = false
+	} else {
+		conf.KeepAliveInterval = kcp.keepAliveInterval
+		// yamux waits for the keepalive pong as long as for a write
+		conf.ConnectionWriteTimeout = kcp.keepAliveTimeout
+	}
+
+	return conf
+}
+
+type smuxMux struct {
+	*smux.Session
+}
+
+func (m *smuxMux) OpenStream() (muxStream, error) {
+	stream, err := m.Session.OpenStream()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (m *smuxMux) AcceptStream() (muxStream, error) {
+	stream, err := m.Session.AcceptStream()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+type yamuxMux struct {
+	*yamux.Session
+}
+
+func (m *yamuxMux) OpenStream() (muxStream, error) {
+	stream, err := m.Session.OpenStream()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &yamuxStream{Stream: stream}, nil
+}
+
+func (m *yamuxMux) AcceptStream() (muxStream, error) {
+	stream, err := m.Session.AcceptStream()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &yamuxStream{Stream: stream}, nil
+}
+
+type yamuxStream struct {
+	*yamux.Stream
+}
+
+func (s *yamuxStream) ID() uint32 {
+	return s.StreamID()
+}
+
+// CloseWrite closes the stream for writing, yamux Close only sends FIN and the stream
+// stays readable until the remote peer closes it too
+func (s *yamuxStream) CloseWrite() error {
+	return s.Stream.Close()
+}
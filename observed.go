@@ -0,0 +1,98 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libs4go/errors"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// maxObservedAddr the max size of an observed address sent by a peer
+const maxObservedAddr = 256
+
+// ObservedAddrHandler receives the local multiaddr of a connection to p as observed by p
+type ObservedAddrHandler func(p peer.ID, local, observed multiaddr.Multiaddr)
+
+// WithObservedAddrHandler create kcp transport which calls handler with the observed address
+// of each connection, e.g. to feed identify or autonat the public address of a node behind
+// a nat. Only ProtocolV2 connections exchange their observed addresses
+func WithObservedAddrHandler(handler ObservedAddrHandler) Option {
+	return func(kcp *kcpTransport) error {
+		if handler == nil {
+			return errors.Wrap(ErrOption, "nil observed addr handler")
+		}
+
+		kcp.observedHandler = handler
+
+		return nil
+	}
+}
+
+// exchangeObserved sends raddr, where the packets of the peer come from, and returns the
+// address the peer sees the local packets coming from
+func (kcp *kcpTransport) exchangeObserved(conn net.Conn, raddr net.Addr) (multiaddr.Multiaddr, error) {
+	observed, err := manet.FromNetAddr(raddr)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "create observed multiaddr error")
+	}
+
+	msg := make([]byte, 2, 2+len(observed.Bytes()))
+
+	binary.BigEndian.PutUint16(msg, uint16(len(observed.Bytes())))
+
+	if _, err := conn.Write(append(msg, observed.Bytes()...)); err != nil {
+		return nil, err
+	}
+
+	var size [2]byte
+
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint16(size[:]) > maxObservedAddr {
+		return nil, errors.Wrap(ErrAddr, "observed address of %d bytes", binary.BigEndian.Uint16(size[:]))
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	local, err := multiaddr.NewMultiaddrBytes(buf)
+
+	if err != nil {
+		return nil, errors.Wrap(ErrAddr, "invalid observed address: %s", err)
+	}
+
+	addr, err := manet.ToNetAddr(local)
+
+	if err != nil {
+		return nil, errors.Wrap(ErrAddr, "invalid observed address %s: %s", local, err)
+	}
+
+	if _, ok := addr.(*net.UDPAddr); !ok {
+		return nil, errors.Wrap(ErrAddr, "observed address %s isn't udp", local)
+	}
+
+	return kcp.toMultiaddr(addr)
+}
+
+// reportObserved passes the observed address of c to the handler of the transport
+func (c *kcpCapableConn) reportObserved() {
+	if c.observedAddr != nil && c.kcp.observedHandler != nil {
+		c.kcp.observedHandler(c.remotePeerID, c.localMultiaddr, c.observedAddr)
+	}
+}
+
+// ObservedAddr returns the local multiaddr of the connection as observed by the remote
+// peer, nil unless the connection exchanged it, see ProtocolV2
+func (c *kcpCapableConn) ObservedAddr() multiaddr.Multiaddr {
+	return c.observedAddr
+}
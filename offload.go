@@ -0,0 +1,85 @@
+package kcp
+
+import (
+	"net"
+)
+
+// WithUDPOffload create kcp transport which enables udp receive offload (GRO) where the
+// kernel supports it, so that a burst of packets from a peer is read with one syscall and
+// split again before kcp sees it. It falls back to plain reads elsewhere. Send offload
+// (GSO) isn't supported since kcp-go writes the packets one by one.
+func WithUDPOffload() Option {
+	return func(kcp *kcpTransport) error {
+		kcp.offload = true
+
+		return nil
+	}
+}
+
+// groBufferSize is the largest coalesced read, a udp datagram can't exceed it
+const groBufferSize = 65535
+
+// groConn reads coalesced packets from the gro enabled socket and returns them one by
+// one, ReadFrom is called by the kcp-go read loop of the socket only so it needs no locking
+type groConn struct {
+	*net.UDPConn
+	buf      []byte
+	oob      []byte
+	segments [][]byte // the unread packets of the last coalesced read
+	addr     net.Addr // source of segments
+}
+
+func (conn *groConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for len(conn.segments) == 0 {
+		n, oobn, _, addr, err := conn.ReadMsgUDP(conn.buf, conn.oob)
+
+		if err != nil {
+			return 0, addr, err
+		}
+
+		conn.segments = splitSegments(conn.buf[:n], groSegmentSize(conn.oob[:oobn]))
+		conn.addr = addr
+	}
+
+	n := copy(b, conn.segments[0])
+
+	conn.segments = conn.segments[1:]
+
+	return n, conn.addr, nil
+}
+
+// splitSegments splits the coalesced packets of size each, the last one may be shorter,
+// size 0 means a single packet
+func splitSegments(buf []byte, size int) [][]byte {
+	if size <= 0 || size >= len(buf) {
+		return [][]byte{buf}
+	}
+
+	segments := make([][]byte, 0, (len(buf)+size-1)/size)
+
+	for len(buf) > size {
+		segments = append(segments, buf[:size])
+		buf = buf[size:]
+	}
+
+	return append(segments, buf)
+}
+
+// offloadConn wraps udpConn for receive offload, or returns it as is if the kernel
+// doesn't support it
+func (kcp *kcpTransport) offloadConn(udpConn *net.UDPConn) net.PacketConn {
+	if !kcp.offload {
+		return udpConn
+	}
+
+	if err := enableGRO(udpConn); err != nil {
+		kcp.D("udp receive offload is not supported: {@err}", err)
+		return udpConn
+	}
+
+	return &groConn{
+		UDPConn: udpConn,
+		buf:     make([]byte, groBufferSize),
+		oob:     make([]byte, groOOBSize),
+	}
+}
@@ -0,0 +1,210 @@
+package kcp
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+// packetMuxBacklog the max packets queued for a reader of a muxed socket
+const packetMuxBacklog = 1024
+
+// WithDialFromListener create kcp transport which dials from the udp socket of one of its
+// listeners of the same ip family, so the dialed peers and the nats on the path see the
+// listen port, which hole punching needs. Only the listeners created with it can be
+// dialed from, and without one dials use a new socket
+func WithDialFromListener() Option {
+	return func(kcp *kcpTransport) error {
+		kcp.dialFromListener = true
+
+		return nil
+	}
+}
+
+// packetMux splits the packets of a listener socket between the kcp-go listener and the
+// sessions dialed from the socket, by their remote address
+type packetMux struct {
+	net.PacketConn
+	sync.Mutex
+	listener *muxedConn
+	dialed   map[string]*muxedConn
+	closed   chan struct{} // closed when the socket fails
+	err      error
+}
+
+func newPacketMux(conn net.PacketConn) *packetMux {
+	mux := &packetMux{
+		PacketConn: conn,
+		dialed:     make(map[string]*muxedConn),
+		closed:     make(chan struct{}),
+	}
+
+	mux.listener = mux.newConn("", nil)
+
+	go mux.read()
+
+	return mux
+}
+
+func (mux *packetMux) newConn(raddr string, ref net.PacketConn) *muxedConn {
+	return &muxedConn{
+		PacketConn: mux.PacketConn,
+		mux:        mux,
+		raddr:      raddr,
+		ref:        ref,
+		packets:    make(chan muxedPacket, packetMuxBacklog),
+		closed:     make(chan struct{}),
+	}
+}
+
+// dial returns the packet conn of a session dialed to raddr, which holds ref until it's
+// closed. It returns nil if a session to raddr is dialed from the socket already
+func (mux *packetMux) dial(raddr net.Addr, ref net.PacketConn) *muxedConn {
+	mux.Lock()
+	defer mux.Unlock()
+
+	if _, ok := mux.dialed[raddr.String()]; ok {
+		return nil
+	}
+
+	conn := mux.newConn(raddr.String(), ref)
+
+	mux.dialed[conn.raddr] = conn
+
+	return conn
+}
+
+func (mux *packetMux) remove(conn *muxedConn) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	if mux.dialed[conn.raddr] == conn {
+		delete(mux.dialed, conn.raddr)
+	}
+}
+
+// read hands the packets from the dialed addresses to their sessions and the others to
+// the listener, a reader which doesn't keep up loses its packets like a full socket buffer
+func (mux *packetMux) read() {
+	defer close(mux.closed)
+
+	// kcp-go doesn't send packets larger than its mtu limit
+	buf := make([]byte, pathMTUMax)
+
+	for {
+		n, addr, err := mux.PacketConn.ReadFrom(buf)
+
+		if err != nil {
+			mux.err = err
+			return
+		}
+
+		mux.Lock()
+		conn, ok := mux.dialed[addr.String()]
+		mux.Unlock()
+
+		if !ok {
+			conn = mux.listener
+		}
+
+		packet := muxedPacket{b: append([]byte{}, buf[:n]...), addr: addr}
+
+		select {
+		case conn.packets <- packet:
+		default:
+		}
+	}
+}
+
+type muxedPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+// muxedConn the packet conn of the listener or a dialed session on a muxed socket
+type muxedConn struct {
+	net.PacketConn
+	mux       *packetMux
+	raddr     string         // remote address of the dialed session, empty for the listener
+	ref       net.PacketConn // socket reference released by Close
+	packets   chan muxedPacket
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (conn *muxedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-conn.packets:
+		return copy(b, packet.b), packet.addr, nil
+	case <-conn.closed:
+		return 0, nil, io.ErrClosedPipe
+	case <-conn.mux.closed:
+		return 0, nil, conn.mux.err
+	}
+}
+
+// Close stops the reads of the conn, the packets from its remote address go to the
+// listener again
+func (conn *muxedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+
+		conn.mux.remove(conn)
+
+		if conn.ref != nil {
+			conn.ref.Close()
+		}
+	})
+
+	return nil
+}
+
+// muxListener the kcp-go listener on a muxed socket, closing it stops the reads of the
+// listener, the sessions dialed from the socket keep it open
+type muxListener struct {
+	*kcpgo.Listener
+	mux *packetMux
+}
+
+func (l *muxListener) Close() error {
+	err := l.Listener.Close()
+
+	l.mux.listener.Close()
+
+	return err
+}
+
+// dialMux returns the muxed socket of a listener which can dial addr, and its monitor
+func (kcp *kcpTransport) dialMux(addr *net.UDPAddr) (*sharedSocket, *monitorConn) {
+	if !kcp.dialFromListener {
+		return nil, nil
+	}
+
+	lc := kcp.lifecycle
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	for l := range lc.listeners {
+		if l.socket.mux == nil {
+			continue
+		}
+
+		local := l.socket.LocalAddr().(*net.UDPAddr)
+
+		if (local.IP.To4() != nil) != (addr.IP.To4() != nil) {
+			continue
+		}
+
+		// a socket bound to a loopback address can only reach loopback addresses
+		if local.IP.IsLoopback() && !addr.IP.IsLoopback() {
+			continue
+		}
+
+		return l.socket, l.monitor
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,94 @@
+package kcp
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+// rejectBackoff the quiet time after which the address of a rejected peer is accepted again,
+// kcp-go accepts every later packet of the dialer as a new session
+const rejectBackoff = 10 * time.Second
+
+// PeerValidator checks the authenticated remote peer of a session accepted from raddr
+type PeerValidator func(p peer.ID, raddr net.Addr) bool
+
+// WithPeerValidator create kcp transport whose listeners close the accepted sessions
+// whose authenticated remote peer is rejected by validator, before smux is set up.
+// The remote peer is only authenticated with tls or WithSecurity
+func WithPeerValidator(validator PeerValidator) Option {
+	return func(kcp *kcpTransport) error {
+		kcp.peerValidator = validator
+		return nil
+	}
+}
+
+// WithAllowedPeers create kcp transport whose listeners only accept sessions
+// authenticated as one of peers
+func WithAllowedPeers(peers ...peer.ID) Option {
+	allowed := make(map[peer.ID]struct{}, len(peers))
+
+	for _, p := range peers {
+		allowed[p] = struct{}{}
+	}
+
+	return WithPeerValidator(func(p peer.ID, raddr net.Addr) bool {
+		_, ok := allowed[p]
+		return ok
+	})
+}
+
+// reject closes the secured session sess of a rejected peer
+func (l *kcpListener) reject(sess net.Conn, udpSession *kcpgo.UDPSession) {
+	// the close alert fails the smux session of the dialer
+	if closer, ok := sess.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+	}
+
+	l.rejected.add(udpSession.RemoteAddr())
+
+	udpSession.Close()
+	l.monitor.unwatch(udpSession)
+}
+
+// rejectedAddrs the remote addresses of rejected peers
+type rejectedAddrs struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+func (r *rejectedAddrs) add(raddr net.Addr) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.seen == nil {
+		r.seen = make(map[string]time.Time)
+	}
+
+	r.seen[raddr.String()] = time.Now()
+}
+
+// contains returns whether raddr was rejected and refreshes its backoff
+func (r *rejectedAddrs) contains(raddr net.Addr) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+
+	for addr, seen := range r.seen {
+		if now.Sub(seen) > rejectBackoff {
+			delete(r.seen, addr)
+		}
+	}
+
+	if _, ok := r.seen[raddr.String()]; !ok {
+		return false
+	}
+
+	r.seen[raddr.String()] = now
+
+	return true
+}
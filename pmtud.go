@@ -0,0 +1,180 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/libs4go/errors"
+)
+
+const (
+	pathMTUMin          = 512                    // udp payload every path is assumed to carry
+	pathMTUMax          = 1500                   // kcp-go mtu limit
+	pathMTUPrecision    = 16                     // stop the search when the range is narrower
+	pathMTUProbes       = 2                      // probes sent per size before it is considered too large
+	pathMTUProbeMin     = 100 * time.Millisecond // min probe reply timeout
+	pathMTUProbeMax     = 2 * time.Second        // max probe reply timeout
+	pathMTUProbeDefault = time.Second            // probe reply timeout before the rtt is sampled
+	pathMTUPoll         = 5 * time.Millisecond   // probe reply polling interval
+)
+
+// out-of-band path mtu probes, padded to the probed size with non zero bytes so that
+// peers which don't monitor their sockets never mistake them for a new kcp session
+var (
+	probeMTU    = []byte("\x00kcp-pmtu")
+	probeMTUAck = []byte("\x00kcp-pmtu-ack")
+)
+
+// WithPathMTUDiscovery create kcp transport which discovers the path mtu of each
+// connection, up to maxMtu, by probing with padded packets of increasing size, and
+// sets the session mtu accordingly. The remote peer must enable the discovery too,
+// otherwise the probes are never answered and the mtu is kept. The don't fragment bit is only set on
+// linux, elsewhere fragmented probes may pass and overestimate the path mtu.
+func WithPathMTUDiscovery(maxMtu int) Option {
+	return func(kcp *kcpTransport) error {
+		if maxMtu < pathMTUMin || maxMtu > pathMTUMax {
+			return errors.Wrap(ErrOption, "invalid path mtu discovery max mtu %d", maxMtu)
+		}
+
+		kcp.pathMTU = maxMtu
+		kcp.socketConf.dontFragment = true
+
+		return nil
+	}
+}
+
+// newMTUProbe creates a probe packet of size bytes
+func newMTUProbe(size int) []byte {
+	probe := bytes.Repeat([]byte{0xff}, size)
+
+	copy(probe, probeMTU)
+
+	return probe
+}
+
+// answerMTUProbe replies probe with its size, returns false if packet isn't a probe
+func (conn *monitorConn) answerMTUProbe(packet []byte, addr net.Addr) bool {
+	if !bytes.HasPrefix(packet, probeMTUAck) {
+		if !bytes.HasPrefix(packet, probeMTU) {
+			return false
+		}
+
+		ack := make([]byte, len(probeMTUAck)+2)
+		copy(ack, probeMTUAck)
+		binary.LittleEndian.PutUint16(ack[len(probeMTUAck):], uint16(len(packet)))
+
+		conn.PacketConn.WriteTo(ack, addr)
+
+		return true
+	}
+
+	if len(packet) == len(probeMTUAck)+2 {
+		if m := conn.lookup(addr); m != nil {
+			atomic.StoreInt32(&m.mtuAck, int32(binary.LittleEndian.Uint16(packet[len(probeMTUAck):])))
+		}
+	}
+
+	return true
+}
+
+// probeMTU checks if a size bytes packet reaches the remote peer
+func (c *kcpCapableConn) probeMTU(m *sessionMonitor, size int) bool {
+	timeout := pathMTUProbeDefault
+
+	if rtt := m.rtt(); rtt > 0 {
+		timeout = rtt * 4
+
+		if timeout < pathMTUProbeMin {
+			timeout = pathMTUProbeMin
+		}
+
+		if timeout > pathMTUProbeMax {
+			timeout = pathMTUProbeMax
+		}
+	}
+
+	probe := newMTUProbe(size)
+
+	for i := 0; i < pathMTUProbes; i++ {
+		atomic.StoreInt32(&m.mtuAck, 0)
+
+		sent := time.Now()
+
+		// too large packets may be refused by the local stack
+		if _, err := c.monitorConn.PacketConn.WriteTo(probe, c.udpSession.RemoteAddr()); err != nil {
+			return false
+		}
+
+		if c.awaitMTUAck(m, size, timeout) {
+			// the replies also time the peers which don't push data
+			m.sampleRTT(int64(time.Since(sent)))
+			return true
+		}
+	}
+
+	return false
+}
+
+// awaitMTUAck waits for the reply of the size bytes probe
+func (c *kcpCapableConn) awaitMTUAck(m *sessionMonitor, size int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	ticker := time.NewTicker(pathMTUPoll)
+	defer ticker.Stop()
+
+	for atomic.LoadInt32(&m.mtuAck) != int32(size) {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return false
+		}
+	}
+
+	return true
+}
+
+// runPathMTU binary searches the largest mtu which reaches the remote peer, the mtu is
+// kept if no probe is answered, e.g. by a peer without discovery
+func (c *kcpCapableConn) runPathMTU(m *sessionMonitor) {
+	lo, hi := pathMTUMin, c.kcp.pathMTU
+	acked := false
+
+	for hi-lo >= pathMTUPrecision {
+		size := (lo + hi + 1) / 2
+
+		if c.probeMTU(m, size) {
+			lo = size
+			acked = true
+		} else {
+			hi = size - 1
+		}
+
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+	}
+
+	current := c.MTU()
+
+	if !acked {
+		c.kcp.W("path mtu probes to {@raddr} not answered, keep mtu {@mtu}", c.remoteMultiaddr, current)
+		return
+	}
+
+	if lo == current {
+		return
+	}
+
+	if c.setMTU(lo) {
+		c.kcp.I("path mtu to {@raddr} discovered, change mtu from {@old} to {@new}", c.remoteMultiaddr, current, lo)
+	}
+}
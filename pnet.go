@@ -0,0 +1,48 @@
+package kcp
+
+import (
+	"net"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	ipnet "github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/libp2p/go-libp2p-core/transport"
+	pnet "github.com/libp2p/go-libp2p-pnet"
+	"github.com/libs4go/errors"
+)
+
+// WithPrivateNetwork create kcp transport which joins the libp2p private network of psk,
+// the connections are protected by psk before the security handshake, so only the peers
+// sharing psk can connect
+func WithPrivateNetwork(psk ipnet.PSK) Option {
+	return func(kcp *kcpTransport) error {
+		if len(psk) != 32 {
+			return errors.Wrap(ErrOption, "invalid private network psk length %d", len(psk))
+		}
+
+		kcp.psk = psk
+
+		return nil
+	}
+}
+
+// Constructor returns the libp2p transport constructor for libp2p.Transport, which
+// creates kcp transport with the host's private key and private network psk if any,
+// followed by options
+func Constructor(options ...Option) func(privkey crypto.PrivKey, psk ipnet.PSK) (transport.Transport, error) {
+	return func(privkey crypto.PrivKey, psk ipnet.PSK) (transport.Transport, error) {
+		if len(psk) > 0 {
+			options = append([]Option{WithPrivateNetwork(psk)}, options...)
+		}
+
+		return New(privkey, options...)
+	}
+}
+
+// protect protects conn by the private network psk if any
+func (kcp *kcpTransport) protect(conn net.Conn) (net.Conn, error) {
+	if kcp.psk == nil {
+		return conn, nil
+	}
+
+	return pnet.NewProtectedConn(kcp.psk, conn)
+}
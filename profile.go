@@ -0,0 +1,130 @@
+package kcp
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libs4go/errors"
+)
+
+// Profile kcp and smux settings of the connections to one peer, zero fields keep
+// the transport settings
+type Profile struct {
+	Mode         string // kcptun preset, see WithMode
+	Interval     int    // kcp update interval in milliseconds, enables the nodelay parameters below
+	NoDelay      bool   // kcp nodelay mode, see WithNoDelay
+	Resend       int    // kcp fast resend
+	NoCongestion bool   // disable kcp congestion control
+	SndWnd       int    // kcp send window in packets
+	RcvWnd       int    // kcp receive window in packets
+	MTU          int    // kcp session mtu
+	DataShards   int    // fec data shards, only applies to dialed connections
+	ParityShards int    // fec parity shards, only applies to dialed connections
+	SmuxVersion  int    // smux protocol version
+}
+
+// options converts the profile to transport options
+func (profile Profile) options() []Option {
+	var options []Option
+
+	if profile.Mode != "" {
+		options = append(options, WithMode(profile.Mode))
+	}
+
+	if profile.Interval > 0 {
+		options = append(options, WithNoDelay(boolToInt(profile.NoDelay), profile.Interval, profile.Resend, boolToInt(profile.NoCongestion)))
+	}
+
+	if profile.SndWnd > 0 || profile.RcvWnd > 0 {
+		options = append(options, WithWindowSize(profile.SndWnd, profile.RcvWnd))
+	}
+
+	if profile.MTU > 0 {
+		options = append(options, WithMTU(profile.MTU))
+	}
+
+	if profile.DataShards > 0 || profile.ParityShards > 0 {
+		options = append(options, WithFEC(profile.DataShards, profile.ParityShards))
+	}
+
+	if profile.SmuxVersion > 0 {
+		options = append(options, WithSmuxVersion(profile.SmuxVersion))
+	}
+
+	return options
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// WithPeerProfile create kcp transport which applies profile to the connections
+// dialed to or accepted from peer p, the fec settings of accepted connections are
+// decided by the listener and can't be changed per peer
+func WithPeerProfile(p peer.ID, profile Profile) Option {
+	return func(kcp *kcpTransport) error {
+		// validate the profile early instead of failing the dials
+		probe := *kcp
+
+		for _, option := range profile.options() {
+			if err := option(&probe); err != nil {
+				return errors.Wrap(err, "invalid profile of peer %s", p.Pretty())
+			}
+		}
+
+		// the derived transports share the map, e.g. those of WithDialOptions, so it's
+		// replaced instead of modified
+		profiles := make(map[peer.ID]Profile, len(kcp.profiles)+1)
+
+		for id, profile := range kcp.profiles {
+			profiles[id] = profile
+		}
+
+		profiles[p] = profile
+
+		kcp.profiles = profiles
+
+		return nil
+	}
+}
+
+// derive returns a copy of the transport with options applied, or the transport
+// itself if there are no options
+func (kcp *kcpTransport) derive(options []Option) (*kcpTransport, error) {
+	if len(options) == 0 {
+		return kcp, nil
+	}
+
+	derived := *kcp
+	derived.base = kcp.root()
+
+	for _, option := range options {
+		if err := option(&derived); err != nil {
+			return nil, err
+		}
+	}
+
+	return &derived, nil
+}
+
+// peerOptions returns the profile options of peer p
+func (kcp *kcpTransport) peerOptions(p peer.ID) []Option {
+	profile, ok := kcp.profiles[p]
+
+	if !ok {
+		return nil
+	}
+
+	return profile.options()
+}
+
+// root returns the transport created by New
+func (kcp *kcpTransport) root() *kcpTransport {
+	if kcp.base != nil {
+		return kcp.base
+	}
+
+	return kcp
+}
@@ -0,0 +1,58 @@
+package kcp
+
+import (
+	"github.com/libs4go/errors"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// WithProtocolCode create kcp transport whose multiaddrs use code instead of 482 for the
+// kcp component, e.g. a private-use code which doesn't collide with the other protocols
+// of the process. Both peers need the same code
+func WithProtocolCode(code int) Option {
+	return func(kcp *kcpTransport) error {
+		if code <= 0 {
+			return errors.Wrap(ErrOption, "invalid multiaddr protocol code %d", code)
+		}
+
+		kcp.protocol.Code = code
+		kcp.protocol.VCode = multiaddr.CodeToVarint(code)
+
+		return nil
+	}
+}
+
+// WithProtocolName create kcp transport whose multiaddrs name the kcp component name
+// instead of kcp, usually together with WithProtocolCode as a name takes only one code
+func WithProtocolName(name string) Option {
+	return func(kcp *kcpTransport) error {
+		if name == "" {
+			return errors.Wrap(ErrOption, "empty multiaddr protocol name")
+		}
+
+		kcp.protocol.Name = name
+
+		return nil
+	}
+}
+
+// registerProtocol registers the multiaddr protocol proto, the transports with the same
+// protocol share the registration
+func registerProtocol(proto multiaddr.Protocol) error {
+	if registered := multiaddr.ProtocolWithCode(proto.Code); registered.Code != 0 {
+		if registered.Name != proto.Name {
+			return errors.Wrap(ErrOption, "multiaddr protocol code %d is taken by %s", proto.Code, registered.Name)
+		}
+
+		return nil
+	}
+
+	if registered := multiaddr.ProtocolWithName(proto.Name); registered.Code != 0 {
+		return errors.Wrap(ErrOption, "multiaddr protocol name %s is taken by code %d", proto.Name, registered.Code)
+	}
+
+	if err := multiaddr.AddProtocol(proto); err != nil {
+		return errors.Wrap(ErrOption, "register multiaddr protocol %s error: %s", proto.Name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package kcp
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libs4go/errors"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// connMemoryPriority reserves the connection memory as long as the limit isn't exceeded,
+// like network.ReservationPriorityAlways of the libp2p resource manager
+const connMemoryPriority = 255
+
+// ResourceManager the connection and stream limits of the libp2p resource manager, which
+// go-libp2p-core v0.6 doesn't have. A go-libp2p network.ResourceManager is adapted by
+// returning its network.ConnManagementScope and network.StreamManagementScope
+type ResourceManager interface {
+	// OpenConnection reserves a connection to or from endpoint in direction dir
+	OpenConnection(dir network.Direction, usefd bool, endpoint multiaddr.Multiaddr) (ConnScope, error)
+	// OpenStream reserves a stream with peer p in direction dir
+	OpenStream(p peer.ID, dir network.Direction) (StreamScope, error)
+}
+
+// ResourceScope the memory reservations of a scope
+type ResourceScope interface {
+	// ReserveMemory reserves size bytes of memory with priority prio
+	ReserveMemory(size int, prio uint8) error
+	// ReleaseMemory releases size bytes of reserved memory
+	ReleaseMemory(size int)
+}
+
+// ConnScope the resource scope of a connection, released by Done
+type ConnScope interface {
+	ResourceScope
+	// SetPeer moves the scope to the scope of the remote peer p
+	SetPeer(p peer.ID) error
+	// Done releases the scope and all of its reservations
+	Done()
+}
+
+// StreamScope the resource scope of a stream, released by Done
+type StreamScope interface {
+	ResourceScope
+	// Done releases the scope and all of its reservations
+	Done()
+}
+
+// WithResourceManager create kcp transport whose connections reserve a connection and
+// the muxer receive buffer, and whose streams reserve a stream and the stream buffer in
+// the scopes of rcmgr. The connections exceeding the limits fail to be dialed or accepted,
+// the streams fail to be opened or are closed when accepted
+func WithResourceManager(rcmgr ResourceManager) Option {
+	return func(kcp *kcpTransport) error {
+		if rcmgr == nil {
+			return errors.Wrap(ErrOption, "nil resource manager")
+		}
+
+		kcp.rcmgr = rcmgr
+
+		return nil
+	}
+}
+
+// nullScope the scope of the connections without resource manager
+type nullScope struct{}
+
+func (nullScope) ReserveMemory(size int, prio uint8) error { return nil }
+func (nullScope) ReleaseMemory(size int)                   {}
+func (nullScope) SetPeer(p peer.ID) error                  { return nil }
+func (nullScope) Done()                                    {}
+
+// openConnScope reserves a connection to or from endpoint in direction dir
+func (kcp *kcpTransport) openConnScope(dir network.Direction, endpoint multiaddr.Multiaddr) (ConnScope, error) {
+	if kcp.rcmgr == nil {
+		return nullScope{}, nil
+	}
+
+	scope, err := kcp.rcmgr.OpenConnection(dir, false, endpoint)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "resource manager refused connection %s", endpoint)
+	}
+
+	return scope, nil
+}
+
+// reserveConn moves scope to the scope of the remote peer p and reserves the memory
+// of the muxer session
+func (kcp *kcpTransport) reserveConn(scope ConnScope, p peer.ID) error {
+	if err := scope.SetPeer(p); err != nil {
+		return errors.Wrap(err, "resource manager refused peer %s", p.Pretty())
+	}
+
+	if err := scope.ReserveMemory(kcp.muxerMemory(), connMemoryPriority); err != nil {
+		return errors.Wrap(err, "resource manager refused connection memory")
+	}
+
+	return nil
+}
+
+// muxerMemory returns the receive buffer size of the muxer session
+func (kcp *kcpTransport) muxerMemory() int {
+	if kcp.yamux {
+		return int(kcp.yamuxConf().MaxStreamWindowSize)
+	}
+
+	return kcp.smuxConf().MaxReceiveBuffer
+}
+
+// openStreamScope reserves a stream in direction dir and its buffer
+func (c *kcpCapableConn) openStreamScope(dir network.Direction) (StreamScope, error) {
+	if c.kcp.rcmgr == nil {
+		return nullScope{}, nil
+	}
+
+	scope, err := c.kcp.rcmgr.OpenStream(c.remotePeerID, dir)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "resource manager refused stream")
+	}
+
+	if err := scope.ReserveMemory(c.kcp.streamMemory(), connMemoryPriority); err != nil {
+		scope.Done()
+		return nil, errors.Wrap(err, "resource manager refused stream memory")
+	}
+
+	return scope, nil
+}
+
+// streamMemory returns the max bytes a stream buffers, smux v1 doesn't limit the streams
+// but the session receive buffer, their share is counted as the v2 stream buffer
+func (kcp *kcpTransport) streamMemory() int {
+	if kcp.yamux {
+		return int(kcp.yamuxConf().MaxStreamWindowSize)
+	}
+
+	return kcp.smuxConf().MaxStreamBuffer
+}
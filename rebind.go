@@ -0,0 +1,438 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libs4go/errors"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+const (
+	pathKeyLabel    = "EXPORTER-libp2p-kcp-path" // tls exporter label of the path key
+	pathKeySize     = 32
+	maxPathProbes   = 4               // pending validations of new addresses per session
+	pathProbeExpiry = 3 * time.Second // unanswered validations are dropped after it
+)
+
+// WithNATRebinding create kcp transport whose listeners key the sessions of tls connections
+// by their conv besides the remote address, so a session whose peer comes from a new
+// address after a nat rebinding keeps going instead of being orphaned. The packets from
+// the new address are dropped, and the session keeps sending to the old one, until the
+// new address answers a path challenge with a key exported by the tls session, so a
+// spoofed packet can't move it. A conv used by several connections of a listener isn't
+// rebound, dialers should use the random convs or DerivedConv with distinct seeds. With
+// WithAddressValidation the new address must validate first. The listeners answer the
+// path challenges of migrating dialers too, see WithMigration. The sharded listeners
+// don't rebind, see WithReusePortShards
+func WithNATRebinding() Option {
+	return func(kcp *kcpTransport) error {
+		kcp.natRebinding = true
+
+		return nil
+	}
+}
+
+// rebindingConn hands the packets of a bound conv arriving from a new address to kcp-go
+// as coming from the address kcp-go keys the session by, and sends the packets written
+// to that address to the new one
+type rebindingConn struct {
+	net.PacketConn
+	sync.RWMutex
+	kcp      *kcpTransport
+	monitor  *monitorConn
+	block    kcpgo.BlockCrypt        // kcp packets are encrypted by block
+	fec      bool                    // kcp packets are wrapped by fec headers
+	sessions map[string]*rebinding   // by the remote address kcp-go keys them by
+	paths    map[string]*rebinding   // by the current remote address
+	convs    map[uint32][]*rebinding // by conv
+	probes   map[string]*pathProbe   // by the new address they validate
+}
+
+// rebindAddrs wraps the packet conn of a listener with nat rebinding if enabled
+func (kcp *kcpTransport) rebindAddrs(packetConn net.PacketConn, monitor *monitorConn) *rebindingConn {
+	if !kcp.natRebinding {
+		return nil
+	}
+
+	return &rebindingConn{
+		PacketConn: packetConn,
+		kcp:        kcp,
+		monitor:    monitor,
+		block:      kcp.block,
+		fec:        kcp.dataShards > 0,
+		sessions:   make(map[string]*rebinding),
+		paths:      make(map[string]*rebinding),
+		convs:      make(map[uint32][]*rebinding),
+		probes:     make(map[string]*pathProbe),
+	}
+}
+
+// rebinding the binding of an accepted session to the current address of its peer
+type rebinding struct {
+	conn    *rebindingConn
+	conv    uint32
+	peer    peer.ID
+	key     []byte   // authenticates the path responses of the peer
+	addr    net.Addr // the remote address kcp-go keys the session by
+	current net.Addr // guarded by the conn
+	probes  int      // pending path probes, guarded by the conn
+}
+
+// pathProbe the validation of a new address of a session, which must answer the challenge
+// with response
+type pathProbe struct {
+	r        *rebinding
+	response []byte
+	sent     time.Time
+}
+
+// bind binds the session of a tls connection, whose path key is exported from state,
+// returns nil if conn is nil
+func (conn *rebindingConn) bind(udpSession *kcpgo.UDPSession, p peer.ID, state tls.ConnectionState) (*rebinding, error) {
+	if conn == nil {
+		return nil, nil
+	}
+
+	key, err := exportPathKey(state)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rebinding{
+		conn:    conn,
+		conv:    udpSession.GetConv(),
+		peer:    p,
+		key:     key,
+		addr:    udpSession.RemoteAddr(),
+		current: udpSession.RemoteAddr(),
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.sessions[r.addr.String()] = r
+	conn.paths[r.addr.String()] = r
+	conn.convs[r.conv] = append(conn.convs[r.conv], r)
+
+	return r, nil
+}
+
+func (conn *rebindingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := conn.PacketConn.ReadFrom(b)
+
+		if err != nil {
+			return n, addr, err
+		}
+
+		if n < kcpgo.IKCP_OVERHEAD && (answerChallenge(conn.PacketConn, b[:n], addr) || conn.checkResponse(b[:n], addr)) {
+			continue
+		}
+
+		conn.RLock()
+		r, ok := conn.paths[addr.String()]
+		conn.RUnlock()
+
+		if ok {
+			return n, r.addr, nil
+		}
+
+		// the packets of a bound session from a new address are lost until it's validated
+		if r := conn.lookup(b[:n]); r != nil {
+			conn.probe(r, addr)
+			continue
+		}
+
+		return n, addr, nil
+	}
+}
+
+func (conn *rebindingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	conn.RLock()
+	if r, ok := conn.sessions[addr.String()]; ok {
+		addr = r.current
+	}
+	conn.RUnlock()
+
+	return conn.PacketConn.WriteTo(b, addr)
+}
+
+// lookup returns the session of the conv of packet, nil if the packet isn't a kcp packet
+// of a conv bound to a single session
+func (conn *rebindingConn) lookup(packet []byte) *rebinding {
+	conv, ok := conn.conv(packet)
+
+	if !ok {
+		return nil
+	}
+
+	conn.RLock()
+	defer conn.RUnlock()
+
+	if len(conn.convs[conv]) != 1 {
+		return nil
+	}
+
+	return conn.convs[conv][0]
+}
+
+// probe sends a path challenge to the new address of the session of r, at most every
+// pathChallengeInterval, and to maxPathProbes addresses at once
+func (conn *rebindingConn) probe(r *rebinding, addr net.Addr) {
+	now := time.Now()
+
+	conn.Lock()
+
+	probe, ok := conn.probes[addr.String()]
+
+	if ok && (probe.r != r || now.Sub(probe.sent) < pathChallengeInterval) {
+		conn.Unlock()
+		return
+	}
+
+	if !ok {
+		conn.expireProbes(now)
+
+		if r.probes >= maxPathProbes {
+			conn.Unlock()
+			return
+		}
+
+		probe = &pathProbe{r: r}
+		conn.probes[addr.String()] = probe
+		r.probes++
+	}
+
+	token := make([]byte, pathTokenSize)
+
+	if _, err := rand.Read(token); err != nil {
+		conn.Unlock()
+		return
+	}
+
+	probe.response = append(append([]byte{}, pathResponse...), pathMAC(r.key, token)...)
+	probe.sent = now
+
+	conn.Unlock()
+
+	conn.kcp.D("session {@conv} of {@peer} validates {@raddr}", r.conv, r.peer, addr)
+
+	conn.PacketConn.WriteTo(append(append([]byte{}, pathChallenge...), token...), addr)
+}
+
+// expireProbes drops the probes unanswered for pathProbeExpiry, the conn must be locked
+func (conn *rebindingConn) expireProbes(now time.Time) {
+	for key, probe := range conn.probes {
+		if now.Sub(probe.sent) > pathProbeExpiry {
+			delete(conn.probes, key)
+			probe.r.probes--
+		}
+	}
+}
+
+// checkResponse moves the session whose probe of addr is answered by packet, returns
+// false if packet isn't a path response
+func (conn *rebindingConn) checkResponse(packet []byte, addr net.Addr) bool {
+	if len(packet) != len(pathResponse)+pathTokenSize || !bytes.HasPrefix(packet, pathResponse) {
+		return false
+	}
+
+	conn.Lock()
+
+	probe, ok := conn.probes[addr.String()]
+
+	if !ok || !hmac.Equal(packet, probe.response) {
+		conn.Unlock()
+		return true
+	}
+
+	delete(conn.probes, addr.String())
+
+	r := probe.r
+	r.probes--
+
+	// closed meanwhile
+	if conn.sessions[r.addr.String()] != r {
+		conn.Unlock()
+		return true
+	}
+
+	old := r.current
+
+	delete(conn.paths, old.String())
+	conn.paths[addr.String()] = r
+	r.current = addr
+
+	conn.Unlock()
+
+	conn.kcp.I("session {@conv} of {@peer} moved from {@old} to {@raddr}", r.conv, r.peer, old, addr)
+
+	if conn.monitor != nil {
+		if m := conn.monitor.lookup(old); m != nil {
+			conn.monitor.detach(old)
+			conn.monitor.attach(addr, m)
+		}
+	}
+
+	return true
+}
+
+// conv returns the conv of a kcp packet
+func (conn *rebindingConn) conv(packet []byte) (conv uint32, ok bool) {
+	read := func(plain []byte) {
+		if conn.fec {
+			plain = fecPayload(plain)
+		}
+
+		if len(plain) >= kcpgo.IKCP_OVERHEAD {
+			conv, ok = binary.LittleEndian.Uint32(plain), true
+		}
+	}
+
+	if conn.block == nil {
+		read(packet)
+	} else {
+		decryptPayload(conn.block, packet, read)
+	}
+
+	return conv, ok
+}
+
+// remoteAddr returns the current remote address of the session
+func (r *rebinding) remoteAddr() net.Addr {
+	r.conn.RLock()
+	defer r.conn.RUnlock()
+
+	return r.current
+}
+
+// release unbinds the session of a closed connection, r may be nil
+func (r *rebinding) release() {
+	if r == nil {
+		return
+	}
+
+	conn := r.conn
+
+	conn.Lock()
+
+	if conn.sessions[r.addr.String()] == r {
+		delete(conn.sessions, r.addr.String())
+	}
+
+	if conn.paths[r.current.String()] == r {
+		delete(conn.paths, r.current.String())
+	}
+
+	bound := conn.convs[r.conv]
+
+	for i, other := range bound {
+		if other == r {
+			bound = append(bound[:i], bound[i+1:]...)
+			break
+		}
+	}
+
+	if len(bound) == 0 {
+		delete(conn.convs, r.conv)
+	} else {
+		conn.convs[r.conv] = bound
+	}
+
+	for key, probe := range conn.probes {
+		if probe.r == r {
+			delete(conn.probes, key)
+		}
+	}
+
+	current := r.current
+
+	conn.Unlock()
+
+	// the connection detaches the monitor of the address kcp-go keys the session by
+	if conn.monitor != nil && current.String() != r.addr.String() {
+		conn.monitor.detach(current)
+	}
+}
+
+// exportPathKey exports the key of the path responses from the tls session of a connection
+func exportPathKey(state tls.ConnectionState) ([]byte, error) {
+	key, err := state.ExportKeyingMaterial(pathKeyLabel, nil, pathKeySize)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "export path key error")
+	}
+
+	return key, nil
+}
+
+// pathMAC returns the authenticated answer to the challenge token
+func pathMAC(key, token []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+
+	mac.Write(token)
+
+	return mac.Sum(nil)[:pathTokenSize]
+}
+
+// pathKey the path key of a dialed session, set once the tls handshake completed
+type pathKey struct {
+	key atomic.Value // []byte
+}
+
+func (k *pathKey) export(state tls.ConnectionState) error {
+	key, err := exportPathKey(state)
+
+	if err != nil {
+		return err
+	}
+
+	k.key.Store(key)
+
+	return nil
+}
+
+// answeringConn the dialer side of nat rebinding, answers the path challenges of the
+// listener with the path key, and drops them before the key is set
+type answeringConn struct {
+	net.PacketConn
+	raddr net.Addr
+	key   *pathKey
+}
+
+// answerPaths wraps the packet conn of a session dialed to raddr, key may be nil. The bare
+// sockets of WithBatchIO stay unwrapped, their sessions don't move
+func answerPaths(packetConn net.PacketConn, raddr net.Addr, key *pathKey) net.PacketConn {
+	if _, bare := packetConn.(*net.UDPConn); bare || key == nil {
+		return packetConn
+	}
+
+	return &answeringConn{PacketConn: packetConn, raddr: raddr, key: key}
+}
+
+func (conn *answeringConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := conn.PacketConn.ReadFrom(b)
+
+		if err != nil || n != len(pathChallenge)+pathTokenSize || !bytes.HasPrefix(b[:n], pathChallenge) {
+			return n, addr, err
+		}
+
+		if key, ok := conn.key.key.Load().([]byte); ok && addr.String() == conn.raddr.String() {
+			response := append(append([]byte{}, pathResponse...), pathMAC(key, b[len(pathChallenge):n])...)
+
+			conn.PacketConn.WriteTo(response, addr)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package kcp
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libs4go/errors"
+)
+
+// reconfigured the options applied by Transport.Reconfigure, shared by the derived transports
+type reconfigured struct {
+	sync.Mutex
+	options []Option
+}
+
+// Reconfigure applies profile to the future connections and re-applies the kcp session
+// settings of the established ones, fec and smux settings of the established connections
+// and the listeners can't be changed, peer profiles still override the profile
+func (kcp *kcpTransport) Reconfigure(profile Profile) error {
+	root := kcp.root()
+
+	options := profile.options()
+
+	// validate the profile before touching anything
+	if _, err := root.derive(options); err != nil {
+		return errors.Wrap(err, "invalid profile")
+	}
+
+	root.reconfigured.Lock()
+	root.reconfigured.options = append(append([]Option{}, root.reconfigured.options...), options...)
+	root.reconfigured.Unlock()
+
+	lc := root.lifecycle
+
+	lc.Lock()
+	conns := make([]*kcpCapableConn, 0, len(lc.conns))
+
+	for conn := range lc.conns {
+		conns = append(conns, conn)
+	}
+	lc.Unlock()
+
+	for _, conn := range conns {
+		derived, err := root.derive(root.connOptions(conn.addrOptions, conn.remotePeerID))
+
+		if err != nil {
+			return errors.Wrap(err, "reconfigure connection to %s error", conn.remoteMultiaddr)
+		}
+
+		derived.sessionConf.apply(conn.udpSession)
+
+		if window := derived.sessionConf.window; window != nil && window.sndwnd > 0 {
+			atomic.StoreInt32(&conn.sndwnd, int32(window.sndwnd))
+		}
+
+		if mtu := derived.sessionConf.mtu; mtu > 0 {
+			conn.setMTU(mtu)
+		}
+
+		// the nodelay settings turned kcp-go's congestion window back on
+		if state, ok := conn.congestion.Load().(*congestionState); ok {
+			state.reconfigure(conn, derived)
+		}
+	}
+
+	root.I("reconfigured {@conns} connections", len(conns))
+
+	return nil
+}
+
+// connOptions returns the options which override the transport settings for the
+// connections of peer p, addrOptions are placed between the reconfigured and the
+// peer profile options
+func (kcp *kcpTransport) connOptions(addrOptions []Option, p peer.ID) []Option {
+	root := kcp.root()
+
+	root.reconfigured.Lock()
+	options := append([]Option{}, root.reconfigured.options...)
+	root.reconfigured.Unlock()
+
+	options = append(options, addrOptions...)
+
+	return append(options, kcp.peerOptions(p)...)
+}
@@ -0,0 +1,985 @@
+package kcp
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/sec"
+	"github.com/libp2p/go-libp2p-core/transport"
+	"github.com/libs4go/errors"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// relay stream messages, a message type followed by a length prefixed peer id
+const (
+	relayReserve   = 1 // keep the connection as the reservation of its peer
+	relayConnect   = 2 // connect to the peer through the relay
+	relayConnected = 3 // the peer connects through the relay
+)
+
+// relay statuses replying to relayReserve, relayConnect and relayConnected
+const (
+	relayOK               = 0
+	relayNoReservation    = 1 // the peer has no reservation on the relay
+	relayRefused          = 2 // the peer didn't take the relayed connection
+	relayResourceLimit    = 3 // the relay is out of reservations or circuits
+	relayPermissionDenied = 4 // the RelayACL of the relay denied the request
+)
+
+// the default relay limits, those of the libp2p circuit relay v2
+const (
+	defaultRelayReservations = 128
+	defaultRelayCircuits     = 1024
+	defaultRelayPeerCircuits = 16
+	defaultRelayDuration     = 2 * time.Minute
+	defaultRelayBytes        = 128 * 1024
+)
+
+var circuitMultiaddr = multiaddr.StringCast("/p2p-circuit")
+
+// RelayOption the options of ServeRelay
+type RelayOption func(s *relayService) error
+
+// RelayACL authorizes the reservations and the relayed connections of a relay
+type RelayACL interface {
+	// AllowReserve checks if p may reserve a slot on the relay
+	AllowReserve(p peer.ID) bool
+	// AllowConnect checks if src may connect to dst through the relay
+	AllowConnect(src, dst peer.ID) bool
+}
+
+// WithRelayReservations create relay which keeps at most max reservations, the others
+// are refused until a reserved peer disconnects. 128 by default
+func WithRelayReservations(max int) RelayOption {
+	return func(s *relayService) error {
+		if max <= 0 {
+			return errors.Wrap(ErrOption, "invalid relay reservations %d", max)
+		}
+
+		s.maxReservations = max
+
+		return nil
+	}
+}
+
+// WithRelayCircuits create relay which relays at most max connections, and at most
+// perPeer of them from or to the same peer. 1024 and 16 by default
+func WithRelayCircuits(max, perPeer int) RelayOption {
+	return func(s *relayService) error {
+		if max <= 0 || perPeer <= 0 || perPeer > max {
+			return errors.Wrap(ErrOption, "invalid relay circuits %d per peer %d", max, perPeer)
+		}
+
+		s.maxCircuits = max
+		s.maxPeerCircuits = perPeer
+
+		return nil
+	}
+}
+
+// WithRelayLimit create relay which resets the relayed connections after d, or once
+// either direction relayed n bytes, so that relays only bootstrap direct connections.
+// 2 minutes and 128KiB by default
+func WithRelayLimit(d time.Duration, n int64) RelayOption {
+	return func(s *relayService) error {
+		if d <= 0 || n <= 0 {
+			return errors.Wrap(ErrOption, "invalid relay limit %s %d bytes", d, n)
+		}
+
+		s.maxDuration = d
+		s.maxBytes = n
+
+		return nil
+	}
+}
+
+// WithRelayACL create relay which serves only the reservations and the connections acl
+// allows, by default the relay serves any peer
+func WithRelayACL(acl RelayACL) RelayOption {
+	return func(s *relayService) error {
+		if acl == nil {
+			return errors.Wrap(ErrOption, "nil relay acl")
+		}
+
+		s.acl = acl
+
+		return nil
+	}
+}
+
+// ServeRelay serves the connections accepted by l, a kcp listener, as a relay. The peers
+// reserve a slot on it by listening on its /p2p-circuit address with the relay transport,
+// and the other peers connect to them through it. It returns when l fails or is closed
+func ServeRelay(l transport.Listener, options ...RelayOption) error {
+	listener, ok := l.(*kcpListener)
+
+	if !ok {
+		return errors.Wrap(ErrOption, "relay needs a kcp listener")
+	}
+
+	service := &relayService{
+		kcp:             listener.transport,
+		reservations:    make(map[peer.ID]transport.CapableConn),
+		peerCircuits:    make(map[peer.ID]int),
+		maxReservations: defaultRelayReservations,
+		maxCircuits:     defaultRelayCircuits,
+		maxPeerCircuits: defaultRelayPeerCircuits,
+		maxDuration:     defaultRelayDuration,
+		maxBytes:        defaultRelayBytes,
+	}
+
+	for _, option := range options {
+		if err := option(service); err != nil {
+			return err
+		}
+	}
+
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			return err
+		}
+
+		go service.serve(conn)
+	}
+}
+
+// relayService forwards the streams between the peers connected to a relay
+type relayService struct {
+	sync.Mutex
+	kcp             *kcpTransport
+	reservations    map[peer.ID]transport.CapableConn
+	circuits        int
+	peerCircuits    map[peer.ID]int // the circuits from or to each peer
+	maxReservations int
+	maxCircuits     int
+	maxPeerCircuits int
+	maxDuration     time.Duration
+	maxBytes        int64
+	acl             RelayACL
+}
+
+func (s *relayService) serve(conn transport.CapableConn) {
+	defer s.release(conn)
+
+	for {
+		stream, err := conn.AcceptStream()
+
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn, stream)
+	}
+}
+
+func (s *relayService) handle(conn transport.CapableConn, stream mux.MuxedStream) {
+	msg, p, err := readRelayMsg(stream)
+
+	if err != nil {
+		stream.Reset()
+		return
+	}
+
+	switch msg {
+	case relayReserve:
+		writeRelayStatus(stream, s.reserve(conn))
+		stream.Close()
+	case relayConnect:
+		s.connect(conn, stream, p)
+	default:
+		stream.Reset()
+	}
+}
+
+// reserve keeps conn as the reservation of its peer, a new reservation of the peer
+// replaces the old one
+func (s *relayService) reserve(conn transport.CapableConn) byte {
+	p := conn.RemotePeer()
+
+	if s.acl != nil && !s.acl.AllowReserve(p) {
+		s.kcp.D("relay reservation of {@peer} denied", p.Pretty())
+		return relayPermissionDenied
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.reservations[p]; !ok && len(s.reservations) >= s.maxReservations {
+		s.kcp.W("relay reservation of {@peer} refused, {@max} reservations", p.Pretty(), s.maxReservations)
+		return relayResourceLimit
+	}
+
+	s.reservations[p] = conn
+
+	s.kcp.D("relay reservation of {@peer}", p.Pretty())
+
+	return relayOK
+}
+
+// connect pipes stream to a new stream on the reservation of target
+func (s *relayService) connect(conn transport.CapableConn, stream mux.MuxedStream, target peer.ID) {
+	src := conn.RemotePeer()
+
+	if s.acl != nil && !s.acl.AllowConnect(src, target) {
+		s.kcp.D("relay {@src} to {@dst} denied", src.Pretty(), target.Pretty())
+
+		writeRelayStatus(stream, relayPermissionDenied)
+		stream.Close()
+		return
+	}
+
+	s.Lock()
+	reserved, ok := s.reservations[target]
+	s.Unlock()
+
+	if !ok {
+		writeRelayStatus(stream, relayNoReservation)
+		stream.Close()
+		return
+	}
+
+	if !s.acquireCircuit(src, target) {
+		s.kcp.W("relay {@src} to {@dst} refused, out of circuits", src.Pretty(), target.Pretty())
+
+		writeRelayStatus(stream, relayResourceLimit)
+		stream.Close()
+		return
+	}
+
+	defer s.releaseCircuit(src, target)
+
+	relayed, err := reserved.OpenStream()
+
+	if err == nil {
+		err = writeRelayMsg(relayed, relayConnected, src)
+	}
+
+	var status byte
+
+	if err == nil {
+		status, err = readRelayStatus(relayed)
+	}
+
+	if err != nil || status != relayOK {
+		s.kcp.D("relay {@src} to {@dst} refused: {@err}", src.Pretty(), target.Pretty(), err)
+
+		if relayed != nil {
+			relayed.Reset()
+		}
+
+		writeRelayStatus(stream, relayRefused)
+		stream.Close()
+		return
+	}
+
+	if err := writeRelayStatus(stream, relayOK); err != nil {
+		relayed.Reset()
+		stream.Reset()
+		return
+	}
+
+	s.kcp.D("relay {@src} to {@dst}", src.Pretty(), target.Pretty())
+
+	deadline := time.Now().Add(s.maxDuration)
+
+	stream.SetDeadline(deadline)
+	relayed.SetDeadline(deadline)
+
+	pipe(stream, relayed, s.maxBytes)
+}
+
+// acquireCircuit counts a circuit from src to dst, unless it exceeds the limits
+func (s *relayService) acquireCircuit(src, dst peer.ID) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.circuits >= s.maxCircuits || s.peerCircuits[src] >= s.maxPeerCircuits || s.peerCircuits[dst] >= s.maxPeerCircuits {
+		return false
+	}
+
+	s.circuits++
+	s.peerCircuits[src]++
+	s.peerCircuits[dst]++
+
+	return true
+}
+
+func (s *relayService) releaseCircuit(src, dst peer.ID) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.circuits--
+
+	for _, p := range []peer.ID{src, dst} {
+		if s.peerCircuits[p]--; s.peerCircuits[p] == 0 {
+			delete(s.peerCircuits, p)
+		}
+	}
+}
+
+// release drops the reservation of conn and closes it
+func (s *relayService) release(conn transport.CapableConn) {
+	s.Lock()
+
+	if s.reservations[conn.RemotePeer()] == conn {
+		delete(s.reservations, conn.RemotePeer())
+	}
+
+	s.Unlock()
+
+	conn.Close()
+}
+
+// pipe copies a and b to each other until both directions end. The end of a direction
+// is forwarded by closing the other stream for writing, so the opposite direction keeps
+// flowing, and errors reset both streams as does a direction which exceeds limit bytes
+func pipe(a, b mux.MuxedStream, limit int64) {
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		pipeOneWay(a, b, limit)
+	}()
+
+	go func() {
+		defer wg.Done()
+		pipeOneWay(b, a, limit)
+	}()
+
+	wg.Wait()
+
+	a.Close()
+	b.Close()
+}
+
+// pipeOneWay copies src to dst until src ends
+func pipeOneWay(dst, src mux.MuxedStream, limit int64) {
+	_, err := io.CopyN(dst, src, limit)
+
+	if err != io.EOF {
+		// a copy without error reached the limit
+		dst.Reset()
+		src.Reset()
+		return
+	}
+
+	if closer, ok := dst.(interface{ CloseWrite() error }); ok && closer.CloseWrite() == nil {
+		return
+	}
+
+	// the muxer has no half-close, smux, so the end of either direction ends both
+	dst.Close()
+	src.Close()
+}
+
+func writeRelayMsg(w io.Writer, msg byte, p peer.ID) error {
+	_, err := w.Write(append([]byte{msg, byte(len(p))}, p...))
+
+	return err
+}
+
+func readRelayMsg(r io.Reader) (byte, peer.ID, error) {
+	var header [2]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, "", err
+	}
+
+	buf := make([]byte, header[1])
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, "", err
+	}
+
+	if len(buf) == 0 {
+		return header[0], "", nil
+	}
+
+	p, err := peer.IDFromBytes(buf)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	return header[0], p, nil
+}
+
+func writeRelayStatus(w io.Writer, status byte) error {
+	_, err := w.Write([]byte{status})
+
+	return err
+}
+
+func readRelayStatus(r io.Reader) (byte, error) {
+	var status [1]byte
+
+	_, err := io.ReadFull(r, status[:])
+
+	return status[0], err
+}
+
+// NewRelayTransport creates the transport which dials and listens on /p2p-circuit addresses
+// through relays served by ServeRelay, e.g.
+// /ip4/1.2.3.4/udp/9000/kcp/p2p/QmRelay/p2p-circuit/p2p/QmTarget. tpt is the kcp transport
+// which connects to the relays and secures the relayed connections end to end
+func NewRelayTransport(tpt transport.Transport) (transport.Transport, error) {
+	kcp, ok := tpt.(*kcpTransport)
+
+	if !ok {
+		return nil, errors.Wrap(ErrOption, "relay transport needs a kcp transport")
+	}
+
+	return &relayTransport{kcp: kcp}, nil
+}
+
+// relayTransport the transport of the connections through kcp relays
+type relayTransport struct {
+	kcp *kcpTransport
+}
+
+// splitCircuit splits addr into the kcp multiaddr of the relay, the relay and the target
+func (r *relayTransport) splitCircuit(addr multiaddr.Multiaddr) (multiaddr.Multiaddr, peer.ID, peer.ID, error) {
+	relayAddr, circuit := multiaddr.SplitFunc(addr, func(c multiaddr.Component) bool {
+		return c.Protocol().Code == multiaddr.P_CIRCUIT
+	})
+
+	if relayAddr == nil || circuit == nil {
+		return nil, "", "", errors.Wrap(ErrAddr, "%s isn't a circuit address", addr)
+	}
+
+	base, last := multiaddr.SplitLast(relayAddr)
+
+	if base == nil || last == nil || last.Protocol().Code != multiaddr.P_P2P || !r.kcp.CanDial(base) {
+		return nil, "", "", errors.Wrap(ErrAddr, "%s has no kcp relay", addr)
+	}
+
+	relay, err := peer.IDFromBytes(last.RawValue())
+
+	if err != nil {
+		return nil, "", "", errors.Wrap(ErrAddr, "invalid relay of %s: %s", addr, err)
+	}
+
+	_, rest := multiaddr.SplitFirst(circuit)
+
+	if rest == nil {
+		return relayAddr, relay, "", nil
+	}
+
+	target, tail := multiaddr.SplitFirst(rest)
+
+	if target.Protocol().Code != multiaddr.P_P2P || tail != nil {
+		return nil, "", "", errors.Wrap(ErrAddr, "invalid target of %s", addr)
+	}
+
+	p, err := peer.IDFromBytes(target.RawValue())
+
+	if err != nil {
+		return nil, "", "", errors.Wrap(ErrAddr, "invalid target of %s: %s", addr, err)
+	}
+
+	return relayAddr, relay, p, nil
+}
+
+func (r *relayTransport) CanDial(addr multiaddr.Multiaddr) bool {
+	_, _, _, err := r.splitCircuit(addr)
+
+	return err == nil
+}
+
+// Dial connects to p through the relay of raddr, the connection is secured end to end
+func (r *relayTransport) Dial(ctx context.Context, raddr multiaddr.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	relayAddr, relay, target, err := r.splitCircuit(raddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if target == "" {
+		raddr = raddr.Encapsulate(multiaddr.StringCast("/p2p/" + p.Pretty()))
+	} else if target != p {
+		return nil, errors.Wrap(ErrAddr, "%s isn't an address of %s", raddr, p.Pretty())
+	}
+
+	r.kcp.I("relayed dial to {@addr}", raddr)
+
+	relayConn, err := r.kcp.Dial(ctx, relayAddr, relay)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "dial relay %s error", relayAddr)
+	}
+
+	stream, err := relayConn.OpenStream()
+
+	if err == nil {
+		err = writeRelayMsg(stream, relayConnect, p)
+	}
+
+	var status byte
+
+	if err == nil {
+		status, err = readRelayStatus(stream)
+	}
+
+	if err == nil && status != relayOK {
+		err = errors.Wrap(ErrUnreachable, "relay %s status %d", relay.Pretty(), status)
+	}
+
+	if err != nil {
+		relayConn.Close()
+		return nil, errors.Wrap(err, "connect to %s through relay %s error", p.Pretty(), relay.Pretty())
+	}
+
+	localMultiaddr := relayConn.LocalMultiaddr().Encapsulate(circuitMultiaddr)
+
+	conn, err := r.upgrade(ctx, relayConn, stream, localMultiaddr, raddr, p, true)
+
+	if err != nil {
+		relayConn.Close()
+		return nil, err
+	}
+
+	conn.relay = relayConn
+
+	return conn, nil
+}
+
+// upgrade secures stream, a stream of via, and sets up the muxer session of the relayed
+// connection on it
+func (r *relayTransport) upgrade(ctx context.Context, via transport.CapableConn, stream mux.MuxedStream, laddr, raddr multiaddr.Multiaddr, p peer.ID, client bool) (*relayedConn, error) {
+	kcp := r.kcp
+
+	watched := &watchedConn{
+		Conn: &streamConn{
+			MuxedStream: stream,
+			local:       circuitAddr{laddr},
+			remote:      circuitAddr{raddr},
+		},
+	}
+
+	var conn net.Conn = watched
+
+	// bound the tls handshake, which takes no context, by the deadline of ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+		defer stream.SetDeadline(time.Time{})
+	}
+
+	creds := kcp.credentials()
+
+	remotePeer := p
+	var remotePubKey crypto.PubKey
+
+	if security := creds.security; security != nil {
+		var secConn sec.SecureConn
+		var err error
+
+		if client {
+			secConn, err = security.SecureOutbound(ctx, conn, p)
+		} else {
+			secConn, err = security.SecureInbound(ctx, conn)
+		}
+
+		if err != nil {
+			stream.Reset()
+			return nil, errors.Wrap(err, "relayed security handshake error")
+		}
+
+		remotePeer = secConn.RemotePeer()
+		remotePubKey = secConn.RemotePublicKey()
+
+		conn = secConn
+	} else if identity := creds.identity; identity != nil {
+		var tlsConn *tls.Conn
+		var keyCh <-chan crypto.PubKey
+
+		if client {
+			var tlsConf *tls.Config
+			tlsConf, keyCh = identity.ConfigForPeer(p)
+			tlsConn = tls.Client(conn, kcp.tlsConfig(tlsConf, p))
+		} else {
+			var tlsConf *tls.Config
+			tlsConf, keyCh = identity.ConfigForAny()
+			tlsConn = tls.Server(conn, kcp.tlsConfig(tlsConf, ""))
+		}
+
+		err := tlsConn.Handshake()
+
+		if err == nil {
+			err = kcp.checkTLSState(tlsConn.ConnectionState())
+		}
+
+		if err != nil {
+			stream.Reset()
+			return nil, errors.Wrap(err, "relayed tls handshake error")
+		}
+
+		select {
+		case remotePubKey = <-keyCh:
+		default:
+			remotePubKey, err = resumedPubKey(tlsConn.ConnectionState(), p)
+		}
+
+		if remotePubKey == nil {
+			stream.Reset()
+			return nil, errors.Wrap(err, "relayed tls handshake error")
+		}
+
+		remotePeer, err = peer.IDFromPublicKey(remotePubKey)
+
+		if err != nil {
+			stream.Reset()
+			return nil, err
+		}
+
+		conn = tlsConn
+		kcp = kcp.negotiatedMuxer(tlsConn.ConnectionState())
+	}
+
+	if remotePeer != p {
+		stream.Reset()
+		return nil, errors.Wrap(ErrTLS, "relayed peer %s isn't %s", remotePeer.Pretty(), p.Pretty())
+	}
+
+	session, err := kcp.muxSession(conn, client)
+
+	if err != nil {
+		stream.Reset()
+		return nil, errors.Wrap(err, "create relayed muxer session error")
+	}
+
+	return &relayedConn{
+		transport:       r,
+		via:             via,
+		conn:            conn,
+		watched:         watched,
+		session:         session,
+		localPeer:       creds.localPeer,
+		privKey:         creds.privKey,
+		remotePeer:      remotePeer,
+		remotePubKey:    remotePubKey,
+		localMultiaddr:  laddr,
+		remoteMultiaddr: raddr,
+	}, nil
+}
+
+// Listen reserves a slot on the relay of laddr, a /p2p-circuit address without target,
+// and accepts the connections relayed to the local peer
+func (r *relayTransport) Listen(laddr multiaddr.Multiaddr) (transport.Listener, error) {
+	relayAddr, relay, target, err := r.splitCircuit(laddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if target != "" {
+		return nil, errors.Wrap(ErrAddr, "listen on %s with a target", laddr)
+	}
+
+	r.kcp.I("listen on relay {@addr}", laddr)
+
+	relayConn, err := r.kcp.Dial(context.Background(), relayAddr, relay)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "dial relay %s error", relayAddr)
+	}
+
+	stream, err := relayConn.OpenStream()
+
+	if err == nil {
+		err = writeRelayMsg(stream, relayReserve, "")
+	}
+
+	var status byte
+
+	if err == nil {
+		status, err = readRelayStatus(stream)
+	}
+
+	if err == nil && status != relayOK {
+		err = errors.Wrap(ErrUnreachable, "relay %s status %d", relay.Pretty(), status)
+	}
+
+	if err != nil {
+		relayConn.Close()
+		return nil, errors.Wrap(err, "reserve on relay %s error", relay.Pretty())
+	}
+
+	stream.Close()
+
+	l := &relayListener{
+		transport: r,
+		relayConn: relayConn,
+		laddr:     laddr,
+		accepted:  make(chan transport.CapableConn),
+		closed:    make(chan struct{}),
+	}
+
+	go l.serve()
+
+	return l, nil
+}
+
+func (r *relayTransport) Protocols() []int {
+	return []int{multiaddr.P_CIRCUIT}
+}
+
+// Proxy returns true, the relayed connections go through the relay
+func (r *relayTransport) Proxy() bool {
+	return true
+}
+
+func (r *relayTransport) String() string {
+	return "kcp-relay"
+}
+
+// relayListener accepts the connections relayed through its reservation
+type relayListener struct {
+	transport *relayTransport
+	relayConn transport.CapableConn
+	laddr     multiaddr.Multiaddr
+	accepted  chan transport.CapableConn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// serve upgrades the streams the relay opens for the relayed connections
+func (l *relayListener) serve() {
+	for {
+		stream, err := l.relayConn.AcceptStream()
+
+		if err != nil {
+			l.Close()
+			return
+		}
+
+		go func() {
+			conn, err := l.upgrade(stream)
+
+			if err != nil {
+				l.transport.kcp.W("drop relayed connection: {@err}", err)
+				return
+			}
+
+			select {
+			case l.accepted <- conn:
+			case <-l.closed:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (l *relayListener) upgrade(stream mux.MuxedStream) (transport.CapableConn, error) {
+	msg, p, err := readRelayMsg(stream)
+
+	if err == nil && (msg != relayConnected || p == "") {
+		err = errors.Wrap(ErrAddr, "unexpected relay message %d", msg)
+	}
+
+	if err == nil {
+		err = writeRelayStatus(stream, relayOK)
+	}
+
+	if err != nil {
+		stream.Reset()
+		return nil, err
+	}
+
+	relayAddr, _ := multiaddr.SplitLast(l.laddr)
+
+	raddr := relayAddr.Encapsulate(multiaddr.StringCast("/p2p-circuit/p2p/" + p.Pretty()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.transport.kcp.handshakeTimeout)
+	defer cancel()
+
+	return l.transport.upgrade(ctx, l.relayConn, stream, l.laddr, raddr, p, false)
+}
+
+func (l *relayListener) Accept() (transport.CapableConn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+// Close gives up the reservation on the relay
+func (l *relayListener) Close() error {
+	var err error
+
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		err = l.relayConn.Close()
+	})
+
+	return err
+}
+
+func (l *relayListener) Addr() net.Addr {
+	return circuitAddr{l.laddr}
+}
+
+func (l *relayListener) Multiaddr() multiaddr.Multiaddr {
+	return l.laddr
+}
+
+// circuitAddr the net.Addr of a circuit multiaddr
+type circuitAddr struct {
+	multiaddr.Multiaddr
+}
+
+func (addr circuitAddr) Network() string {
+	return "p2p-circuit"
+}
+
+// streamConn a relay stream as a net.Conn
+type streamConn struct {
+	mux.MuxedStream
+	local  net.Addr
+	remote net.Addr
+}
+
+func (conn *streamConn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+func (conn *streamConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// relayedConn a connection through a relay, secured end to end
+type relayedConn struct {
+	transport       *relayTransport
+	relay           transport.CapableConn // the connection to the relay of dialed connections
+	via             transport.CapableConn // the connection to the relay, shared by the accepted ones
+	conn            net.Conn
+	watched         *watchedConn // the relay stream read by the muxer session
+	session         muxSession
+	localPeer       peer.ID
+	privKey         crypto.PrivKey
+	remotePeer      peer.ID
+	remotePubKey    crypto.PubKey
+	localMultiaddr  multiaddr.Multiaddr
+	remoteMultiaddr multiaddr.Multiaddr
+}
+
+func (c *relayedConn) Close() error {
+	err := c.session.Close()
+
+	c.conn.Close()
+
+	if c.relay != nil {
+		c.relay.Close()
+	}
+
+	return err
+}
+
+// IsClosed checks if the connection is closed or lost, which happens when the relay
+// stream fails or the connection to the relay is closed
+func (c *relayedConn) IsClosed() bool {
+	return c.watched.failed() || c.session.IsClosed() || c.via.IsClosed()
+}
+
+func (c *relayedConn) OpenStream() (mux.MuxedStream, error) {
+	stream, err := c.session.OpenStream()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &relayedStream{muxStream: stream}, nil
+}
+
+func (c *relayedConn) AcceptStream() (mux.MuxedStream, error) {
+	stream, err := c.session.AcceptStream()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &relayedStream{muxStream: stream}, nil
+}
+
+func (c *relayedConn) LocalPeer() peer.ID {
+	return c.localPeer
+}
+
+func (c *relayedConn) LocalPrivateKey() crypto.PrivKey {
+	return c.privKey
+}
+
+func (c *relayedConn) RemotePeer() peer.ID {
+	return c.remotePeer
+}
+
+func (c *relayedConn) RemotePublicKey() crypto.PubKey {
+	return c.remotePubKey
+}
+
+func (c *relayedConn) LocalMultiaddr() multiaddr.Multiaddr {
+	return c.localMultiaddr
+}
+
+func (c *relayedConn) RemoteMultiaddr() multiaddr.Multiaddr {
+	return c.remoteMultiaddr
+}
+
+func (c *relayedConn) Transport() transport.Transport {
+	return c.transport
+}
+
+// relayedStream a stream of a relayed connection, whose muxer may have no reset
+type relayedStream struct {
+	muxStream
+	reset int32 // aborted by Reset
+}
+
+func (s *relayedStream) Read(b []byte) (int, error) {
+	n, err := s.muxStream.Read(b)
+
+	return n, s.resetErr(err)
+}
+
+func (s *relayedStream) Write(b []byte) (int, error) {
+	n, err := s.muxStream.Write(b)
+
+	return n, s.resetErr(err)
+}
+
+// Reset aborts the stream with the reset of the muxer, as kcpStream.Reset does. smux has
+// no stream reset, the stream is closed instead
+func (s *relayedStream) Reset() error {
+	atomic.StoreInt32(&s.reset, 1)
+
+	if resetter, ok := s.muxStream.(interface{ Reset() error }); ok {
+		return resetter.Reset()
+	}
+
+	s.muxStream.Close()
+
+	return nil
+}
+
+// resetErr replaces err with mux.ErrReset if the stream was reset by either peer
+func (s *relayedStream) resetErr(err error) error {
+	if err != nil && (atomic.LoadInt32(&s.reset) != 0 || isStreamReset(err)) {
+		return mux.ErrReset
+	}
+
+	return err
+}
@@ -0,0 +1,119 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	tlsp2p "github.com/libp2p/go-libp2p-tls"
+	"github.com/libs4go/errors"
+)
+
+// resumption tls 1.3 session resumption state shared by the connections of a transport
+type resumption struct {
+	sync.Mutex
+	ticketKey [32]byte               // session ticket key of the listeners
+	cache     tls.ClientSessionCache // session tickets of the dialed peers
+}
+
+// rotate replaces the session ticket key, revoking the issued tickets
+func (r *resumption) rotate() error {
+	var ticketKey [32]byte
+
+	if _, err := rand.Read(ticketKey[:]); err != nil {
+		return errors.Wrap(err, "generate session ticket key error")
+	}
+
+	r.Lock()
+	r.ticketKey = ticketKey
+	r.Unlock()
+
+	return nil
+}
+
+func (r *resumption) key() [32]byte {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.ticketKey
+}
+
+// WithSessionResumption create kcp transport which resumes the tls sessions of reconnecting
+// peers, caching up to size session tickets of dialed peers in memory. Resumed sessions
+// skip the certificate exchange, but still take one round trip, crypto/tls has no 0-RTT.
+// Both peers need the option, it has no effect without WithTLS
+func WithSessionResumption(size int) Option {
+	return func(kcp *kcpTransport) error {
+		if size <= 0 {
+			return errors.Wrap(ErrOption, "invalid session cache size %d", size)
+		}
+
+		r := &resumption{
+			cache: tls.NewLRUClientSessionCache(size),
+		}
+
+		if err := r.rotate(); err != nil {
+			return err
+		}
+
+		kcp.resumption = r
+
+		return nil
+	}
+}
+
+// peerSessionCache the client session cache of the dialed peer p, tickets are cached
+// per peer as the remote address may be reused by another peer
+type peerSessionCache struct {
+	tls.ClientSessionCache
+	p peer.ID
+}
+
+func (c *peerSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return c.ClientSessionCache.Get(c.p.Pretty() + "/" + sessionKey)
+}
+
+func (c *peerSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.ClientSessionCache.Put(c.p.Pretty()+"/"+sessionKey, cs)
+}
+
+// resumable returns the tls config which resumes the sessions with peer p,
+// p is empty for the listeners
+func (kcp *kcpTransport) resumable(conf *tls.Config, p peer.ID) *tls.Config {
+	if kcp.resumption == nil {
+		return conf
+	}
+
+	conf = conf.Clone()
+	conf.SessionTicketsDisabled = false
+
+	if p == "" {
+		conf.SetSessionTicketKeys([][32]byte{kcp.resumption.key()})
+	} else {
+		conf.ClientSessionCache = &peerSessionCache{ClientSessionCache: kcp.resumption.cache, p: p}
+	}
+
+	return conf
+}
+
+// resumedPubKey returns the remote public key of the resumed tls session, whose
+// certificates aren't verified by the handshake
+func resumedPubKey(state tls.ConnectionState, p peer.ID) (crypto.PubKey, error) {
+	if !state.DidResume {
+		return nil, ErrTLS
+	}
+
+	pubKey, err := tlsp2p.PubKeyFromCertChain(state.PeerCertificates)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p != "" && !p.MatchesPublicKey(pubKey) {
+		return nil, errors.Wrap(ErrTLS, "resumed session of another peer")
+	}
+
+	return pubKey, nil
+}
@@ -0,0 +1,61 @@
+package kcp
+
+import (
+	"github.com/libp2p/go-libp2p-core/sec"
+	"github.com/libp2p/go-libp2p-core/sec/insecure"
+	"github.com/libs4go/errors"
+)
+
+// WithSecurity create kcp transport whose connections are secured by the libp2p security
+// transport s, e.g. noise or the host's own security stack, instead of the built-in TLS.
+// It replaces WithTLS and the other way around, whichever comes last wins. Without TLS
+// there is no alpn, so smux v2 isn't negotiated, see WithSmuxVersion.
+func WithSecurity(s sec.SecureTransport) Option {
+	return func(kcp *kcpTransport) error {
+		if s == nil {
+			return errors.Wrap(ErrOption, "nil security transport")
+		}
+
+		kcp.security = s
+		kcp.identity = nil
+
+		return nil
+	}
+}
+
+// WithPlaintext create kcp transport whose connections aren't encrypted, the peers only
+// exchange and validate their peer ids and public keys like libp2p plaintext/2.0.0. The keys
+// aren't authenticated, use it for benchmarks and closed testbeds only
+func WithPlaintext() Option {
+	return func(kcp *kcpTransport) error {
+		return WithSecurity(insecure.NewWithIdentity(kcp.localPeer, kcp.privKey))(kcp)
+	}
+}
+
+// WithRequireSecurity create kcp transport which fails to be created unless its connections
+// are authenticated and encrypted by WithTLS, WithIdentity or WithSecurity, so a forgotten
+// option can't silently yield plain connections. WithPlaintext doesn't count as security
+func WithRequireSecurity() Option {
+	return func(kcp *kcpTransport) error {
+		kcp.requireSecurity = true
+
+		return nil
+	}
+}
+
+// secured checks if the connections are authenticated and encrypted
+func (kcp *kcpTransport) secured() bool {
+	if kcp.identity != nil {
+		return true
+	}
+
+	if kcp.upgrader != nil {
+		_, plaintext := kcp.upgrader.Secure.(*insecure.Transport)
+
+		return kcp.upgrader.Secure != nil && !plaintext
+	}
+
+	_, plaintext := kcp.security.(*insecure.Transport)
+
+	return kcp.security != nil && !plaintext
+}
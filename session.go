@@ -0,0 +1,184 @@
+package kcp
+
+import (
+	"github.com/libs4go/errors"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+// noDelayConf kcp nodelay parameters, see kcpgo.UDPSession.SetNoDelay
+type noDelayConf struct {
+	nodelay  int
+	interval int
+	resend   int
+	nc       int
+}
+
+// windowConf kcp send and receive window sizes in packets
+type windowConf struct {
+	sndwnd int
+	rcvwnd int
+}
+
+// sessionConf kcp session tuning, unset parameters keep kcp-go defaults
+type sessionConf struct {
+	noDelay    *noDelayConf
+	window     *windowConf
+	ackNoDelay *bool
+	writeDelay *bool
+	streamMode *bool
+	mtu        int
+}
+
+// modeConf kcptun compatible preset
+type modeConf struct {
+	noDelay noDelayConf
+	window  windowConf
+}
+
+// modes kcptun presets, ordered from the most bandwidth friendly to the lowest latency
+var modes = map[string]modeConf{
+	"normal": {noDelay: noDelayConf{nodelay: 0, interval: 40, resend: 2, nc: 1}, window: windowConf{sndwnd: 128, rcvwnd: 512}},
+	"fast":   {noDelay: noDelayConf{nodelay: 0, interval: 30, resend: 2, nc: 1}, window: windowConf{sndwnd: 128, rcvwnd: 512}},
+	"fast2":  {noDelay: noDelayConf{nodelay: 1, interval: 20, resend: 2, nc: 1}, window: windowConf{sndwnd: 256, rcvwnd: 1024}},
+	"fast3":  {noDelay: noDelayConf{nodelay: 1, interval: 10, resend: 2, nc: 1}, window: windowConf{sndwnd: 256, rcvwnd: 1024}},
+}
+
+// WithNoDelay create kcp transport with kcp nodelay parameters, nodelay enables
+// nodelay mode(0 or 1), interval is the internal update interval in milliseconds,
+// resend enables fast resend after the given number of skipped acks(0 disables it)
+// and nc disables congestion control(0 or 1)
+func WithNoDelay(nodelay, interval, resend, nc int) Option {
+	return func(kcp *kcpTransport) error {
+		if nodelay < 0 || nodelay > 1 || nc < 0 || nc > 1 || interval <= 0 || resend < 0 {
+			return errors.Wrap(ErrOption, "invalid nodelay parameters %d %d %d %d", nodelay, interval, resend, nc)
+		}
+
+		kcp.sessionConf.noDelay = &noDelayConf{
+			nodelay:  nodelay,
+			interval: interval,
+			resend:   resend,
+			nc:       nc,
+		}
+
+		return nil
+	}
+}
+
+// WithWindowSize create kcp transport with the kcp send and receive window sizes in
+// packets, zero keeps the current size
+func WithWindowSize(sndwnd, rcvwnd int) Option {
+	return func(kcp *kcpTransport) error {
+		if sndwnd < 0 || rcvwnd < 0 || sndwnd+rcvwnd == 0 {
+			return errors.Wrap(ErrOption, "invalid window size %d %d", sndwnd, rcvwnd)
+		}
+
+		window := windowConf{sndwnd: sndwnd, rcvwnd: rcvwnd}
+
+		if current := kcp.sessionConf.window; current != nil {
+			if sndwnd == 0 {
+				window.sndwnd = current.sndwnd
+			}
+
+			if rcvwnd == 0 {
+				window.rcvwnd = current.rcvwnd
+			}
+		}
+
+		kcp.sessionConf.window = &window
+
+		return nil
+	}
+}
+
+// WithMode create kcp transport with one of the kcptun presets normal, fast, fast2
+// or fast3, which sets the nodelay parameters and the window sizes at once
+func WithMode(mode string) Option {
+	return func(kcp *kcpTransport) error {
+		conf, ok := modes[mode]
+
+		if !ok {
+			return errors.Wrap(ErrOption, "unknown kcp mode %s", mode)
+		}
+
+		noDelay := conf.noDelay
+		window := conf.window
+
+		kcp.sessionConf.noDelay = &noDelay
+		kcp.sessionConf.window = &window
+
+		return nil
+	}
+}
+
+// WithACKNoDelay create kcp transport which flushes acks immediately instead of
+// batching them until the next update interval
+func WithACKNoDelay(nodelay bool) Option {
+	return func(kcp *kcpTransport) error {
+		kcp.sessionConf.ackNoDelay = &nodelay
+		return nil
+	}
+}
+
+// WithWriteDelay create kcp transport which delays flushing written data until the
+// next update interval when delay is true, trading latency for fewer packets, kcp-go
+// flushes on every write by default
+func WithWriteDelay(delay bool) Option {
+	return func(kcp *kcpTransport) error {
+		kcp.sessionConf.writeDelay = &delay
+		return nil
+	}
+}
+
+// WithStreamMode create kcp transport which merges consecutive writes into full
+// segments when stream is true, instead of keeping each write as one kcp message
+func WithStreamMode(stream bool) Option {
+	return func(kcp *kcpTransport) error {
+		kcp.sessionConf.streamMode = &stream
+		return nil
+	}
+}
+
+// initialMTU returns the mtu sessions start with
+func (conf *sessionConf) initialMTU() int {
+	if conf.mtu > 0 {
+		return conf.mtu
+	}
+
+	return defaultMTU
+}
+
+// initialSendWindow returns the kcp send window of new sessions
+func (conf *sessionConf) initialSendWindow() int {
+	if conf.window != nil && conf.window.sndwnd > 0 {
+		return conf.window.sndwnd
+	}
+
+	return kcpgo.IKCP_WND_SND
+}
+
+// apply applies the tuning to udpSession
+func (conf *sessionConf) apply(udpSession *kcpgo.UDPSession) {
+	if conf.mtu > 0 {
+		udpSession.SetMtu(conf.mtu)
+	}
+
+	if conf.noDelay != nil {
+		udpSession.SetNoDelay(conf.noDelay.nodelay, conf.noDelay.interval, conf.noDelay.resend, conf.noDelay.nc)
+	}
+
+	if conf.window != nil {
+		udpSession.SetWindowSize(conf.window.sndwnd, conf.window.rcvwnd)
+	}
+
+	if conf.ackNoDelay != nil {
+		udpSession.SetACKNoDelay(*conf.ackNoDelay)
+	}
+
+	if conf.writeDelay != nil {
+		udpSession.SetWriteDelay(*conf.writeDelay)
+	}
+
+	if conf.streamMode != nil {
+		udpSession.SetStreamMode(*conf.streamMode)
+	}
+}
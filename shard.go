@@ -0,0 +1,184 @@
+package kcp
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/libs4go/errors"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+// WithReusePortShards create kcp transport whose listeners open n udp sockets bound to the
+// same port with SO_REUSEPORT, the kernel spreads the remote addresses over them and each
+// socket is read and accepted by its own kcp-go listener, so packet processing scales over
+// cores. It's only supported on linux, and the sharded listeners can't be dialed from, see
+// WithDialFromListener
+func WithReusePortShards(n int) Option {
+	return func(kcp *kcpTransport) error {
+		if n <= 0 {
+			return errors.Wrap(ErrOption, "invalid reuse port shards %d", n)
+		}
+
+		if !reusePortSupported {
+			return errors.Wrap(ErrOption, "reuse port is not supported on this platform")
+		}
+
+		kcp.listenShards = n
+
+		return nil
+	}
+}
+
+// listenSharded listens on addr with the SO_REUSEPORT sockets of the transport
+func (kcp *kcpTransport) listenSharded(network string, addr *net.UDPAddr) (sessionAcceptor, *sharedSocket, *monitorConn, error) {
+	conf := kcp.socketConf
+	conf.reusePort = true
+
+	shards := &shardedConn{}
+
+	var listeners []*kcpgo.Listener
+	var monitor *monitorConn
+
+	fail := func(err error) (sessionAcceptor, *sharedSocket, *monitorConn, error) {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+
+		shards.Close()
+
+		return nil, nil, nil, err
+	}
+
+	for i := 0; i < kcp.listenShards; i++ {
+		udpConn, err := conf.listenUDP(kcp, network, addr)
+
+		if err != nil {
+			return fail(err)
+		}
+
+		if i == 0 {
+			shards.UDPConn = udpConn
+			// the other shards bind the port the first one got
+			addr = udpConn.LocalAddr().(*net.UDPAddr)
+		}
+
+		shards.conns = append(shards.conns, udpConn)
+
+		packetConn, shardMonitor := kcp.wrapPacketConn(udpConn)
+
+		// a session is monitored by the shard its remote address is hashed to
+		if monitor == nil {
+			monitor = shardMonitor
+		} else if shardMonitor != nil {
+			shardMonitor.monitors = monitor.monitors
+		}
+
+		listener, err := kcpgo.ServeConn(kcp.block, kcp.dataShards, kcp.parityShards, kcp.validateAddrs(packetConn))
+
+		if err != nil {
+			return fail(err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return newShardedAcceptor(listeners), newSharedSocket(shards), monitor, nil
+}
+
+// shardedConn the udp sockets of a sharded listener, which are closed together
+type shardedConn struct {
+	*net.UDPConn // the first shard
+	conns        []*net.UDPConn
+}
+
+func (conn *shardedConn) Close() error {
+	var err error
+
+	for _, udpConn := range conn.conns {
+		if closeErr := udpConn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// shardedAcceptor accepts the sessions of the kcp-go listeners of the shards
+type shardedAcceptor struct {
+	listeners []*kcpgo.Listener
+	sessions  chan *kcpgo.UDPSession
+	closeOnce sync.Once
+	closed    chan struct{}
+	failOnce  sync.Once
+	failed    chan struct{} // closed when a shard fails
+	err       error
+}
+
+func newShardedAcceptor(listeners []*kcpgo.Listener) *shardedAcceptor {
+	a := &shardedAcceptor{
+		listeners: listeners,
+		sessions:  make(chan *kcpgo.UDPSession),
+		closed:    make(chan struct{}),
+		failed:    make(chan struct{}),
+	}
+
+	for _, listener := range listeners {
+		go a.accept(listener)
+	}
+
+	return a
+}
+
+func (a *shardedAcceptor) accept(listener *kcpgo.Listener) {
+	for {
+		udpSession, err := listener.AcceptKCP()
+
+		if err != nil {
+			a.failOnce.Do(func() {
+				a.err = err
+				close(a.failed)
+			})
+
+			return
+		}
+
+		select {
+		case a.sessions <- udpSession:
+		case <-a.closed:
+			udpSession.Close()
+			return
+		}
+	}
+}
+
+func (a *shardedAcceptor) AcceptKCP() (*kcpgo.UDPSession, error) {
+	select {
+	case udpSession := <-a.sessions:
+		return udpSession, nil
+	case <-a.closed:
+		return nil, io.ErrClosedPipe
+	case <-a.failed:
+		return nil, a.err
+	}
+}
+
+func (a *shardedAcceptor) Addr() net.Addr {
+	return a.listeners[0].Addr()
+}
+
+func (a *shardedAcceptor) Close() error {
+	var err error
+
+	a.closeOnce.Do(func() {
+		close(a.closed)
+
+		for _, listener := range a.listeners {
+			if closeErr := listener.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	})
+
+	return err
+}
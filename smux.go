@@ -0,0 +1,167 @@
+package kcp
+
+import (
+	"math"
+	"net"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/xtaci/smux"
+)
+
+const (
+	defaultKeepAliveInterval = 5 * time.Second
+	defaultKeepAliveTimeout  = 13 * time.Second
+
+	// keepAliveDisabled is the keepalive interval and timeout which never expire, smux
+	// has no switch to turn keepalive off
+	keepAliveDisabled = time.Duration(math.MaxInt64)
+)
+
+// WithKeepAlive create kcp transport whose smux sessions send a keepalive every interval
+// and are closed when nothing is received for timeout
+func WithKeepAlive(interval, timeout time.Duration) Option {
+	return func(kcp *kcpTransport) error {
+		if interval <= 0 || timeout < interval {
+			return errors.Wrap(ErrOption, "invalid keepalive interval %s timeout %s", interval, timeout)
+		}
+
+		kcp.keepAliveInterval = interval
+		kcp.keepAliveTimeout = timeout
+
+		return nil
+	}
+}
+
+// WithoutKeepAlive create kcp transport whose smux sessions neither send keepalives nor
+// close the sessions that receive nothing, for the peers that have their own heartbeats.
+// The remote peer must disable keepalive too, otherwise it closes idle sessions after
+// its keepalive timeout. Dead peers are no longer detected by smux, see WithWatchdog and
+// WithIdleTimeout.
+func WithoutKeepAlive() Option {
+	return func(kcp *kcpTransport) error {
+		kcp.keepAliveInterval = keepAliveDisabled
+		kcp.keepAliveTimeout = keepAliveDisabled
+
+		return nil
+	}
+}
+
+// WithSmuxConfig create kcp transport with the smux config, the version and keepalive
+// settings of conf are overridden by the later WithSmuxVersion and WithKeepAlive options
+func WithSmuxConfig(conf *smux.Config) Option {
+	return func(kcp *kcpTransport) error {
+		if conf == nil {
+			return errors.Wrap(ErrOption, "nil smux config")
+		}
+
+		if err := smux.VerifyConfig(conf); err != nil {
+			return errors.Wrap(ErrOption, "invalid smux config: %s", err)
+		}
+
+		copied := *conf
+
+		kcp.smuxConfig = &copied
+		kcp.smuxVersion = conf.Version
+		kcp.smuxNegotiate = false
+		kcp.yamux = false
+		kcp.mplex = false
+		kcp.keepAliveInterval = conf.KeepAliveInterval
+		kcp.keepAliveTimeout = conf.KeepAliveTimeout
+
+		return nil
+	}
+}
+
+// WithMaxStreams create kcp transport whose connections hold at most max open smux
+// streams, OpenStream fails with ErrTooManyStreams beyond it and the streams opened by
+// the remote peer beyond it are closed
+func WithMaxStreams(max int) Option {
+	return func(kcp *kcpTransport) error {
+		if max <= 0 {
+			return errors.Wrap(ErrOption, "invalid max streams %d", max)
+		}
+
+		kcp.maxStreams = max
+
+		return nil
+	}
+}
+
+// WithWriteTimeout create kcp transport whose streams fail a Write that doesn't complete
+// within d, instead of blocking forever on a stalled peer. The deadline is renewed by
+// every Write, and a deadline set by SetWriteDeadline or SetDeadline replaces it until
+// it's cleared with the zero time.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(kcp *kcpTransport) error {
+		if d <= 0 {
+			return errors.Wrap(ErrOption, "invalid write timeout %s", d)
+		}
+
+		kcp.writeTimeout = d
+
+		return nil
+	}
+}
+
+// WithSmuxVersion create kcp transport with smux protocol version, both peers
+// must use the same version. Without it TLS connections use smux v2 when both
+// peers support it and v1 otherwise, and plain connections use v1.
+func WithSmuxVersion(version int) Option {
+	return func(kcp *kcpTransport) error {
+		if version != 1 && version != 2 {
+			return errors.Wrap(ErrOption, "unsupported smux version %d", version)
+		}
+
+		kcp.smuxVersion = version
+		kcp.smuxNegotiate = false
+		kcp.yamux = false
+		kcp.mplex = false
+
+		return nil
+	}
+}
+
+// smuxVersionConn checks the version of the first smux frame sent by remote peer
+type smuxVersionConn struct {
+	net.Conn
+	kcp     *kcpTransport
+	version byte
+	checked bool // only accessed by smux recv loop
+}
+
+func (conn *smuxVersionConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+
+	if !conn.checked && n > 0 {
+		conn.checked = true
+
+		if b[0] != conn.version {
+			conn.kcp.W("smux version mismatch with {@raddr}, local {@local} remote {@remote}", conn.RemoteAddr(), conn.version, b[0])
+
+			return 0, errors.Wrap(ErrSmuxVersion, "local smux version %d, remote smux version %d", conn.version, b[0])
+		}
+	}
+
+	return n, err
+}
+
+func (kcp *kcpTransport) smuxSession(conn net.Conn, client bool) (*smux.Session, error) {
+	conf := kcp.smuxConf()
+
+	if kcp.compression {
+		conn = newCompStream(conn)
+	}
+
+	conn = &smuxVersionConn{
+		Conn:    conn,
+		kcp:     kcp,
+		version: byte(conf.Version),
+	}
+
+	if client {
+		return smux.Client(conn, conf)
+	}
+
+	return smux.Server(conn, conf)
+}
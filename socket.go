@@ -0,0 +1,288 @@
+package kcp
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/slf4go"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// defaultSocketBuffer is the udp buffer size tried when none is configured, the os
+// defaults of about 200KB overflow at high rates
+const defaultSocketBuffer = 4 * 1024 * 1024
+
+// socketConf udp socket options, zero values keep the os defaults
+type socketConf struct {
+	readBuffer   int
+	writeBuffer  int
+	dscp         int    // 0 means unmarked
+	ttl          int    // ipv4 ttl and ipv6 hop limit, 0 means the os default
+	dontFragment bool   // set the don't fragment bit where supported
+	localIP      net.IP // source address of dialed sessions and listeners on unspecified addresses
+	bindDevice   string // network interface the sockets are bound to
+	reusePort    bool   // bind with SO_REUSEPORT
+}
+
+// WithUDPReadBuffer create kcp transport which sets the receive buffer size of its udp sockets,
+// the size is limited to the os maximum, e.g. net.core.rmem_max on linux
+func WithUDPReadBuffer(bytes int) Option {
+	return func(kcp *kcpTransport) error {
+		if bytes <= 0 {
+			return errors.Wrap(ErrOption, "invalid udp read buffer size %d", bytes)
+		}
+
+		kcp.socketConf.readBuffer = bytes
+
+		return nil
+	}
+}
+
+// WithUDPWriteBuffer create kcp transport which sets the send buffer size of its udp sockets,
+// the size is limited to the os maximum, e.g. net.core.wmem_max on linux
+func WithUDPWriteBuffer(bytes int) Option {
+	return func(kcp *kcpTransport) error {
+		if bytes <= 0 {
+			return errors.Wrap(ErrOption, "invalid udp write buffer size %d", bytes)
+		}
+
+		kcp.socketConf.writeBuffer = bytes
+
+		return nil
+	}
+}
+
+// WithDSCP create kcp transport which marks its udp packets with the dscp code point,
+// e.g. 46 for EF or 34 for AF41
+func WithDSCP(dscp int) Option {
+	return func(kcp *kcpTransport) error {
+		if dscp < 0 || dscp > 63 {
+			return errors.Wrap(ErrOption, "invalid dscp %d", dscp)
+		}
+
+		kcp.socketConf.dscp = dscp
+
+		return nil
+	}
+}
+
+// WithTTL create kcp transport which sends its udp packets with the ipv4 ttl and the
+// ipv6 hop limit ttl, low values keep the traffic within a few router hops
+func WithTTL(ttl int) Option {
+	return func(kcp *kcpTransport) error {
+		if ttl < 1 || ttl > 255 {
+			return errors.Wrap(ErrOption, "invalid ttl %d", ttl)
+		}
+
+		kcp.socketConf.ttl = ttl
+
+		return nil
+	}
+}
+
+// WithLocalAddr create kcp transport whose dialed sessions are sent from ip, and whose
+// listeners on an unspecified address such as /ip4/0.0.0.0 are bound to ip instead.
+// Dialing or listening on the other address family fails with ErrAddr.
+func WithLocalAddr(ip net.IP) Option {
+	return func(kcp *kcpTransport) error {
+		if ip == nil || ip.IsUnspecified() {
+			return errors.Wrap(ErrOption, "invalid local address %s", ip)
+		}
+
+		kcp.socketConf.localIP = ip
+
+		return nil
+	}
+}
+
+// WithBindDevice create kcp transport whose udp sockets are bound to the network interface
+// name, so the packets go through it regardless of the routing table. It's only supported
+// on linux, and binding may require the CAP_NET_RAW capability.
+func WithBindDevice(name string) Option {
+	return func(kcp *kcpTransport) error {
+		if name == "" {
+			return errors.Wrap(ErrOption, "invalid bind device %s", name)
+		}
+
+		if !bindDeviceSupported {
+			return errors.Wrap(ErrOption, "bind device is not supported on this platform")
+		}
+
+		kcp.socketConf.bindDevice = name
+
+		return nil
+	}
+}
+
+// sameFamily checks if ip and other are both ipv4 or both ipv6
+func sameFamily(ip, other net.IP) bool {
+	return (ip.To4() == nil) == (other.To4() == nil)
+}
+
+// dialAddr returns the local address for the sessions dialed to raddr, nil means any
+func (conf *socketConf) dialAddr(raddr *net.UDPAddr) (*net.UDPAddr, error) {
+	if conf.localIP == nil {
+		return nil, nil
+	}
+
+	if !sameFamily(conf.localIP, raddr.IP) {
+		return nil, errors.Wrap(ErrAddr, "local address %s can't dial %s", conf.localIP, raddr)
+	}
+
+	return &net.UDPAddr{IP: conf.localIP}, nil
+}
+
+// listenAddr returns the address the listener on laddr binds to
+func (conf *socketConf) listenAddr(laddr *net.UDPAddr) (*net.UDPAddr, error) {
+	if conf.localIP == nil || (laddr.IP != nil && !laddr.IP.IsUnspecified()) {
+		return laddr, nil
+	}
+
+	if laddr.IP != nil && !sameFamily(conf.localIP, laddr.IP) {
+		return nil, errors.Wrap(ErrAddr, "local address %s can't listen on %s", conf.localIP, laddr)
+	}
+
+	return &net.UDPAddr{IP: conf.localIP, Port: laddr.Port}, nil
+}
+
+// listenUDP creates the udp socket on laddr and applies the socket options to it
+func (conf *socketConf) listenUDP(logger slf4go.Logger, network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	var udpConn *net.UDPConn
+
+	if conf.bindDevice == "" && !conf.reusePort {
+		conn, err := net.ListenUDP(network, laddr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		udpConn = conn
+	} else {
+		var address string
+
+		if laddr != nil {
+			address = laddr.String()
+		}
+
+		// the device must be bound before the socket binds its address
+		lc := net.ListenConfig{
+			Control: func(network, address string, rawConn syscall.RawConn) error {
+				var sockErr error
+
+				err := rawConn.Control(func(fd uintptr) {
+					if conf.bindDevice != "" {
+						sockErr = bindDevice(fd, conf.bindDevice)
+					}
+
+					if sockErr == nil && conf.reusePort {
+						sockErr = reusePort(fd)
+					}
+				})
+
+				if err != nil {
+					return err
+				}
+
+				return sockErr
+			},
+		}
+
+		conn, err := lc.ListenPacket(context.Background(), network, address)
+
+		if err != nil && conf.bindDevice != "" {
+			return nil, errors.Wrap(err, "bind udp socket to %s error", conf.bindDevice)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		udpConn = conn.(*net.UDPConn)
+	}
+
+	if err := conf.apply(logger, udpConn); err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+
+	return udpConn, nil
+}
+
+// apply applies the socket options to udpConn
+func (conf *socketConf) apply(logger slf4go.Logger, udpConn *net.UDPConn) error {
+	if err := conf.tuneBuffers(logger, udpConn); err != nil {
+		return err
+	}
+
+	if conf.dontFragment {
+		if err := setDontFragment(udpConn); err != nil {
+			return errors.Wrap(err, "set don't fragment error")
+		}
+	}
+
+	if conf.dscp > 0 {
+		// the socket may carry either address family, so both are tried
+		err4 := ipv4.NewConn(udpConn).SetTOS(conf.dscp << 2)
+		err6 := ipv6.NewConn(udpConn).SetTrafficClass(conf.dscp << 2)
+
+		if err4 != nil && err6 != nil {
+			return errors.Wrap(err4, "set dscp %d error", conf.dscp)
+		}
+	}
+
+	if conf.ttl > 0 {
+		err4 := ipv4.NewConn(udpConn).SetTTL(conf.ttl)
+		err6 := ipv6.NewConn(udpConn).SetHopLimit(conf.ttl)
+
+		if err4 != nil && err6 != nil {
+			return errors.Wrap(err4, "set ttl %d error", conf.ttl)
+		}
+	}
+
+	return nil
+}
+
+// bufferSize returns the buffer size to set, configured or the default, limited to the os
+// maximum max if known
+func bufferSize(logger slf4go.Logger, name string, configured int, max int) int {
+	size := configured
+
+	if size == 0 {
+		size = defaultSocketBuffer
+	}
+
+	if max <= 0 || size <= max {
+		return size
+	}
+
+	if configured > 0 {
+		logger.W("udp {@name} buffer {@size} exceeds os maximum {@max}", name, configured, max)
+	}
+
+	return max
+}
+
+// tuneBuffers sizes the udp buffers to the configured or default size within the os maximum
+func (conf *socketConf) tuneBuffers(logger slf4go.Logger, udpConn *net.UDPConn) error {
+	readMax, writeMax := socketBufferMax()
+
+	read := bufferSize(logger, "read", conf.readBuffer, readMax)
+	write := bufferSize(logger, "write", conf.writeBuffer, writeMax)
+
+	if err := udpConn.SetReadBuffer(read); err != nil {
+		return errors.Wrap(err, "set udp read buffer %d error", read)
+	}
+
+	if err := udpConn.SetWriteBuffer(write); err != nil {
+		return errors.Wrap(err, "set udp write buffer %d error", write)
+	}
+
+	if read, write, err := socketBuffers(udpConn); err == nil {
+		logger.D("udp socket {@addr} read buffer {@read} write buffer {@write}", udpConn.LocalAddr(), read, write)
+	}
+
+	return nil
+}
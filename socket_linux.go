@@ -0,0 +1,149 @@
+//go:build linux
+// +build linux
+
+package kcp
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const bindDeviceSupported = true
+
+// bindDevice binds the socket fd to the network interface name
+func bindDevice(fd uintptr, name string) error {
+	return syscall.BindToDevice(int(fd), name)
+}
+
+const reusePortSupported = true
+
+// reusePort lets the sockets bound to the same address share its packets
+func reusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1)
+}
+
+// setDontFragment sets the don't fragment bit of the packets sent by udpConn, the kernel
+// path mtu cache is ignored so that only the local interface mtu limits the packet size
+func setDontFragment(udpConn *net.UDPConn) error {
+	rawConn, err := udpConn.SyscallConn()
+
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+
+		// the socket may carry either address family
+		if err4 != nil && err6 != nil {
+			sockErr = err4
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+const (
+	udpGRO     = 104 // UDP_GRO socket option and control message type
+	groOOBSize = 64  // room for the UDP_GRO control message
+)
+
+// enableGRO turns on udp receive offload of udpConn, linux 5.0 or later
+func enableGRO(udpConn *net.UDPConn) error {
+	rawConn, err := udpConn.SyscallConn()
+
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpGRO, 1)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// groSegmentSize returns the size of the packets coalesced by gro, 0 if the read wasn't
+// coalesced
+func groSegmentSize(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+
+	if err != nil {
+		return 0
+	}
+
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.IPPROTO_UDP && msg.Header.Type == udpGRO && len(msg.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&msg.Data[0])))
+		}
+	}
+
+	return 0
+}
+
+// socketBufferMax returns net.core.rmem_max and net.core.wmem_max, 0 if unknown
+func socketBufferMax() (int, int) {
+	return sysctlInt("/proc/sys/net/core/rmem_max"), sysctlInt("/proc/sys/net/core/wmem_max")
+}
+
+func sysctlInt(path string) int {
+	buf, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return 0
+	}
+
+	value, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
+
+// socketBuffers returns the buffer sizes of udpConn, linux reports twice the size set
+// for its bookkeeping overhead so the halves are returned
+func socketBuffers(udpConn *net.UDPConn) (int, int, error) {
+	rawConn, err := udpConn.SyscallConn()
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var read, write int
+	var sockErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		read, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+
+		if sockErr != nil {
+			return
+		}
+
+		write, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return read / 2, write / 2, sockErr
+}
@@ -0,0 +1,51 @@
+//go:build !linux
+// +build !linux
+
+package kcp
+
+import (
+	"net"
+
+	"github.com/libs4go/errors"
+)
+
+const bindDeviceSupported = false
+
+// bindDevice is not supported on this platform
+func bindDevice(fd uintptr, name string) error {
+	return nil
+}
+
+const reusePortSupported = false
+
+// reusePort is not supported on this platform
+func reusePort(fd uintptr) error {
+	return nil
+}
+
+// setDontFragment is not supported on this platform
+func setDontFragment(udpConn *net.UDPConn) error {
+	return nil
+}
+
+const groOOBSize = 0
+
+// enableGRO is not supported on this platform
+func enableGRO(udpConn *net.UDPConn) error {
+	return errors.New("udp receive offload is not supported on this platform")
+}
+
+// groSegmentSize returns 0 since gro is not supported on this platform
+func groSegmentSize(oob []byte) int {
+	return 0
+}
+
+// socketBufferMax returns 0 since the os maximum buffer sizes are unknown on this platform
+func socketBufferMax() (int, int) {
+	return 0, 0
+}
+
+// socketBuffers is not supported on this platform
+func socketBuffers(udpConn *net.UDPConn) (int, int, error) {
+	return 0, 0, errors.New("socket buffers are not supported on this platform")
+}
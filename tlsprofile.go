@@ -0,0 +1,158 @@
+package kcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	tlsp2p "github.com/libp2p/go-libp2p-tls"
+	"github.com/libs4go/errors"
+)
+
+// WithTLSCurves create kcp transport whose tls handshakes only use the key exchange curves,
+// in preference order. Peers without a common curve fail the handshake
+func WithTLSCurves(curves ...tls.CurveID) Option {
+	return func(kcp *kcpTransport) error {
+		if len(curves) == 0 {
+			return errors.Wrap(ErrOption, "no tls curve")
+		}
+
+		kcp.tlsCurves = curves
+
+		return nil
+	}
+}
+
+// WithTLSCipherSuites create kcp transport whose tls connections only use the cipher suites.
+// The tls connections are always tls 1.3, whose cipher suites crypto/tls doesn't let be
+// configured, so the handshakes which negotiated another suite fail afterwards
+func WithTLSCipherSuites(suites ...uint16) Option {
+	return func(kcp *kcpTransport) error {
+		if len(suites) == 0 {
+			return errors.Wrap(ErrOption, "no tls cipher suite")
+		}
+
+		for _, suite := range suites {
+			switch suite {
+			case tls.TLS_AES_128_GCM_SHA256, tls.TLS_AES_256_GCM_SHA384, tls.TLS_CHACHA20_POLY1305_SHA256:
+			default:
+				return errors.Wrap(ErrOption, "unsupported tls 1.3 cipher suite %s", tls.CipherSuiteName(suite))
+			}
+		}
+
+		kcp.tlsCipherSuites = suites
+
+		return nil
+	}
+}
+
+// tlsProfile returns the tls config restricted to the configured curves
+func (kcp *kcpTransport) tlsProfile(conf *tls.Config) *tls.Config {
+	if kcp.tlsCurves == nil {
+		return conf
+	}
+
+	conf = conf.Clone()
+	conf.CurvePreferences = kcp.tlsCurves
+
+	return conf
+}
+
+// checkTLSState checks the state of a completed tls handshake against the configured crypto
+// profile and peer certificate verifier. The verifier runs after the handshake since
+// tls.Config.VerifyPeerCertificate isn't called for resumed sessions
+func (kcp *kcpTransport) checkTLSState(state tls.ConnectionState) error {
+	if err := kcp.checkTLSProfile(state); err != nil {
+		return err
+	}
+
+	verify := kcp.certVerifier
+
+	if verify == nil {
+		return nil
+	}
+
+	pubKey, err := tlsp2p.PubKeyFromCertChain(state.PeerCertificates)
+
+	if err != nil {
+		return err
+	}
+
+	remotePeer, err := peer.IDFromPublicKey(pubKey)
+
+	if err != nil {
+		return err
+	}
+
+	if err := verify(remotePeer, state.PeerCertificates); err != nil {
+		return fmt.Errorf("peer certificate rejected: %w", err)
+	}
+
+	return nil
+}
+
+// checkTLSProfile checks the tls connection state against the configured crypto profile
+func (kcp *kcpTransport) checkTLSProfile(state tls.ConnectionState) error {
+	if state.Version != tls.VersionTLS13 {
+		return fmt.Errorf("tls version %x not allowed", state.Version)
+	}
+
+	if kcp.tlsCipherSuites == nil {
+		return nil
+	}
+
+	for _, suite := range kcp.tlsCipherSuites {
+		if suite == state.CipherSuite {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("tls cipher suite %s not allowed", tls.CipherSuiteName(state.CipherSuite))
+}
+
+// PeerCertificateVerifier checks the certificate chain of the remote peer p after the libp2p
+// tls verification, rejecting the handshake with an error
+type PeerCertificateVerifier func(p peer.ID, chain []*x509.Certificate) error
+
+// WithVerifyPeerCertificate create kcp transport whose tls handshakes also verify the remote
+// peer's certificates with verify, resumed sessions included
+func WithVerifyPeerCertificate(verify PeerCertificateVerifier) Option {
+	return func(kcp *kcpTransport) error {
+		if verify == nil {
+			return errors.Wrap(ErrOption, "nil peer certificate verifier")
+		}
+
+		kcp.certVerifier = verify
+
+		return nil
+	}
+}
+
+// WithTLSKeyLog create kcp transport which writes the tls secrets of its connections to w in
+// NSS key log format, e.g. a file named by SSLKEYLOGFILE, so captured traffic can be
+// decrypted by Wireshark. Only for debugging, it compromises the security of the connections
+func WithTLSKeyLog(w io.Writer) Option {
+	return func(kcp *kcpTransport) error {
+		if w == nil {
+			return errors.Wrap(ErrOption, "nil tls key log writer")
+		}
+
+		kcp.tlsKeyLog = w
+
+		return nil
+	}
+}
+
+// tlsConfig returns the tls config of a connection with peer p, p is empty for the listeners
+func (kcp *kcpTransport) tlsConfig(conf *tls.Config, p peer.ID) *tls.Config {
+	conf = kcp.tlsProfile(kcp.resumable(kcp.muxerProtos(conf), p))
+
+	if kcp.tlsKeyLog != nil {
+		conf = conf.Clone()
+		conf.KeyLogWriter = kcp.tlsKeyLog
+	}
+
+	return conf
+}
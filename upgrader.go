@@ -0,0 +1,180 @@
+package kcp
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	"github.com/libs4go/errors"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+// WithUpgrader create kcp transport whose kcp sessions are upgraded by upgrader, e.g. the
+// host's, which negotiates the security and muxer protocols by multistream-select like
+// on tcp, instead of the built-in tls, smux and yamux. The upgraded connections aren't
+// kcp.Conn, so the connection statistics, monitors and lifecycle events don't apply
+func WithUpgrader(upgrader *tptu.Upgrader) Option {
+	return func(kcp *kcpTransport) error {
+		if upgrader == nil {
+			return errors.Wrap(ErrOption, "nil upgrader")
+		}
+
+		kcp.upgrader = upgrader
+
+		return nil
+	}
+}
+
+// UpgraderConstructor returns the libp2p transport constructor for libp2p.Transport, which
+// creates kcp transport upgraded by the host's upgrader, followed by options
+func UpgraderConstructor(options ...Option) func(upgrader *tptu.Upgrader, privkey crypto.PrivKey) (transport.Transport, error) {
+	return func(upgrader *tptu.Upgrader, privkey crypto.PrivKey) (transport.Transport, error) {
+		return New(privkey, append([]Option{WithUpgrader(upgrader)}, options...)...)
+	}
+}
+
+// dialUpgraded dials p at raddr and upgrades the kcp session with the upgrader
+func (kcp *kcpTransport) dialUpgraded(ctx context.Context, raddr multiaddr.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	raddr, _ = splitKcpMode(raddr)
+
+	udpNetwork, host, err := manet.DialArgs(raddr)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "manet.DialArgs error")
+	}
+
+	addr, err := net.ResolveUDPAddr(udpNetwork, host)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve udp addr %s %s error", udpNetwork, host)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "kcp dial to %s cancelled", addr.String())
+	}
+
+	udpSession, socket, _, err := kcp.dialSession(addr, p, nil)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "kcp dial to %s error", addr.String())
+	}
+
+	conn, err := kcp.rawConn(udpSession, socket)
+
+	if err != nil {
+		udpSession.Close()
+		socket.Close()
+		return nil, err
+	}
+
+	// cancelling ctx aborts the upgrade
+	watcher := watchDial(ctx, conn)
+
+	capable, err := kcp.upgrader.UpgradeOutbound(ctx, kcp.root(), conn, p)
+
+	if watcher.stop() {
+		if err == nil {
+			capable.Close()
+		}
+
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "kcp dial to %s upgrade error", addr.String())
+	}
+
+	return capable, nil
+}
+
+// upgradeWith upgrades the accepted udpSession with the upgrader of the transport
+func (l *kcpListener) upgradeWith(udpSession *kcpgo.UDPSession) (transport.CapableConn, error) {
+	l.transport.sessionConf.apply(udpSession)
+
+	conn, err := l.transport.rawConn(udpSession, nil)
+
+	if err != nil {
+		udpSession.Close()
+		return nil, err
+	}
+
+	upgrader := l.transport.upgrader
+
+	if gater := upgrader.ConnGater; gater != nil && !gater.InterceptAccept(conn) {
+		l.transport.D("drop session from {@raddr}, gated", udpSession.RemoteAddr())
+		conn.Close()
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.transport.handshakeTimeout)
+	defer cancel()
+
+	capable, err := upgrader.UpgradeInbound(ctx, l.transport.root(), conn)
+
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "upgrade session from %s error", udpSession.RemoteAddr())
+	}
+
+	return capable, nil
+}
+
+// rawConn returns the manet.Conn of udpSession, which closes socket with the session
+func (kcp *kcpTransport) rawConn(udpSession *kcpgo.UDPSession, socket net.PacketConn) (*rawConn, error) {
+	localMultiaddr, err := kcp.toMultiaddr(udpSession.LocalAddr())
+
+	if err != nil {
+		return nil, errors.Wrap(err, "create local multiaddr error")
+	}
+
+	remoteMultiaddr, err := kcp.toMultiaddr(udpSession.RemoteAddr())
+
+	if err != nil {
+		return nil, errors.Wrap(err, "create remote multiaddr error")
+	}
+
+	return &rawConn{
+		UDPSession:      udpSession,
+		socket:          socket,
+		localMultiaddr:  localMultiaddr,
+		remoteMultiaddr: remoteMultiaddr,
+	}, nil
+}
+
+// rawConn a kcp session handed to the upgrader
+type rawConn struct {
+	*kcpgo.UDPSession
+	socket          net.PacketConn // udp socket of dialed sessions, nil for accepted ones
+	closeOnce       sync.Once
+	localMultiaddr  multiaddr.Multiaddr
+	remoteMultiaddr multiaddr.Multiaddr
+}
+
+func (conn *rawConn) Close() error {
+	var err error
+
+	conn.closeOnce.Do(func() {
+		err = conn.UDPSession.Close()
+
+		if conn.socket != nil {
+			conn.socket.Close()
+		}
+	})
+
+	return err
+}
+
+func (conn *rawConn) LocalMultiaddr() multiaddr.Multiaddr {
+	return conn.localMultiaddr
+}
+
+func (conn *rawConn) RemoteMultiaddr() multiaddr.Multiaddr {
+	return conn.remoteMultiaddr
+}
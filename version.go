@@ -0,0 +1,232 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/libs4go/errors"
+)
+
+// wire protocol versions of kcp connections
+const (
+	// ProtocolV1 the security handshake followed by the muxer session, it's the version
+	// of the peers which don't negotiate one
+	ProtocolV1 = 1
+	// ProtocolV2 ProtocolV1 with the exchange of the observed addresses of the peers
+	// between the security handshake and the muxer session
+	ProtocolV2 = 2
+	// ProtocolV3 ProtocolV2 with the client session id sent by the dialer after the
+	// observed addresses, see WithClientSessionID
+	ProtocolV3 = 3
+)
+
+// supportedVersions the wire protocol versions this transport speaks
+var supportedVersions = map[int]bool{ProtocolV1: true, ProtocolV2: true, ProtocolV3: true}
+
+// versionMagic starts the version preamble, no security handshake starts with it
+var versionMagic = []byte("/kcp")
+
+const (
+	// versionPeekTimeout bounds the wait of listeners for the version preamble, the
+	// dialers which don't negotiate may wait for the listener to speak first
+	versionPeekTimeout = 500 * time.Millisecond
+	// versionLabel the tls exporter label of the version confirmation
+	versionLabel = "EXPORTER-libp2p-kcp-version"
+	// versionMACSize the size of the version confirmation
+	versionMACSize = 16
+)
+
+// WithProtocolVersions create kcp transport which negotiates the wire protocol version
+// of its connections, in preference order and the listener's preference wins. Dialers
+// send the versions before the security handshake, so their peers must negotiate too.
+// Listeners still accept the dialers without negotiation as ProtocolV1. TLS connections
+// confirm the negotiation once the handshake completes, which fails the downgrades by
+// the forged preambles, the WithSecurity ones can't and trust the preamble
+func WithProtocolVersions(versions ...int) Option {
+	return func(kcp *kcpTransport) error {
+		if len(versions) == 0 {
+			return errors.Wrap(ErrOption, "no protocol version")
+		}
+
+		for _, version := range versions {
+			if !supportedVersions[version] {
+				return errors.Wrap(ErrOption, "unsupported protocol version %d", version)
+			}
+		}
+
+		kcp.versions = versions
+
+		return nil
+	}
+}
+
+// dialVersion sends the versions of the dialer and returns the one picked by the listener,
+// and the transcript of the negotiation, nil without negotiation
+func (kcp *kcpTransport) dialVersion(conn net.Conn) (int, []byte, error) {
+	if len(kcp.versions) == 0 {
+		return ProtocolV1, nil, nil
+	}
+
+	hello := append(append([]byte{}, versionMagic...), byte(len(kcp.versions)))
+
+	for _, version := range kcp.versions {
+		hello = append(hello, byte(version))
+	}
+
+	if _, err := conn.Write(hello); err != nil {
+		return 0, nil, err
+	}
+
+	reply := make([]byte, len(versionMagic)+1)
+
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0, nil, err
+	}
+
+	if !bytes.Equal(reply[:len(versionMagic)], versionMagic) {
+		return 0, nil, errors.Wrap(ErrVersion, "invalid version reply")
+	}
+
+	version := int(reply[len(versionMagic)])
+
+	for _, offered := range kcp.versions {
+		if offered == version {
+			return version, append(hello, reply...), nil
+		}
+	}
+
+	return 0, nil, errors.Wrap(ErrVersion, "no common protocol version with %v", kcp.versions)
+}
+
+// acceptVersion reads the versions sent by the dialer and replies with the picked one,
+// the first bytes of dialers which don't negotiate are replayed to the security handshake.
+// The preamble is awaited for versionPeekTimeout at most, then the handshake deadline
+// applies again. It returns the transcript of the negotiation, nil without negotiation
+func (kcp *kcpTransport) acceptVersion(conn net.Conn, deadline time.Time) (net.Conn, int, []byte, error) {
+	if len(kcp.versions) == 0 {
+		return conn, ProtocolV1, nil, nil
+	}
+
+	head := make([]byte, len(versionMagic))
+
+	peek := time.Now().Add(versionPeekTimeout)
+
+	// the handshake deadline fails the session as usual when it comes first
+	fallback := deadline.IsZero() || peek.Before(deadline)
+
+	if !fallback {
+		peek = deadline
+	}
+
+	conn.SetReadDeadline(peek)
+
+	n, err := io.ReadFull(conn, head)
+
+	conn.SetReadDeadline(deadline)
+
+	if err != nil && !(fallback && isTimeout(err)) {
+		return nil, 0, nil, err
+	}
+
+	if err != nil || !bytes.Equal(head, versionMagic) {
+		return &replayConn{Conn: conn, head: head[:n]}, ProtocolV1, nil, nil
+	}
+
+	var count [1]byte
+
+	if _, err := io.ReadFull(conn, count[:]); err != nil {
+		return nil, 0, nil, err
+	}
+
+	offered := make([]byte, count[0])
+
+	if _, err := io.ReadFull(conn, offered); err != nil {
+		return nil, 0, nil, err
+	}
+
+	version := kcp.pickVersion(offered)
+
+	reply := append(append([]byte{}, versionMagic...), byte(version))
+
+	if _, err := conn.Write(reply); err != nil {
+		return nil, 0, nil, err
+	}
+
+	if version == 0 {
+		return nil, 0, nil, errors.Wrap(ErrVersion, "no common protocol version with %v", offered)
+	}
+
+	transcript := append(append(append([]byte{}, head...), count[0]), offered...)
+
+	return conn, version, append(transcript, reply...), nil
+}
+
+// confirmVersion binds the version negotiation, which runs before the security handshake
+// and isn't authenticated, to the tls session: both peers send the exported mac of their
+// transcript and check the other's, so a tampered preamble or reply fails the connection.
+// A dialer whose preamble was stripped expects the mac, the listener sends none then
+func confirmVersion(conn *tls.Conn, transcript []byte) error {
+	if transcript == nil {
+		return nil
+	}
+
+	state := conn.ConnectionState()
+
+	mac, err := state.ExportKeyingMaterial(versionLabel, transcript, versionMACSize)
+
+	if err != nil {
+		return errors.Wrap(err, "export version mac error")
+	}
+
+	if _, err := conn.Write(mac); err != nil {
+		return err
+	}
+
+	remote := make([]byte, versionMACSize)
+
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return err
+	}
+
+	if !hmac.Equal(mac, remote) {
+		return errors.Wrap(ErrVersion, "protocol version negotiation tampered with")
+	}
+
+	return nil
+}
+
+// pickVersion returns the first version of the listener offered by the dialer, 0 if none
+func (kcp *kcpTransport) pickVersion(offered []byte) int {
+	for _, version := range kcp.versions {
+		if bytes.IndexByte(offered, byte(version)) >= 0 {
+			return version
+		}
+	}
+
+	return 0
+}
+
+// replayConn returns the bytes read ahead before reading from the connection
+type replayConn struct {
+	net.Conn
+	head []byte
+}
+
+func (conn *replayConn) Read(b []byte) (int, error) {
+	if len(conn.head) > 0 {
+		n := copy(b, conn.head)
+		conn.head = conn.head[n:]
+		return n, nil
+	}
+
+	return conn.Conn.Read(b)
+}
+
+// Version returns the wire protocol version of the connection
+func (c *kcpCapableConn) Version() int {
+	return c.version
+}
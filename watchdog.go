@@ -0,0 +1,117 @@
+package kcp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/libs4go/errors"
+)
+
+const watchdogProbes = 3 // unanswered liveness probes before the peer is considered gone
+
+// WithWatchdog create kcp transport which watches its sessions for stalls: when data
+// is being sent but no kcp packet arrives for the stall duration, out-of-band probes
+// are sent on the same socket to tell a gone peer from a wedged kcp session, in both
+// cases the connection is closed if it doesn't recover. The probes are answered by the
+// session monitor of the remote peer, which runs with the watchdog and the other
+// monitoring options, so a session is watched once a first probe is answered, the
+// sessions to peers without it, e.g. with WithBatchIO, aren't. Stall durations shorter
+// than two smux keepalive intervals are raised to it, since idle sessions only receive
+// keepalive packets, unless keepalive is disabled.
+func WithWatchdog(stall time.Duration) Option {
+	return func(kcp *kcpTransport) error {
+		if stall <= 0 {
+			return errors.Wrap(ErrOption, "invalid watchdog stall duration %s", stall)
+		}
+
+		kcp.watchdog = stall
+
+		return nil
+	}
+}
+
+func (c *kcpCapableConn) runWatchdog(m *sessionMonitor) {
+	stall := c.kcp.watchdog
+
+	if interval := c.kcp.keepAliveInterval; interval != keepAliveDisabled && stall < interval*2 {
+		stall = interval * 2
+	}
+
+	interval := stall / watchdogProbes
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var suspected time.Time
+	var probes int
+	var armed bool
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+
+		if c.session.IsClosed() {
+			return
+		}
+
+		// a peer which doesn't answer the probes can't be told from a gone one
+		if !armed {
+			if atomic.LoadInt64(&m.lastPong) == 0 {
+				if err := c.monitorConn.ping(c.udpSession.RemoteAddr()); err != nil {
+					c.kcp.D("send liveness probe to {@raddr} error: {@err}", c.remoteMultiaddr, err)
+				}
+
+				continue
+			}
+
+			c.kcp.D("watchdog of kcp session to {@raddr} armed", c.remoteMultiaddr)
+			armed = true
+		}
+
+		now := time.Now()
+		lastRecv := time.Unix(0, atomic.LoadInt64(&m.lastRecv))
+		lastSend := time.Unix(0, atomic.LoadInt64(&m.lastSend))
+
+		if suspected.IsZero() {
+			if lastSend.After(lastRecv) && now.Sub(lastRecv) > stall {
+				c.kcp.W("kcp session to {@raddr} suspected stalled, probing", c.remoteMultiaddr)
+				suspected = now
+				probes = 0
+			} else {
+				continue
+			}
+		}
+
+		if lastRecv.After(suspected) {
+			c.kcp.I("kcp session to {@raddr} recovered", c.remoteMultiaddr)
+			suspected = time.Time{}
+			continue
+		}
+
+		lastPong := time.Unix(0, atomic.LoadInt64(&m.lastPong))
+
+		if lastPong.After(suspected) {
+			if now.Sub(suspected) > stall {
+				c.abort(errors.Wrap(ErrStalled, "kcp session to %s stalled while the peer is reachable", c.remoteMultiaddr))
+				return
+			}
+
+			continue
+		}
+
+		if probes >= watchdogProbes {
+			c.abort(errors.Wrap(ErrUnreachable, "peer %s doesn't answer liveness probes", c.remoteMultiaddr))
+			return
+		}
+
+		if err := c.monitorConn.ping(c.udpSession.RemoteAddr()); err != nil {
+			c.abort(errors.Wrap(err, "send liveness probe to %s error", c.remoteMultiaddr))
+			return
+		}
+
+		probes++
+	}
+}
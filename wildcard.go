@@ -0,0 +1,103 @@
+package kcp
+
+import (
+	"strconv"
+
+	"github.com/libs4go/errors"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// interfaceMultiaddrs returns the addresses of the network interfaces
+var interfaceMultiaddrs = manet.InterfaceMultiaddrs
+
+// withPort returns addr with the port of its udp component replaced by port
+func withPort(addr multiaddr.Multiaddr, port int) multiaddr.Multiaddr {
+	var components []multiaddr.Multiaddr
+
+	multiaddr.ForEach(addr, func(c multiaddr.Component) bool {
+		if c.Protocol().Code != multiaddr.P_UDP {
+			components = append(components, &c)
+			return true
+		}
+
+		udp, err := multiaddr.NewComponent("udp", strconv.Itoa(port))
+
+		if err != nil {
+			components = append(components, &c)
+			return true
+		}
+
+		components = append(components, udp)
+
+		return true
+	})
+
+	return multiaddr.Join(components...)
+}
+
+// expandWildcard returns the multiaddrs of the interface addresses addr listens on, an
+// unspecified address listens on the addresses of its ip family except the ipv6 link
+// local ones, which can't be dialed without their zone
+func expandWildcard(addr multiaddr.Multiaddr) ([]multiaddr.Multiaddr, error) {
+	first, rest := multiaddr.SplitFirst(addr)
+
+	if first == nil || rest == nil || !manet.IsIPUnspecified(addr) {
+		return []multiaddr.Multiaddr{addr}, nil
+	}
+
+	ifaces, err := interfaceMultiaddrs()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "get interface addrs error")
+	}
+
+	var expanded []multiaddr.Multiaddr
+
+	for _, iface := range ifaces {
+		ip, _ := multiaddr.SplitFirst(iface)
+
+		if ip == nil || ip.Protocol().Code != first.Protocol().Code || manet.IsIP6LinkLocal(iface) {
+			continue
+		}
+
+		expanded = append(expanded, iface.Encapsulate(rest))
+	}
+
+	return expanded, nil
+}
+
+// Multiaddrs returns the dialable multiaddrs of the listener, a listener on an unspecified
+// address has one for each interface address of its ip family
+func (l *kcpListener) Multiaddrs() ([]multiaddr.Multiaddr, error) {
+	return expandWildcard(l.localMultiaddr)
+}
+
+// ListenAddrs returns the dialable multiaddrs of all the listeners of the transport
+func (kcp *kcpTransport) ListenAddrs() ([]multiaddr.Multiaddr, error) {
+	lc := kcp.lifecycle
+
+	lc.Lock()
+
+	listeners := make([]*kcpListener, 0, len(lc.listeners))
+
+	for l := range lc.listeners {
+		listeners = append(listeners, l)
+	}
+
+	lc.Unlock()
+
+	var addrs []multiaddr.Multiaddr
+
+	for _, l := range listeners {
+		expanded, err := l.Multiaddrs()
+
+		if err != nil {
+			return nil, err
+		}
+
+		addrs = append(addrs, expanded...)
+	}
+
+	return addrs, nil
+}
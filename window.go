@@ -0,0 +1,108 @@
+package kcp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/libs4go/errors"
+)
+
+const (
+	windowTuneInterval = time.Second // adaptive window sampling interval
+	windowHeadroom     = 2           // target window in multiples of the bdp
+	windowBusyRatio    = 0.8         // inflight ratio of a window limited session
+	windowHysteresis   = 8           // ignore window changes smaller than 1/8
+)
+
+// windowRange adaptive window limits in packets
+type windowRange struct {
+	min int
+	max int
+}
+
+// WithAdaptiveWindow create kcp transport which periodically resizes the kcp send windows
+// of its sessions, within [minWnd, maxWnd] packets, toward the bandwidth-delay product
+// measured from the observed rtt and delivery rate of the sent data. The receive windows
+// keep their size, so a peer which mostly receives doesn't throttle its sender
+func WithAdaptiveWindow(minWnd, maxWnd int) Option {
+	return func(kcp *kcpTransport) error {
+		if minWnd <= 0 || maxWnd < minWnd {
+			return errors.Wrap(ErrOption, "invalid adaptive window range %d %d", minWnd, maxWnd)
+		}
+
+		if kcp.congestion != nil {
+			return errors.Wrap(ErrOption, "adaptive window can't be combined with congestion controller")
+		}
+
+		kcp.adaptiveWindow = &windowRange{min: minWnd, max: maxWnd}
+
+		return nil
+	}
+}
+
+// tuneWindow returns the window for a session which delivered acked packets in interval
+// with inflight packets outstanding at the end of it
+func tuneWindow(current, acked, inflight int, rtt, interval time.Duration, minWnd, maxWnd int) int {
+	target := current
+
+	if acked > 0 && rtt > 0 {
+		bdp := float64(acked) / interval.Seconds() * rtt.Seconds()
+		target = int(bdp * windowHeadroom)
+	}
+
+	// the delivery rate of a window limited session underestimates the link
+	if float64(inflight) >= float64(current)*windowBusyRatio && target < current*2 {
+		target = current * 2
+	}
+
+	if target < minWnd {
+		target = minWnd
+	}
+
+	if target > maxWnd {
+		target = maxWnd
+	}
+
+	if diff := target - current; diff < current/windowHysteresis && -diff < current/windowHysteresis {
+		return current
+	}
+
+	return target
+}
+
+func (c *kcpCapableConn) runWindowTuner(m *sessionMonitor) {
+	limits := c.kcp.adaptiveWindow
+
+	current := c.kcp.sessionConf.initialSendWindow()
+
+	ticker := time.NewTicker(windowTuneInterval)
+	defer ticker.Stop()
+
+	una := atomic.LoadUint32(&m.una)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+
+		next := atomic.LoadUint32(&m.una)
+		acked := int(int32(next - una))
+		una = next
+
+		inflight := int(int32(atomic.LoadUint32(&m.nextSN) - next))
+
+		window := tuneWindow(current, acked, inflight, m.rtt(), windowTuneInterval, limits.min, limits.max)
+
+		if window == current {
+			continue
+		}
+
+		c.kcp.D("resize kcp send window of {@raddr} from {@old} to {@new}", c.remoteMultiaddr, current, window)
+
+		c.setWindow(window, 0)
+
+		current = window
+	}
+}